@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/store"
+	"time"
+)
+
+var ErrEmptyIndex = errors.New("the database has no articles but storage does, run reprocess first or use -force")
+
+// storage that can remove attachments nothing refers to
+type garbageCollector interface {
+	CollectGarbage(referenced store.AttachmentRefChecker, minAge time.Duration, dryRun bool) (store.GCStats, error)
+}
+
+var ErrNoGC = errors.New("storage does not support garbage collection")
+
+// open the article storage and database of a config
+func openStoreAndDB(conf *config.Config) (st store.Storage, db database.Database, err error) {
+	if conf.Store == nil {
+		err = ErrNoStore
+		return
+	}
+	if conf.Database == nil {
+		err = ErrNoDatabase
+		return
+	}
+	st, err = store.NewStorageFromConfig(conf.Store, true)
+	if err == nil {
+		db, err = database.NewDBFromConfig(conf.Database)
+	}
+	if err == nil {
+		err = db.Ensure()
+	}
+	return
+}
+
+// check that the database knows about the stored articles
+// everything would look unreferenced to an index that was never built or is missing articles
+// a reprocess run that got through every article is enough if some articles can never be indexed
+func checkIndexed(conf *config.Config, st store.Storage, db database.Database) (err error) {
+	var indexed int64
+	indexed, err = db.CountArticles()
+	if err != nil {
+		return
+	}
+	var stored int64
+	err = st.WalkArticles("", func(msgid string) error {
+		stored++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if stored > 0 && indexed == 0 {
+		return ErrEmptyIndex
+	}
+	if indexed < stored && !newReprocessor(conf, st, db).Done() {
+		return fmt.Errorf("the database has %d of %d stored articles, run reprocess first or use -force", indexed, stored)
+	}
+	return
+}
+
+// remove attachments no article refers to, orphaned thumbnails and leftover temp files
+func gcCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only print what would be removed")
+	minAge := flags.Duration("min-age", store.MinGarbageAge, "keep files modified more recently than this")
+	force := flags.Bool("force", false, "collect even if the database has no articles")
+	flags.Parse(args)
+
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	st, db, err := openStoreAndDB(conf)
+	if err != nil {
+		return
+	}
+	gc, ok := st.(garbageCollector)
+	if !ok {
+		return ErrNoGC
+	}
+	if !*force {
+		err = checkIndexed(conf, st, db)
+		if err != nil {
+			return
+		}
+	}
+	var stats store.GCStats
+	stats, err = gc.CollectGarbage(func(fname string) (bool, error) {
+		refs, e := db.CountAttachmentRefs(fname)
+		return refs > 0, e
+	}, *minAge, *dryRun)
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d attachments, %d thumbnails, %d temp files, %d bytes\n",
+		verb, stats.Attachments, stats.Thumbnails, stats.TempFiles, stats.Bytes)
+	return
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/database"
 	"github.com/majestrate/srndv2/lib/frontend"
+	"github.com/majestrate/srndv2/lib/metrics"
+	"github.com/majestrate/srndv2/lib/mod"
 	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/process"
 	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/thumbnail"
 	"github.com/majestrate/srndv2/lib/webhooks"
 	"net"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 	"time"
 )
@@ -31,13 +38,98 @@ func (st *runStatus) Stop() {
 	log.Info("stopping daemon process")
 }
 
+// configuration file used by the daemon and all commands
+const cfgFname = "nntpchan.json"
+
+// a command line subcommand
+type command struct {
+	// what the command does
+	help string
+	// run the command with the arguments after its name
+	run func(args []string) error
+}
+
+var commands = map[string]*command{
+	"run": {
+		help: "run the daemon (default)",
+		run: func(args []string) error {
+			runDaemon()
+			return nil
+		},
+	},
+	"gc": {
+		help: "remove unreferenced attachments, thumbnails and temp files",
+		run:  gcCommand,
+	},
+	"passwd": {
+		help: "hash a password for the admin panel",
+		run:  passwdCommand,
+	},
+	"reprocess": {
+		help: "rebuild the database and attachments from stored articles",
+		run:  reprocessCommand,
+	},
+	"rethumb": {
+		help: "make thumbnails of stored attachments (missing|all)",
+		run:  rethumbCommand,
+	},
+	"status": {
+		help: "show connections and feeds of the running daemon",
+		run:  statusCommand,
+	},
+	"store": {
+		help: "maintain the article storage (fsck)",
+		run:  storeCommand,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [args...]\n\ncommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].help)
+	}
+}
+
 func main() {
+	name := "run"
+	var args []string
+	if len(os.Args) > 1 {
+		name = os.Args[1]
+		args = os.Args[2:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+		os.Exit(1)
+	}
+}
+
+// create a runner for the external programs of a config
+// every runner has its own slots so programs run by one never wait on another's
+func newRunner(conf *config.Config) *process.Runner {
+	if conf.Processes == nil {
+		return process.NewRunnerFromConfig(&config.DefaultProcessConfig)
+	}
+	return process.NewRunnerFromConfig(conf.Processes)
+}
+
+// run the nntp daemon until interrupted
+func runDaemon() {
 	st := &runStatus{
 		run:  true,
 		done: make(chan error),
 	}
 	log.Info("starting up nntpchan...")
-	cfgFname := "nntpchan.json"
 	conf, err := config.Ensure(cfgFname)
 	if err != nil {
 		log.Fatal(err)
@@ -75,11 +167,40 @@ func main() {
 	}
 
 	// create article storage
-	nserv.Storage, err = store.NewFilesytemStorage(sconfig.Path, true)
+	nserv.Storage, err = store.NewStorageFromConfig(sconfig, true)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// create database
+	db, err := database.NewDBFromConfig(dconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Ensure()
+	if err != nil {
+		log.Fatalf("failed to ensure database: %s", err.Error())
+	}
+	nserv.Bans = db
+	nserv.Addrs = db
+	nserv.Index = db
+	nserv.Reprocessor = newReprocessor(conf, nserv.Storage, db)
+
+	// thumbnailers have their own limits on external programs
+	runner := newRunner(conf)
+
+	// thumbnail attachments as they are stored
+	var thumbs *thumbnail.Pool
+	if conf.Thumbnails != nil {
+		thumbs, err = newThumbnailPool(conf, runner, nserv.Storage, db)
+		if err == nil {
+			thumbs.Start()
+			nserv.Thumbnails = thumbs
+		} else {
+			log.Warnf("not making thumbnails: %s", err.Error())
+		}
+	}
+
 	if conf.WebHooks != nil && len(conf.WebHooks) > 0 {
 		// put webhooks into nntp server event hooks
 		nserv.Hooks = webhooks.NewWebhooks(conf.WebHooks, nserv.Storage)
@@ -90,21 +211,64 @@ func main() {
 		if nserv.Hooks != nil {
 			hooks = append(hooks, nserv.Hooks)
 		}
+		// hooks run in the background, a slow one must not hold up thumbnails
+		hookRunner := newRunner(conf)
 		for _, h := range conf.NNTPHooks {
-			hooks = append(hooks, nntp.NewHook(h))
+			hooks = append(hooks, nntp.NewHook(h, hookRunner))
 		}
 		nserv.Hooks = hooks
 	}
 
-	var db database.Database
+	// process moderation messages before anything else sees them
+	modhooks := nntp.MulitHook{mod.NewModerator(conf.Mod, nserv.Storage, db)}
+	if nserv.Hooks != nil {
+		modhooks = append(modhooks, nserv.Hooks)
+	}
+	nserv.Hooks = modhooks
+
+	// filters run on every article so they do not wait on thumbnailers
+	filterRunner := newRunner(conf)
+	for _, fconf := range conf.Filters {
+		var f nntp.ArticleFilter
+		f, err = nntp.NewFilter(fconf, filterRunner)
+		if err != nil {
+			log.Fatalf("failed to create filter %s: %s", fconf.Name, err.Error())
+		}
+		nserv.Filters = append(nserv.Filters, f)
+	}
+
 	for _, fconf := range conf.Frontends {
 		var f frontend.Frontend
-		f, err = frontend.NewHTTPFrontend(fconf, db)
+		f, err = frontend.NewHTTPFrontend(fconf, db, nserv)
 		if err == nil {
 			go f.Serve()
 		}
 	}
 
+	if conf.Metrics != nil && conf.Metrics.Bind != "" {
+		go func() {
+			log.Infof("serving metrics on %s", conf.Metrics.Bind)
+			err := http.ListenAndServe(conf.Metrics.Bind, metrics.Handler())
+			if err != nil {
+				log.Errorf("metrics listener failed: %s", err.Error())
+			}
+		}()
+	}
+
+	if conf.Control != nil && conf.Control.Socket != "" {
+		go serveControl(conf.Control.Socket, nserv)
+	}
+
+	if conf.Expire != nil {
+		// expire articles in the background
+		exp := &nntp.Expirer{
+			Storage: nserv.Storage,
+			Index:   db,
+			Config:  conf.Expire,
+		}
+		go exp.Run()
+	}
+
 	// start persisting feeds
 	go nserv.PersistFeeds()
 
@@ -153,6 +317,9 @@ func main() {
 		st.done <- err
 	}()
 	e := <-st.done
+	if thumbs != nil {
+		thumbs.Stop()
+	}
 	if e != nil {
 		log.Fatal(e)
 	}
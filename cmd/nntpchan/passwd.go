@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+var ErrEmptyPassword = errors.New("empty password")
+
+// read a password from stdin and print its bcrypt hash for the admin panel config
+func passwdCommand(args []string) (err error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	var line string
+	line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	passwd := strings.TrimRight(line, "\r\n")
+	if passwd == "" {
+		return ErrEmptyPassword
+	}
+	var hash []byte
+	hash, err = bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
+	if err == nil {
+		fmt.Println(string(hash))
+	}
+	return
+}
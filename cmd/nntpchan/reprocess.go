@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/store"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+var ErrNoStore = errors.New("no article storage configured")
+var ErrNoDatabase = errors.New("no database configured")
+
+// how often the reprocess command prints its progress
+const reprocessReportInterval = time.Second * 10
+
+// create the reprocessor for a storage and database
+// articles are rechecked against the inbound article policy
+func newReprocessor(conf *config.Config, st store.Storage, db database.Database) *nntp.Reprocessor {
+	r := &nntp.Reprocessor{
+		Storage:   st,
+		Index:     db,
+		StateFile: filepath.Join(conf.Store.DataDir(), "reprocess.state"),
+		DoneFile:  filepath.Join(conf.Store.DataDir(), "reprocess.done"),
+	}
+	if conf.NNTP != nil && conf.NNTP.Article != nil {
+		r.Acceptor = nntp.NewPolicyAcceptor(conf.NNTP.Article)
+	}
+	return r
+}
+
+func printProgress(p nntp.ReprocessProgress) {
+	fmt.Printf("%d processed, %d deleted, %d failed, last %s (%s)\n",
+		p.Processed, p.Deleted, p.Failed, p.Last, time.Since(p.Started).Round(time.Second))
+}
+
+// walk every stored article and register it in the database again
+// safe to run while the daemon runs
+func reprocessCommand(args []string) (err error) {
+	var opts nntp.ReprocessOptions
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	flags.BoolVar(&opts.Recheck, "recheck", false, "check articles against the article policy again and delete the ones it does not allow")
+	flags.BoolVar(&opts.Resume, "resume", false, "continue after the last article an interrupted run got to")
+	flags.Parse(args)
+
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	if conf.Log != "debug" {
+		log.SetLevel(log.WarnLevel)
+	}
+	st, db, err := openStoreAndDB(conf)
+	if err != nil {
+		return
+	}
+	r := newReprocessor(conf, st, db)
+
+	// stop cleanly on interrupt so the run can be resumed
+	sigchnl := make(chan os.Signal, 1)
+	signal.Notify(sigchnl, os.Interrupt)
+	go func() {
+		<-sigchnl
+		fmt.Println("stopping, run again with -resume to continue")
+		r.Stop()
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- r.Run(opts)
+	}()
+	ticker := time.NewTicker(reprocessReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-done:
+			printProgress(r.Progress())
+			return
+		case <-ticker.C:
+			printProgress(r.Progress())
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/process"
+	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/thumbnail"
+)
+
+var ErrNoThumbnailConfig = errors.New("no thumbnails configured")
+
+var ErrNoThumbnailStore = errors.New("storage does not keep thumbnails")
+
+var ErrRethumbUsage = errors.New("give missing or all")
+
+// create the thumbnail pool for the storage and database of a config
+func newThumbnailPool(conf *config.Config, runner *process.Runner, st store.Storage, db database.Database) (*thumbnail.Pool, error) {
+	if conf.Thumbnails == nil {
+		return nil, ErrNoThumbnailConfig
+	}
+	tst, ok := st.(thumbnail.Store)
+	if !ok {
+		return nil, ErrNoThumbnailStore
+	}
+	return thumbnail.NewPoolFromConfig(conf.Thumbnails, runner, tst, db), nil
+}
+
+// make thumbnails of stored attachments that have none, or of all of them
+func rethumbCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("rethumb", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: rethumb [missing|all]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || (flags.Arg(0) != "missing" && flags.Arg(0) != "all") {
+		flags.Usage()
+		return ErrRethumbUsage
+	}
+
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	st, db, err := openStoreAndDB(conf)
+	if err != nil {
+		return
+	}
+	pool, err := newThumbnailPool(conf, newRunner(conf), st, db)
+	if err != nil {
+		return
+	}
+	var stats thumbnail.RethumbStats
+	stats, err = pool.Rethumb(flags.Arg(0) == "all")
+	fmt.Printf("made %d thumbnails, %d failed, %d skipped\n", stats.Made, stats.Failed, stats.Skipped)
+	if err == nil && stats.Failed > 0 {
+		err = fmt.Errorf("%d attachments failed to thumbnail", stats.Failed)
+	}
+	return
+}
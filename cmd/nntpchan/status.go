@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var ErrNoControlSocket = errors.New("no control socket configured")
+
+// connection as sent by the admin api
+type connStatus struct {
+	State     nntp.ConnState `json:"state"`
+	Authed    bool           `json:"authed"`
+	LastError *string        `json:"lasterror"`
+	Stats     nntp.ConnStats `json:"stats"`
+}
+
+// feed as sent by the admin api
+type feedStatus struct {
+	Name          string    `json:"name"`
+	Addr          string    `json:"addr"`
+	Connected     bool      `json:"connected"`
+	Queue         int       `json:"queue"`
+	LastError     string    `json:"lasterror"`
+	LastErrorTime time.Time `json:"lasterrortime"`
+}
+
+type serverStatus struct {
+	Inbound  []connStatus `json:"inbound"`
+	Outbound []connStatus `json:"outbound"`
+	Feeds    []feedStatus `json:"feeds"`
+}
+
+// serve the control socket for commands run next to the daemon
+// the socket is only accessible by the user running the daemon so it needs no login
+func serveControl(path string, nserv *nntp.Server) {
+	// remove a socket left behind by a daemon that did not shut down cleanly
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err == nil {
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			l.Close()
+		}
+	}
+	if err != nil {
+		log.Errorf("failed to create control socket %s: %s", path, err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/admin/feeds", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/json; encoding=UTF-8")
+		json.NewEncoder(w).Encode(nserv.Status())
+	})
+	log.Infof("serving control socket on %s", path)
+	err = http.Serve(l, mux)
+	if err != nil {
+		log.Errorf("control socket failed: %s", err.Error())
+	}
+}
+
+// decode a json reply, returning the error it carries if the request failed
+func decodeReply(resp *http.Response, obj interface{}) (err error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return errors.New(e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+// get the status of all connections from the control socket of the daemon
+func fetchStatus(path string) (st *serverStatus, err error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: time.Second * 30,
+	}
+	var resp *http.Response
+	// the host is ignored, every request goes to the socket
+	resp, err = client.Get("http://nntpchan/api/admin/feeds")
+	if err == nil {
+		st = new(serverStatus)
+		err = decodeReply(resp, st)
+	}
+	return
+}
+
+func printConns(w io.Writer, conns []connStatus) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tFEED\tMODE\tUP\tOFFERED\tACCEPTED\tREJECTED\tDEFERRED\tIN\tOUT\tLAST ERROR")
+	for _, c := range conns {
+		lasterr := ""
+		if c.LastError != nil {
+			lasterr = *c.LastError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			c.State.HostName, c.State.FeedName, c.State.Mode,
+			time.Since(c.Stats.Started).Round(time.Second),
+			c.Stats.Offered, c.Stats.Accepted, c.Stats.Rejected, c.Stats.Deferred,
+			c.Stats.BytesIn, c.Stats.BytesOut, lasterr)
+	}
+	tw.Flush()
+}
+
+func printStatus(w io.Writer, st *serverStatus) {
+	fmt.Fprintln(w, "feeds:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDR\tCONNECTED\tQUEUE\tLAST ERROR")
+	for _, f := range st.Feeds {
+		lasterr := f.LastError
+		if lasterr != "" {
+			lasterr += " (" + f.LastErrorTime.Format(time.RFC3339) + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%d\t%s\n", f.Name, f.Addr, f.Connected, f.Queue, lasterr)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\noutbound connections:")
+	printConns(w, st.Outbound)
+	fmt.Fprintln(w, "\ninbound connections:")
+	printConns(w, st.Inbound)
+}
+
+// show connections and feeds of the running daemon
+// asks the daemon over its control socket
+func statusCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	raw := flags.Bool("json", false, "print status as json")
+	flags.Parse(args)
+
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	if conf.Control == nil || conf.Control.Socket == "" {
+		return ErrNoControlSocket
+	}
+	var st *serverStatus
+	st, err = fetchStatus(conf.Control.Socket)
+	if err != nil {
+		return
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(st)
+	} else {
+		printStatus(os.Stdout, st)
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/store"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrNoSuchStoreCommand = errors.New("no such store command")
+
+var ErrNoFsck = errors.New("storage does not support fsck")
+
+var ErrNoMigrate = errors.New("only filesystem storage has layouts to migrate")
+
+var ErrNoCompress = errors.New("storage does not support compression")
+
+// storage that can rewrite its articles compressed another way
+type recompressor interface {
+	Recompress(method string) (store.CompressStats, error)
+}
+
+// storage that can check itself for damage
+type fscker interface {
+	Fsck(repair bool) (*store.FsckReport, error)
+}
+
+// fsck found problems it did not repair
+var ErrStoreDamaged = errors.New("storage has problems, run with -repair to fix them")
+
+// subcommands of the store command
+var storeCommands = map[string]*command{
+	"fsck": {
+		help: "check stored articles, newsgroups and attachments for damage",
+		run:  fsckCommand,
+	},
+	"migrate": {
+		help: "convert filesystem storage to the current layout and configured shard depth",
+		run:  migrateCommand,
+	},
+	"compress": {
+		help: "compress or decompress stored articles",
+		run:  compressCommand,
+	},
+}
+
+// maintain the article storage
+func storeCommand(args []string) (err error) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s store [command] [args...]\n\ncommands:\n", os.Args[0])
+		var names []string
+		for name := range storeCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, storeCommands[name].help)
+		}
+		return ErrNoSuchStoreCommand
+	}
+	cmd, ok := storeCommands[args[0]]
+	if !ok {
+		return ErrNoSuchStoreCommand
+	}
+	return cmd.run(args[1:])
+}
+
+// check storage integrity, optionally repairing what is found
+func fsckCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair problems, stop the daemon first")
+	flags.Parse(args)
+
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	if conf.Store == nil {
+		return ErrNoStore
+	}
+	var st store.Storage
+	st, err = store.NewStorageFromConfig(conf.Store, true)
+	if err != nil {
+		return
+	}
+	fs, ok := st.(fscker)
+	if !ok {
+		return ErrNoFsck
+	}
+	var report *store.FsckReport
+	report, err = fs.Fsck(*repair)
+	if err != nil {
+		return
+	}
+	unrepaired := 0
+	for _, p := range report.Problems {
+		status := "found"
+		if p.Repaired {
+			status = "repaired"
+		} else {
+			unrepaired++
+		}
+		fmt.Printf("%-8s %-14s %s: %s\n", status, p.Kind, p.Path, p.Detail)
+	}
+	fmt.Printf("checked %d articles, %d newsgroups, %d links, %d attachments: %d problems\n",
+		report.Articles, report.Newsgroups, report.Links, report.Attachments, len(report.Problems))
+	if unrepaired > 0 {
+		err = ErrStoreDamaged
+	}
+	return
+}
+
+// convert filesystem storage to the current on disk layout and shard depth
+func migrateCommand(args []string) (err error) {
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	if conf.Store == nil {
+		return ErrNoStore
+	}
+	switch strings.ToLower(conf.Store.Type) {
+	case "", "filesystem":
+	default:
+		return ErrNoMigrate
+	}
+	fmt.Fprintln(os.Stderr, "migrating", conf.Store.Path, "to shard depth", conf.Store.ShardDepth, "make sure the daemon is stopped")
+	var st store.MigrateStats
+	st, err = store.MigrateFilesystemStorage(conf.Store.Path, conf.Store.ShardDepth)
+	if err == nil {
+		fmt.Printf("moved %d articles and %d attachments, renamed %d newsgroups, rewrote %d links\n", st.Articles, st.Attachments, st.Newsgroups, st.Links)
+	}
+	return
+}
+
+// rewrite stored articles with the configured compression or the one given
+func compressCommand(args []string) (err error) {
+	var conf *config.Config
+	conf, err = config.Load(cfgFname)
+	if err != nil {
+		return
+	}
+	if conf.Store == nil {
+		return ErrNoStore
+	}
+	flags := flag.NewFlagSet("compress", flag.ExitOnError)
+	method := flags.String("method", conf.Store.Compression, "gzip, zstd or none to decompress")
+	flags.Parse(args)
+
+	var st store.Storage
+	st, err = store.NewStorageFromConfig(conf.Store, true)
+	if err != nil {
+		return
+	}
+	rc, ok := st.(recompressor)
+	if !ok {
+		return ErrNoCompress
+	}
+	var stats store.CompressStats
+	stats, err = rc.Recompress(*method)
+	if err == nil {
+		fmt.Printf("rewrote %d articles, %d bytes before and %d after\n", stats.Articles, stats.BytesBefore, stats.BytesAfter)
+	}
+	return
+}
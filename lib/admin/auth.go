@@ -0,0 +1,335 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/sessions"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// name of the admin session cookie
+const sessionName = "srnd-admin"
+
+// how long a login lasts in seconds
+const sessionMaxAge = 60 * 60 * 12
+
+// how long a key login challenge can be signed
+const challengeTimeout = time.Minute * 10
+
+// max number of unused key login challenges
+const maxChallenges = 1024
+
+var ErrBadLogin = errors.New("invalid username or password")
+var ErrNoChallenge = errors.New("no login challenge, reload the login page")
+var ErrTooManyChallenges = errors.New("too many login challenges, try again later")
+var ErrNotAdminKey = errors.New("key not allowed to log in")
+var ErrBadCSRF = errors.New("invalid csrf token")
+
+// get the admin session of a request
+// a new session is returned if the cookie is missing or invalid
+func (s *Server) session(r *http.Request) *sessions.Session {
+	sess, err := s.store.Get(r, sessionName)
+	if err != nil {
+		// bad cookie, most likely signed with an old secret
+		sess, _ = s.store.New(r, sessionName)
+	}
+	sess.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		HttpOnly: true,
+	}
+	return sess
+}
+
+// get a string value from a session, empty if not set
+func sessionString(sess *sessions.Session, key string) string {
+	v, _ := sess.Values[key].(string)
+	return v
+}
+
+// get the csrf token of a session, making one if it has none
+func csrfToken(sess *sessions.Session) string {
+	tok := sessionString(sess, "csrf")
+	if tok == "" {
+		tok = hex.EncodeToString(crypto.RandBytes(16))
+		sess.Values["csrf"] = tok
+	}
+	return tok
+}
+
+// check the csrf token sent with a form
+func checkCSRF(sess *sessions.Session, r *http.Request) bool {
+	tok := sessionString(sess, "csrf")
+	return tok != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(r.FormValue("csrf"))) == 1
+}
+
+// is the panel usable at all?
+func (s *Server) enabled() bool {
+	if s.conf == nil {
+		return false
+	}
+	if s.conf.NeedsPassword() && (s.conf.Username == "" || s.conf.PasswordHash == "") {
+		return false
+	}
+	return s.conf.NeedsPassword() || s.conf.NeedsKey()
+}
+
+// has this session done every login step the config requires?
+func (s *Server) loggedIn(sess *sessions.Session) bool {
+	if !s.enabled() {
+		return false
+	}
+	if s.conf.NeedsPassword() && sessionString(sess, "user") == "" {
+		return false
+	}
+	if s.conf.NeedsKey() && sessionString(sess, "pubkey") == "" {
+		return false
+	}
+	return true
+}
+
+// name of who is logged in for the audit log
+func actor(sess *sessions.Session) string {
+	var names []string
+	if user := sessionString(sess, "user"); user != "" {
+		names = append(names, user)
+	}
+	if pubkey := sessionString(sess, "pubkey"); pubkey != "" {
+		names = append(names, pubkey)
+	}
+	return strings.Join(names, "/")
+}
+
+// make a new key login challenge, expires old ones
+// challenges are kept here and not in the session so a replayed cookie can't reuse one
+func (s *Server) newChallenge() (string, error) {
+	now := time.Now()
+	s.challengeMtx.Lock()
+	defer s.challengeMtx.Unlock()
+	for k, created := range s.challenges {
+		if now.Sub(created) > challengeTimeout {
+			delete(s.challenges, k)
+		}
+	}
+	if len(s.challenges) >= maxChallenges {
+		return "", ErrTooManyChallenges
+	}
+	challenge := hex.EncodeToString(crypto.RandBytes(32))
+	s.challenges[challenge] = now
+	return challenge, nil
+}
+
+// use up a key login challenge
+// returns false if it was never made, already used or expired
+func (s *Server) useChallenge(challenge string) bool {
+	s.challengeMtx.Lock()
+	defer s.challengeMtx.Unlock()
+	created, ok := s.challenges[challenge]
+	delete(s.challenges, challenge)
+	return ok && time.Since(created) <= challengeTimeout
+}
+
+// check if a public key may log in
+func (s *Server) isAdminKey(pubkey string) (bool, error) {
+	for _, k := range s.conf.Keys {
+		if strings.ToLower(k) == pubkey {
+			return true, nil
+		}
+	}
+	return s.db.IsModKey(pubkey)
+}
+
+// wrap a handler so it can only be used when logged in
+// requests that are not logged in get redirected to the login page or a json error
+func (s *Server) RequireLogin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.loggedIn(s.session(r)) {
+			h.ServeHTTP(w, r)
+		} else if r.Method == "GET" && !wantsJSON(r) {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		} else {
+			sendError(w, http.StatusUnauthorized, errors.New("not logged in"))
+		}
+	})
+}
+
+// show the login page
+// gives a new challenge to sign for key login
+func (s *Server) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if !s.enabled() {
+		http.Error(w, "admin panel disabled", http.StatusNotFound)
+		return
+	}
+	sess := s.session(r)
+	challenge, err := s.newChallenge()
+	if err != nil {
+		sendError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	sess.Values["challenge"] = challenge
+	param := map[string]interface{}{
+		"CSRF":         csrfToken(sess),
+		"Challenge":    challenge,
+		"NeedPassword": s.conf.NeedsPassword() && sessionString(sess, "user") == "",
+		"NeedKey":      s.conf.NeedsKey() && sessionString(sess, "pubkey") == "",
+		"Error":        r.FormValue("error"),
+	}
+	err = sess.Save(r, w)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if wantsJSON(r) {
+		delete(param, "Error")
+		sendJSON(w, http.StatusOK, param)
+	} else {
+		s.render(w, "login", param)
+	}
+}
+
+// log in with username and password
+func (s *Server) handleLoginPassword(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	if !s.enabled() || !s.conf.NeedsPassword() {
+		s.loginFailed(w, r, ErrBadLogin)
+		return
+	}
+	if !checkCSRF(sess, r) {
+		s.loginFailed(w, r, ErrBadCSRF)
+		return
+	}
+	user, passwd := r.FormValue("username"), r.FormValue("password")
+	// always check the password so a wrong username takes as long
+	passwdOK := bcrypt.CompareHashAndPassword([]byte(s.conf.PasswordHash), []byte(passwd)) == nil
+	if subtle.ConstantTimeCompare([]byte(user), []byte(s.conf.Username)) != 1 || !passwdOK {
+		log.WithFields(log.Fields{
+			"pkg":  "admin",
+			"user": user,
+			"addr": r.RemoteAddr,
+		}).Warn("failed admin login")
+		s.loginFailed(w, r, ErrBadLogin)
+		return
+	}
+	sess.Values["user"] = user
+	s.loginStep(w, r, sess)
+}
+
+// log in by signing the challenge from the login page with an allowed key
+func (s *Server) handleLoginKey(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	if !s.enabled() || !s.conf.NeedsKey() {
+		s.loginFailed(w, r, ErrNotAdminKey)
+		return
+	}
+	if !checkCSRF(sess, r) {
+		s.loginFailed(w, r, ErrBadCSRF)
+		return
+	}
+	challenge := sessionString(sess, "challenge")
+	delete(sess.Values, "challenge")
+	// a challenge can only be used once
+	if challenge == "" || !s.useChallenge(challenge) {
+		sess.Save(r, w)
+		s.loginFailed(w, r, ErrNoChallenge)
+		return
+	}
+	pubkey := strings.ToLower(strings.TrimSpace(r.FormValue("pubkey")))
+	ok, err := s.isAdminKey(pubkey)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var pk, sig []byte
+	if ok {
+		pk, err = hex.DecodeString(pubkey)
+		if err == nil {
+			sig, err = hex.DecodeString(strings.TrimSpace(r.FormValue("signature")))
+		}
+		if err == nil && len(pk) == 32 {
+			v := crypto.CreateVerifier(pk)
+			v.Write([]byte(challenge))
+			ok = v.Verify(sig)
+		} else {
+			ok = false
+		}
+	}
+	if !ok {
+		log.WithFields(log.Fields{
+			"pkg":    "admin",
+			"pubkey": pubkey,
+			"addr":   r.RemoteAddr,
+		}).Warn("failed admin key login")
+		// save the session so the used challenge is gone
+		sess.Save(r, w)
+		s.loginFailed(w, r, ErrNotAdminKey)
+		return
+	}
+	sess.Values["pubkey"] = pubkey
+	s.loginStep(w, r, sess)
+}
+
+// finish a login step and go to the panel or the next step
+func (s *Server) loginStep(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	// new token after login
+	delete(sess.Values, "csrf")
+	csrfToken(sess)
+	err := sess.Save(r, w)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	done := s.loggedIn(sess)
+	if done {
+		log.WithFields(log.Fields{
+			"pkg":   "admin",
+			"actor": actor(sess),
+			"addr":  r.RemoteAddr,
+		}).Info("admin logged in")
+	}
+	if wantsJSON(r) {
+		sendJSON(w, http.StatusOK, map[string]interface{}{
+			"loggedin": done,
+			"csrf":     sessionString(sess, "csrf"),
+		})
+	} else if done {
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+	}
+}
+
+func (s *Server) loginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if wantsJSON(r) {
+		sendError(w, http.StatusForbidden, err)
+	} else {
+		http.Redirect(w, r, "/admin/login?error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+	}
+}
+
+// log out of the panel
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	if !checkCSRF(sess, r) {
+		sendError(w, http.StatusForbidden, ErrBadCSRF)
+		return
+	}
+	sess.Options.MaxAge = -1
+	sess.Values = make(map[interface{}]interface{})
+	err := sess.Save(r, w)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if wantsJSON(r) {
+		sendJSON(w, http.StatusOK, map[string]bool{"loggedin": false})
+	} else {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+	}
+}
@@ -1,16 +1,500 @@
 package admin
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/util"
+	"html/template"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// audit log entries per page
+const auditPageSize = 50
+
+var ErrNoStorage = errors.New("no article storage")
+var ErrInvalidMessageID = errors.New("invalid message-id")
+var ErrInvalidPubKey = errors.New("invalid public key")
+var ErrNoReprocessor = errors.New("reprocessing articles is not supported")
+
 type Server struct {
+	// admin login settings
+	conf *config.AdminConfig
+	// database driver
+	db database.Database
+	// nntp server for connection status and storage, may be nil
+	nntpd *nntp.Server
+	// session storage
+	store sessions.Store
+	// routes
+	mux *mux.Router
+	// page templates
+	tmpl *template.Template
+	// unused key login challenges and when they were made
+	challenges map[string]time.Time
+	// protects challenges
+	challengeMtx sync.Mutex
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// does the request want a json reply instead of html?
+func wantsJSON(r *http.Request) bool {
+	return r.FormValue("t") == "json"
+}
+
+// render an html page
+func (s *Server) render(w http.ResponseWriter, name string, param map[string]interface{}) {
+	buff := new(bytes.Buffer)
+	err := s.tmpl.ExecuteTemplate(buff, name, param)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":  "admin",
+			"page": name,
+		}).Error("failed to render page ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buff.WriteTo(w)
+}
+
+// render a view or send its data as json
+func (s *Server) view(w http.ResponseWriter, r *http.Request, name string, data interface{}, param map[string]interface{}) {
+	if wantsJSON(r) {
+		sendJSON(w, http.StatusOK, data)
+		return
+	}
+	sess := s.session(r)
+	param["CSRF"] = csrfToken(sess)
+	param["Actor"] = actor(sess)
+	param["Page"] = name
+	sess.Save(r, w)
+	s.render(w, name, param)
+}
+
+// wrap an action that changes something
+// checks the csrf token and passes the session along
+func (s *Server) action(h func(w http.ResponseWriter, r *http.Request, sess *sessions.Session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := s.session(r)
+		if !checkCSRF(sess, r) {
+			sendError(w, http.StatusForbidden, ErrBadCSRF)
+			return
+		}
+		h(w, r, sess)
+	}
+}
+
+// record an action in the audit log
+func (s *Server) audit(sess *sessions.Session, e *model.AuditEntry) {
+	e.Actor = actor(sess)
+	e.Time = time.Now()
+	log.WithFields(log.Fields{
+		"pkg":    "admin",
+		"actor":  e.Actor,
+		"action": e.Action,
+		"target": e.Target,
+	}).Info("admin action")
+	err := s.db.LogAudit(e)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":    "admin",
+			"action": e.Action,
+		}).Error("failed to write audit log ", err)
+	}
+}
+
+// record an action in the audit log and reply to it
+// html forms are sent back to the page they came from
+func (s *Server) done(w http.ResponseWriter, r *http.Request, sess *sessions.Session, back string, e *model.AuditEntry, reply interface{}) {
+	s.audit(sess, e)
+	if wantsJSON(r) {
+		sendJSON(w, http.StatusOK, reply)
+	} else {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	}
+}
+
+// convert an object to generic json values so templates can use json field names
+func jsonValues(obj interface{}) (v interface{}) {
+	d, err := json.Marshal(obj)
+	if err == nil {
+		json.Unmarshal(d, &v)
+	}
+	return
+}
+
+// show connection and feed status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := &nntp.ServerStatus{}
+	if s.nntpd != nil {
+		st = s.nntpd.Status()
+	}
+	s.view(w, r, "status", st, map[string]interface{}{
+		"Status": jsonValues(st),
+	})
+}
+
+// send the status of all connections and feeds as json
+// mounted at /api/admin/feeds by the frontend, wrap with RequireLogin
+func (s *Server) HandleFeeds(w http.ResponseWriter, r *http.Request) {
+	st := &nntp.ServerStatus{}
+	if s.nntpd != nil {
+		st = s.nntpd.Status()
+	}
+	sendJSON(w, http.StatusOK, st)
+}
+
+// list all bans
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.db.ListAddrBans()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.view(w, r, "bans", bans, map[string]interface{}{
+		"Bans": bans,
+	})
+}
+
+// ban an address range
+// takes form values addr, reason and expires, expires is a duration like 24h
+// or empty for a ban that never expires
+func (s *Server) handleAddBan(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	addr := r.FormValue("addr")
+	reason := r.FormValue("reason")
+	var expires time.Time
+	if str := r.FormValue("expires"); str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, err)
+			return
+		}
+		expires = time.Now().Add(d)
+	}
+	err := s.db.BanAddr(addr, reason, expires)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	detail := reason
+	if !expires.IsZero() {
+		detail += " (expires " + expires.UTC().Format(time.RFC1123) + ")"
+	}
+	s.done(w, r, sess, "/admin/bans", &model.AuditEntry{
+		Action: "ban",
+		Target: addr,
+		Detail: detail,
+	}, map[string]string{"banned": addr})
+}
+
+// remove a ban
+// takes form value addr
+func (s *Server) handleRemoveBan(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	addr := r.FormValue("addr")
+	err := s.db.UnbanAddr(addr)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.done(w, r, sess, "/admin/bans", &model.AuditEntry{
+		Action: "unban",
+		Target: addr,
+	}, map[string]string{"unbanned": addr})
+}
 
+// list moderator keys
+func (s *Server) handleListModKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.db.ListModKeys()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.view(w, r, "modkeys", keys, map[string]interface{}{
+		"Keys":   keys,
+		"Config": s.conf.Keys,
+	})
 }
 
-func NewServer() *Server {
-	return &Server{}
+// trust a moderator key
+// takes form values pubkey and note
+func (s *Server) handleAddModKey(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	pubkey := strings.ToLower(strings.TrimSpace(r.FormValue("pubkey")))
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil || len(pk) != 32 {
+		sendError(w, http.StatusBadRequest, ErrInvalidPubKey)
+		return
+	}
+	note := r.FormValue("note")
+	err = s.db.AddModKey(pubkey, note)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.done(w, r, sess, "/admin/modkeys", &model.AuditEntry{
+		Action: "add-mod-key",
+		Target: pubkey,
+		Detail: note,
+	}, map[string]string{"added": pubkey})
+}
+
+// stop trusting a moderator key
+// takes form value pubkey
+func (s *Server) handleRemoveModKey(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	pubkey := strings.ToLower(strings.TrimSpace(r.FormValue("pubkey")))
+	err := s.db.RemoveModKey(pubkey)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.done(w, r, sess, "/admin/modkeys", &model.AuditEntry{
+		Action: "remove-mod-key",
+		Target: pubkey,
+	}, map[string]string{"removed": pubkey})
+}
+
+// browse the audit log newest first
+// takes form value offset
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	entries, err := s.db.ListAudit(offset, auditPageSize)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	param := map[string]interface{}{
+		"Entries": entries,
+		"Prev":    -1,
+		"Next":    -1,
+	}
+	if offset > 0 {
+		prev := offset - auditPageSize
+		if prev < 0 {
+			prev = 0
+		}
+		param["Prev"] = prev
+	}
+	if len(entries) == auditPageSize {
+		param["Next"] = offset + auditPageSize
+	}
+	s.view(w, r, "audit", entries, param)
+}
+
+// get article storage
+func (s *Server) storage() store.Storage {
+	if s.nntpd == nil {
+		return nil
+	}
+	return s.nntpd.Storage
+}
+
+// delete an article
+// takes form value msgid
+func (s *Server) handleDeleteArticle(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	msgid := r.FormValue("msgid")
+	if !nntp.MessageID(msgid).Valid() {
+		sendError(w, http.StatusBadRequest, ErrInvalidMessageID)
+		return
+	}
+	st := s.storage()
+	if st == nil {
+		sendError(w, http.StatusInternalServerError, ErrNoStorage)
+		return
+	}
+	var freed int64
+	err := st.HasArticle(msgid)
+	if err == nil {
+		freed, err = nntp.DeleteStoredArticle(st, s.db, msgid)
+	}
+	if err == store.ErrNoSuchArticle {
+		sendError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.done(w, r, sess, "/admin/", &model.AuditEntry{
+		Action: "delete-article",
+		Target: msgid,
+		Detail: fmt.Sprintf("%d attachments freed", freed),
+	}, map[string]interface{}{"deleted": msgid, "freed": freed})
+}
+
+// delete an attachment and its thumbnail
+// takes form value filename
+func (s *Server) handleDeleteAttachment(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	fname := r.FormValue("filename")
+	st := s.storage()
+	if st == nil {
+		sendError(w, http.StatusInternalServerError, ErrNoStorage)
+		return
+	}
+	err := st.DeleteAttachment(fname)
+	if err == store.ErrNoSuchAttachment {
+		sendError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.done(w, r, sess, "/admin/", &model.AuditEntry{
+		Action: "delete-attachment",
+		Target: fname,
+	}, map[string]string{"deleted": fname})
+}
+
+// get the article reprocessor, nil if there is none
+func (s *Server) reprocessor() *nntp.Reprocessor {
+	if s.nntpd == nil {
+		return nil
+	}
+	return s.nntpd.Reprocessor
+}
+
+// show progress of reprocessing stored articles
+func (s *Server) handleReprocessStatus(w http.ResponseWriter, r *http.Request) {
+	var p nntp.ReprocessProgress
+	rp := s.reprocessor()
+	if rp != nil {
+		p = rp.Progress()
+	}
+	s.view(w, r, "reprocess", p, map[string]interface{}{
+		"Supported": rp != nil,
+		"Progress":  p,
+	})
+}
+
+// start reprocessing stored articles in the background
+// takes form values recheck and resume, both booleans
+func (s *Server) handleReprocessStart(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	rp := s.reprocessor()
+	if rp == nil {
+		sendError(w, http.StatusNotFound, ErrNoReprocessor)
+		return
+	}
+	opts := nntp.ReprocessOptions{
+		Recheck: r.FormValue("recheck") != "",
+		Resume:  r.FormValue("resume") != "",
+	}
+	err := rp.Start(opts)
+	if err == nntp.ErrReprocessRunning {
+		sendError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.done(w, r, sess, "/admin/reprocess", &model.AuditEntry{
+		Action: "reprocess",
+		Detail: fmt.Sprintf("recheck=%v resume=%v", opts.Recheck, opts.Resume),
+	}, rp.Progress())
+}
+
+// stop reprocessing stored articles
+func (s *Server) handleReprocessStop(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	rp := s.reprocessor()
+	if rp == nil {
+		sendError(w, http.StatusNotFound, ErrNoReprocessor)
+		return
+	}
+	rp.Stop()
+	s.done(w, r, sess, "/admin/reprocess", &model.AuditEntry{
+		Action: "reprocess-stop",
+	}, rp.Progress())
+}
+
+// decrypt the poster address of a local post
+// takes form value msgid
+func (s *Server) handleDecryptAddr(w http.ResponseWriter, r *http.Request) {
+	msgid := r.FormValue("msgid")
+	encaddr, key, err := s.db.GetEncAddrByMessageID(msgid)
+	if err == database.ErrNoSuchEncAddr {
+		sendError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// looking up who posted something is audited too
+	s.audit(s.session(r), &model.AuditEntry{
+		Action: "decrypt-addr",
+		Target: msgid,
+	})
+	sendJSON(w, http.StatusOK, map[string]string{
+		"msgid":   msgid,
+		"encaddr": encaddr,
+		"addr":    util.DecAddr(encaddr, key),
+	})
+}
+
+// send a json reply
+func sendJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "text/json; encoding=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+// send a json error reply
+func sendError(w http.ResponseWriter, code int, err error) {
+	sendJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// create a new admin panel served under /admin/
+// the panel refuses all logins if the configured login method is not set up
+// nntpd may be nil in which case there is no status and nothing to delete
+func NewServer(c *config.AdminConfig, db database.Database, nntpd *nntp.Server, st sessions.Store) *Server {
+	s := &Server{
+		conf:       c,
+		db:         db,
+		nntpd:      nntpd,
+		store:      st,
+		mux:        mux.NewRouter(),
+		tmpl:       template.Must(template.New("admin").Funcs(templateFuncs).Parse(templates)),
+		challenges: make(map[string]time.Time),
+	}
+	r := s.mux.PathPrefix("/admin/").Subrouter()
+	r.Path("/login").Methods("GET").HandlerFunc(s.handleLoginPage)
+	r.Path("/login").Methods("POST").HandlerFunc(s.handleLoginPassword)
+	r.Path("/login/key").Methods("POST").HandlerFunc(s.handleLoginKey)
+	r.Path("/logout").Methods("POST").HandlerFunc(s.handleLogout)
+
+	// everything else needs a login
+	route := func(path, method string, h http.HandlerFunc) {
+		r.Path(path).Methods(method).Handler(s.RequireLogin(h))
+	}
+	route("/", "GET", s.handleStatus)
+	route("/bans", "GET", s.handleListBans)
+	route("/bans/add", "POST", s.action(s.handleAddBan))
+	route("/bans/remove", "POST", s.action(s.handleRemoveBan))
+	route("/modkeys", "GET", s.handleListModKeys)
+	route("/modkeys/add", "POST", s.action(s.handleAddModKey))
+	route("/modkeys/remove", "POST", s.action(s.handleRemoveModKey))
+	route("/audit", "GET", s.handleAudit)
+	route("/articles/delete", "POST", s.action(s.handleDeleteArticle))
+	route("/attachments/delete", "POST", s.action(s.handleDeleteAttachment))
+	route("/addr", "GET", s.handleDecryptAddr)
+	route("/reprocess", "GET", s.handleReprocessStatus)
+	route("/reprocess/start", "POST", s.action(s.handleReprocessStart))
+	route("/reprocess/stop", "POST", s.action(s.handleReprocessStop))
+	return s
 }
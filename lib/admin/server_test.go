@@ -0,0 +1,233 @@
+package admin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/model"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// database that keeps bans, mod keys and the audit log in memory
+type memDB struct {
+	database.Database
+	bans  map[string]string
+	mods  map[string]bool
+	audit []*model.AuditEntry
+}
+
+func (db *memDB) BanAddr(addr, reason string, expires time.Time) error {
+	db.bans[addr] = reason
+	return nil
+}
+
+func (db *memDB) IsModKey(pubkey string) (bool, error) {
+	return db.mods[pubkey], nil
+}
+
+func (db *memDB) LogAudit(e *model.AuditEntry) error {
+	db.audit = append(db.audit, e)
+	return nil
+}
+
+// http client for the admin panel that keeps cookies
+type testClient struct {
+	t    *testing.T
+	base string
+	c    *http.Client
+}
+
+func newTestClient(t *testing.T, conf *config.AdminConfig, db database.Database) (*testClient, func()) {
+	s := NewServer(conf, db, nil, sessions.NewCookieStore(crypto.RandBytes(32)))
+	srv := httptest.NewServer(s)
+	jar, _ := cookiejar.New(nil)
+	return &testClient{
+		t:    t,
+		base: srv.URL,
+		c: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, srv.Close
+}
+
+// do a request and decode the json reply
+func (tc *testClient) do(method, path string, form url.Values) (int, map[string]interface{}) {
+	var resp *http.Response
+	var err error
+	if method == "GET" {
+		resp, err = tc.c.Get(tc.base + path + "?" + form.Encode())
+	} else {
+		resp, err = tc.c.PostForm(tc.base+path, form)
+	}
+	if err != nil {
+		tc.t.Logf("request to %s failed: %s", path, err)
+		tc.t.FailNow()
+	}
+	defer resp.Body.Close()
+	j := make(map[string]interface{})
+	json.NewDecoder(resp.Body).Decode(&j)
+	return resp.StatusCode, j
+}
+
+// get the login page and return the csrf token and challenge
+func (tc *testClient) loginPage() (string, string) {
+	code, j := tc.do("GET", "/admin/login", url.Values{"t": {"json"}})
+	if code != http.StatusOK {
+		tc.t.Logf("login page gave %d", code)
+		tc.t.FailNow()
+	}
+	csrf, _ := j["CSRF"].(string)
+	challenge, _ := j["Challenge"].(string)
+	return csrf, challenge
+}
+
+func TestPasswordLogin(t *testing.T) {
+	db := &memDB{bans: make(map[string]string)}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	tc, done := newTestClient(t, &config.AdminConfig{Username: "admin", PasswordHash: string(hash)}, db)
+	defer done()
+
+	code, _ := tc.do("GET", "/admin/bans", url.Values{"t": {"json"}})
+	if code != http.StatusUnauthorized {
+		t.Logf("not logged in gave %d", code)
+		t.Fail()
+	}
+
+	csrf, _ := tc.loginPage()
+	code, _ = tc.do("POST", "/admin/login", url.Values{"t": {"json"}, "csrf": {csrf}, "username": {"admin"}, "password": {"wrong"}})
+	if code != http.StatusForbidden {
+		t.Logf("bad password gave %d", code)
+		t.Fail()
+	}
+	code, j := tc.do("POST", "/admin/login", url.Values{"t": {"json"}, "csrf": {csrf}, "username": {"admin"}, "password": {"hunter2"}})
+	if code != http.StatusOK || j["loggedin"] != true {
+		t.Logf("login failed: %d %v", code, j)
+		t.FailNow()
+	}
+	csrf, _ = j["csrf"].(string)
+
+	// actions need the csrf token
+	code, _ = tc.do("POST", "/admin/bans/add", url.Values{"t": {"json"}, "addr": {"10.0.0.0/8"}})
+	if code != http.StatusForbidden || len(db.bans) != 0 {
+		t.Logf("action without csrf token gave %d", code)
+		t.Fail()
+	}
+	code, _ = tc.do("POST", "/admin/bans/add", url.Values{"t": {"json"}, "csrf": {csrf}, "addr": {"10.0.0.0/8"}, "reason": {"spam"}})
+	if code != http.StatusOK || db.bans["10.0.0.0/8"] != "spam" {
+		t.Logf("ban failed: %d %v", code, db.bans)
+		t.Fail()
+	}
+	if len(db.audit) != 1 || db.audit[0].Actor != "admin" || db.audit[0].Action != "ban" {
+		t.Logf("ban not audited: %v", db.audit)
+		t.Fail()
+	}
+
+	// key login is not enabled
+	code, _ = tc.do("POST", "/admin/login/key", url.Values{"t": {"json"}, "csrf": {csrf}})
+	if code != http.StatusForbidden {
+		t.Logf("key login when disabled gave %d", code)
+		t.Fail()
+	}
+}
+
+func TestKeyLogin(t *testing.T) {
+	pk, sk := crypto.GenKeypair()
+	pubkey := hex.EncodeToString(pk)
+	opk, osk := crypto.GenKeypair()
+	db := &memDB{mods: map[string]bool{pubkey: true}}
+	tc, done := newTestClient(t, &config.AdminConfig{Login: "key"}, db)
+	defer done()
+
+	sign := func(key []byte, challenge string) string {
+		s := crypto.CreateSigner(key)
+		s.Write([]byte(challenge))
+		return hex.EncodeToString(s.Sign())
+	}
+
+	// not a moderator
+	csrf, challenge := tc.loginPage()
+	code, _ := tc.do("POST", "/admin/login/key", url.Values{"t": {"json"}, "csrf": {csrf}, "pubkey": {hex.EncodeToString(opk)}, "signature": {sign(osk, challenge)}})
+	if code != http.StatusForbidden {
+		t.Logf("non moderator key login gave %d", code)
+		t.Fail()
+	}
+
+	// wrong signature
+	csrf, challenge = tc.loginPage()
+	code, _ = tc.do("POST", "/admin/login/key", url.Values{"t": {"json"}, "csrf": {csrf}, "pubkey": {pubkey}, "signature": {sign(osk, challenge)}})
+	if code != http.StatusForbidden {
+		t.Logf("forged key login gave %d", code)
+		t.Fail()
+	}
+
+	// challenges can't be reused
+	csrf, challenge = tc.loginPage()
+	sig := sign(sk, challenge)
+	u, _ := url.Parse(tc.base)
+	oldCookies := tc.c.Jar.Cookies(u)
+	code, j := tc.do("POST", "/admin/login/key", url.Values{"t": {"json"}, "csrf": {csrf}, "pubkey": {pubkey}, "signature": {sig}})
+	if code != http.StatusOK || j["loggedin"] != true {
+		t.Logf("key login failed: %d %v", code, j)
+		t.FailNow()
+	}
+	oldCsrf := csrf
+	csrf, _ = j["csrf"].(string)
+	code, _ = tc.do("POST", "/admin/login/key", url.Values{"t": {"json"}, "csrf": {csrf}, "pubkey": {pubkey}, "signature": {sig}})
+	if code != http.StatusForbidden {
+		t.Logf("reused challenge gave %d", code)
+		t.Fail()
+	}
+	// not even with the cookie from before the login
+	replay, _ := cookiejar.New(nil)
+	replay.SetCookies(u, oldCookies)
+	rc := &testClient{t: t, base: tc.base, c: &http.Client{Jar: replay}}
+	code, _ = rc.do("POST", "/admin/login/key", url.Values{"t": {"json"}, "csrf": {oldCsrf}, "pubkey": {pubkey}, "signature": {sig}})
+	if code != http.StatusForbidden {
+		t.Logf("replayed challenge cookie gave %d", code)
+		t.Fail()
+	}
+
+	code, j = tc.do("GET", "/admin/", url.Values{"t": {"json"}})
+	if code != http.StatusOK {
+		t.Logf("status after key login gave %d %v", code, j)
+		t.Fail()
+	}
+
+	code, _ = tc.do("POST", "/admin/logout", url.Values{"t": {"json"}, "csrf": {csrf}})
+	if code != http.StatusOK {
+		t.Logf("logout gave %d", code)
+		t.Fail()
+	}
+	code, _ = tc.do("GET", "/admin/", url.Values{"t": {"json"}})
+	if code != http.StatusUnauthorized {
+		t.Logf("status after logout gave %d", code)
+		t.Fail()
+	}
+}
+
+func TestPanelDisabled(t *testing.T) {
+	tc, done := newTestClient(t, &config.AdminConfig{}, &memDB{})
+	defer done()
+	code, _ := tc.do("GET", "/admin/login", url.Values{"t": {"json"}})
+	if code != http.StatusNotFound {
+		t.Logf("login page of unconfigured panel gave %d", code)
+		t.Fail()
+	}
+	code, _ = tc.do("POST", "/admin/login", url.Values{"t": {"json"}, "username": {""}, "password": {""}})
+	if code != http.StatusForbidden {
+		t.Logf("empty login to unconfigured panel gave %d", code)
+		t.Fail()
+	}
+}
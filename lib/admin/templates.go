@@ -0,0 +1,191 @@
+package admin
+
+import (
+	"html/template"
+	"time"
+)
+
+var templateFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+}
+
+// admin panel pages
+// every page is a full html document built from header and footer
+const templates = `
+{{define "header"}}<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>admin panel</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+form.inline { display: inline; }
+.error { color: #b00; }
+nav a { margin-right: 1em; }
+</style>
+</head>
+<body>
+{{if .Actor}}<nav>
+<a href="/admin/">status</a>
+<a href="/admin/bans">bans</a>
+<a href="/admin/modkeys">mod keys</a>
+<a href="/admin/audit">audit log</a>
+<a href="/admin/reprocess">reprocess</a>
+<form class="inline" method="post" action="/admin/logout"><input type="hidden" name="csrf" value="{{.CSRF}}"><input type="submit" value="log out {{.Actor}}"></form>
+</nav>{{end}}
+{{end}}
+
+{{define "footer"}}
+</body>
+</html>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+<h1>log in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .NeedPassword}}
+<form method="post" action="/admin/login">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p><label>username <input type="text" name="username"></label></p>
+<p><label>password <input type="password" name="password"></label></p>
+<p><input type="submit" value="log in"></p>
+</form>
+{{end}}
+{{if .NeedKey}}
+<form method="post" action="/admin/login/key">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p>sign this challenge with your moderator key:</p>
+<pre>{{.Challenge}}</pre>
+<p><label>public key <input type="text" name="pubkey" size="64"></label></p>
+<p><label>signature <input type="text" name="signature" size="128"></label></p>
+<p><input type="submit" value="log in with key"></p>
+</form>
+{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "conns"}}<table>
+<tr><th>host</th><th>feed</th><th>mode</th><th>group</th><th>authed</th><th>tls</th><th>since</th><th>offered</th><th>accepted</th><th>rejected</th><th>deferred</th><th>bytes in</th><th>bytes out</th><th>last error</th></tr>
+{{range .}}<tr>
+<td>{{.state.hostname}}</td><td>{{.state.feedname}}</td><td>{{.state.mode}}</td><td>{{.state.newsgroup}}</td><td>{{.authed}}</td><td>{{if .tls}}yes{{else}}no{{end}}</td>
+<td>{{.stats.started}}</td><td>{{.stats.offered}}</td><td>{{.stats.accepted}}</td><td>{{.stats.rejected}}</td><td>{{.stats.deferred}}</td><td>{{.stats.bytesin}}</td><td>{{.stats.bytesout}}</td>
+<td>{{.lasterror}}</td>
+</tr>{{end}}
+</table>{{end}}
+
+{{define "status"}}{{template "header" .}}
+<h1>outbound feeds</h1>
+<table>
+<tr><th>name</th><th>address</th><th>connected</th><th>queued</th><th>last error</th><th>at</th></tr>
+{{range .Status.feeds}}<tr>
+<td>{{.name}}</td><td>{{.addr}}</td><td>{{.connected}}</td><td>{{.queue}}</td><td>{{.lasterror}}</td><td>{{if .lasterror}}{{.lasterrortime}}{{end}}</td>
+</tr>{{end}}
+</table>
+<h1>outbound connections</h1>
+{{template "conns" .Status.outbound}}
+<h1>inbound connections</h1>
+{{template "conns" .Status.inbound}}
+<h1>delete</h1>
+<form method="post" action="/admin/articles/delete">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>article message-id <input type="text" name="msgid" size="40"></label>
+<input type="submit" value="delete article">
+</form>
+<form method="post" action="/admin/attachments/delete">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>attachment file name <input type="text" name="filename" size="40"></label>
+<input type="submit" value="delete attachment">
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "bans"}}{{template "header" .}}
+<h1>bans</h1>
+<form method="post" action="/admin/bans/add">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>address or range <input type="text" name="addr"></label>
+<label>reason <input type="text" name="reason"></label>
+<label>expires in <input type="text" name="expires" placeholder="24h, empty for never"></label>
+<input type="submit" value="ban">
+</form>
+<table>
+<tr><th>range</th><th>reason</th><th>made</th><th>expires</th><th></th></tr>
+{{range .Bans}}<tr>
+<td>{{.Addr}}</td><td>{{.Reason}}</td><td>{{date .Made}}</td><td>{{date .Expires}}</td>
+<td><form class="inline" method="post" action="/admin/bans/remove"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="addr" value="{{.Addr}}"><input type="submit" value="unban"></form></td>
+</tr>{{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "modkeys"}}{{template "header" .}}
+<h1>moderator keys</h1>
+<form method="post" action="/admin/modkeys/add">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>public key <input type="text" name="pubkey" size="64"></label>
+<label>note <input type="text" name="note"></label>
+<input type="submit" value="add">
+</form>
+<table>
+<tr><th>public key</th><th>note</th><th>added</th><th></th></tr>
+{{range .Keys}}<tr>
+<td><code>{{.PubKey}}</code></td><td>{{.Note}}</td><td>{{date .Added}}</td>
+<td><form class="inline" method="post" action="/admin/modkeys/remove"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="pubkey" value="{{.PubKey}}"><input type="submit" value="remove"></form></td>
+</tr>{{end}}
+{{range .Config}}<tr>
+<td><code>{{.}}</code></td><td>from config file</td><td></td><td></td>
+</tr>{{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "reprocess"}}{{template "header" .}}
+<h1>reprocess stored articles</h1>
+{{if .Supported}}
+{{with .Progress}}
+<table>
+<tr><th>running</th><td>{{.Running}}</td></tr>
+<tr><th>started</th><td>{{date .Started}}</td></tr>
+<tr><th>finished</th><td>{{if .Running}}{{else}}{{date .Finished}}{{end}}</td></tr>
+<tr><th>processed</th><td>{{.Processed}}</td></tr>
+<tr><th>deleted</th><td>{{.Deleted}}</td></tr>
+<tr><th>failed</th><td>{{.Failed}}</td></tr>
+<tr><th>last article</th><td><code>{{.Last}}</code></td></tr>
+{{if .Error}}<tr><th>error</th><td class="error">{{.Error}}</td></tr>{{end}}
+</table>
+{{end}}
+{{if .Progress.Running}}
+<form method="post" action="/admin/reprocess/stop">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="submit" value="stop">
+</form>
+{{else}}
+<form method="post" action="/admin/reprocess/start">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label><input type="checkbox" name="recheck" value="1"> check articles against the article policy again and delete the ones it does not allow</label><br>
+<label><input type="checkbox" name="resume" value="1"> continue where the last run stopped</label><br>
+<input type="submit" value="start">
+</form>
+{{end}}
+{{else}}
+<p>reprocessing is not supported by this server</p>
+{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "audit"}}{{template "header" .}}
+<h1>audit log</h1>
+<table>
+<tr><th>time</th><th>who</th><th>action</th><th>target</th><th>detail</th></tr>
+{{range .Entries}}<tr>
+<td>{{date .Time}}</td><td><code>{{.Actor}}</code></td><td>{{.Action}}</td><td><code>{{.Target}}</code></td><td>{{.Detail}}</td>
+</tr>{{end}}
+</table>
+<p>
+{{if ge .Prev 0}}<a href="/admin/audit?offset={{.Prev}}">newer</a>{{end}}
+{{if ge .Next 0}}<a href="/admin/audit?offset={{.Next}}">older</a>{{end}}
+</p>
+{{template "footer" .}}{{end}}
+`
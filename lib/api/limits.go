@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// posts a client address may make at once
+const postBurst = 5
+
+// posts a client address gets back per second
+const postRate = 1.0 / 30
+
+// max number of client addresses whose posts are counted
+const maxLimitedAddrs = 65536
+
+// rate limits posts with a token bucket per client address
+// ipv6 clients are limited per /64 as they usually get a whole one
+type addrLimiter struct {
+	access sync.Mutex
+	// tokens added per second
+	rate float64
+	// max tokens held
+	burst float64
+	addrs map[string]*addrBucket
+}
+
+// tokens of one client address
+type addrBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// create a limiter where every address starts with a full bucket
+func newAddrLimiter(rate, burst float64) *addrLimiter {
+	return &addrLimiter{
+		rate:  rate,
+		burst: burst,
+		addrs: make(map[string]*addrBucket),
+	}
+}
+
+// get what posts from an address are counted under
+func limitKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// take a token for a post from an address
+// returns false if the address is posting too fast
+func (l *addrLimiter) allow(addr string) bool {
+	now := time.Now()
+	key := limitKey(addr)
+	l.access.Lock()
+	defer l.access.Unlock()
+	b, ok := l.addrs[key]
+	if !ok {
+		if len(l.addrs) >= maxLimitedAddrs {
+			l.prune(now)
+		}
+		if len(l.addrs) >= maxLimitedAddrs {
+			// too many addresses posting at once to tell them apart
+			return false
+		}
+		b = &addrBucket{tokens: l.burst, last: now}
+		l.addrs[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forget the addresses whose buckets filled up again
+func (l *addrLimiter) prune(now time.Time) {
+	for key, b := range l.addrs {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.addrs, key)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/util"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// max size of a post made via the api
+const maxPostSize = 32 << 20
+
+// how long a post waits for its proof of work
+const pendingTimeout = time.Minute * 10
+
+// max number of posts waiting for proof of work
+const maxPending = 1024
+
+// least proof of work a post needs when there is no captcha
+// about 65 thousand hashes on average
+const minPoWBits = 16
+
+var ErrTooManyPending = errors.New("too many posts waiting for proof of work")
+var ErrNoSuchPending = errors.New("no such post waiting for proof of work")
+var ErrBadPoW = errors.New("insufficient proof of work")
+var ErrBadCaptcha = errors.New("bad captcha")
+var ErrPostingTooFast = errors.New("posting too fast, try again later")
+
+// a post waiting for proof of work from the client
+type pendingPost struct {
+	article *nntp.PendingArticle
+	created time.Time
+}
+
+// a post made via the api
+type postRequest struct {
+	Newsgroup   string             `json:"newsgroup"`
+	Reference   string             `json:"reference"`
+	Name        string             `json:"name"`
+	Subject     string             `json:"subject"`
+	Message     string             `json:"message"`
+	Attachments []model.Attachment `json:"attachments"`
+	// solution to the captcha of the poster's session
+	Captcha string `json:"captcha"`
+}
+
+// proof of work for a pending post
+type powRequest struct {
+	// token the post was given when it was made
+	Token string `json:"token"`
+	Nonce string `json:"nonce"`
+}
+
+// handle a new post
+// the poster solves a captcha first, without captchas every post needs proof of work
+// if the post requires proof of work the reply holds everything the client
+// needs to compute it and the post is submitted once it is sent to /post/pow
+func (s *Server) HandlePost(w http.ResponseWriter, r *http.Request) {
+	if s.rejectBanned(w, r) {
+		return
+	}
+	addr := util.AddrIP(r.RemoteAddr)
+	if !s.limits.allow(addr) {
+		sendError(w, http.StatusTooManyRequests, ErrPostingTooFast)
+		return
+	}
+	var req postRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostSize)).Decode(&req)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	if s.captcha != nil {
+		var solved bool
+		solved, err = s.captcha.CheckSession(w, r, req.Captcha)
+		if err != nil || !solved {
+			sendError(w, http.StatusForbidden, ErrBadCaptcha)
+			return
+		}
+	}
+	a := s.nntpd.NewArticle(req.Newsgroup, req.Reference, req.Name, req.Subject, req.Message)
+	for _, att := range req.Attachments {
+		var body []byte
+		body, err = base64.StdEncoding.DecodeString(att.Body)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, err)
+			return
+		}
+		mime := att.Mime
+		if mime == "" {
+			mime = "application/octet-stream"
+		}
+		a.Attachments = append(a.Attachments, &message.Attachment{
+			Mime:     mime,
+			FileName: att.Name,
+			Body:     ioutil.NopCloser(bytes.NewReader(body)),
+		})
+	}
+	var p *nntp.PendingArticle
+	p, err = s.nntpd.PrepareArticle(a)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.Addr = addr
+	if s.captcha == nil && p.Bits < minPoWBits {
+		p.Bits = minPoWBits
+	}
+	if p.Bits == 0 {
+		// no proof of work needed
+		s.submit(w, p)
+		return
+	}
+	s.RequirePoW(w, p)
+}
+
+// keep a post until the client sends proof of work for it to /post/pow
+// the reply holds everything the client needs to compute it and the token
+// only the client knows that it sends the proof of work with
+func (s *Server) RequirePoW(w http.ResponseWriter, p *nntp.PendingArticle) {
+	token, err := s.addPending(p)
+	if err != nil {
+		sendError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	sendJSON(w, http.StatusAccepted, map[string]interface{}{
+		"token":       token,
+		"message_id":  p.MessageID().String(),
+		"date":        p.Date(),
+		"body_digest": hex.EncodeToString(p.BodyDigest()),
+		"bits":        p.Bits,
+		"header":      nntp.PoWHeader,
+	})
+}
+
+// handle proof of work for a pending post
+func (s *Server) HandlePoW(w http.ResponseWriter, r *http.Request) {
+	if s.rejectBanned(w, r) {
+		return
+	}
+	var req powRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.pendingMtx.Lock()
+	pp, ok := s.pending[req.Token]
+	if ok && pp.article.SetPoW(req.Nonce) {
+		delete(s.pending, req.Token)
+	} else if ok {
+		err = ErrBadPoW
+	} else {
+		err = ErrNoSuchPending
+	}
+	s.pendingMtx.Unlock()
+	if err != nil {
+		sendError(w, http.StatusForbidden, err)
+		return
+	}
+	s.submit(w, pp.article)
+}
+
+// submit a post to the nntp server and reply with the result
+func (s *Server) submit(w http.ResponseWriter, p *nntp.PendingArticle) {
+	status, err := s.nntpd.PostArticle(p)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":   "api",
+			"msgid": p.MessageID(),
+		}).Error("failed to post article ", err)
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	code := http.StatusOK
+	if !status.Accept() {
+		code = http.StatusForbidden
+	}
+	sendJSON(w, code, map[string]string{
+		"message_id": p.MessageID().String(),
+		"newsgroup":  p.Newsgroup().String(),
+		"status":     status.String(),
+	})
+}
+
+// add a post waiting for proof of work, expires old ones
+// returns the token the proof of work is sent with
+func (s *Server) addPending(p *nntp.PendingArticle) (string, error) {
+	now := time.Now()
+	s.pendingMtx.Lock()
+	defer s.pendingMtx.Unlock()
+	for k, pp := range s.pending {
+		if now.Sub(pp.created) > pendingTimeout {
+			delete(s.pending, k)
+		}
+	}
+	if len(s.pending) >= maxPending {
+		return "", ErrTooManyPending
+	}
+	token := hex.EncodeToString(crypto.RandBytes(32))
+	s.pending[token] = &pendingPost{
+		article: p,
+		created: now,
+	}
+	return token, nil
+}
+
+// reply with an error if the poster of a request is banned
+// returns true if the request was rejected
+func (s *Server) rejectBanned(w http.ResponseWriter, r *http.Request) bool {
+	if s.bans == nil {
+		return false
+	}
+	ban, err := s.bans.CheckAddrBan(util.AddrIP(r.RemoteAddr))
+	if err != nil {
+		// don't lock everyone out if the ban list is broken
+		log.WithFields(log.Fields{
+			"pkg":  "api",
+			"addr": r.RemoteAddr,
+		}).Error("failed to check ban ", err)
+		return false
+	}
+	if ban == nil {
+		return false
+	}
+	sendError(w, http.StatusForbidden, errors.New("banned: "+ban.Reason))
+	return true
+}
+
+// send a json reply
+func sendJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "text/json; encoding=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+// send a json error reply
+func sendError(w http.ResponseWriter, code int, err error) {
+	sendJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// bans every address but one
+type testBans string
+
+func (b testBans) CheckAddrBan(addr string) (*model.AddrBan, error) {
+	if addr == string(b) {
+		return nil, nil
+	}
+	return &model.AddrBan{Addr: addr + "/32", Reason: "spam"}, nil
+}
+
+func TestPostBanned(t *testing.T) {
+	s := NewServer(nil, testBans("10.0.0.1"), nil)
+	for _, path := range []string{"/post", "/post/pow"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+		req.RemoteAddr = "10.0.0.2:1234"
+		w := httptest.NewRecorder()
+		if path == "/post" {
+			s.HandlePost(w, req)
+		} else {
+			s.HandlePoW(w, req)
+		}
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "banned: spam") {
+			t.Logf("banned poster to %s got %d %q", path, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+	// not banned gets past the ban check to the bad pow request
+	req := httptest.NewRequest("POST", "/post/pow", strings.NewReader("{}"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	s.HandlePoW(w, req)
+	if strings.Contains(w.Body.String(), "banned") {
+		t.Logf("poster not banned was rejected: %q", w.Body.String())
+		t.Fail()
+	}
+}
+
+// captcha nobody solves
+type testCaptcha struct{}
+
+func (testCaptcha) CheckSession(w http.ResponseWriter, r *http.Request, solution string) (bool, error) {
+	return false, nil
+}
+
+func TestPostNeedsCaptcha(t *testing.T) {
+	s := NewServer(nil, nil, testCaptcha{})
+	req := httptest.NewRequest("POST", "/post", strings.NewReader(`{"newsgroup": "overchan.test", "captcha": "nope"}`))
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	s.HandlePost(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ErrBadCaptcha.Error()) {
+		t.Logf("post without captcha got %d %q", w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+func TestPostRateLimit(t *testing.T) {
+	s := NewServer(nil, nil, testCaptcha{})
+	for n := 0; n <= postBurst; n++ {
+		req := httptest.NewRequest("POST", "/post", strings.NewReader("{}"))
+		// every address in a /64 counts as one
+		req.RemoteAddr = fmt.Sprintf("[2001:db8::%d]:1234", n)
+		w := httptest.NewRecorder()
+		s.HandlePost(w, req)
+		if (n < postBurst) == (w.Code == http.StatusTooManyRequests) {
+			t.Logf("post %d got %d %q", n, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+	if !s.limits.allow("10.0.0.1") {
+		t.Log("other address limited")
+		t.Fail()
+	}
+}
+
+func TestPostPoWToken(t *testing.T) {
+	nntpd := nntp.NewServer()
+	nntpd.Config = &config.NNTPServerConfig{Name: "test.tld"}
+	// without captchas every post needs proof of work
+	s := NewServer(nntpd, nil, nil)
+	req := httptest.NewRequest("POST", "/post", strings.NewReader(`{"newsgroup": "overchan.test", "message": "hello"}`))
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	s.HandlePost(w, req)
+	var reply struct {
+		Token     string `json:"token"`
+		MessageID string `json:"message_id"`
+		Bits      int    `json:"bits"`
+	}
+	json.NewDecoder(w.Body).Decode(&reply)
+	if w.Code != http.StatusAccepted || reply.Token == "" || reply.Bits != minPoWBits {
+		t.Logf("post without captcha got %d %+v", w.Code, reply)
+		t.FailNow()
+	}
+	cases := []struct {
+		body string
+		err  error
+	}{
+		// knowing the message-id is not enough to send proof of work
+		{`{"message_id": "` + reply.MessageID + `", "nonce": "x"}`, ErrNoSuchPending},
+		{`{"token": "` + reply.MessageID + `", "nonce": "x"}`, ErrNoSuchPending},
+		{`{"token": "` + reply.Token + `", "nonce": "x"}`, ErrBadPoW},
+	}
+	for _, c := range cases {
+		req = httptest.NewRequest("POST", "/post/pow", strings.NewReader(c.body))
+		w = httptest.NewRecorder()
+		s.HandlePoW(w, req)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), c.err.Error()) {
+			t.Logf("%s got %d %q", c.body, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+}
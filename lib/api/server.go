@@ -2,11 +2,44 @@ package api
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/majestrate/srndv2/lib/nntp"
 	"net/http"
+	"sync"
 )
 
+// checks that a poster solved a captcha
+type CaptchaChecker interface {
+	// return true if the session of a request solved its last captcha with the given solution
+	CheckSession(w http.ResponseWriter, r *http.Request, solution string) (bool, error)
+}
+
 // api server
 type Server struct {
+	// nntp server posts are submitted to
+	nntpd *nntp.Server
+	// checks posters for bans, nil for no ban checks
+	bans nntp.BanChecker
+	// captchas posters solve, nil to require proof of work on every post instead
+	captcha CaptchaChecker
+	// limits how fast each client address posts
+	limits *addrLimiter
+	// posts waiting for proof of work from the client by their token
+	pending map[string]*pendingPost
+	// protects pending
+	pendingMtx sync.Mutex
+}
+
+// create a new api server that submits posts to an nntp server
+// posters are checked against bans, which may be nil for no ban checks
+// posters solve captchas of captcha, which may be nil to require proof of work from them instead
+func NewServer(nntpd *nntp.Server, bans nntp.BanChecker, captcha CaptchaChecker) *Server {
+	return &Server{
+		nntpd:   nntpd,
+		bans:    bans,
+		captcha: captcha,
+		limits:  newAddrLimiter(postRate, postBurst),
+		pending: make(map[string]*pendingPost),
+	}
 }
 
 func (s *Server) HandlePing(w http.ResponseWriter, r *http.Request) {
@@ -17,4 +50,7 @@ func (s *Server) HandlePing(w http.ResponseWriter, r *http.Request) {
 func (s *Server) SetupRoutes(r *mux.Router) {
 	// setup api pinger
 	r.Path("/ping").HandlerFunc(s.HandlePing)
+	// setup posting
+	r.Path("/post").Methods("POST").HandlerFunc(s.HandlePost)
+	r.Path("/post/pow").Methods("POST").HandlerFunc(s.HandlePoW)
 }
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// admin panel configuration
+// the admin panel is disabled unless the login method it uses is set up
+type AdminConfig struct {
+	// how to log in, one of:
+	// "password" to log in with username and password (default)
+	// "key" to log in by signing a challenge with a moderator key
+	// "both" to require both
+	Login string `json:"login"`
+	// username to log into the admin panel with
+	Username string `json:"username"`
+	// bcrypt hash of the password to log into the admin panel with
+	// make one with: nntpchan passwd
+	PasswordHash string `json:"password_hash"`
+	// hex encoded ed25519 public keys that can log in by signature
+	// moderator keys in the database can log in as well
+	Keys []string `json:"keys"`
+}
+
+// does logging in require a username and password?
+func (c *AdminConfig) NeedsPassword() bool {
+	return c.Login == "" || c.Login == "password" || c.Login == "both"
+}
+
+// does logging in require a key signature?
+func (c *AdminConfig) NeedsKey() bool {
+	return c.Login == "key" || c.Login == "both"
+}
+
+// check that the login method, password hash and keys are valid
+func (c *AdminConfig) Compile() error {
+	switch c.Login {
+	case "", "password", "key", "both":
+	default:
+		return fmt.Errorf("unknown login method: %s", c.Login)
+	}
+	if c.PasswordHash != "" {
+		_, err := bcrypt.Cost([]byte(c.PasswordHash))
+		if err != nil {
+			return fmt.Errorf("invalid password hash: %s", err.Error())
+		}
+	}
+	for _, k := range c.Keys {
+		d, err := hex.DecodeString(k)
+		if err != nil || len(d) != 32 {
+			return fmt.Errorf("invalid public key: %s", k)
+		}
+	}
+	return nil
+}
@@ -1,13 +1,25 @@
 package config
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+)
 
 // configration for local article policies
+//
+// a newsgroup is checked in this order:
+// if it matches any pattern in the blacklist it is disallowed,
+// if the last matching pattern in the groups wildmat is negated it is disallowed,
+// if the last matching pattern in the groups wildmat is not negated it is allowed,
+// if it matches any pattern in the whitelist it is allowed,
+// otherwise it is allowed only if force-whitelist is not set
 type ArticleConfig struct {
 	// explicitly allow these newsgroups (regexp)
 	AllowGroups []string `json:"whitelist"`
 	// explicitly disallow these newsgroups (regexp)
 	DisallowGroups []string `json:"blacklist"`
+	// INN style wildmat of newsgroups, i.e. "overchan.*,!overchan.cp"
+	Groups string `json:"groups"`
 	// only allow explicitly allowed groups
 	ForceWhitelist bool `json:"force-whitelist"`
 	// allow anonymous posts?
@@ -16,27 +28,97 @@ type ArticleConfig struct {
 	AllowAttachments bool `json:"attachments"`
 	// allow anonymous attachments?
 	AllowAnonAttachments bool `json:"anon-attachments"`
+
+	// unexported fields ...
+
+	// compiled patterns, nil if not compiled yet
+	rules *articleRules
 }
 
-func (c *ArticleConfig) AllowGroup(group string) bool {
+// compiled newsgroup patterns of an ArticleConfig
+type articleRules struct {
+	allow    []*regexp.Regexp
+	disallow []*regexp.Regexp
+	groups   Wildmat
+}
 
-	for _, g := range c.DisallowGroups {
-		r := regexp.MustCompile(g)
-		if r.MatchString(group) && c.ForceWhitelist {
-			// disallowed
+func (r *articleRules) allowGroup(group string, forceWhitelist bool) bool {
+	for _, re := range r.disallow {
+		if re.MatchString(group) {
 			return false
 		}
 	}
 
-	// check allowed groups first
-	for _, g := range c.AllowGroups {
-		r := regexp.MustCompile(g)
-		if r.MatchString(g) {
+	allow, found := r.groups.Eval(group)
+	if found {
+		return allow
+	}
+
+	for _, re := range r.allow {
+		if re.MatchString(group) {
 			return true
 		}
 	}
 
-	return !c.ForceWhitelist
+	return !forceWhitelist
+}
+
+func compileRegexps(exprs []string) (res []*regexp.Regexp, err error) {
+	for _, expr := range exprs {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(expr)
+		if err != nil {
+			err = fmt.Errorf("bad regexp %q: %s", expr, err.Error())
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+func (c *ArticleConfig) compileRules() (r *articleRules, err error) {
+	r = new(articleRules)
+	r.allow, err = compileRegexps(c.AllowGroups)
+	if err == nil {
+		r.disallow, err = compileRegexps(c.DisallowGroups)
+	}
+	if err == nil && c.Groups != "" {
+		r.groups, err = CompileWildmat(c.Groups)
+		if err != nil {
+			err = fmt.Errorf("bad wildmat %q: %s", c.Groups, err.Error())
+		}
+	}
+	if err != nil {
+		r = nil
+	}
+	return
+}
+
+// compile all newsgroup patterns
+// must be called again after the patterns are modified
+// returns error if any pattern is malformed
+func (c *ArticleConfig) Compile() (err error) {
+	var r *articleRules
+	r, err = c.compileRules()
+	if err == nil {
+		c.rules = r
+	}
+	return
+}
+
+// is this newsgroup allowed by this policy?
+func (c *ArticleConfig) AllowGroup(group string) bool {
+	r := c.rules
+	if r == nil {
+		// not compiled ahead of time, compile for this call only
+		var err error
+		r, err = c.compileRules()
+		if err != nil {
+			// malformed policy, allow nothing
+			return false
+		}
+	}
+	return r.allowGroup(group, c.ForceWhitelist)
 }
 
 // allow an article?
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func doTestAllowGroups(t *testing.T, c *ArticleConfig, allowed, disallowed []string) {
+	for _, g := range allowed {
+		if !c.AllowGroup(g) {
+			t.Logf("group not allowed when it should be: %s", g)
+			t.Fail()
+		}
+	}
+	for _, g := range disallowed {
+		if c.AllowGroup(g) {
+			t.Logf("group allowed when it should not be: %s", g)
+			t.Fail()
+		}
+	}
+}
+
+func TestAllowGroupWhitelistMatchesGroup(t *testing.T) {
+	c := &ArticleConfig{
+		AllowGroups:    []string{`^overchan\.test$`},
+		ForceWhitelist: true,
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile policy: %s", err)
+		t.FailNow()
+	}
+	doTestAllowGroups(t, c, []string{"overchan.test"}, []string{"overchan.b", "ctl"})
+}
+
+func TestAllowGroupBlacklistWithoutForceWhitelist(t *testing.T) {
+	c := &ArticleConfig{
+		DisallowGroups: []string{`^overchan\.cp$`},
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile policy: %s", err)
+		t.FailNow()
+	}
+	doTestAllowGroups(t, c, []string{"overchan.test", "ctl"}, []string{"overchan.cp"})
+}
+
+func TestAllowGroupBlacklistBeatsWhitelist(t *testing.T) {
+	c := &ArticleConfig{
+		AllowGroups:    []string{`^overchan\.`},
+		DisallowGroups: []string{`^overchan\.cp$`},
+		ForceWhitelist: true,
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile policy: %s", err)
+		t.FailNow()
+	}
+	doTestAllowGroups(t, c, []string{"overchan.test"}, []string{"overchan.cp", "ctl"})
+}
+
+func TestAllowGroupWildmat(t *testing.T) {
+	c := &ArticleConfig{
+		AllowGroups:    []string{`^ctl$`},
+		Groups:         "overchan.*,!overchan.cp",
+		ForceWhitelist: true,
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile policy: %s", err)
+		t.FailNow()
+	}
+	doTestAllowGroups(t, c, []string{"overchan.test", "overchan.b", "ctl"}, []string{"overchan.cp", "alt.test"})
+}
+
+func TestAllowGroupWildmatBeatsWhitelist(t *testing.T) {
+	c := &ArticleConfig{
+		AllowGroups: []string{`^overchan\.`},
+		Groups:      "!overchan.cp",
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile policy: %s", err)
+		t.FailNow()
+	}
+	doTestAllowGroups(t, c, []string{"overchan.test", "alt.test"}, []string{"overchan.cp"})
+}
+
+func TestAllowGroupDefaultPolicy(t *testing.T) {
+	c := DefaultArticlePolicy
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile default policy: %s", err)
+		t.FailNow()
+	}
+	doTestAllowGroups(t, &c, []string{"ctl", "overchan.test", "overchan.b"}, []string{"overchan.cp"})
+}
+
+func TestAllowGroupUncompiled(t *testing.T) {
+	c := &ArticleConfig{
+		DisallowGroups: []string{`^overchan\.cp$`},
+		Groups:         "overchan.*",
+		ForceWhitelist: true,
+	}
+	doTestAllowGroups(t, c, []string{"overchan.test"}, []string{"overchan.cp", "ctl"})
+}
+
+func TestAllowGroupBadPatterns(t *testing.T) {
+	for _, c := range []*ArticleConfig{
+		{AllowGroups: []string{"("}},
+		{DisallowGroups: []string{"[a-"}},
+		{Groups: "overchan.[a"},
+	} {
+		if c.Compile() == nil {
+			t.Logf("bad policy compiled: %v", c)
+			t.Fail()
+		}
+		// malformed policies allow nothing
+		doTestAllowGroups(t, c, nil, []string{"overchan.test", "ctl"})
+	}
+}
+
+func TestAllowArticle(t *testing.T) {
+	c := DefaultArticlePolicy
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile default policy: %s", err)
+		t.FailNow()
+	}
+	if !c.Allow("", "overchan.test", true, false) {
+		t.Log("anon post without attachments disallowed")
+		t.Fail()
+	}
+	if c.Allow("", "overchan.test", true, true) {
+		t.Log("anon post with attachments allowed")
+		t.Fail()
+	}
+	if !c.Allow("", "overchan.test", false, true) {
+		t.Log("post with attachments disallowed")
+		t.Fail()
+	}
+	if c.Allow("", "overchan.cp", false, false) {
+		t.Log("post to blacklisted group allowed")
+		t.Fail()
+	}
+}
+
+func TestLoadReportsBadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-config")
+	if err != nil {
+		t.Logf("failed to make temp dir: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(fname, []byte(`{"feeds": [{"name": "bad", "policy": {"whitelist": ["("]}}]}`), 0600)
+	if err != nil {
+		t.Logf("failed to write config: %s", err)
+		t.FailNow()
+	}
+	_, err = Load(fname)
+	if err == nil {
+		t.Log("config with bad regexp loaded")
+		t.Fail()
+	} else {
+		t.Logf("load failed as expected: %s", err)
+	}
+
+	err = ioutil.WriteFile(fname, []byte(`{"nntp": {"policy": {"groups": "overchan.*,!overchan.cp"}}}`), 0600)
+	if err != nil {
+		t.Logf("failed to write config: %s", err)
+		t.FailNow()
+	}
+	var c *Config
+	c, err = Load(fname)
+	if err != nil {
+		t.Logf("failed to load config: %s", err)
+		t.FailNow()
+	}
+	if c.NNTP.Article.rules == nil {
+		t.Log("policy not compiled on load")
+		t.Fail()
+	}
+	doTestAllowGroups(t, c.NNTP.Article, []string{"overchan.test"}, []string{"overchan.cp"})
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 )
@@ -19,12 +20,26 @@ type Config struct {
 	WebHooks []*WebhookConfig `json:"webhooks"`
 	// external scripts to call
 	NNTPHooks []*NNTPHookConfig `json:"nntphooks"`
+	// filters applied in order to inbound articles
+	Filters []*FilterConfig `json:"filters"`
 	// database backend configuration
 	Database *DatabaseConfig `json:"db"`
 	// list of feeds to add on runtime
 	Feeds []*FeedConfig `json:"feeds"`
 	// frontend config
 	Frontends []*FrontendConfig `json:"frontends"`
+	// moderation config
+	Mod *ModConfig `json:"mod"`
+	// metrics listener, nil to not serve metrics on their own address
+	Metrics *MetricsConfig `json:"metrics"`
+	// article expiry, nil to keep articles forever
+	Expire *ExpireConfig `json:"expire"`
+	// thumbnailing of stored attachments, nil to make no thumbnails
+	Thumbnails *ThumbnailConfig `json:"thumbnails"`
+	// limits on external programs, nil for the defaults
+	Processes *ProcessConfig `json:"processes"`
+	// local control socket, nil to not serve one
+	Control *ControlConfig `json:"control"`
 	// unexported fields ...
 
 	// absolute filepath to configuration
@@ -33,14 +48,19 @@ type Config struct {
 
 // default configuration
 var DefaultConfig = Config{
-	Store:     &DefaultStoreConfig,
-	NNTP:      &DefaultNNTPConfig,
-	Database:  &DefaultDatabaseConfig,
-	WebHooks:  []*WebhookConfig{DefaultWebHookConfig},
-	NNTPHooks: []*NNTPHookConfig{DefaultNNTPHookConfig},
-	Feeds:     DefaultFeeds,
-	Frontends: []*FrontendConfig{&DefaultFrontendConfig},
-	Log:       "debug",
+	Store:      &DefaultStoreConfig,
+	NNTP:       &DefaultNNTPConfig,
+	Database:   &DefaultDatabaseConfig,
+	WebHooks:   []*WebhookConfig{DefaultWebHookConfig},
+	NNTPHooks:  []*NNTPHookConfig{DefaultNNTPHookConfig},
+	Filters:    DefaultFilters,
+	Feeds:      DefaultFeeds,
+	Frontends:  []*FrontendConfig{&DefaultFrontendConfig},
+	Mod:        &DefaultModConfig,
+	Thumbnails: &DefaultThumbnailConfig,
+	Processes:  &DefaultProcessConfig,
+	Control:    &DefaultControlConfig,
+	Log:        "debug",
 }
 
 // reload configuration
@@ -50,6 +70,60 @@ func (c *Config) Reload() (err error) {
 	if err == nil {
 		err = json.Unmarshal(b, c)
 	}
+	if err == nil {
+		err = c.compile()
+	}
+	return
+}
+
+// compile all article policies
+func (c *Config) compile() (err error) {
+	if c.NNTP != nil && c.NNTP.Article != nil {
+		err = c.NNTP.Article.Compile()
+		if err != nil {
+			return fmt.Errorf("nntp policy: %s", err.Error())
+		}
+	}
+	if c.NNTP != nil && c.NNTP.PoW != nil {
+		err = c.NNTP.PoW.Compile()
+		if err != nil {
+			return fmt.Errorf("nntp proof of work: %s", err.Error())
+		}
+	}
+	if c.Expire != nil {
+		err = c.Expire.Compile()
+		if err != nil {
+			return fmt.Errorf("expire: %s", err.Error())
+		}
+	}
+	if c.Thumbnails != nil {
+		err = c.Thumbnails.Compile()
+		if err != nil {
+			return fmt.Errorf("thumbnails: %s", err.Error())
+		}
+	}
+	if c.Processes != nil {
+		err = c.Processes.Compile()
+		if err != nil {
+			return fmt.Errorf("processes: %s", err.Error())
+		}
+	}
+	for _, f := range c.Frontends {
+		if f.Admin != nil {
+			err = f.Admin.Compile()
+			if err != nil {
+				return fmt.Errorf("admin panel for frontend %s: %s", f.BindAddr, err.Error())
+			}
+		}
+	}
+	for _, f := range c.Feeds {
+		if f.Policy != nil {
+			err = f.Policy.Compile()
+			if err != nil {
+				return fmt.Errorf("policy for feed %s: %s", f.Name, err.Error())
+			}
+		}
+	}
 	return
 }
 
@@ -0,0 +1,11 @@
+package config
+
+// configuration for the local control socket used by commands like status
+type ControlConfig struct {
+	// path of the unix socket, only the user running the daemon may connect to it
+	Socket string `json:"socket"`
+}
+
+var DefaultControlConfig = ControlConfig{
+	Socket: "nntpchan.sock",
+}
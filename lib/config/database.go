@@ -9,10 +9,17 @@ type DatabaseConfig struct {
 	Username string `json:"username"`
 	// type of database to use
 	Type string `json:"type"`
+	// name of the database, empty for the driver's default
+	Name string `json:"name"`
+	// postgres ssl mode such as disable, require or verify-full, empty for the driver's default
+	SSLMode string `json:"sslmode"`
 }
 
 var DefaultDatabaseConfig = DatabaseConfig{
 	Type:     "postgres",
 	Addr:     "/var/run/postgresql",
 	Password: "",
+	Name:     "srnd",
+	// the default address is a local socket
+	SSLMode: "disable",
 }
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// an INN style expiry rule for the newsgroups matching a wildmat
+// a zero value disables that limit
+type ExpireRule struct {
+	// INN style wildmat of newsgroups this rule applies to, i.e. "overchan.*,!overchan.test"
+	Groups string `json:"groups"`
+	// days to keep articles for
+	Days float64 `json:"days"`
+	// max articles to keep in a newsgroup, the oldest are expired first
+	Articles int `json:"articles"`
+	// max bytes of articles to keep in a newsgroup, the oldest are expired first
+	Bytes int64 `json:"bytes"`
+
+	// unexported fields ...
+
+	// compiled newsgroup wildmat
+	groups Wildmat
+}
+
+// max age of articles, 0 for no limit
+func (r *ExpireRule) MaxAge() time.Duration {
+	return time.Duration(r.Days * float64(24*time.Hour))
+}
+
+// configuration of article expiry
+// the last rule that matches a newsgroup applies to it, groups no rule
+// matches are kept forever
+type ExpireConfig struct {
+	// seconds between expire runs
+	Interval int `json:"interval"`
+	// expiry rules checked in order
+	Rules []*ExpireRule `json:"rules"`
+}
+
+// compile newsgroup patterns of all rules
+func (c *ExpireConfig) Compile() (err error) {
+	if c.Interval < 0 {
+		return fmt.Errorf("negative interval %d", c.Interval)
+	}
+	for idx, r := range c.Rules {
+		if r.Days < 0 || r.Articles < 0 || r.Bytes < 0 {
+			return fmt.Errorf("rule %d has a negative limit", idx)
+		}
+		r.groups, err = CompileWildmat(r.Groups)
+		if err != nil {
+			return fmt.Errorf("rule %d: %s", idx, err.Error())
+		}
+	}
+	return
+}
+
+// get the rule for a newsgroup, nil if it is kept forever
+func (c *ExpireConfig) RuleFor(group string) (rule *ExpireRule) {
+	for _, r := range c.Rules {
+		w := r.groups
+		if w == nil {
+			// not compiled ahead of time
+			var err error
+			w, err = CompileWildmat(r.Groups)
+			if err != nil {
+				continue
+			}
+		}
+		if w.Match(group) {
+			rule = r
+		}
+	}
+	return
+}
+
+// time between expire runs
+func (c *ExpireConfig) Every() time.Duration {
+	if c.Interval == 0 {
+		return time.Hour
+	}
+	return time.Duration(c.Interval) * time.Second
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireRuleFor(t *testing.T) {
+	c := &ExpireConfig{
+		Rules: []*ExpireRule{
+			{Groups: "*", Days: 30},
+			{Groups: "overchan.*,!overchan.test", Days: 7, Articles: 100},
+			{Groups: "ctl", Days: 0.5},
+		},
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	tests := map[string]float64{
+		"overchan.random": 7,
+		"overchan.test":   30,
+		"ctl":             0.5,
+		"alt.test":        30,
+	}
+	for group, days := range tests {
+		r := c.RuleFor(group)
+		if r == nil || r.Days != days {
+			t.Logf("wrong rule for %s: %+v", group, r)
+			t.Fail()
+		}
+	}
+	if c.RuleFor("ctl").MaxAge() != 12*time.Hour {
+		t.Logf("wrong max age %s", c.RuleFor("ctl").MaxAge())
+		t.Fail()
+	}
+	c.Rules = c.Rules[1:2]
+	if c.RuleFor("alt.test") != nil {
+		t.Log("rule for group no rule matches")
+		t.Fail()
+	}
+	c.Rules = []*ExpireRule{{Groups: "*", Articles: -1}}
+	if c.Compile() == nil {
+		t.Log("negative limit compiled")
+		t.Fail()
+	}
+}
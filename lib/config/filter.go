@@ -0,0 +1,28 @@
+package config
+
+// configuration for 1 article filter
+type FilterConfig struct {
+	// name of filter
+	Name string `json:"name"`
+	// type of filter, one of: header, date, exif, exec
+	// exif (or metadata) strips exif, xmp and comments from jpeg, png and webp attachments
+	Type string `json:"type"`
+	// headers to remove (header filter)
+	Strip []string `json:"strip"`
+	// headers to replace the value of if present (header filter)
+	Rewrite map[string]string `json:"rewrite"`
+	// executable script path to be called with 1 argument: header or body (exec filter)
+	// the article header or body is sent on stdin, the filtered version is read from stdout
+	Exec string `json:"exec"`
+}
+
+// default filters strip poster identifying headers
+// the date filter is left out as rewriting the date of relayed articles makes them
+// differ from the copies other servers have, local posts get a date when posted
+var DefaultFilters = []*FilterConfig{
+	{
+		Name:  "strip-posting-host",
+		Type:  "header",
+		Strip: []string{"X-Originating-IP", "NNTP-Posting-Host"},
+	},
+}
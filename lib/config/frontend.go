@@ -11,6 +11,12 @@ type FrontendConfig struct {
 	Static string `json:"static_dir"`
 	// http middleware configuration
 	Middleware *MiddlewareConfig `json:"middleware"`
+	// hex encoded key for signing session cookies, random on each start if empty
+	Secret string `json:"secret"`
+	// admin panel settings, nil to disable the admin panel
+	Admin *AdminConfig `json:"admin"`
+	// serve prometheus metrics at /metrics
+	Metrics bool `json:"metrics"`
 }
 
 // default Frontend Configuration
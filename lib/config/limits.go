@@ -0,0 +1,30 @@
+package config
+
+// limits on inbound nntp connections
+// a zero value disables that limit
+type LimitsConfig struct {
+	// max number of inbound connections
+	MaxConns int `json:"max_conns"`
+	// max number of inbound connections from one ip address
+	MaxConnsPerIP int `json:"max_conns_per_ip"`
+	// seconds a connection has to send a whole command line before it is closed
+	IdleTimeout int `json:"idle_timeout"`
+	// seconds a connection may stall while sending an article before it is closed
+	ReadTimeout int `json:"read_timeout"`
+	// seconds a connection has to send a whole article before it is closed
+	ArticleTimeout int `json:"article_timeout"`
+	// max articles a connection may send per minute
+	ArticlesPerMinute int `json:"articles_per_minute"`
+	// max bytes per second read from a connection
+	BytesPerSecond int `json:"bytes_per_second"`
+}
+
+var DefaultLimitsConfig = LimitsConfig{
+	MaxConns:          256,
+	MaxConnsPerIP:     16,
+	IdleTimeout:       600,
+	ReadTimeout:       60,
+	ArticleTimeout:    600,
+	ArticlesPerMinute: 600,
+	BytesPerSecond:    1024 * 1024,
+}
@@ -0,0 +1,28 @@
+package config
+
+// which articles get metadata stripped from their image attachments on ingest
+// exif, xmp and comments are removed from jpeg, png and webp attachments
+type MetadataConfig struct {
+	// strip articles posted on this server
+	Local bool `json:"local"`
+	// strip articles from other servers
+	// their attachments will no longer match what other servers have
+	Federated bool `json:"federated"`
+}
+
+// strip locally posted articles only
+var DefaultMetadataConfig = MetadataConfig{
+	Local: true,
+}
+
+// should an article be stripped?
+// local is true for articles posted on this server
+func (c *MetadataConfig) Strip(local bool) bool {
+	if c == nil {
+		return false
+	}
+	if local {
+		return c.Local
+	}
+	return c.Federated
+}
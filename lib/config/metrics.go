@@ -0,0 +1,7 @@
+package config
+
+// configuration for serving prometheus metrics on their own address
+type MetricsConfig struct {
+	// address to bind the metrics listener to
+	Bind string `json:"bind"`
+}
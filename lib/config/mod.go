@@ -0,0 +1,11 @@
+package config
+
+// moderation configuration
+type ModConfig struct {
+	// hex encoded ed25519 public keys of moderators whose ctl messages we obey
+	Keys []string `json:"keys"`
+}
+
+var DefaultModConfig = ModConfig{
+	Keys: []string{},
+}
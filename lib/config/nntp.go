@@ -13,6 +13,12 @@ type NNTPServerConfig struct {
 	SSL *SSLSettings
 	// file with login credentials
 	LoginsFile string `json:"authfile"`
+	// proof of work required from unauthenticated peers
+	PoW *PoWConfig `json:"pow"`
+	// limits on inbound connections
+	Limits *LimitsConfig `json:"limits"`
+	// metadata stripping of image attachments, nil to store attachments as sent
+	Metadata *MetadataConfig `json:"strip_metadata"`
 }
 
 var DefaultNNTPConfig = NNTPServerConfig{
@@ -21,4 +27,7 @@ var DefaultNNTPConfig = NNTPServerConfig{
 	Name:       "nntp.server.tld",
 	Article:    &DefaultArticlePolicy,
 	LoginsFile: "",
+	PoW:        &DefaultPoWConfig,
+	Limits:     &DefaultLimitsConfig,
+	Metadata:   &DefaultMetadataConfig,
 }
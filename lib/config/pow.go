@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+)
+
+// proof of work required on articles from unauthenticated peers
+type PoWConfig struct {
+	// default difficulty in leading zero bits, 0 for no proof of work
+	Bits int `json:"bits"`
+	// per newsgroup difficulty, the first matching rule is used
+	Groups []*PoWGroupConfig `json:"groups"`
+}
+
+// proof of work difficulty for a set of newsgroups
+type PoWGroupConfig struct {
+	// INN style wildmat of newsgroups this applies to
+	Newsgroups string `json:"newsgroups"`
+	// difficulty in leading zero bits
+	Bits int `json:"bits"`
+
+	// unexported fields ...
+
+	// compiled wildmat, nil if not compiled yet
+	match Wildmat
+}
+
+// compile all newsgroup wildmats
+// returns error if any wildmat is malformed
+func (c *PoWConfig) Compile() (err error) {
+	for _, g := range c.Groups {
+		var w Wildmat
+		w, err = CompileWildmat(g.Newsgroups)
+		if err != nil {
+			return fmt.Errorf("bad wildmat %q: %s", g.Newsgroups, err.Error())
+		}
+		g.match = w
+	}
+	return
+}
+
+// get the proof of work difficulty in bits for a newsgroup
+func (c *PoWConfig) BitsFor(group string) int {
+	for _, g := range c.Groups {
+		w := g.match
+		if w == nil {
+			var err error
+			w, err = CompileWildmat(g.Newsgroups)
+			if err != nil {
+				continue
+			}
+		}
+		if w.Match(group) {
+			return g.Bits
+		}
+	}
+	return c.Bits
+}
+
+// no proof of work until the operator asks for it
+// peers that do not compute it would have every article rejected
+var DefaultPoWConfig = PoWConfig{
+	Bits: 0,
+}
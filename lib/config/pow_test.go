@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestPoWBitsFor(t *testing.T) {
+	c := &PoWConfig{
+		Bits: 16,
+		Groups: []*PoWGroupConfig{
+			{Newsgroups: "ctl", Bits: 0},
+			{Newsgroups: "overchan.*,!overchan.test", Bits: 20},
+		},
+	}
+	err := c.Compile()
+	if err != nil {
+		t.Logf("failed to compile: %s", err)
+		t.FailNow()
+	}
+	cases := map[string]int{
+		"ctl":              0,
+		"overchan.random":  20,
+		"overchan.test":    16,
+		"alt.binaries.foo": 16,
+	}
+	for group, bits := range cases {
+		if c.BitsFor(group) != bits {
+			t.Logf("%s requires %d bits not %d", group, c.BitsFor(group), bits)
+			t.Fail()
+		}
+	}
+	c.Groups = append(c.Groups, &PoWGroupConfig{Newsgroups: "[a-"})
+	if c.Compile() == nil {
+		t.Log("bad wildmat compiled")
+		t.Fail()
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// limits on external programs run by thumbnailers and hooks
+// a zero value disables that limit
+type ProcessConfig struct {
+	// seconds a program may run before it is killed
+	Timeout int `json:"timeout"`
+	// bytes of stdout and of stderr kept, the rest is discarded
+	MaxOutput int64 `json:"max_output"`
+	// environment of programs, nothing is inherited from the daemon
+	Env []string `json:"env"`
+	// directory programs run in, empty for the directory of the daemon
+	Dir string `json:"dir"`
+	// seconds of cpu time a program may use
+	MaxCPU uint64 `json:"max_cpu"`
+	// bytes of address space a program may use
+	MaxMemory uint64 `json:"max_memory"`
+	// bytes a program may write to one file
+	MaxFileSize uint64 `json:"max_file_size"`
+	// files a program may have open
+	MaxOpenFiles uint64 `json:"max_open_files"`
+	// programs run at the same time, the rest wait
+	MaxProcs int `json:"max_procs"`
+}
+
+// check for values that make no sense
+func (c *ProcessConfig) Compile() error {
+	if c.Timeout < 0 || c.MaxOutput < 0 || c.MaxProcs < 0 {
+		return fmt.Errorf("negative timeout, max output or max procs")
+	}
+	return nil
+}
+
+// time a program may run for, 0 for no limit
+func (c *ProcessConfig) TimeLimit() time.Duration {
+	return time.Duration(c.Timeout) * time.Second
+}
+
+var DefaultProcessConfig = ProcessConfig{
+	Timeout:      60,
+	MaxOutput:    64 * 1024,
+	Env:          []string{"PATH=/usr/local/bin:/usr/bin:/bin", "LANG=C"},
+	MaxCPU:       60,
+	MaxMemory:    2 * 1024 * 1024 * 1024,
+	MaxFileSize:  64 * 1024 * 1024,
+	MaxOpenFiles: 64,
+	MaxProcs:     4,
+}
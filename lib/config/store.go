@@ -1,10 +1,34 @@
 package config
 
+import (
+	"path/filepath"
+	"strings"
+)
+
 type StoreConfig struct {
-	// path to article directory
+	// type of storage, filesystem or sqlite
+	Type string `json:"type"`
+	// path to article directory or sqlite database file
 	Path string `json:"path"`
+	// sync stored files to disk before acknowledging them, slower but survives power loss
+	Fsync bool `json:"fsync"`
+	// levels of directories filesystem storage spreads articles and attachments over, 0 for none
+	// changing it for existing storage needs the store migrate command
+	ShardDepth int `json:"shard_depth"`
+	// compress newly stored articles in filesystem storage with gzip or zstd, empty for none
+	// the store compress command converts articles already stored
+	Compression string `json:"compression"`
+}
+
+// directory for files kept next to the storage
+func (c *StoreConfig) DataDir() string {
+	if strings.ToLower(c.Type) == "sqlite" {
+		return filepath.Dir(c.Path)
+	}
+	return c.Path
 }
 
 var DefaultStoreConfig = StoreConfig{
+	Type: "filesystem",
 	Path: "storage",
 }
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// configuration of thumbnailing attachments as they are stored
+type ThumbnailConfig struct {
+	// path to the imagemagick convert program, empty to not thumbnail images
+	ConvertPath string `json:"convert"`
+	// path to the ffmpeg program, empty to not thumbnail videos or draw waveforms of compressed audio
+	FFMpegPath string `json:"ffmpeg"`
+	// width of thumbnails
+	Width int `json:"width"`
+	// height of thumbnails
+	Height int `json:"height"`
+	// make jpeg thumbnails of every image type
+	JpegOnly bool `json:"jpeg_only"`
+	// most pixels an image decoded in process may have, 0 for the default
+	MaxPixels int64 `json:"max_pixels"`
+	// most bytes an image decoded in process may take, 0 for the default
+	MaxMemory int64 `json:"max_memory"`
+	// thumbnails made at the same time
+	Workers int `json:"workers"`
+	// attachments waiting to be thumbnailed before new ones are skipped
+	QueueSize int `json:"queue_size"`
+	// times a failed thumbnail is tried again
+	Retries int `json:"retries"`
+	// seconds to wait before trying a failed thumbnail again
+	RetryDelay int `json:"retry_delay"`
+}
+
+// check for values that make no sense
+func (c *ThumbnailConfig) Compile() error {
+	if c.Width <= 0 || c.Height <= 0 {
+		return fmt.Errorf("bad thumbnail size %dx%d", c.Width, c.Height)
+	}
+	if c.Workers < 0 || c.QueueSize < 0 || c.Retries < 0 || c.RetryDelay < 0 {
+		return fmt.Errorf("negative workers, queue size, retries or retry delay")
+	}
+	if c.MaxPixels < 0 || c.MaxMemory < 0 {
+		return fmt.Errorf("negative image limits")
+	}
+	return nil
+}
+
+// time to wait before trying a failed thumbnail again
+func (c *ThumbnailConfig) RetryAfter() time.Duration {
+	return time.Duration(c.RetryDelay) * time.Second
+}
+
+var DefaultThumbnailConfig = ThumbnailConfig{
+	ConvertPath: "/usr/bin/convert",
+	FFMpegPath:  "/usr/bin/ffmpeg",
+	Width:       300,
+	Height:      200,
+	JpegOnly:    true,
+	Workers:     2,
+	QueueSize:   1024,
+	Retries:     3,
+	RetryDelay:  30,
+}
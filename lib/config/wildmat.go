@@ -0,0 +1,198 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrEmptyWildmat = errors.New("empty pattern in wildmat")
+var ErrBadWildmatClass = errors.New("unterminated character class in wildmat")
+var ErrBadWildmatEscape = errors.New("trailing backslash in wildmat")
+
+// 1 pattern in a wildmat expression
+type wildmatPattern struct {
+	// the pattern itself without the ! or @ prefix
+	pattern string
+	// true if this pattern is prefixed with ! or @
+	negate bool
+}
+
+// an INN style wildmat expression, i.e. "overchan.*,!overchan.cp"
+//
+// patterns are separated by commas and are evaluated in order, the last
+// pattern that matches decides the result. a pattern prefixed with ! or @
+// negates a match. in a pattern * matches any run of characters, ? matches
+// exactly 1 character, [abc] or [a-z] matches a character class, [^abc]
+// matches a negated class and \ escapes the next character
+type Wildmat []wildmatPattern
+
+// compile a wildmat expression
+// returns error if the expression is malformed
+func CompileWildmat(expr string) (w Wildmat, err error) {
+	for _, p := range strings.Split(expr, ",") {
+		p = strings.TrimSpace(p)
+		negate := false
+		if strings.HasPrefix(p, "!") || strings.HasPrefix(p, "@") {
+			negate = true
+			p = p[1:]
+		}
+		if len(p) == 0 {
+			return nil, ErrEmptyWildmat
+		}
+		err = checkWildmatPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, wildmatPattern{
+			pattern: p,
+			negate:  negate,
+		})
+	}
+	return
+}
+
+// evaluate this wildmat against a string
+// found is true if any pattern matched
+// allow is true if the last matching pattern was not negated
+func (w Wildmat) Eval(str string) (allow, found bool) {
+	for _, p := range w {
+		if wildmatMatch(p.pattern, str) {
+			found = true
+			allow = !p.negate
+		}
+	}
+	return
+}
+
+// return true if this wildmat positively matches a string
+func (w Wildmat) Match(str string) bool {
+	allow, _ := w.Eval(str)
+	return allow
+}
+
+// check a single pattern for syntax errors
+func checkWildmatPattern(p string) error {
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+			if i == len(p) {
+				return ErrBadWildmatEscape
+			}
+		case '[':
+			end := wildmatClassEnd(p, i)
+			if end == -1 {
+				return ErrBadWildmatClass
+			}
+			i = end
+		}
+	}
+	return nil
+}
+
+// find the index of the ] that closes the character class starting at p[start]
+// returns -1 if the class is not terminated
+func wildmatClassEnd(p string, start int) int {
+	i := start + 1
+	if i < len(p) && p[i] == '^' {
+		i++
+	}
+	// a ] right after [ or [^ is a literal
+	if i < len(p) && p[i] == ']' {
+		i++
+	}
+	for ; i < len(p); i++ {
+		if p[i] == '\\' {
+			i++
+		} else if p[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+// match a character class p[start:end+1] against c
+func wildmatClassMatch(p string, start, end int, c byte) bool {
+	i := start + 1
+	negate := false
+	if p[i] == '^' {
+		negate = true
+		i++
+	}
+	matched := false
+	for i < end {
+		lo := p[i]
+		if lo == '\\' {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < end && p[i+1] == '-' {
+			hi = p[i+2]
+			if hi == '\\' && i+3 < end {
+				hi = p[i+3]
+				i++
+			}
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return matched != negate
+}
+
+// match a single pre-checked pattern against a string
+func wildmatMatch(p, str string) bool {
+	// backtracking positions for the last * seen
+	star := -1
+	mark := 0
+	pi, si := 0, 0
+	for si < len(str) {
+		if pi < len(p) {
+			switch p[pi] {
+			case '*':
+				star = pi
+				mark = si
+				pi++
+				continue
+			case '?':
+				pi++
+				si++
+				continue
+			case '[':
+				end := wildmatClassEnd(p, pi)
+				if wildmatClassMatch(p, pi, end, str[si]) {
+					pi = end + 1
+					si++
+					continue
+				}
+			case '\\':
+				if p[pi+1] == str[si] {
+					pi += 2
+					si++
+					continue
+				}
+			default:
+				if p[pi] == str[si] {
+					pi++
+					si++
+					continue
+				}
+			}
+		}
+		if star == -1 {
+			return false
+		}
+		// backtrack, let the last * eat 1 more character
+		pi = star + 1
+		mark++
+		si = mark
+	}
+	// only trailing stars may remain
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
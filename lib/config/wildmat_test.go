@@ -0,0 +1,119 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestWildmatSimple(t *testing.T) {
+	w, err := CompileWildmat("overchan.*,!overchan.cp")
+	if err != nil {
+		t.Logf("failed to compile wildmat: %s", err)
+		t.FailNow()
+	}
+	for _, g := range []string{"overchan.test", "overchan.b", "overchan.cpx", "overchan."} {
+		if !w.Match(g) {
+			t.Logf("%s should match", g)
+			t.Fail()
+		}
+	}
+	for _, g := range []string{"overchan.cp", "ctl", "overchan", "xoverchan.test"} {
+		if w.Match(g) {
+			t.Logf("%s should not match", g)
+			t.Fail()
+		}
+	}
+}
+
+func TestWildmatLastMatchWins(t *testing.T) {
+	w, err := CompileWildmat("*,!overchan.*,overchan.test")
+	if err != nil {
+		t.Logf("failed to compile wildmat: %s", err)
+		t.FailNow()
+	}
+	cases := map[string]bool{
+		"ctl":            true,
+		"overchan.b":     false,
+		"overchan.test":  true,
+		"overchan.tests": false,
+	}
+	for g, expect := range cases {
+		if w.Match(g) != expect {
+			t.Logf("match %s should be %v", g, expect)
+			t.Fail()
+		}
+	}
+}
+
+func TestWildmatEval(t *testing.T) {
+	w, err := CompileWildmat("overchan.*, @overchan.cp")
+	if err != nil {
+		t.Logf("failed to compile wildmat: %s", err)
+		t.FailNow()
+	}
+	allow, found := w.Eval("overchan.cp")
+	if allow || !found {
+		t.Logf("poisoned group gave allow=%v found=%v", allow, found)
+		t.Fail()
+	}
+	allow, found = w.Eval("ctl")
+	if allow || found {
+		t.Logf("unmatched group gave allow=%v found=%v", allow, found)
+		t.Fail()
+	}
+	allow, found = w.Eval("overchan.test")
+	if !allow || !found {
+		t.Logf("matched group gave allow=%v found=%v", allow, found)
+		t.Fail()
+	}
+}
+
+func TestWildmatPatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"*.test", "overchan.test", true},
+		{"overchan.[a-c]", "overchan.b", true},
+		{"overchan.[a-c]", "overchan.d", false},
+		{"overchan.[^a-c]", "overchan.d", true},
+		{"overchan.[^a-c]", "overchan.a", false},
+		{"[]x]", "]", true},
+		{"[]x]", "x", true},
+		{"[]x]", "y", false},
+		{"a[-z]", "a-", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{`a\?`, "a?", true},
+		{"overchan.test", "overchan.test", true},
+		{"overchan.test", "overchan.tes", false},
+	}
+	for _, c := range cases {
+		w, err := CompileWildmat(c.pattern)
+		if err != nil {
+			t.Logf("failed to compile %q: %s", c.pattern, err)
+			t.Fail()
+			continue
+		}
+		if w.Match(c.str) != c.match {
+			t.Logf("pattern %q against %q should be %v", c.pattern, c.str, c.match)
+			t.Fail()
+		}
+	}
+}
+
+func TestWildmatInvalid(t *testing.T) {
+	for _, expr := range []string{"", "a,,b", "!", "overchan.[abc", `overchan.\`, "a,@"} {
+		_, err := CompileWildmat(expr)
+		if err == nil {
+			t.Logf("invalid wildmat %q compiled", expr)
+			t.Fail()
+		}
+	}
+}
@@ -5,20 +5,80 @@ import (
 	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/model"
 	"strings"
+	"time"
 )
 
+var ErrNoSuchEncAddr = errors.New("no such encrypted address")
+var ErrNoSuchThumbnail = errors.New("no such thumbnail")
+
 //
 type Database interface {
 	ThreadByMessageID(msgid string) (*model.Thread, error)
 	ThreadByHash(hash string) (*model.Thread, error)
 	BoardPage(newsgroup string, pageno, perpage int) (*model.BoardPage, error)
+
+	// ban an address range given in CIDR notation or a single address
+	// expires is the zero time if the ban never expires
+	BanAddr(addr, reason string, expires time.Time) error
+	// remove a ban on an address range given exactly as it was banned
+	UnbanAddr(addr string) error
+	// check if an ip address is in any banned range
+	// returns the ban or nil if it is not banned
+	CheckAddrBan(addr string) (*model.AddrBan, error)
+	// get all bans that have not expired
+	ListAddrBans() ([]*model.AddrBan, error)
+
+	// remember the key of the encrypted address of a local post
+	RegisterEncAddr(msgid, encaddr, key string) error
+	// get the key of an encrypted address of a local post
+	// returns ErrNoSuchEncAddr if the address is not from a local post
+	GetEncAddrKey(encaddr string) (string, error)
+	// get the encrypted address and its key of a local post by message-id
+	// returns ErrNoSuchEncAddr if the article is not a local post
+	GetEncAddrByMessageID(msgid string) (string, string, error)
+
+	// trust a moderator's hex encoded public key
+	AddModKey(pubkey, note string) error
+	// stop trusting a moderator's public key
+	RemoveModKey(pubkey string) error
+	// return true if a public key is a trusted moderator
+	IsModKey(pubkey string) (bool, error)
+	// get all trusted moderator keys
+	ListModKeys() ([]*model.ModKey, error)
+
+	// record a moderation action in the audit log
+	LogAudit(e *model.AuditEntry) error
+	// get audit log entries newest first
+	ListAudit(offset, limit int) ([]*model.AuditEntry, error)
+
+	// remember a stored article and its attachments, replacing any earlier entry for it
+	RegisterArticle(a *model.Article) error
+	// forget a stored article and its attachments
+	DeleteArticle(msgid string) error
+	// count the stored articles
+	CountArticles() (int64, error)
+	// get the file names of the attachments of a stored article
+	ArticleAttachments(msgid string) ([]string, error)
+	// count the stored articles that have an attachment with this file name
+	CountAttachmentRefs(filename string) (int64, error)
+
+	// remember the file name of the thumbnail made for an attachment
+	RegisterThumbnail(filename, thumbnail string) error
+	// get the file name of the thumbnail of an attachment
+	// returns ErrNoSuchThumbnail if none was made
+	GetThumbnail(filename string) (string, error)
+	// forget the thumbnail of an attachment that was deleted
+	DeleteThumbnail(filename string) error
+
+	// ensure the database schema is created
+	Ensure() error
 }
 
 // get new database connector from configuration
 func NewDBFromConfig(c *config.DatabaseConfig) (db Database, err error) {
 	dbtype := strings.ToLower(c.Type)
 	if dbtype == "postgres" {
-		db, err = createPostgresDatabase(c.Addr, c.Username, c.Password)
+		db, err = createPostgresDatabase(c)
 	} else {
 		err = errors.New("no such database driver: " + c.Type)
 	}
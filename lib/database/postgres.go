@@ -1,10 +1,19 @@
 package database
 
 import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/util"
+	"net"
+	"strings"
+	"time"
 )
 
 type PostgresDB struct {
+	conn *sql.DB
 }
 
 func (db *PostgresDB) ThreadByMessageID(msgid string) (thread *model.Thread, err error) {
@@ -22,7 +31,377 @@ func (db *PostgresDB) BoardPage(newsgroup string, pageno, perpage int) (page *mo
 	return
 }
 
-func createPostgresDatabase(addr, user, passwd string) (p *PostgresDB, err error) {
+// create all tables
+func (db *PostgresDB) Ensure() (err error) {
+	tables := []string{
+		// banned address ranges
+		// addr_min and addr_max are the bounds of the range as zero padded strings
+		// so they compare lexically
+		`CREATE TABLE IF NOT EXISTS addr_bans (
+			addr VARCHAR(128) PRIMARY KEY,
+			addr_min VARCHAR(64) NOT NULL,
+			addr_max VARCHAR(64) NOT NULL,
+			reason TEXT NOT NULL,
+			made BIGINT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS addr_bans_range ON addr_bans(addr_min, addr_max)`,
+		// keys of encrypted poster addresses of local posts
+		`CREATE TABLE IF NOT EXISTS enc_addrs (
+			encaddr VARCHAR(128) PRIMARY KEY,
+			addrkey VARCHAR(128) NOT NULL,
+			msgid VARCHAR(255) NOT NULL,
+			made BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS enc_addrs_msgid ON enc_addrs(msgid)`,
+		// trusted moderator keys
+		`CREATE TABLE IF NOT EXISTS mod_keys (
+			pubkey VARCHAR(64) PRIMARY KEY,
+			note TEXT NOT NULL,
+			added BIGINT NOT NULL
+		)`,
+		// log of moderation actions
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id SERIAL PRIMARY KEY,
+			made BIGINT NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			action VARCHAR(255) NOT NULL,
+			target TEXT NOT NULL,
+			detail TEXT NOT NULL
+		)`,
+		// stored articles
+		`CREATE TABLE IF NOT EXISTS articles (
+			msgid VARCHAR(255) PRIMARY KEY,
+			newsgroup VARCHAR(255) NOT NULL,
+			reference VARCHAR(255) NOT NULL,
+			subject TEXT NOT NULL,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL,
+			encaddr VARCHAR(128) NOT NULL,
+			posted BIGINT NOT NULL,
+			message TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS articles_newsgroup ON articles(newsgroup, posted)`,
+		`CREATE INDEX IF NOT EXISTS articles_reference ON articles(reference)`,
+		// attachments of stored articles
+		`CREATE TABLE IF NOT EXISTS article_attachments (
+			msgid VARCHAR(255) NOT NULL,
+			filepath VARCHAR(255) NOT NULL,
+			filename TEXT NOT NULL,
+			mime VARCHAR(255) NOT NULL,
+			hash VARCHAR(255) NOT NULL,
+			PRIMARY KEY (msgid, filepath)
+		)`,
+		`CREATE INDEX IF NOT EXISTS article_attachments_filepath ON article_attachments(filepath)`,
+		// thumbnails made for attachments
+		`CREATE TABLE IF NOT EXISTS attachment_thumbnails (
+			filepath VARCHAR(255) PRIMARY KEY,
+			thumbnail VARCHAR(255) NOT NULL,
+			made BIGINT NOT NULL
+		)`,
+	}
+	for _, q := range tables {
+		_, err = db.conn.Exec(q)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (db *PostgresDB) BanAddr(addr, reason string, expires time.Time) (err error) {
+	var inet *net.IPNet
+	inet, err = util.ParseAddrRange(addr)
+	if err != nil {
+		return
+	}
+	min, max := util.IPNet2MinMax(inet)
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.Unix()
+	}
+	_, err = db.conn.Exec(`INSERT INTO addr_bans(addr, addr_min, addr_max, reason, made, expires) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (addr) DO UPDATE SET reason = EXCLUDED.reason, made = EXCLUDED.made, expires = EXCLUDED.expires`,
+		inet.String(), util.ZeroIPString(min), util.ZeroIPString(max), reason, time.Now().Unix(), exp)
+	return
+}
+
+func (db *PostgresDB) UnbanAddr(addr string) (err error) {
+	var inet *net.IPNet
+	inet, err = util.ParseAddrRange(addr)
+	if err == nil {
+		_, err = db.conn.Exec(`DELETE FROM addr_bans WHERE addr = $1`, inet.String())
+	}
+	return
+}
+
+func (db *PostgresDB) CheckAddrBan(addr string) (ban *model.AddrBan, err error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		err = fmt.Errorf("invalid address: %s", addr)
+		return
+	}
+	zip := util.ZeroIPString(ip)
+	var rows *sql.Rows
+	rows, err = db.conn.Query(`SELECT addr, reason, made, expires FROM addr_bans
+		WHERE addr_min <= $1 AND addr_max >= $1 AND (expires = 0 OR expires > $2) LIMIT 1`, zip, time.Now().Unix())
+	if err != nil {
+		return
+	}
+	var bans []*model.AddrBan
+	bans, err = scanAddrBans(rows)
+	if len(bans) > 0 {
+		ban = bans[0]
+	}
+	return
+}
+
+func (db *PostgresDB) ListAddrBans() (bans []*model.AddrBan, err error) {
+	var rows *sql.Rows
+	rows, err = db.conn.Query(`SELECT addr, reason, made, expires FROM addr_bans
+		WHERE expires = 0 OR expires > $1 ORDER BY made DESC`, time.Now().Unix())
+	if err == nil {
+		bans, err = scanAddrBans(rows)
+	}
+	return
+}
+
+func (db *PostgresDB) RegisterEncAddr(msgid, encaddr, key string) (err error) {
+	_, err = db.conn.Exec(`INSERT INTO enc_addrs(encaddr, addrkey, msgid, made) VALUES($1, $2, $3, $4)`,
+		encaddr, key, msgid, time.Now().Unix())
+	return
+}
+
+func (db *PostgresDB) GetEncAddrKey(encaddr string) (key string, err error) {
+	err = db.conn.QueryRow(`SELECT addrkey FROM enc_addrs WHERE encaddr = $1`, encaddr).Scan(&key)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEncAddr
+	}
+	return
+}
+
+func (db *PostgresDB) GetEncAddrByMessageID(msgid string) (encaddr, key string, err error) {
+	err = db.conn.QueryRow(`SELECT encaddr, addrkey FROM enc_addrs WHERE msgid = $1 LIMIT 1`, msgid).Scan(&encaddr, &key)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEncAddr
+	}
+	return
+}
+
+func (db *PostgresDB) AddModKey(pubkey, note string) (err error) {
+	_, err = db.conn.Exec(`INSERT INTO mod_keys(pubkey, note, added) VALUES($1, $2, $3)
+		ON CONFLICT (pubkey) DO UPDATE SET note = EXCLUDED.note`,
+		strings.ToLower(pubkey), note, time.Now().Unix())
+	return
+}
+
+func (db *PostgresDB) RemoveModKey(pubkey string) (err error) {
+	_, err = db.conn.Exec(`DELETE FROM mod_keys WHERE pubkey = $1`, strings.ToLower(pubkey))
+	return
+}
+
+func (db *PostgresDB) IsModKey(pubkey string) (is bool, err error) {
+	var count int64
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM mod_keys WHERE pubkey = $1`, strings.ToLower(pubkey)).Scan(&count)
+	is = count > 0
+	return
+}
+
+func (db *PostgresDB) ListModKeys() (keys []*model.ModKey, err error) {
+	var rows *sql.Rows
+	rows, err = db.conn.Query(`SELECT pubkey, note, added FROM mod_keys ORDER BY added`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var added int64
+		k := new(model.ModKey)
+		err = rows.Scan(&k.PubKey, &k.Note, &added)
+		if err != nil {
+			return
+		}
+		k.Added = time.Unix(added, 0)
+		keys = append(keys, k)
+	}
+	err = rows.Err()
+	return
+}
+
+func (db *PostgresDB) LogAudit(e *model.AuditEntry) (err error) {
+	t := e.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	_, err = db.conn.Exec(`INSERT INTO audit_log(made, actor, action, target, detail) VALUES($1, $2, $3, $4, $5)`,
+		t.Unix(), e.Actor, e.Action, e.Target, e.Detail)
+	return
+}
+
+func (db *PostgresDB) ListAudit(offset, limit int) (entries []*model.AuditEntry, err error) {
+	var rows *sql.Rows
+	rows, err = db.conn.Query(`SELECT made, actor, action, target, detail FROM audit_log
+		ORDER BY id DESC LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var made int64
+		e := new(model.AuditEntry)
+		err = rows.Scan(&made, &e.Actor, &e.Action, &e.Target, &e.Detail)
+		if err != nil {
+			return
+		}
+		e.Time = time.Unix(made, 0)
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	return
+}
+
+func (db *PostgresDB) RegisterArticle(a *model.Article) (err error) {
+	var tx *sql.Tx
+	tx, err = db.conn.Begin()
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO articles(msgid, newsgroup, reference, subject, name, path, encaddr, posted, message)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (msgid) DO UPDATE SET newsgroup = EXCLUDED.newsgroup, reference = EXCLUDED.reference,
+		subject = EXCLUDED.subject, name = EXCLUDED.name, path = EXCLUDED.path, encaddr = EXCLUDED.encaddr,
+		posted = EXCLUDED.posted, message = EXCLUDED.message`,
+		a.MessageID, a.Newsgroup, a.Reference, a.Subject, a.Name, a.Path, a.Addr, a.Posted, a.Text)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM article_attachments WHERE msgid = $1`, a.MessageID)
+	}
+	for idx := 0; err == nil && idx < len(a.Attachments); idx++ {
+		att := a.Attachments[idx]
+		_, err = tx.Exec(`INSERT INTO article_attachments(msgid, filepath, filename, mime, hash) VALUES($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`,
+			a.MessageID, att.Path, att.Name, att.Mime, att.Hash)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return
+}
+
+func (db *PostgresDB) DeleteArticle(msgid string) (err error) {
+	_, err = db.conn.Exec(`DELETE FROM article_attachments WHERE msgid = $1`, msgid)
+	if err == nil {
+		_, err = db.conn.Exec(`DELETE FROM articles WHERE msgid = $1`, msgid)
+	}
+	return
+}
+
+func (db *PostgresDB) CountArticles() (count int64, err error) {
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM articles`).Scan(&count)
+	return
+}
+
+func (db *PostgresDB) ArticleAttachments(msgid string) (files []string, err error) {
+	var rows *sql.Rows
+	rows, err = db.conn.Query(`SELECT filepath FROM article_attachments WHERE msgid = $1`, msgid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fpath string
+		err = rows.Scan(&fpath)
+		if err != nil {
+			return
+		}
+		files = append(files, fpath)
+	}
+	err = rows.Err()
+	return
+}
+
+func (db *PostgresDB) CountAttachmentRefs(filename string) (count int64, err error) {
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM article_attachments WHERE filepath = $1`, filename).Scan(&count)
+	return
+}
+
+func (db *PostgresDB) RegisterThumbnail(filename, thumbnail string) (err error) {
+	_, err = db.conn.Exec(`INSERT INTO attachment_thumbnails(filepath, thumbnail, made) VALUES($1, $2, $3)
+		ON CONFLICT (filepath) DO UPDATE SET thumbnail = EXCLUDED.thumbnail, made = EXCLUDED.made`,
+		filename, thumbnail, time.Now().Unix())
+	return
+}
+
+func (db *PostgresDB) GetThumbnail(filename string) (thumbnail string, err error) {
+	err = db.conn.QueryRow(`SELECT thumbnail FROM attachment_thumbnails WHERE filepath = $1`, filename).Scan(&thumbnail)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchThumbnail
+	}
+	return
+}
+
+func (db *PostgresDB) DeleteThumbnail(filename string) (err error) {
+	_, err = db.conn.Exec(`DELETE FROM attachment_thumbnails WHERE filepath = $1`, filename)
+	return
+}
+
+// read all bans from query result and close it
+func scanAddrBans(rows *sql.Rows) (bans []*model.AddrBan, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var made, expires int64
+		ban := new(model.AddrBan)
+		err = rows.Scan(&ban.Addr, &ban.Reason, &made, &expires)
+		if err != nil {
+			return
+		}
+		ban.Made = time.Unix(made, 0)
+		if expires > 0 {
+			ban.Expires = time.Unix(expires, 0)
+		}
+		bans = append(bans, ban)
+	}
+	err = rows.Err()
+	return
+}
+
+var paramEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quote a connection string parameter value
+func quoteParam(v string) string {
+	return "'" + paramEscaper.Replace(v) + "'"
+}
 
+func createPostgresDatabase(c *config.DatabaseConfig) (p *PostgresDB, err error) {
+	var params []string
+	if c.Addr != "" {
+		host, port, e := net.SplitHostPort(c.Addr)
+		if e == nil {
+			params = append(params, "host="+host, "port="+port)
+		} else {
+			// unix socket directory or host without port
+			params = append(params, "host="+c.Addr)
+		}
+	}
+	if c.Name != "" {
+		params = append(params, "dbname="+quoteParam(c.Name))
+	}
+	if c.Username != "" {
+		params = append(params, "user="+quoteParam(c.Username))
+	}
+	if c.Password != "" {
+		params = append(params, "password="+quoteParam(c.Password))
+	}
+	if c.SSLMode != "" {
+		params = append(params, "sslmode="+quoteParam(c.SSLMode))
+	}
+	var conn *sql.DB
+	conn, err = sql.Open("postgres", strings.Join(params, " "))
+	if err == nil {
+		p = &PostgresDB{
+			conn: conn,
+		}
+	}
 	return
 }
@@ -1,7 +1,10 @@
 package frontend
 
 import (
+	"encoding/hex"
+	"github.com/gorilla/sessions"
 	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/crypto"
 	"github.com/majestrate/srndv2/lib/database"
 	"github.com/majestrate/srndv2/lib/model"
 	"github.com/majestrate/srndv2/lib/nntp"
@@ -30,17 +33,30 @@ type Frontend interface {
 }
 
 // create a new http frontend give frontend config
-func NewHTTPFrontend(c *config.FrontendConfig, db database.Database) (f Frontend, err error) {
+// posts made on the frontend are submitted to the given nntp server
+func NewHTTPFrontend(c *config.FrontendConfig, db database.Database, nntpd *nntp.Server) (f Frontend, err error) {
+
+	var key []byte
+	if c.Secret == "" {
+		// sessions won't survive a restart
+		key = crypto.RandBytes(32)
+	} else {
+		key, err = hex.DecodeString(c.Secret)
+		if err != nil {
+			return
+		}
+	}
+	captcha := NewCaptchaServer(200, 400, "/captcha/", sessions.NewCookieStore(key))
 
 	var mid Middleware
 	if c.Middleware != nil {
 		// middleware configured
-		mid, err = OverchanMiddleware(c.Middleware, db)
+		mid, err = OverchanMiddleware(c.Middleware, db, captcha)
 	}
 
 	if err == nil {
 		// create http frontend only if no previous errors
-		f, err = createHttpFrontend(c, mid, db)
+		f, err = createHttpFrontend(c, mid, db, nntpd, captcha)
 	}
 	return
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/majestrate/srndv2/lib/api"
 	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/metrics"
 	"github.com/majestrate/srndv2/lib/model"
 	"github.com/majestrate/srndv2/lib/nntp"
 	"net/http"
@@ -31,6 +32,12 @@ type httpFrontend struct {
 	apiserve *api.Server
 	// database driver
 	db database.Database
+	// nntp server posts are submitted to
+	nntpd *nntp.Server
+	// captcha server for posting
+	captcha *CaptchaServer
+	// serve prometheus metrics?
+	metrics bool
 }
 
 // reload http frontend
@@ -40,7 +47,7 @@ func (f *httpFrontend) Reload(c *config.FrontendConfig) {
 		if c.Middleware != nil {
 			var err error
 			// no middleware set, create middleware
-			f.middleware, err = OverchanMiddleware(c.Middleware, f.db)
+			f.middleware, err = OverchanMiddleware(c.Middleware, f.db, f.captcha)
 			if err != nil {
 				log.Errorf("overchan middleware reload failed: %s", err.Error())
 			}
@@ -88,12 +95,16 @@ func (f *httpFrontend) SentArticleVia(msgid nntp.MessageID, feedname string) {
 	// TODO: implement
 }
 
-func createHttpFrontend(c *config.FrontendConfig, mid Middleware, db database.Database) (f *httpFrontend, err error) {
+func createHttpFrontend(c *config.FrontendConfig, mid Middleware, db database.Database, nntpd *nntp.Server, captcha *CaptchaServer) (f *httpFrontend, err error) {
 	f = new(httpFrontend)
 	// set db
 	// db.Ensure() called elsewhere
 	f.db = db
 
+	// set nntp server and captcha for posting
+	f.nntpd = nntpd
+	f.captcha = captcha
+
 	// set bind address
 	f.addr = c.BindAddr
 
@@ -101,14 +112,29 @@ func createHttpFrontend(c *config.FrontendConfig, mid Middleware, db database.Da
 	f.httpmux = mux.NewRouter()
 
 	// set up admin panel
-	f.adminPanel = admin.NewServer()
+	// sessions are shared with the captcha server
+	if c.Admin != nil && db != nil && captcha != nil {
+		f.adminPanel = admin.NewServer(c.Admin, db, nntpd, captcha.store)
+	}
 
 	// set static files dir
 	f.staticDir = c.Static
 
+	f.metrics = c.Metrics
+
 	// set middleware
 	f.middleware = mid
 
+	// set up api server
+	// posts via the api solve the same captchas as the web form
+	if f.nntpd != nil {
+		var checker api.CaptchaChecker
+		if captcha != nil {
+			checker = captcha
+		}
+		f.apiserve = api.NewServer(f.nntpd, db, checker)
+	}
+
 	// set up routes
 
 	if f.adminPanel != nil {
@@ -116,16 +142,31 @@ func createHttpFrontend(c *config.FrontendConfig, mid Middleware, db database.Da
 		f.httpmux.PathPrefix("/admin/").Handler(f.adminPanel)
 	}
 
+	if f.nntpd != nil {
+		// route up posting endpoint
+		f.httpmux.Path("/post").HandlerFunc(f.handlePost)
+	}
+
 	if f.middleware != nil {
 		// route up middleware
 		f.middleware.SetupRoutes(f.httpmux)
 	}
 
+	if f.adminPanel != nil {
+		// route up connection status for admins, before the rest of the api
+		f.httpmux.Path("/api/admin/feeds").Methods("GET").Handler(f.adminPanel.RequireLogin(http.HandlerFunc(f.adminPanel.HandleFeeds)))
+	}
+
 	if f.apiserve != nil {
 		// route up api
 		f.apiserve.SetupRoutes(f.httpmux.PathPrefix("/api/").Subrouter())
 	}
 
+	if f.metrics {
+		// route up prometheus metrics
+		f.httpmux.Path("/metrics").Methods("GET").Handler(metrics.Handler())
+	}
+
 	// route up robots.txt
 	f.httpmux.Path("/robots.txt").HandlerFunc(f.serveRobots)
 
@@ -3,7 +3,6 @@ package frontend
 import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/database"
 	"html/template"
@@ -16,7 +15,6 @@ import (
 type overchanMiddleware struct {
 	templ   *template.Template
 	captcha *CaptchaServer
-	store   *sessions.CookieStore
 	db      database.Database
 }
 
@@ -27,13 +25,10 @@ func (m *overchanMiddleware) SetupRoutes(mux *mux.Router) {
 	mux.Path("/t/{id}/").HandlerFunc(m.ServeThread)
 	// setup board page handler
 	mux.Path("/b/{name}/").HandlerFunc(m.ServeBoardPage)
-	// setup posting endpoint
-	mux.Path("/post")
-	// create captcha
-	captchaPrefix := "/captcha/"
-	m.captcha = NewCaptchaServer(200, 400, captchaPrefix, m.store)
 	// setup captcha endpoint
-	m.captcha.SetupRoutes(mux.PathPrefix(captchaPrefix).Subrouter())
+	if m.captcha != nil {
+		m.captcha.SetupRoutes(mux.PathPrefix(m.captcha.prefix).Subrouter())
+	}
 }
 
 // reload middleware
@@ -104,10 +99,12 @@ func (m *overchanMiddleware) serveTemplate(w http.ResponseWriter, r *http.Reques
 }
 
 // create standard overchan middleware
-func OverchanMiddleware(c *config.MiddlewareConfig, db database.Database) (m Middleware, err error) {
+// captchas are served from the given captcha server
+func OverchanMiddleware(c *config.MiddlewareConfig, db database.Database, captcha *CaptchaServer) (m Middleware, err error) {
 	om := new(overchanMiddleware)
 	om.templ, err = template.ParseGlob(filepath.Join(c.Templates, "*.tmpl"))
 	om.db = db
+	om.captcha = captcha
 	if err == nil {
 		m = om
 	}
@@ -1 +1,128 @@
 package frontend
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/util"
+	"net/http"
+)
+
+// max size of a post made via the web form
+const maxPostSize = 32 << 20
+
+// most proof of work done here for a post, so visitors cannot keep our cpus busy
+// about 65 thousand hashes on average
+const maxFormPoWBits = 16
+
+// handle a post made via the web form
+// easy proof of work for the post is done here so posters do not need javascript
+// harder proof of work is left to the poster's browser through the api
+func (f *httpFrontend) handlePost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if f.db != nil {
+		ban, err := f.db.CheckAddrBan(util.AddrIP(r.RemoteAddr))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pkg":  "frontend",
+				"addr": r.RemoteAddr,
+			}).Error("failed to check ban ", err)
+		} else if ban != nil {
+			f.postError(w, r, http.StatusForbidden, "banned: "+ban.Reason)
+			return
+		}
+	}
+	err := r.ParseMultipartForm(maxPostSize)
+	if err != nil {
+		f.postError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	if f.captcha != nil {
+		var solved bool
+		solved, err = f.captcha.CheckSession(w, r, r.FormValue("captcha"))
+		if err != nil || !solved {
+			f.postError(w, r, http.StatusForbidden, "bad captcha")
+			return
+		}
+	}
+	a := f.nntpd.NewArticle(r.FormValue("newsgroup"), r.FormValue("reference"), r.FormValue("name"), r.FormValue("subject"), r.FormValue("message"))
+	for _, fh := range r.MultipartForm.File["attachment"] {
+		fd, err := fh.Open()
+		if err != nil {
+			for _, att := range a.Attachments {
+				att.Body.Close()
+			}
+			f.postError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		mime := fh.Header.Get("Content-Type")
+		if mime == "" {
+			mime = "application/octet-stream"
+		}
+		a.Attachments = append(a.Attachments, &message.Attachment{
+			Mime:     mime,
+			FileName: fh.Filename,
+			Body:     fd,
+		})
+	}
+	var p *nntp.PendingArticle
+	p, err = f.nntpd.PrepareArticle(a)
+	if err != nil {
+		f.postError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.Addr = util.AddrIP(r.RemoteAddr)
+	if p.Bits > maxFormPoWBits {
+		if r.URL.Query().Get("t") != "json" || f.apiserve == nil {
+			f.postError(w, r, http.StatusForbidden, "this newsgroup needs proof of work done by your browser")
+			return
+		}
+		// the client sends the proof of work to /api/post/pow
+		f.apiserve.RequirePoW(w, p)
+		return
+	}
+	p.SolvePoW()
+	var status nntp.PolicyStatus
+	status, err = f.nntpd.PostArticle(p)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":   "frontend",
+			"msgid": p.MessageID(),
+		}).Error("failed to post article ", err)
+		f.postError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !status.Accept() {
+		f.postError(w, r, http.StatusForbidden, "post rejected: "+status.String())
+		return
+	}
+	if r.URL.Query().Get("t") == "json" {
+		w.Header().Set("Content-Type", "text/json; encoding=UTF-8")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message_id": p.MessageID().String(),
+			"newsgroup":  p.Newsgroup().String(),
+		})
+		return
+	}
+	next := r.Referer()
+	if next == "" {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// reply with a posting error
+func (f *httpFrontend) postError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if r.URL.Query().Get("t") == "json" {
+		w.Header().Set("Content-Type", "text/json; encoding=UTF-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	http.Error(w, msg, code)
+}
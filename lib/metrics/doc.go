@@ -0,0 +1,5 @@
+//
+// metrics exported in the prometheus text format
+// each package registers its own metrics with promauto
+//
+package metrics
@@ -0,0 +1,11 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// http handler serving all metrics registered with the default prometheus registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,4 @@
+//
+// moderation of articles via signed ctl messages
+//
+package mod
@@ -0,0 +1,212 @@
+package mod
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/util"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// newsgroup moderation messages are posted to
+const CtlGroup = "ctl"
+
+var ErrNotSigned = errors.New("article is not signed")
+var ErrNotModerator = errors.New("article not signed by a moderator")
+var ErrBadSignature = errors.New("invalid signature")
+var ErrBadEncAddr = errors.New("malformed encrypted address")
+
+// processes moderation messages posted to ctl
+// a moderation message is a signed article whose inner message has one action per line
+// implements nntp.EventHooks
+type Moderator struct {
+	// article storage
+	storage store.Storage
+	// database driver
+	db database.Database
+	// moderator public keys from config, lower case hex
+	// keys added to the database are trusted as well
+	keys map[string]bool
+	// header reader
+	hdrio *message.HeaderIO
+}
+
+// create a new moderator that obeys ctl messages signed by configured keys
+func NewModerator(c *config.ModConfig, st store.Storage, db database.Database) *Moderator {
+	m := &Moderator{
+		storage: st,
+		db:      db,
+		keys:    make(map[string]bool),
+		hdrio:   message.NewHeaderIO(),
+	}
+	if c != nil {
+		for _, k := range c.Keys {
+			m.keys[strings.ToLower(k)] = true
+		}
+	}
+	return m
+}
+
+func (m *Moderator) GotArticle(msgid nntp.MessageID, group nntp.Newsgroup) {
+	if group.String() != CtlGroup {
+		return
+	}
+	err := m.Process(msgid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":   "mod",
+			"msgid": msgid,
+		}).Warn("not processing moderation message: ", err)
+	}
+}
+
+func (m *Moderator) SentArticleVia(msgid nntp.MessageID, feedname string) {
+
+}
+
+// verify a stored moderation message and execute its actions
+func (m *Moderator) Process(msgid nntp.MessageID) (err error) {
+	f, err := m.storage.OpenArticle(msgid.String())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var hdr message.Header
+	hdr, err = m.hdrio.ReadHeader(br)
+	if err != nil {
+		return
+	}
+	pubkey := strings.ToLower(hdr.Get("X-Pubkey-Ed25519", ""))
+	if pubkey == "" {
+		return ErrNotSigned
+	}
+	var ok bool
+	ok, err = m.isModerator(pubkey)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return ErrNotModerator
+	}
+	var body, pk, sig []byte
+	body, err = ioutil.ReadAll(br)
+	if err == nil {
+		pk, err = hex.DecodeString(pubkey)
+	}
+	if err == nil {
+		sig, err = hex.DecodeString(hdr.Get("X-Signature-Ed25519-SHA512", ""))
+	}
+	if err != nil {
+		return
+	}
+	v := crypto.CreateVerifier(pk)
+	v.Write(body)
+	if !v.Verify(sig) {
+		return ErrBadSignature
+	}
+	// skip the inner message's header
+	inner := bytes.NewReader(body)
+	_, err = m.hdrio.ReadHeader(inner)
+	if err != nil {
+		return
+	}
+	sc := bufio.NewScanner(inner)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		err = m.handleLine(line, pubkey)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pkg":    "mod",
+				"msgid":  msgid,
+				"pubkey": pubkey,
+				"line":   line,
+			}).Warn("moderation action failed: ", err)
+		}
+	}
+	return sc.Err()
+}
+
+// check if a public key belongs to a trusted moderator
+func (m *Moderator) isModerator(pubkey string) (bool, error) {
+	if m.keys[pubkey] {
+		return true, nil
+	}
+	return m.db.IsModKey(pubkey)
+}
+
+// execute one moderation action
+func (m *Moderator) handleLine(line, pubkey string) (err error) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return
+	}
+	switch parts[0] {
+	case "overchan-inet-ban":
+		err = m.inetBan(parts[1], pubkey)
+	default:
+		log.WithFields(log.Fields{
+			"pkg":    "mod",
+			"action": parts[0],
+		}).Debug("ignoring unknown moderation action")
+	}
+	return
+}
+
+// ban an address range given as key:encaddr where encaddr is the range encrypted with util.EncAddr
+// or ban the poster of a local post given the encrypted address from its header
+func (m *Moderator) inetBan(arg, pubkey string) (err error) {
+	var addr string
+	encaddr := arg
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) == 2 {
+		encaddr = parts[1]
+		addr = util.DecAddr(encaddr, parts[0])
+	} else {
+		var key string
+		key, err = m.db.GetEncAddrKey(arg)
+		if err == database.ErrNoSuchEncAddr {
+			// not posted here, the node it was posted on will ban it
+			log.WithFields(log.Fields{
+				"pkg":     "mod",
+				"encaddr": arg,
+			}).Debug("encrypted address is not from a local post")
+			return nil
+		} else if err != nil {
+			return
+		}
+		addr = util.DecAddr(arg, key)
+	}
+	if addr == "" {
+		return ErrBadEncAddr
+	}
+	err = m.db.BanAddr(addr, "banned by moderator "+pubkey, time.Time{})
+	if err == nil {
+		log.WithFields(log.Fields{
+			"pkg":    "mod",
+			"pubkey": pubkey,
+		}).Info("address banned by moderator")
+		// the audit log gets the encrypted address without its key, not the address itself
+		err = m.db.LogAudit(&model.AuditEntry{
+			Actor:  pubkey,
+			Action: "ban",
+			Target: encaddr,
+			Detail: "overchan-inet-ban",
+		})
+	}
+	return
+}
@@ -0,0 +1,143 @@
+package mod
+
+import (
+	"encoding/hex"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/majestrate/srndv2/lib/database"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp"
+	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// database that records bans
+type banDB struct {
+	database.Database
+	bans    []string
+	keys    map[string]string
+	mods    map[string]bool
+	audited []*model.AuditEntry
+}
+
+func (db *banDB) IsModKey(pubkey string) (bool, error) {
+	return db.mods[pubkey], nil
+}
+
+func (db *banDB) LogAudit(e *model.AuditEntry) error {
+	db.audited = append(db.audited, e)
+	return nil
+}
+
+func (db *banDB) GetEncAddrKey(encaddr string) (string, error) {
+	key, ok := db.keys[encaddr]
+	if !ok {
+		return "", database.ErrNoSuchEncAddr
+	}
+	return key, nil
+}
+
+func (db *banDB) BanAddr(addr, reason string, expires time.Time) error {
+	db.bans = append(db.bans, addr)
+	return nil
+}
+
+// storage that opens articles from a directory
+type dirStore struct {
+	store.Storage
+	dir string
+}
+
+func (s *dirStore) OpenArticle(msgid string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, msgid))
+}
+
+// write a signed moderation message to a directory
+func writeModMessage(t *testing.T, dir, msgid string, sk []byte, pubkey, actions string) {
+	body := "Content-Type: text/plain\n\n" + actions
+	s := crypto.CreateSigner(sk)
+	s.Write([]byte(body))
+	sig := hex.EncodeToString(s.Sign())
+	article := "Message-ID: " + msgid + "\nNewsgroups: ctl\nX-Pubkey-Ed25519: " + pubkey + "\nX-Signature-Ed25519-SHA512: " + sig + "\n\n" + body
+	err := ioutil.WriteFile(filepath.Join(dir, msgid), []byte(article), 0600)
+	if err != nil {
+		t.Logf("failed to write article: %s", err)
+		t.FailNow()
+	}
+}
+
+func TestInetBan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-mod")
+	if err != nil {
+		t.Logf("failed to make temp dir: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	pk, sk := crypto.GenKeypair()
+	pubkey := hex.EncodeToString(pk)
+	db := new(banDB)
+	m := NewModerator(&config.ModConfig{Keys: []string{pubkey}}, &dirStore{dir: dir}, db)
+
+	key, encaddr := util.NewAddrEnc("10.0.0.0/8")
+	writeModMessage(t, dir, "<mod@test.tld>", sk, pubkey, "overchan-inet-ban "+key+":"+encaddr+"\nunknown-action foo\n")
+	m.GotArticle(nntp.MessageID("<mod@test.tld>"), nntp.Newsgroup(CtlGroup))
+	if len(db.bans) != 1 || db.bans[0] != "10.0.0.0/8" {
+		t.Logf("wrong bans: %v", db.bans)
+		t.Fail()
+	}
+	if len(db.audited) != 1 || db.audited[0].Actor != pubkey || db.audited[0].Action != "ban" {
+		t.Logf("ban not audited: %v", db.audited)
+		t.FailNow()
+	}
+	// the key would decrypt the address again
+	if db.audited[0].Target != encaddr || strings.Contains(db.audited[0].Target, key) {
+		t.Logf("audit log has the address key: %q", db.audited[0].Target)
+		t.Fail()
+	}
+
+	// not a moderator
+	opk, osk := crypto.GenKeypair()
+	writeModMessage(t, dir, "<notmod@test.tld>", osk, hex.EncodeToString(opk), "overchan-inet-ban "+key+":"+encaddr+"\n")
+	if m.Process(nntp.MessageID("<notmod@test.tld>")) != ErrNotModerator {
+		t.Log("message from non moderator processed")
+		t.Fail()
+	}
+
+	// signed by someone else with a moderator's pubkey
+	writeModMessage(t, dir, "<forged@test.tld>", osk, pubkey, "overchan-inet-ban "+key+":"+encaddr+"\n")
+	if m.Process(nntp.MessageID("<forged@test.tld>")) != ErrBadSignature {
+		t.Log("forged message processed")
+		t.Fail()
+	}
+	if len(db.bans) != 1 {
+		t.Logf("wrong bans: %v", db.bans)
+		t.Fail()
+	}
+
+	// moderators can be added to the database too
+	db.mods = map[string]bool{hex.EncodeToString(opk): true}
+	err = m.Process(nntp.MessageID("<notmod@test.tld>"))
+	if err != nil || len(db.bans) != 2 {
+		t.Logf("message from database moderator not processed: %v %v", db.bans, err)
+		t.Fail()
+	}
+
+	// ban posters by encrypted address, only local posts can be decrypted
+	key, encaddr = util.NewAddrEnc("192.168.1.1")
+	_, remote := util.NewAddrEnc("192.168.1.2")
+	db.keys = map[string]string{encaddr: key}
+	db.bans = nil
+	writeModMessage(t, dir, "<encban@test.tld>", sk, pubkey, "overchan-inet-ban "+encaddr+"\noverchan-inet-ban "+remote+"\n")
+	err = m.Process(nntp.MessageID("<encban@test.tld>"))
+	if err != nil || len(db.bans) != 1 || db.bans[0] != "192.168.1.1" {
+		t.Logf("wrong bans: %v %v", db.bans, err)
+		t.Fail()
+	}
+}
@@ -5,6 +5,8 @@ type Attachment struct {
 	Name string
 	Mime string
 	Hash string
+	// file name of the thumbnail, empty if it has none
+	Thumbnail string
 	// only filled for api
 	Body string
 }
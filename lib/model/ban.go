@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+)
+
+// a ban of an ip address range
+type AddrBan struct {
+	// banned range in CIDR notation
+	Addr string `json:"addr"`
+	// why it was banned
+	Reason string `json:"reason"`
+	// when the ban was made
+	Made time.Time `json:"made"`
+	// when the ban expires, zero time if it never expires
+	Expires time.Time `json:"expires"`
+}
+
+// has this ban expired at a point in time?
+func (b *AddrBan) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
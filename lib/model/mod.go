@@ -0,0 +1,29 @@
+package model
+
+import (
+	"time"
+)
+
+// a moderator's public key trusted by this node
+type ModKey struct {
+	// hex encoded ed25519 public key
+	PubKey string `json:"pubkey"`
+	// who this key belongs to
+	Note string `json:"note"`
+	// when the key was added
+	Added time.Time `json:"added"`
+}
+
+// one entry of the moderation audit log
+type AuditEntry struct {
+	// when the action happened
+	Time time.Time `json:"time"`
+	// who did it, an admin username or a moderator public key
+	Actor string `json:"actor"`
+	// what was done
+	Action string `json:"action"`
+	// what it was done to
+	Target string `json:"target"`
+	// extra information about the action
+	Detail string `json:"detail"`
+}
@@ -1,6 +1,7 @@
 package nntp
 
 import (
+	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/nntp/message"
 )
 
@@ -67,3 +68,39 @@ type ArticleAcceptor interface {
 	// get max article size in bytes
 	MaxArticleSize() int64
 }
+
+// biggest article an acceptor without its own limit takes
+const DefaultMaxArticleSize = 32 * 1024 * 1024
+
+// acceptor that checks articles against an inbound article policy
+// articles without an encrypted poster address are anonymous
+// multipart articles have attachments
+type policyAcceptor struct {
+	conf *config.ArticleConfig
+}
+
+// create an acceptor for an inbound article policy
+func NewPolicyAcceptor(c *config.ArticleConfig) ArticleAcceptor {
+	return &policyAcceptor{
+		conf: c,
+	}
+}
+
+func (p *policyAcceptor) CheckHeader(hdr message.Header) PolicyStatus {
+	anon := findHeaderKey(hdr, EncAddrHeader) == ""
+	if p.conf.Allow(hdr.MessageID(), hdr.Newsgroup(), anon, hdr.IsMultipart()) {
+		return PolicyAccept
+	}
+	return PolicyReject
+}
+
+func (p *policyAcceptor) CheckMessageID(msgid MessageID) PolicyStatus {
+	if msgid.Valid() {
+		return PolicyAccept
+	}
+	return PolicyReject
+}
+
+func (p *policyAcceptor) MaxArticleSize() int64 {
+	return DefaultMaxArticleSize
+}
@@ -0,0 +1,21 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/model"
+)
+
+// checks if addresses are banned
+type BanChecker interface {
+	// check if an ip address is banned
+	// returns the ban or nil if it is not banned
+	CheckAddrBan(addr string) (*model.AddrBan, error)
+}
+
+// header holding the encrypted address of the poster of a local post
+const EncAddrHeader = "X-Encrypted-IP"
+
+// stores the keys of encrypted poster addresses
+type EncAddrStore interface {
+	// remember the key of the encrypted address of a local post
+	RegisterEncAddr(msgid, encaddr, key string) error
+}
@@ -0,0 +1,55 @@
+package nntp
+
+import (
+	"bufio"
+	"github.com/majestrate/srndv2/lib/model"
+	"net"
+	"strings"
+	"testing"
+)
+
+// bans everything in 10.0.0.0/8
+type testBans struct{}
+
+func (testBans) CheckAddrBan(addr string) (*model.AddrBan, error) {
+	if strings.HasPrefix(addr, "10.") {
+		return &model.AddrBan{Addr: "10.0.0.0/8", Reason: "test\r\nban"}, nil
+	}
+	return nil, nil
+}
+
+// net.Conn with a fixed remote address
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestRejectBanned(t *testing.T) {
+	s := NewServer()
+	s.Bans = testBans{}
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		done <- s.rejectBanned(addrConn{server, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}})
+	}()
+	line, _ := bufio.NewReader(client).ReadString(10)
+	if !<-done {
+		t.Log("banned connection not rejected")
+		t.Fail()
+	}
+	if line != RPL_GenericFatal+" banned: test  ban\r\n" {
+		t.Logf("wrong reply to banned connection: %q", line)
+		t.Fail()
+	}
+	server, client = net.Pipe()
+	defer client.Close()
+	if s.rejectBanned(addrConn{server, &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}}) {
+		t.Log("connection that is not banned rejected")
+		t.Fail()
+	}
+}
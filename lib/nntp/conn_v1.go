@@ -4,22 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/majestrate/srndv2/lib/model"
 	"github.com/majestrate/srndv2/lib/nntp/message"
 	"github.com/majestrate/srndv2/lib/store"
 	"github.com/majestrate/srndv2/lib/util"
 	"io"
-	"mime"
-	"mime/multipart"
 	"net"
 	"net/textproto"
-	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 // handles 1 line of input from a connection
@@ -42,12 +42,31 @@ type v1Conn struct {
 	authenticated bool
 	// the username logged in with if it has authenticated via user/pass
 	username string
+	// is this connection from a trusted peer?
+	// only peers that logged in with valid credentials are trusted
+	trusted bool
+	// proof of work required from untrusted peers, nil for none
+	pow *config.PoWConfig
+	// limits on this connection, nil for none
+	limits *config.LimitsConfig
+	// underlying socket with deadlines and rate limits, nil if not limited
+	lconn *limitedConn
+	// article rate limiter, nil for no limit
+	articles *tokenBucket
+	// index of stored articles, nil for none
+	index ArticleIndex
+	// thumbnails stored attachments, nil for none
+	thumbnails ThumbnailQueue
 	// underlying network socket
 	conn net.Conn
 	// server's name
 	serverName string
 	// article acceptor checks if we want articles
 	acceptor ArticleAcceptor
+	// filters applied in order to accepted articles
+	filters []ArticleFilter
+	// which articles get metadata stripped from their images, nil for none
+	metadata *config.MetadataConfig
 	// headerIO for read/write of article header
 	hdrio *message.HeaderIO
 	// article storage
@@ -58,6 +77,14 @@ type v1Conn struct {
 	auth ServerAuth
 	// command handlers
 	cmds map[string]lineHandlerFunc
+	// protects lastErr and lastErrTime
+	errMtx sync.Mutex
+	// last error that happened on this connection
+	lastErr error
+	// when lastErr happened
+	lastErrTime time.Time
+	// article and byte counters, nil to not count
+	stats *connStats
 }
 
 // json representation of this connection
@@ -65,38 +92,70 @@ type v1Conn struct {
 // {
 //   "state" : (connection state object),
 //   "authed" : bool,
-//   "tls" : (tls info or null if plaintext connection)
+//   "tls" : (tls info or null if plaintext connection),
+//   "lasterror" : (last error or null if none),
+//   "lasterrortime" : (when the last error happened),
+//   "stats" : (connection counters object)
 // }
 func (c *v1Conn) MarshalJSON() ([]byte, error) {
 	j := make(map[string]interface{})
-	j["state"] = c.state
+	j["state"] = c.GetState()
 	j["authed"] = c.authenticated
 	if c.tlsConn == nil {
 		j["tls"] = nil
 	} else {
 		j["tls"] = c.tlsConn.ConnectionState()
 	}
+	err, t := c.lastError()
+	if err == nil {
+		j["lasterror"] = nil
+	} else {
+		j["lasterror"] = err.Error()
+	}
+	j["lasterrortime"] = t
+	j["stats"] = c.stats.snapshot()
 	return json.Marshal(j)
 }
 
 // get the current state of our connection (immutable)
 func (c *v1Conn) GetState() (state *ConnState) {
-	return &ConnState{
+	state = &ConnState{
 		FeedName: c.state.FeedName,
 		ConnName: c.state.ConnName,
 		HostName: c.state.HostName,
 		Mode:     c.state.Mode,
 		Group:    c.state.Group,
 		Article:  c.state.Article,
-		Policy: &FeedPolicy{
+		Open:     c.state.Open,
+	}
+	if c.state.Policy != nil {
+		state.Policy = &FeedPolicy{
 			Whitelist:            c.state.Policy.Whitelist,
 			Blacklist:            c.state.Policy.Blacklist,
 			AllowAnonPosts:       c.state.Policy.AllowAnonPosts,
 			AllowAnonAttachments: c.state.Policy.AllowAnonAttachments,
 			AllowAttachments:     c.state.Policy.AllowAttachments,
 			UntrustedRequiresPoW: c.state.Policy.UntrustedRequiresPoW,
-		},
+		}
 	}
+	return
+}
+
+// record an error that happened on this connection
+func (c *v1Conn) setError(err error) {
+	c.errMtx.Lock()
+	c.lastErr = err
+	c.lastErrTime = time.Now()
+	c.errMtx.Unlock()
+}
+
+// get the last error that happened on this connection and when
+// returns nil if no error happened
+func (c *v1Conn) lastError() (err error, t time.Time) {
+	c.errMtx.Lock()
+	err, t = c.lastErr, c.lastErrTime
+	c.errMtx.Unlock()
+	return
 }
 
 func (c *v1Conn) Group() string {
@@ -122,6 +181,11 @@ func (c *v1Conn) Process(hooks EventHooks) {
 	var err error
 	var line string
 	for err == nil {
+		if c.limits != nil {
+			// the whole line must come in time, not just each part of it
+			c.setReadTimeout(c.limits.IdleTimeout)
+			c.setDeadline(c.limits.IdleTimeout)
+		}
 		line, err = c.readline()
 		if len(line) == 0 {
 			// eof (proably?)
@@ -140,6 +204,11 @@ func (c *v1Conn) Process(hooks EventHooks) {
 			err = c.printfLine("%s Unknown Command: %s", RPL_UnknownCommand, line)
 		}
 	}
+	log.WithFields(log.Fields{
+		"pkg":   "nntp-conn",
+		"state": &c.state,
+	}).Debug("closing connection ", err)
+	c.Close()
 }
 
 type v1OBConn struct {
@@ -382,6 +451,7 @@ func (c *v1OBConn) StreamAndQuit() {
 			}
 			// send line
 			err := c.C.printfLine("%s %s", stream_CHECK, msgid)
+			c.C.stats.offer()
 			if err == nil {
 				// read response
 				var line string
@@ -436,6 +506,7 @@ func (c *v1OBConn) StreamAndQuit() {
 										cmd := ev.Command()
 										if cmd == RPL_StreamingTransfered {
 											// successful transfer
+											c.C.stats.result(PolicyAccept)
 											log.WithFields(log.Fields{
 												"feed":  c.C.state.FeedName,
 												"msgid": msgid,
@@ -447,6 +518,7 @@ func (c *v1OBConn) StreamAndQuit() {
 											}
 										} else {
 											// failed transfer
+											c.C.stats.result(PolicyReject)
 											log.WithFields(log.Fields{
 												"feed":  c.C.state.FeedName,
 												"msgid": msgid,
@@ -459,6 +531,7 @@ func (c *v1OBConn) StreamAndQuit() {
 										"feed":  c.C.state.FeedName,
 										"msgid": msgid,
 									}).Errorf("failed to transfer: %s", err.Error())
+									c.C.setError(err)
 								}
 							}
 						} else {
@@ -468,6 +541,10 @@ func (c *v1OBConn) StreamAndQuit() {
 								"msgid": msgid,
 							}).Warn("article not in storage, not sending")
 						}
+					} else if cmd == RPL_StreamingDefer {
+						c.C.stats.result(PolicyDefer)
+					} else {
+						c.C.stats.result(PolicyReject)
 					}
 				} else {
 					// invalid reply
@@ -477,6 +554,7 @@ func (c *v1OBConn) StreamAndQuit() {
 						"msgid": msgid,
 						"line":  line,
 					}).Error("invalid streaming response")
+					c.C.setError(fmt.Errorf("invalid streaming response: %q", line))
 					// close
 					return
 				}
@@ -486,6 +564,7 @@ func (c *v1OBConn) StreamAndQuit() {
 					"state": c.C.state,
 					"msgid": msgid,
 				}).Error("streaming error during CHECK", err)
+				c.C.setError(err)
 				return
 			}
 		} else {
@@ -503,19 +582,19 @@ func (c *v1OBConn) Quit() {
 
 func (c *v1OBConn) StartStreaming() (chnl chan ArticleEntry, err error) {
 	if c.streamChnl == nil {
-		c.streamChnl = make(chan ArticleEntry)
-
+		// buffered so the queue depth can be reported
+		c.streamChnl = make(chan ArticleEntry, feedQueueSize)
 	}
 	chnl = c.streamChnl
 	return
 }
 
 func (c *v1OBConn) GetState() *ConnState {
-	return c.GetState()
+	return c.C.GetState()
 }
 
 // create a new connection from an established connection
-func newOutboundConn(c net.Conn, s *Server, conf *config.FeedConfig) Conn {
+func newOutboundConn(c net.Conn, s *Server, conf *config.FeedConfig) *v1OBConn {
 
 	sname := s.Name()
 
@@ -526,6 +605,8 @@ func newOutboundConn(c net.Conn, s *Server, conf *config.FeedConfig) Conn {
 	if storage == nil {
 		storage = store.NewNullStorage()
 	}
+	stats := newConnStats()
+	cc := &countConn{Conn: c, stats: stats}
 	return &v1OBConn{
 		conf: conf,
 		C: v1Conn{
@@ -535,11 +616,18 @@ func newOutboundConn(c net.Conn, s *Server, conf *config.FeedConfig) Conn {
 				HostName: conf.Addr,
 				Open:     true,
 			},
+			// we dialed this feed ourselves
+			trusted:    true,
 			serverName: sname,
 			storage:    storage,
-			C:          textproto.NewConn(c),
-			conn:       c,
+			index:      s.Index,
+			thumbnails: s.Thumbnails,
+			filters:    s.Filters,
+			metadata:   s.metadataConfig(),
+			C:          textproto.NewConn(cc),
+			conn:       cc,
 			hdrio:      message.NewHeaderIO(),
+			stats:      stats,
 		},
 	}
 }
@@ -594,6 +682,49 @@ func (c *v1Conn) Authed() bool {
 	return c.tlsConn != nil || c.authenticated
 }
 
+// get the proof of work difficulty this connection must meet for an article in a newsgroup
+// returns 0 if no proof of work is required
+func (c *v1Conn) requiredPoW(group string) int {
+	if c.trusted || c.pow == nil {
+		return 0
+	}
+	if c.state.Policy != nil && !c.state.Policy.UntrustedRequiresPoW {
+		return 0
+	}
+	return c.pow.BitsFor(group)
+}
+
+// set the deadline for each read from this connection in seconds, 0 for none
+func (c *v1Conn) setReadTimeout(seconds int) {
+	if c.lconn != nil {
+		c.lconn.timeout = time.Duration(seconds) * time.Second
+	}
+}
+
+// set the deadline for everything read from this connection from now on in seconds, 0 for none
+func (c *v1Conn) setDeadline(seconds int) {
+	if c.lconn != nil {
+		c.lconn.deadline = time.Time{}
+		if seconds > 0 {
+			c.lconn.deadline = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+	}
+}
+
+// check if this connection may send another article right now
+func (c *v1Conn) allowArticle() bool {
+	if c.articles == nil || c.articles.allow() {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"pkg":   "nntp-conn",
+		"state": &c.state,
+		"limit": "articles_per_minute",
+		"rate":  c.limits.ArticlesPerMinute,
+	}).Warn("article rate limit hit")
+	return false
+}
+
 // unconditionally close connection
 func (c *v1Conn) Close() {
 	if c.tlsConn == nil {
@@ -623,6 +754,10 @@ func (c *v1Conn) printfLine(format string, args ...interface{}) error {
 
 func (c *v1Conn) readline() (line string, err error) {
 	line, err = c.C.ReadLine()
+	if err == nil && c.lconn != nil && c.lconn.err != nil {
+		// what was read before the deadline is not a whole line
+		line, err = "", c.lconn.err
+	}
 	log.WithFields(log.Fields{
 		"pkg":     "nntp-conn",
 		"version": 1,
@@ -702,26 +837,45 @@ func sendCapabilities(c *v1Conn, line string, hooks EventHooks) (err error) {
 
 // read an article via dotreader
 func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, err error) {
+	return c.readArticleFrom(c.C.DotReader(), newpost, hooks)
+}
+
+// an article being read off a connection
+type articleTx struct {
+	hdr   message.Header
+	entry ArticleEntry
+	// where the article is stored, nil if it is not
+	tx store.ArticleTx
+}
+
+// read an article from an io.Reader until EOF
+func (c *v1Conn) readArticleFrom(src io.Reader, newpost bool, hooks EventHooks) (ps PolicyStatus, err error) {
+	if c.limits != nil {
+		c.setReadTimeout(c.limits.ReadTimeout)
+		c.setDeadline(c.limits.ArticleTimeout)
+	}
 	store_r, store_w := io.Pipe()
 	article_r, article_w := io.Pipe()
 	article_body_r, article_body_w := io.Pipe()
 
 	accept_chnl := make(chan PolicyStatus)
-	store_info_chnl := make(chan ArticleEntry)
+	store_info_chnl := make(chan articleTx)
+	// final status of the article for the store, sent after the body is read
+	store_status_chnl := make(chan PolicyStatus, 1)
 	store_result_chnl := make(chan error)
 
-	hdr_chnl := make(chan message.Header)
+	hdr_chnl := make(chan articleTx)
+	// the parsed article for the index, sent once the body is read
+	article_chnl := make(chan *model.Article, 1)
 
 	log.WithFields(log.Fields{
 		"pkg": "nntp-conn",
 	}).Debug("start reading")
 	done_chnl := make(chan PolicyStatus)
 	go func() {
-		var err error
-		dr := c.C.DotReader()
 		var buff [1024]byte
 		var n int64
-		n, err = io.CopyBuffer(article_w, dr, buff[:])
+		n, err = io.CopyBuffer(article_w, src, buff[:])
 		log.WithFields(log.Fields{
 			"n": n,
 		}).Debug("read from connection")
@@ -744,124 +898,32 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 	// parse message and store attachments in bg
 	go func(msgbody io.ReadCloser) {
 		defer msgbody.Close()
-		hdr, ok := <-hdr_chnl
+		defer close(article_chnl)
+		info, ok := <-hdr_chnl
 		if !ok {
 			return
 		}
-		// all text in this post
-		// txt := new(bytes.Buffer)
-		// the article itself
-		// a := new(model.Article)
-		var err error
-		if hdr.IsMultipart() {
-			var params map[string]string
-			_, params, err = hdr.GetMediaType()
-			if err == nil {
-				boundary, ok := params["boundary"]
-				if ok {
-					part_r := multipart.NewReader(msgbody, boundary)
-					for err == nil {
-						var part *multipart.Part
-						part, err = part_r.NextPart()
-						if err == io.EOF {
-							// we done
-							break
-						} else if err == nil {
-							// we gots a part
-
-							// get header
-							part_hdr := part.Header
-
-							// check for base64 encoding
-							var part_body io.Reader
-							if part_hdr.Get("Content-Transfer-Encoding") == "base64" {
-								part_body = base64.NewDecoder(base64.StdEncoding, part)
-							} else {
-								part_body = part
-							}
-
-							// get content type
-							content_type := part_hdr.Get("Content-Type")
-							if len(content_type) == 0 {
-								// assume text/plain
-								content_type = "text/plain; charset=UTF8"
-							}
-							var part_type string
-							// extract mime type
-							part_type, _, err = mime.ParseMediaType(content_type)
-							if err == nil {
-
-								if part_type == "text/plain" {
-									// if we are plaintext save it to the text buffer
-									_, err = io.Copy(util.Discard, part_body)
-								} else {
-									var fpath string
-									fname := part.FileName()
-									fpath, err = c.storage.StoreAttachment(part_body, fname)
-									if err == nil {
-										// stored attachment good
-										log.WithFields(log.Fields{
-											"pkg":      "nntp-conn",
-											"state":    &c.state,
-											"version":  "1",
-											"filename": fname,
-											"filepath": fpath,
-										}).Debug("attachment stored")
-									} else {
-										// failed to save attachment
-										log.WithFields(log.Fields{
-											"pkg":     "nntp-conn",
-											"state":   &c.state,
-											"version": "1",
-										}).Error("failed to save attachment ", err)
-									}
-								}
-							} else {
-								// cannot read part header
-								log.WithFields(log.Fields{
-									"pkg":     "nntp-conn",
-									"state":   &c.state,
-									"version": "1",
-								}).Error("bad attachment in multipart message ", err)
-							}
-							err = nil
-							part.Close()
-						} else if err != io.EOF {
-							// error reading part
-							log.WithFields(log.Fields{
-								"pkg":     "nntp-conn",
-								"state":   &c.state,
-								"version": "1",
-							}).Error("error reading part ", err)
-						}
-					}
-				}
-			}
-		} else if hdr.IsSigned() {
-			// signed message
-
-			// discard for now
-			_, err = io.Copy(util.Discard, msgbody)
-		} else {
-			// plaintext message
-			var n int64
-			n, err = io.Copy(util.Discard, msgbody)
-			log.WithFields(log.Fields{
-				"bytes": n,
-				"pkg":   "nntp-conn",
-			}).Debug("text body copied")
+		if info.tx == nil {
+			// not stored, nothing to index
+			io.Copy(util.Discard, msgbody)
+			return
 		}
-		if err != nil && err != io.EOF {
+		hdr := info.hdr
+		a := articleFromHeader(hdr)
+		var err error
+		a.Text, a.Attachments, err = storeAttachments(info.tx, hdr, msgbody)
+		if err != nil {
 			log.WithFields(log.Fields{
 				"pkg":   "nntp-conn",
 				"state": &c.state,
 			}).Error("error handing message body", err)
 		}
+		article_chnl <- a
 	}(article_body_r)
 
 	// store function
 	go func(r io.ReadCloser) {
-		e, ok := <-store_info_chnl
+		info, ok := <-store_info_chnl
 		if !ok {
 			// failed to get info
 			// don't read anything
@@ -869,6 +931,7 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 			store_result_chnl <- io.EOF
 			return
 		}
+		e := info.entry
 		msgid := e.MessageID()
 		if msgid.Valid() {
 			// valid message-id
@@ -879,19 +942,70 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 				"state":   &c.state,
 			}).Debug("storing article")
 
-			fpath, err := c.storage.StoreArticle(r, msgid.String(), e.Newsgroup().String())
+			_, err := io.Copy(info.tx, r)
+			if err != nil {
+				// drain so the reader never blocks
+				io.Copy(util.Discard, r)
+			}
 			r.Close()
-			if err == nil {
+			// wait until the whole body is checked
+			status := <-store_status_chnl
+			// and for the attachments to be stored with the article
+			a, parsed := <-article_chnl
+			if err == nil && status.Accept() {
+				var fpath string
+				fpath, err = info.tx.Commit()
+				if err == nil && fpath != "" {
+					log.WithFields(log.Fields{
+						"pkg":     "nntp-conn",
+						"msgid":   msgid,
+						"version": "1",
+						"state":   &c.state,
+					}).Debug("stored article okay to ", fpath)
+					if parsed && c.index != nil {
+						err = c.index.RegisterArticle(a)
+						if err != nil {
+							// attachments of an article missing from the index look unreferenced to gc
+							// so drop the article and have it sent again later
+							log.WithFields(log.Fields{
+								"pkg":     "nntp-conn",
+								"msgid":   msgid,
+								"version": "1",
+								"state":   &c.state,
+							}).Error("failed to index article ", err)
+							derr := c.storage.DeleteArticle(msgid.String())
+							if derr != nil {
+								log.WithFields(log.Fields{
+									"pkg":     "nntp-conn",
+									"msgid":   msgid,
+									"version": "1",
+									"state":   &c.state,
+								}).Error("failed to remove article that was not indexed ", derr)
+							}
+						}
+					}
+				}
+				if err == nil && fpath != "" {
+					// we got the article
+					articlesReceived.WithLabelValues(metricGroups.label(e.Newsgroup().String()), c.state.FeedName).Inc()
+					if parsed && c.thumbnails != nil {
+						enqueueThumbnails(c.thumbnails, a)
+					}
+					if hooks != nil {
+						hooks.GotArticle(msgid, e.Newsgroup())
+					}
+				}
+			} else {
+				// rejected after we started storing it, nothing of it is kept
 				log.WithFields(log.Fields{
 					"pkg":     "nntp-conn",
 					"msgid":   msgid,
 					"version": "1",
 					"state":   &c.state,
-				}).Debug("stored article okay to ", fpath)
-				// we got the article
-				if hooks != nil {
-					hooks.GotArticle(msgid, e.Newsgroup())
-				}
+				}).Debug("aborting rejected article")
+				info.tx.Abort()
+			}
+			if err == nil {
 				store_result_chnl <- io.EOF
 				log.Debugf("store informed")
 			} else {
@@ -902,7 +1016,6 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 					"state":   &c.state,
 					"version": "1",
 				}).Error("failed to store article ", err)
-				io.Copy(util.Discard, r)
 				store_result_chnl <- err
 			}
 		} else {
@@ -914,6 +1027,7 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 				"state":   &c.state,
 				"version": "1",
 			}).Warn("store will discard message with invalid message-id")
+			info.tx.Abort()
 			io.Copy(util.Discard, r)
 			store_result_chnl <- nil
 			r.Close()
@@ -930,42 +1044,87 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 			// append path
 			hdr.AppendPath(c.serverName)
 			// get message-id
-			var msgid MessageID
-			if newpost {
-				// new post
+			// new posts keep their own so proof of work can be done for them
+			msgid := MessageID(hdr.MessageID())
+			if newpost && !msgid.Valid() {
+				// new post without a message-id
 				// generate it
 				msgid = GenMessageID(c.serverName)
 				hdr.Set("Message-ID", msgid.String())
-			} else {
-				// not a new post, get from header
-				msgid = MessageID(hdr.MessageID())
-				if msgid.Valid() {
-					// check store fo existing article
-					err = c.storage.HasArticle(msgid.String())
-					if err == store.ErrNoSuchArticle {
-						// we don't have the article
-						status = PolicyAccept
-						log.Infof("accept article %s", msgid)
-					} else if err == nil {
-						// we do have the article, reject it we don't need it again
-						status = PolicyReject
-					} else {
-						// some other error happened
-						log.WithFields(log.Fields{
-							"pkg":   "nntp-conn",
-							"state": c.state,
-						}).Error("failed to check store for article ", err)
-					}
-					err = nil
+			} else if msgid.Valid() {
+				// check store fo existing article
+				err = c.storage.HasArticle(msgid.String())
+				if err == store.ErrNoSuchArticle {
+					// we don't have the article
+					status = PolicyAccept
+					log.Infof("accept article %s", msgid)
+				} else if err == nil {
+					// we do have the article, reject it we don't need it again
+					status = PolicyReject
 				} else {
-					// bad article
-					status = PolicyBan
+					// some other error happened
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-conn",
+						"state": c.state,
+					}).Error("failed to check store for article ", err)
 				}
+				err = nil
+			} else {
+				// bad article
+				status = PolicyBan
 			}
 			// check the header if we have an acceptor and the previous checks are good
 			if status.Accept() && c.acceptor != nil {
 				status = c.acceptor.CheckHeader(hdr)
 			}
+			// proof of work is checked against the article as it was sent
+			powBits := 0
+			powNonce := hdr.Get(PoWHeader, "")
+			powDate := hdr.Get("Date", "")
+			if status.Accept() {
+				// posting does not get around it, only trust does
+				powBits = c.requiredPoW(hdr.Newsgroup())
+			}
+			if powBits > 0 && powNonce == "" {
+				log.WithFields(log.Fields{
+					"pkg":   "nntp-conn",
+					"msgid": msgid,
+					"state": &c.state,
+					"bits":  powBits,
+				}).Info("rejecting article without proof of work")
+				status = PolicyReject
+			}
+			filters := withMetadataFilter(c.filters, c.metadata, hdr, newpost)
+			if status.Accept() && len(filters) > 0 {
+				// apply header filters to accepted article
+				var fhdr message.Header
+				fhdr, err = filterHeader(filters, hdr)
+				if err == nil {
+					hdr = fhdr
+				} else {
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-conn",
+						"msgid": msgid,
+						"state": &c.state,
+					}).Warn("header filter failed ", err)
+					status = PolicyReject
+					err = nil
+				}
+			}
+			var tx store.ArticleTx
+			if status.Accept() {
+				// nothing is kept until the whole body is checked
+				tx, err = c.storage.BeginArticle(msgid.String(), hdr.Newsgroup())
+				if err != nil {
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-conn",
+						"msgid": msgid,
+						"state": &c.state,
+					}).Error("cannot begin storing article ", err)
+					status = PolicyDefer
+					err = nil
+				}
+			}
 			if status.Accept() {
 				// we have accepted the article
 				// store to disk
@@ -976,8 +1135,11 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 				w = util.Discard
 				out_w.Close()
 			}
-			store_info_chnl <- ArticleEntry{msgid.String(), hdr.Newsgroup()}
-			hdr_chnl <- hdr
+			if status.Accept() {
+				// only inform store of accepted articles
+				store_info_chnl <- articleTx{hdr: hdr, entry: ArticleEntry{msgid.String(), hdr.Newsgroup()}, tx: tx}
+			}
+			hdr_chnl <- articleTx{hdr: hdr, tx: tx}
 			// close the channel for headers
 			close(hdr_chnl)
 			// write header out to storage
@@ -986,41 +1148,74 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 				mw := io.MultiWriter(body_w, w)
 				// we wrote header
 				var n int64
-				if c.acceptor == nil {
+				var body io.Reader = r
+				if c.acceptor != nil {
+					// we care about the article size
+					body = io.LimitReader(r, c.acceptor.MaxArticleSize())
+				}
+				powBody := crypto.Hash()
+				if status.Accept() && powBits > 0 {
+					// hash the body before any filters touch it
+					body = io.TeeReader(body, powBody)
+				}
+				if status.Accept() && len(filters) > 0 {
+					// write the filtered body
+					n, err = filterBody(filters, body, mw)
+					if err != nil {
+						log.WithFields(log.Fields{
+							"pkg":   "nntp-conn",
+							"msgid": msgid,
+							"state": &c.state,
+						}).Warn("body filter failed ", err)
+						status = PolicyDefer
+					}
+					// discard anything the filters did not read
+					_, err = io.Copy(util.Discard, body)
+				} else {
 					// write the rest of the body
-					// we don't care about article size
 					log.WithFields(log.Fields{}).Debug("copying body")
 					var buff [128]byte
-					n, err = io.CopyBuffer(mw, r, buff[:])
-				} else {
-					// we care about the article size
-					max := c.acceptor.MaxArticleSize()
-					var n int64
-					// copy it out
-					n, err = io.CopyN(mw, r, max)
-					if err == nil {
-						if n < max {
-							// under size limit
-							// we gud
-							log.WithFields(log.Fields{
-								"pkg":   "nntp-conn",
-								"bytes": n,
-								"state": &c.state,
-							}).Debug("body fits")
-						} else {
-							// too big, discard the rest
-							_, err = io.Copy(util.Discard, r)
-							// ... and ban it
-							status = PolicyBan
-						}
+					n, err = io.CopyBuffer(mw, body, buff[:])
+				}
+				if err != nil {
+					// failed to read the whole article
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-conn",
+						"msgid": msgid,
+						"state": &c.state,
+					}).Warn("failed to read article body ", err)
+					status = PolicyDefer
+				}
+				if err == nil && c.acceptor != nil {
+					var extra int64
+					extra, err = io.Copy(util.Discard, r)
+					if extra == 0 {
+						// under size limit
+						// we gud
+						log.WithFields(log.Fields{
+							"pkg":   "nntp-conn",
+							"bytes": n,
+							"state": &c.state,
+						}).Debug("body fits")
+					} else {
+						// too big, ban it
+						status = PolicyBan
 					}
 				}
+				if err == nil && status.Accept() && powBits > 0 && !CheckPoW(msgid, powDate, powBody.Sum(nil), powNonce, powBits) {
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-conn",
+						"msgid": msgid,
+						"state": &c.state,
+						"bits":  powBits,
+					}).Info("rejecting article with insufficient proof of work")
+					status = PolicyReject
+				}
 				log.WithFields(log.Fields{
 					"pkg":   "nntp-conn",
 					"bytes": n,
 					"state": &c.state,
 				}).Debug("body wrote")
-				// TODO: inform store to delete article and attachments
 			} else {
 				// error writing header
 				log.WithFields(log.Fields{
@@ -1031,9 +1226,13 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 			// error reading header
 			// possibly a read error?
 			status = PolicyDefer
+			w = util.Discard
+			out_w.Close()
+			close(hdr_chnl)
 		}
 		// close info channel for store
 		close(store_info_chnl)
+		store_status_chnl <- status
 		w.Close()
 		// close body pipe
 		body_w.Close()
@@ -1045,6 +1244,7 @@ func (c *v1Conn) readArticle(newpost bool, hooks EventHooks) (ps PolicyStatus, e
 
 	ps = <-done_chnl
 	close(done_chnl)
+	policyResults.WithLabelValues(ps.String()).Inc()
 	log.Debug("read article done")
 	return
 }
@@ -1054,13 +1254,22 @@ func nntpRecvArticle(c *v1Conn, line string, hooks EventHooks) (err error) {
 	parts := strings.Split(line, " ")
 	if len(parts) == 2 {
 		msgid := MessageID(parts[1])
-		if msgid.Valid() {
+		c.stats.offer()
+		if !c.allowArticle() {
+			// too many articles
+			c.stats.result(PolicyDefer)
+			err = c.printfLine("%s rate limited, try again later", RPL_TransferDefer)
+		} else if msgid.Valid() {
 			// valid message-id
 			err = c.printfLine("%s send article to be transfered", RPL_TransferAccepted)
 			// read in article
 			if err == nil {
 				var status PolicyStatus
 				status, err = c.readArticle(false, hooks)
+				if err != nil {
+					status = PolicyDefer
+				}
+				c.stats.result(status)
 				if err == nil {
 					// we read in article
 					if status.Accept() {
@@ -1080,6 +1289,7 @@ func nntpRecvArticle(c *v1Conn, line string, hooks EventHooks) (err error) {
 			}
 		} else {
 			// invalid message-id
+			c.stats.result(PolicyReject)
 			err = c.printfLine("%s article not wanted", RPL_TransferNotWanted)
 		}
 	} else {
@@ -1092,10 +1302,20 @@ func nntpRecvArticle(c *v1Conn, line string, hooks EventHooks) (err error) {
 // handle POST command
 func nntpPostArticle(c *v1Conn, line string, hooks EventHooks) (err error) {
 	if c.PostingAllowed() {
-		if c.Mode().Is(MODE_READER) {
+		if !c.allowArticle() {
+			// too many articles
+			c.stats.offer()
+			c.stats.result(PolicyDefer)
+			err = c.printfLine("%s rate limited, try again later", RPL_PostingNotPermitted)
+		} else if c.Mode().Is(MODE_READER) {
+			c.stats.offer()
 			err = c.printfLine("%s go ahead yo", RPL_PostAccepted)
 			var status PolicyStatus
 			status, err = c.readArticle(true, hooks)
+			if err != nil {
+				status = PolicyDefer
+			}
+			c.stats.result(status)
 			if err == nil {
 				// read okay
 				if status.Accept() {
@@ -1130,7 +1350,13 @@ func streamingLine(c *v1Conn, line string, hooks EventHooks) (err error) {
 			cmd := ev.Command()
 			msgid := ev.MessageID()
 			if cmd == stream_CHECK {
-				if c.acceptor == nil {
+				// the outcome of accepted articles is counted on TAKETHIS
+				c.stats.offer()
+				if !c.allowArticle() {
+					// too many articles, ask again later
+					c.stats.result(PolicyDefer)
+					err = c.printfLine("%s %s", RPL_StreamingDefer, msgid)
+				} else if c.acceptor == nil {
 					// no acceptor, we'll take them all
 					err = c.printfLine("%s %s", RPL_StreamingAccept, msgid)
 				} else {
@@ -1147,18 +1373,33 @@ func streamingLine(c *v1Conn, line string, hooks EventHooks) (err error) {
 						err = c.printfLine("%s %s", RPL_StreamingAccept, msgid)
 					} else if status.Defer() {
 						// deferred
+						c.stats.result(status)
 						err = c.printfLine("%s %s", RPL_StreamingDefer, msgid)
 					} else {
 						// rejected
+						c.stats.result(status)
 						err = c.printfLine("%s %s", RPL_StreamingReject, msgid)
 					}
 				}
 			} else if cmd == stream_TAKETHIS {
 				var status PolicyStatus
-				status, err = c.readArticle(false, hooks)
+				if c.allowArticle() {
+					status, err = c.readArticle(false, hooks)
+				} else {
+					// too many articles, discard it
+					status = PolicyDefer
+					_, err = io.Copy(util.Discard, c.C.DotReader())
+				}
+				if err != nil {
+					status = PolicyDefer
+				}
+				c.stats.result(status)
 				if status.Accept() {
 					// this article was accepted
 					err = c.printfLine("%s %s", RPL_StreamingTransfered, msgid)
+				} else if status.Defer() {
+					// this article failed to transfer
+					err = c.printfLine("%s %s", RPL_StreamingFailed, msgid)
 				} else {
 					// this article was not accepted
 					err = c.printfLine("%s %s", RPL_StreamingReject, msgid)
@@ -1315,6 +1556,7 @@ func handleAuthInfo(c *v1Conn, line string, hooks EventHooks) (err error) {
 		} else {
 			// check login
 			success, err = c.auth.CheckLogin(c.username, subcmd[5:])
+			c.trusted = success
 		}
 		if success {
 			// login good
@@ -1347,30 +1589,29 @@ func handleXOVER(c *v1Conn, line string, hooks EventHooks) (err error) {
 	if err != nil {
 		return
 	}
-	chnl := make(chan string)
-	go func() {
-		c.storage.ForEachInGroup(group, chnl)
-		close(chnl)
-	}()
-	i := 0
-	for err == nil {
-		m, ok := <-chnl
-		if !ok {
+	// listed sizes are of the articles as sent, not as stored
+	articles, _ := c.storage.ListGroup(group)
+	for _, a := range articles {
+		if err != nil {
 			break
 		}
-		msgid := MessageID(m)
-		if !msgid.Valid() {
+		if a.Size == 0 || !MessageID(a.MessageID).Valid() {
+			// deleted or unusable message-id
 			continue
 		}
-		var f *os.File
-		f, err = c.storage.OpenArticle(m)
-		if f != nil {
-			h, e := c.hdrio.ReadHeader(f)
-			f.Close()
-			if e == nil {
-				i++
-				err = c.printfLine("%.6d\t%s\t%s\t%s\t%s\t%s", i, h.Get("Subject", "None"), h.Get("From", "anon <anon@anon.tld>"), h.Get("Date", "???"), h.MessageID(), h.Reference())
-			}
+		var f io.ReadCloser
+		f, err = c.storage.OpenArticle(a.MessageID)
+		if err == store.ErrNoSuchArticle {
+			// expired while listing
+			err = nil
+			continue
+		} else if err != nil {
+			break
+		}
+		h, e := c.hdrio.ReadHeader(f)
+		f.Close()
+		if e == nil {
+			err = c.printfLine("%.6d\t%s\t%s\t%s\t%s\t%s\t%d\t", a.Number, h.Get("Subject", "None"), h.Get("From", "anon <anon@anon.tld>"), h.Get("Date", "???"), h.MessageID(), h.Reference(), a.Size)
 		}
 	}
 	if err == nil {
@@ -1435,9 +1676,17 @@ func newInboundConn(s *Server, c net.Conn) Conn {
 		storage = store.NewNullStorage()
 	}
 	anon := false
+	var pow *config.PoWConfig
+	var limits *config.LimitsConfig
+	var metadata *config.MetadataConfig
 	if s.Config != nil {
 		anon = s.Config.AnonNNTP
+		pow = s.Config.PoW
+		limits = s.Config.Limits
+		metadata = s.Config.Metadata
 	}
+	stats := newConnStats()
+	lc := newLimitedConn(&countConn{Conn: c, stats: stats}, limits)
 	return &v1IBConn{
 		C: v1Conn{
 			state: ConnState{
@@ -1449,10 +1698,19 @@ func newInboundConn(s *Server, c net.Conn) Conn {
 			authenticated: anon,
 			serverName:    sname,
 			storage:       storage,
+			index:         s.Index,
+			thumbnails:    s.Thumbnails,
 			acceptor:      s.Acceptor,
+			filters:       s.Filters,
+			metadata:      metadata,
+			pow:           pow,
+			limits:        limits,
+			lconn:         lc,
+			articles:      newArticleLimiter(limits),
+			stats:         stats,
 			hdrio:         message.NewHeaderIO(),
-			C:             textproto.NewConn(c),
-			conn:          c,
+			C:             textproto.NewConn(lc),
+			conn:          lc,
 			cmds: map[string]lineHandlerFunc{
 				"STARTTLS":     upgradeTLS,
 				"IHAVE":        nntpRecvArticle,
@@ -0,0 +1,105 @@
+package nntp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/process"
+	"io"
+)
+
+var ErrFilterOutputTooBig = errors.New("filter wrote more than an article may have")
+
+// filter that runs an external program over the article
+// the program is called with 1 argument: "header" or "body"
+// the article header or body is sent on stdin and the filtered version is read
+// from stdout
+// implements ArticleFilter
+type ExecFilter struct {
+	cfg    *config.FilterConfig
+	hdrio  *message.HeaderIO
+	runner *process.Runner
+}
+
+// create a filter that runs its program with runner, nil for process.DefaultRunner
+// the filter keeps up to DefaultMaxArticleSize of output whatever runner keeps
+func NewExecFilter(cfg *config.FilterConfig, runner *process.Runner) *ExecFilter {
+	if runner == nil {
+		runner = process.DefaultRunner
+	}
+	// copies share the slots of runner
+	r := *runner
+	r.MaxOutput = DefaultMaxArticleSize
+	return &ExecFilter{
+		cfg:    cfg,
+		hdrio:  message.NewHeaderIO(),
+		runner: &r,
+	}
+}
+
+// run the filter program over one part of an article
+func (f *ExecFilter) run(part string, in io.Reader) (out []byte, err error) {
+	log.WithFields(log.Fields{
+		"pkg":    "nntp-filter",
+		"filter": f.cfg.Name,
+	}).Debugf("calling %s filter", part)
+	var res process.Result
+	res, err = f.runner.Run(context.Background(), f.cfg.Exec, []string{part}, in)
+	if err == nil && res.Truncated {
+		err = ErrFilterOutputTooBig
+	}
+	if err != nil {
+		log.Errorf("error in nntp filter %s: %s", f.cfg.Name, err.Error())
+		return nil, err
+	}
+	return res.Stdout, nil
+}
+
+func (f *ExecFilter) FilterHeader(hdr message.Header) (message.Header, error) {
+	in := new(bytes.Buffer)
+	err := f.hdrio.WriteHeader(hdr, in)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	out, err = f.run("header", in)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err = f.hdrio.ReadHeader(bytes.NewReader(out))
+	if err == io.EOF {
+		// no trailing blank line
+		err = nil
+	}
+	return hdr, err
+}
+
+func (f *ExecFilter) FilterAndWriteBody(body io.Reader, wr io.Writer) (n int64, modified bool, err error) {
+	hin := crypto.Hash()
+	var out []byte
+	out, err = f.run("body", io.TeeReader(body, hin))
+	if err != nil {
+		return
+	}
+	hout := crypto.Hash()
+	hout.Write(out)
+	modified = !bytes.Equal(hin.Sum(nil), hout.Sum(nil))
+	var written int
+	written, err = wr.Write(out)
+	n = int64(written)
+	return
+}
+
+// io.Writer that counts bytes written
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(d []byte) (int, error) {
+	w.n += int64(len(d))
+	return len(d), nil
+}
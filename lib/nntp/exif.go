@@ -0,0 +1,338 @@
+package nntp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+)
+
+var errNoBoundary = errors.New("no multipart boundary found")
+
+// filter that removes EXIF, XMP and comments from image attachments in multipart articles
+// jpeg, png and webp images are rewritten without decoding their pixels
+// parts that are not base64 encoded images of those kinds are left as is
+// implements ArticleFilter
+type ExifFilter struct{}
+
+func (ExifFilter) FilterHeader(hdr message.Header) (message.Header, error) {
+	return hdr, nil
+}
+
+func (ExifFilter) FilterAndWriteBody(body io.Reader, wr io.Writer) (n int64, modified bool, err error) {
+	var data []byte
+	data, err = ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+	var filtered []byte
+	filtered, modified = stripMultipartExif(data)
+	var written int
+	if modified {
+		written, err = wr.Write(filtered)
+	} else {
+		written, err = wr.Write(data)
+	}
+	n = int64(written)
+	return
+}
+
+// find the multipart boundary of an article body given its first delimiter line
+func sniffBoundary(data []byte) (boundary string, err error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	for err == nil {
+		var line string
+		line, err = r.ReadString(10)
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "--") && len(line) > 2 && !strings.ContainsAny(line, " \t") {
+			boundary = line[2:]
+			return
+		}
+	}
+	err = errNoBoundary
+	return
+}
+
+// strip metadata from all image parts in a multipart body
+// returns the new body and true if anything was changed
+// returns nil and false if nothing was changed or the body is not well formed
+func stripMultipartExif(data []byte) (out []byte, modified bool) {
+	boundary, err := sniffBoundary(data)
+	if err != nil {
+		return nil, false
+	}
+	buff := new(bytes.Buffer)
+	// keep preamble
+	preamble := bytes.Index(data, []byte("--"+boundary))
+	buff.Write(data[:preamble])
+	mr := multipart.NewReader(bytes.NewReader(data), boundary)
+	mw := multipart.NewWriter(buff)
+	mw.SetBoundary(boundary)
+	for {
+		var part *multipart.Part
+		part, err = mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false
+		}
+		var raw []byte
+		raw, err = ioutil.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return nil, false
+		}
+		if strings.EqualFold(strings.TrimSpace(part.Header.Get("Content-Transfer-Encoding")), "base64") {
+			var img []byte
+			img, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+			if err == nil {
+				var stripped []byte
+				// go by what the file is and not what the poster says it is
+				stripped, err = stripImageMetadata(img)
+				if err == nil && !bytes.Equal(stripped, img) {
+					raw = encodeBase64Lines(stripped)
+					modified = true
+				}
+			}
+		}
+		var pw io.Writer
+		pw, err = mw.CreatePart(part.Header)
+		if err != nil {
+			return nil, false
+		}
+		pw.Write(raw)
+	}
+	if !modified {
+		return nil, false
+	}
+	mw.Close()
+	return buff.Bytes(), true
+}
+
+// base64 encode data wrapped at 76 characters per line
+func encodeBase64Lines(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	buff := new(bytes.Buffer)
+	for len(enc) > 76 {
+		buff.WriteString(enc[:76])
+		buff.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	buff.WriteString(enc)
+	return buff.Bytes()
+}
+
+var errBadJpeg = errors.New("malformed jpeg")
+var errBadPng = errors.New("malformed png")
+var errBadWebp = errors.New("malformed webp")
+var errNotImage = errors.New("not a jpeg, png or webp image")
+
+// headers of jpeg APP1 segments that hold metadata
+var jpegMetadataHeaders = [][]byte{
+	[]byte("Exif\x00\x00"),
+	[]byte("http://ns.adobe.com/xap/1.0/\x00"),
+	// xmp too big for one segment
+	[]byte("http://ns.adobe.com/xmp/extension/\x00"),
+}
+
+// header of jpeg APP2 segments indexing the other images of a multi picture file
+var jpegMultiPictureHeader = []byte("MPF\x00")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// png chunks that hold metadata, xmp is kept in an iTXt chunk
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// flags of a webp VP8X chunk saying the file has exif or xmp chunks
+const webpMetadataFlags = 0x08 | 0x04
+
+// remove metadata from a jpeg, png or webp image
+// returns the image unchanged if it has no metadata
+func stripImageMetadata(img []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(img, []byte{0xff, 0xd8}):
+		return stripJpegMetadata(img)
+	case bytes.HasPrefix(img, pngSignature):
+		return stripPngMetadata(img)
+	case len(img) >= 12 && string(img[:4]) == "RIFF" && string(img[8:12]) == "WEBP":
+		return stripWebpMetadata(img)
+	}
+	return nil, errNotImage
+}
+
+// remove exif and xmp APP1 segments, multi picture APP2 segments and comment segments from a jpeg image
+// segments between the scans of progressive images are walked too
+// anything after the end of the image is dropped, it may be another image with its own metadata
+// returns the image unchanged if it has none
+func stripJpegMetadata(img []byte) (out []byte, err error) {
+	if len(img) < 4 || img[0] != 0xff || img[1] != 0xd8 {
+		return nil, errBadJpeg
+	}
+	out = append(out, img[:2]...)
+	idx := 2
+	for idx < len(img) {
+		if img[idx] != 0xff || idx+1 >= len(img) {
+			return nil, errBadJpeg
+		}
+		marker := img[idx+1]
+		if marker == 0xff {
+			// fill byte
+			out = append(out, 0xff)
+			idx++
+			continue
+		}
+		if marker == 0xd9 {
+			// end of image
+			out = append(out, img[idx:idx+2]...)
+			return
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// standalone marker
+			out = append(out, img[idx:idx+2]...)
+			idx += 2
+			continue
+		}
+		if idx+4 > len(img) {
+			return nil, errBadJpeg
+		}
+		l := int(img[idx+2])<<8 | int(img[idx+3])
+		end := idx + 2 + l
+		if l < 2 || end > len(img) {
+			return nil, errBadJpeg
+		}
+		if !isJpegMetadata(marker, img[idx+4:end]) {
+			out = append(out, img[idx:end]...)
+		}
+		idx = end
+		if marker == 0xda {
+			// start of scan, entropy coded data follows up to the next marker
+			end = jpegScanEnd(img, idx)
+			out = append(out, img[idx:end]...)
+			idx = end
+		}
+	}
+	// cut short in the middle of a scan, keep what is there
+	return
+}
+
+// find where the entropy coded data of a jpeg scan starting at idx ends
+// 0xff00 is a stuffed 0xff and restart markers are part of the scan
+func jpegScanEnd(img []byte, idx int) int {
+	for idx+1 < len(img) {
+		if img[idx] == 0xff {
+			next := img[idx+1]
+			if next == 0x00 || (next >= 0xd0 && next <= 0xd7) {
+				idx += 2
+				continue
+			}
+			return idx
+		}
+		idx++
+	}
+	return len(img)
+}
+
+// is a jpeg segment one that holds metadata?
+func isJpegMetadata(marker byte, body []byte) bool {
+	if marker == 0xfe {
+		// comment
+		return true
+	}
+	if marker == 0xe1 {
+		for _, hdr := range jpegMetadataHeaders {
+			if bytes.HasPrefix(body, hdr) {
+				return true
+			}
+		}
+	}
+	if marker == 0xe2 {
+		// index of the images after the end of this one, which are dropped
+		return bytes.HasPrefix(body, jpegMultiPictureHeader)
+	}
+	return false
+}
+
+// remove exif and text chunks from a png image
+// anything after the end of the image is dropped
+// returns the image unchanged if it has none
+func stripPngMetadata(img []byte) (out []byte, err error) {
+	if !bytes.HasPrefix(img, pngSignature) {
+		return nil, errBadPng
+	}
+	out = append(out, pngSignature...)
+	idx := len(pngSignature)
+	for idx < len(img) {
+		if idx+8 > len(img) {
+			return nil, errBadPng
+		}
+		l := int64(binary.BigEndian.Uint32(img[idx:]))
+		kind := string(img[idx+4 : idx+8])
+		// length, type, data and crc
+		end := int64(idx) + 12 + l
+		if end > int64(len(img)) {
+			return nil, errBadPng
+		}
+		if !pngMetadataChunks[kind] {
+			out = append(out, img[idx:end]...)
+		}
+		idx = int(end)
+		if kind == "IEND" {
+			return
+		}
+	}
+	// cut short
+	return nil, errBadPng
+}
+
+// remove exif and xmp chunks from a webp image
+// anything after the end of the image is dropped
+// returns the image unchanged if it has none
+func stripWebpMetadata(img []byte) (out []byte, err error) {
+	if len(img) < 12 || string(img[:4]) != "RIFF" || string(img[8:12]) != "WEBP" {
+		return nil, errBadWebp
+	}
+	size := int64(binary.LittleEndian.Uint32(img[4:])) + 8
+	if size > int64(len(img)) || size < 12 {
+		return nil, errBadWebp
+	}
+	out = append(out, img[:12]...)
+	idx := int64(12)
+	vp8x := -1
+	for idx < size {
+		if idx+8 > size {
+			return nil, errBadWebp
+		}
+		kind := string(img[idx : idx+4])
+		l := int64(binary.LittleEndian.Uint32(img[idx+4:]))
+		// chunks are padded to an even length
+		end := idx + 8 + l + l%2
+		if end > size {
+			return nil, errBadWebp
+		}
+		if kind == "EXIF" || kind == "XMP " {
+			idx = end
+			continue
+		}
+		if kind == "VP8X" && l > 0 {
+			vp8x = len(out) + 8
+		}
+		out = append(out, img[idx:end]...)
+		idx = end
+	}
+	if vp8x >= 0 {
+		out[vp8x] &^= webpMetadataFlags
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return
+}
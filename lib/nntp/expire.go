@@ -0,0 +1,150 @@
+package nntp
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/store"
+	"time"
+)
+
+// what an expire run removed
+type ExpireStats struct {
+	// newsgroups that had articles expired
+	Groups int64 `json:"groups"`
+	// articles removed from a newsgroup
+	Links int64 `json:"links"`
+	// articles deleted as no newsgroup had them anymore
+	Articles int64 `json:"articles"`
+	// bytes of articles deleted
+	Bytes int64 `json:"bytes"`
+	// attachments no remaining article refers to that were deleted
+	Attachments int64 `json:"attachments"`
+}
+
+// removes articles past the limits of the expiry rules of their newsgroup
+type Expirer struct {
+	// where the articles are stored
+	Storage store.Storage
+	// index to remove expired articles from, nil for none
+	// attachments are only deleted with an index to tell which articles refer to them
+	Index ArticleIndex
+	// expiry rules
+	Config *config.ExpireConfig
+}
+
+// pick the articles of a newsgroup to expire given the articles ordered by number
+// links to deleted articles are always expired
+func expireSelect(rule *config.ExpireRule, articles []store.GroupArticle, now time.Time) (expired []store.GroupArticle) {
+	var keep []store.GroupArticle
+	maxAge := rule.MaxAge()
+	for _, a := range articles {
+		if a.Stored.IsZero() || (maxAge > 0 && now.Sub(a.Stored) > maxAge) {
+			expired = append(expired, a)
+		} else {
+			keep = append(keep, a)
+		}
+	}
+	// drop the oldest until both the count and size limits hold
+	var total int64
+	for _, a := range keep {
+		total += a.Size
+	}
+	for len(keep) > 0 && ((rule.Articles > 0 && len(keep) > rule.Articles) || (rule.Bytes > 0 && total > rule.Bytes)) {
+		total -= keep[0].Size
+		expired = append(expired, keep[0])
+		keep = keep[1:]
+	}
+	return
+}
+
+// expire every newsgroup once
+func (e *Expirer) Expire() (st ExpireStats, err error) {
+	var groups []string
+	groups, err = e.Storage.GetAllNewsgroups()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, group := range groups {
+		rule := e.Config.RuleFor(group)
+		if rule == nil {
+			continue
+		}
+		var articles []store.GroupArticle
+		articles, err = e.Storage.ListGroup(group)
+		if err != nil {
+			return
+		}
+		expired := expireSelect(rule, articles, now)
+		if len(expired) == 0 {
+			continue
+		}
+		var deleted []string
+		deleted, err = e.Storage.ExpireArticles(group, expired)
+		if err != nil {
+			return
+		}
+		st.Groups++
+		sizes := make(map[string]int64)
+		for _, a := range expired {
+			expiredArticles.WithLabelValues(metricGroups.label(group)).Inc()
+			st.Links++
+			sizes[a.MessageID] = a.Size
+		}
+		// find attachments before the index forgets them
+		var files []string
+		if e.Index != nil {
+			for _, msgid := range deleted {
+				f, ferr := e.Index.ArticleAttachments(msgid)
+				if ferr == nil {
+					files = append(files, f...)
+				}
+			}
+		}
+		for _, msgid := range deleted {
+			st.Articles++
+			st.Bytes += sizes[msgid]
+			if e.Index != nil {
+				ierr := e.Index.DeleteArticle(msgid)
+				if ierr != nil {
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-expire",
+						"msgid": msgid,
+					}).Error("failed to remove expired article from index ", ierr)
+				}
+			}
+		}
+		if e.Index != nil {
+			st.Attachments += freeAttachments(e.Storage, e.Index, files)
+		}
+		log.WithFields(log.Fields{
+			"pkg":      "nntp-expire",
+			"group":    group,
+			"articles": len(expired),
+			"deleted":  len(deleted),
+		}).Info("expired articles")
+	}
+	return
+}
+
+// expire articles periodically forever
+func (e *Expirer) Run() {
+	for {
+		st, err := e.Expire()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pkg": "nntp-expire",
+			}).Error("expire failed ", err)
+		} else {
+			log.WithFields(log.Fields{
+				"pkg":         "nntp-expire",
+				"groups":      st.Groups,
+				"links":       st.Links,
+				"articles":    st.Articles,
+				"bytes":       st.Bytes,
+				"attachments": st.Attachments,
+			}).Info("expire done")
+		}
+		time.Sleep(e.Config.Every())
+	}
+}
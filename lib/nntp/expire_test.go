@@ -0,0 +1,151 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireSelect(t *testing.T) {
+	now := time.Now()
+	articles := []store.GroupArticle{
+		{Number: 1, MessageID: "<gone@test.tld>"},
+		{Number: 2, MessageID: "<old@test.tld>", Size: 10, Stored: now.Add(-48 * time.Hour)},
+		{Number: 3, MessageID: "<aa@test.tld>", Size: 10, Stored: now.Add(-time.Hour)},
+		{Number: 4, MessageID: "<bb@test.tld>", Size: 10, Stored: now.Add(-time.Hour)},
+		{Number: 5, MessageID: "<cc@test.tld>", Size: 10, Stored: now},
+	}
+	tests := []struct {
+		rule    config.ExpireRule
+		expired int
+	}{
+		{config.ExpireRule{}, 1},
+		{config.ExpireRule{Days: 1}, 2},
+		{config.ExpireRule{Days: 1, Articles: 2}, 3},
+		{config.ExpireRule{Bytes: 15}, 4},
+		{config.ExpireRule{Articles: 10, Bytes: 100}, 1},
+	}
+	for _, test := range tests {
+		expired := expireSelect(&test.rule, articles, now)
+		if len(expired) != test.expired {
+			t.Logf("rule %+v expired %d articles not %d", test.rule, len(expired), test.expired)
+			t.Fail()
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-expire")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	idx := &memIndex{articles: make(map[string]*model.Article)}
+	shared, _ := st.StoreAttachment(strings.NewReader("shared"), "shared.png")
+	single, _ := st.StoreAttachment(strings.NewReader("single"), "single.png")
+	old := time.Now().Add(-2 * store.MinGarbageAge)
+	os.Chtimes(shared, old, old)
+	os.Chtimes(single, old, old)
+	thumb, _ := st.ThumbnailPath(single)
+	ioutil.WriteFile(thumb+".jpg", []byte("thumbnail"), 0644)
+	// may be used by an article that is not indexed yet
+	fresh, _ := st.StoreAttachment(strings.NewReader("fresh"), "fresh.png")
+	atts := map[string][]string{
+		"<aa@test.tld>": {shared, single, fresh},
+		"<bb@test.tld>": {shared},
+		"<cc@test.tld>": {shared},
+	}
+	for _, msgid := range []string{"<aa@test.tld>", "<bb@test.tld>", "<cc@test.tld>"} {
+		_, err = st.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\nNewsgroups: overchan.test\n\nhi\n"), msgid, "overchan.test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		a := &model.Article{MessageID: msgid, Newsgroup: "overchan.test"}
+		for _, fpath := range atts[msgid] {
+			a.Attachments = append(a.Attachments, model.Attachment{Path: filepath.Base(fpath)})
+		}
+		idx.RegisterArticle(a)
+	}
+	e := &Expirer{
+		Storage: st,
+		Index:   idx,
+		Config: &config.ExpireConfig{
+			Rules: []*config.ExpireRule{{Groups: "overchan.*", Articles: 1}},
+		},
+	}
+	err = e.Config.Compile()
+	if err == nil {
+		var stats ExpireStats
+		stats, err = e.Expire()
+		if stats.Links != 2 || stats.Articles != 2 || stats.Attachments != 1 {
+			t.Logf("bad expire stats %+v", stats)
+			t.Fail()
+		}
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, msgid := range []string{"<aa@test.tld>", "<bb@test.tld>"} {
+		if st.HasArticle(msgid) != store.ErrNoSuchArticle || idx.articles[msgid] != nil {
+			t.Logf("%s not expired", msgid)
+			t.Fail()
+		}
+	}
+	list, _ := st.ListGroup("overchan.test")
+	if len(list) != 1 || list[0].MessageID != "<cc@test.tld>" || list[0].Number != 3 {
+		t.Logf("wrong articles left in group: %+v", list)
+		t.Fail()
+	}
+	hi, lo, err := st.GetWatermark("overchan.test")
+	if err != nil || hi != 3 || lo != 3 {
+		t.Logf("wrong watermarks hi=%d lo=%d: %v", hi, lo, err)
+		t.Fail()
+	}
+	if _, err = os.Stat(shared); err != nil {
+		t.Log("attachment still referenced was deleted")
+		t.Fail()
+	}
+	if _, err = os.Stat(single); !os.IsNotExist(err) {
+		t.Log("unreferenced attachment was kept")
+		t.Fail()
+	}
+	if _, err = os.Stat(fresh); err != nil {
+		t.Log("recently stored attachment was deleted")
+		t.Fail()
+	}
+	if _, err = os.Stat(thumb + ".jpg"); !os.IsNotExist(err) {
+		t.Log("thumbnail of unreferenced attachment was kept")
+		t.Fail()
+	}
+	if len(idx.deletedThumbnails) != 1 || idx.deletedThumbnails[0] != filepath.Base(single) {
+		t.Logf("wrong thumbnails forgotten: %q", idx.deletedThumbnails)
+		t.Fail()
+	}
+
+	// deleting removes the group link too
+	err = st.DeleteArticle("<cc@test.tld>")
+	list, _ = st.ListGroup("overchan.test")
+	if err != nil || len(list) != 0 {
+		t.Logf("link left after delete: %+v %v", list, err)
+		t.Fail()
+	}
+	hi, lo, _ = st.GetWatermark("overchan.test")
+	if hi != 3 || lo != 4 {
+		t.Logf("wrong watermarks of empty group hi=%d lo=%d", hi, lo)
+		t.Fail()
+	}
+}
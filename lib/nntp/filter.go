@@ -1,10 +1,17 @@
 package nntp
 
 import (
+	"errors"
+	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/process"
 	"io"
+	"strings"
+	"sync"
 )
 
+var ErrUnknownFilter = errors.New("unknown filter type")
+
 // defines interface for filtering an nntp article
 // filters can (and does) modify the article it operates on
 type ArticleFilter interface {
@@ -17,3 +24,108 @@ type ArticleFilter interface {
 	// modifed (or false if body is unchanged) and an error if one occurs
 	FilterAndWriteBody(body io.Reader, wr io.Writer) (int64, bool, error)
 }
+
+// create a new article filter from configuration
+// exec filters run their programs with runner, nil for process.DefaultRunner
+func NewFilter(cfg *config.FilterConfig, runner *process.Runner) (f ArticleFilter, err error) {
+	switch strings.ToLower(cfg.Type) {
+	case "header":
+		f = &HeaderFilter{
+			Strip:   cfg.Strip,
+			Rewrite: cfg.Rewrite,
+		}
+	case "date":
+		f = DateFilter{}
+	case "exif", "metadata":
+		f = ExifFilter{}
+	case "exec":
+		f = NewExecFilter(cfg, runner)
+	default:
+		err = ErrUnknownFilter
+	}
+	return
+}
+
+// add metadata stripping to the filters for an article if it is configured for where the article came from
+// local is true for articles posted on this server
+// signed articles are left as they are so their signatures still verify
+func withMetadataFilter(filters []ArticleFilter, conf *config.MetadataConfig, hdr message.Header, local bool) []ArticleFilter {
+	if !conf.Strip(local) || hdr.IsSigned() {
+		return filters
+	}
+	// never append to the shared slice of filters
+	return append(filters[:len(filters):len(filters)], ExifFilter{})
+}
+
+// run an article header through filters in order
+func filterHeader(filters []ArticleFilter, hdr message.Header) (message.Header, error) {
+	var err error
+	for _, f := range filters {
+		hdr, err = f.FilterHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hdr, nil
+}
+
+// run an article body through filters in order and write the result to an io.Writer
+// blocks until all filters are done
+// returns the number of bytes written and the first error that occurred
+func filterBody(filters []ArticleFilter, body io.Reader, wr io.Writer) (n int64, err error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(filters))
+	r := body
+	for idx, f := range filters {
+		pr, pw := io.Pipe()
+		wg.Add(1)
+		go func(idx int, f ArticleFilter, in io.Reader, out *io.PipeWriter) {
+			_, _, e := f.FilterAndWriteBody(in, out)
+			errs[idx] = e
+			if upstream, ok := in.(*io.PipeReader); ok && idx > 0 {
+				// unblock the previous filter if we did not read all of its output
+				upstream.Close()
+			}
+			out.CloseWithError(e)
+			wg.Done()
+		}(idx, f, r, pw)
+		r = pr
+	}
+	n, err = io.Copy(wr, r)
+	if pr, ok := r.(*io.PipeReader); ok {
+		// unblock the last filter if we failed to write its output
+		pr.Close()
+	}
+	wg.Wait()
+	// report the filter that failed first, not the ones we closed after it
+	for _, e := range errs {
+		if e != nil && e != io.ErrClosedPipe {
+			return n, e
+		}
+	}
+	for _, e := range errs {
+		if e != nil {
+			return n, e
+		}
+	}
+	return
+}
+
+// find the key of a header case insensitively
+// returns empty string if not found
+func findHeaderKey(hdr message.Header, key string) string {
+	for k := range hdr {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return ""
+}
+
+// a filter that leaves the body of an article as is
+type passBody struct{}
+
+func (passBody) FilterAndWriteBody(body io.Reader, wr io.Writer) (n int64, modified bool, err error) {
+	n, err = io.Copy(wr, body)
+	return
+}
@@ -0,0 +1,443 @@
+package nntp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/process"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderFilter(t *testing.T) {
+	f, err := NewFilter(&config.FilterConfig{
+		Type:    "header",
+		Strip:   []string{"X-Originating-IP"},
+		Rewrite: map[string]string{"NNTP-Posting-Host": "localhost"},
+	}, nil)
+	if err != nil {
+		t.Logf("failed to create filter: %s", err)
+		t.FailNow()
+	}
+	hdr := message.Header{
+		"x-originating-ip":  {"127.0.0.1"},
+		"Nntp-Posting-Host": {"10.0.0.1"},
+		"Subject":           {"test"},
+	}
+	hdr, err = f.FilterHeader(hdr)
+	if err != nil {
+		t.Logf("filter failed: %s", err)
+		t.FailNow()
+	}
+	if hdr.Has("x-originating-ip") {
+		t.Logf("header not stripped: %v", hdr)
+		t.Fail()
+	}
+	if hdr.Get("Nntp-Posting-Host", "") != "localhost" {
+		t.Logf("header not rewritten: %v", hdr)
+		t.Fail()
+	}
+	if hdr.Get("Subject", "") != "test" {
+		t.Logf("unrelated header modified: %v", hdr)
+		t.Fail()
+	}
+}
+
+func TestDateFilter(t *testing.T) {
+	cases := map[string]string{
+		"Mon, 02 Jan 2006 15:04:05 -0700":      "Mon, 02 Jan 2006 22:04:05 +0000",
+		"Mon, 2 Jan 2006 15:04:05 +0100 (CET)": "Mon, 02 Jan 2006 14:04:05 +0000",
+		"2006-01-02T15:04:05Z":                 "Mon, 02 Jan 2006 15:04:05 +0000",
+		"Monday, 02-Jan-06 15:04:05 UTC":       "Mon, 02 Jan 2006 15:04:05 +0000",
+		"Mon, 02 Jan 2006 15:04:05 GMT":        "Mon, 02 Jan 2006 15:04:05 +0000",
+	}
+	for in, expect := range cases {
+		hdr := message.Header{"date": {in}}
+		hdr, err := DateFilter{}.FilterHeader(hdr)
+		if err != nil {
+			t.Logf("filter failed: %s", err)
+			t.Fail()
+			continue
+		}
+		if hdr.Has("date") {
+			t.Logf("old date header kept: %v", hdr)
+			t.Fail()
+		}
+		if hdr.Get("Date", "") != expect {
+			t.Logf("date %q normalised to %q not %q", in, hdr.Get("Date", ""), expect)
+			t.Fail()
+		}
+	}
+	hdr, _ := DateFilter{}.FilterHeader(message.Header{"Date": {"garbage"}})
+	if _, ok := parseDate(hdr.Get("Date", "")); !ok {
+		t.Logf("unparsable date not replaced: %v", hdr)
+		t.Fail()
+	}
+}
+
+// make a minimal progressive jpeg, with exif, xmp, multi picture and comment segments
+// and a second image with its own exif after the end if meta is set
+func testJpeg(meta bool) []byte {
+	var b []byte
+	segment := func(marker byte, payload []byte) {
+		b = append(b, 0xff, marker, byte((len(payload)+2)>>8), byte(len(payload)+2))
+		b = append(b, payload...)
+	}
+	b = append(b, 0xff, 0xd8)
+	// jfif header is kept
+	segment(0xe0, []byte("JFIF\x00\x01\x01"))
+	if meta {
+		segment(0xe1, []byte("Exif\x00\x00GPS data goes here"))
+		segment(0xe2, []byte("MPF\x00index of the next image"))
+		segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+		segment(0xfe, []byte("hello"))
+	}
+	// first scan with a stuffed 0xff and a restart marker
+	segment(0xda, []byte{1, 2, 3})
+	b = append(b, 1, 0xff, 0x00, 2, 0xff, 0xd0, 3)
+	if meta {
+		segment(0xfe, []byte("between scans"))
+		segment(0xe1, []byte("Exif\x00\x00more GPS data"))
+	}
+	segment(0xc4, []byte{4, 5, 6})
+	segment(0xda, []byte{1, 2, 3})
+	b = append(b, 4, 5, 6, 0xff, 0xd9)
+	if meta {
+		// the second image of a multi picture file
+		b = append(b, 0xff, 0xd8)
+		segment(0xe1, []byte("Exif\x00\x00GPS data of the preview"))
+		segment(0xda, []byte{1, 2, 3})
+		b = append(b, 7, 8, 9, 0xff, 0xd9)
+	}
+	return b
+}
+
+func TestStripJpegMetadata(t *testing.T) {
+	stripped, err := stripJpegMetadata(testJpeg(true))
+	if err != nil {
+		t.Logf("failed to strip metadata: %s", err)
+		t.FailNow()
+	}
+	if !bytes.Equal(stripped, testJpeg(false)) {
+		t.Logf("metadata not stripped correctly: %q", stripped)
+		t.Fail()
+	}
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Logf("exif left in stripped jpeg: %q", stripped)
+		t.Fail()
+	}
+	_, err = stripJpegMetadata([]byte("not a jpeg"))
+	if err == nil {
+		t.Log("stripped metadata from garbage")
+		t.Fail()
+	}
+}
+
+// make a minimal png, with exif and text chunks if meta is set
+func testPng(meta bool) []byte {
+	b := append([]byte{}, pngSignature...)
+	chunk := func(kind string, data []byte) {
+		b = append(b, byte(len(data)>>24), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+		b = append(b, kind...)
+		b = append(b, data...)
+		// crc is not checked
+		b = append(b, 1, 2, 3, 4)
+	}
+	chunk("IHDR", make([]byte, 13))
+	if meta {
+		chunk("eXIf", []byte("MM\x00*GPS data goes here"))
+		chunk("tEXt", []byte("Comment\x00hello"))
+		chunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	}
+	chunk("IDAT", []byte("pixels"))
+	if meta {
+		chunk("zTXt", []byte("Author\x00\x00compressed"))
+	}
+	chunk("IEND", nil)
+	return b
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	stripped, err := stripImageMetadata(testPng(true))
+	if err != nil || !bytes.Equal(stripped, testPng(false)) {
+		t.Logf("metadata not stripped correctly: %q %v", stripped, err)
+		t.Fail()
+	}
+	// a trailing image is dropped with its metadata
+	img := append(testPng(true), testJpeg(true)...)
+	stripped, err = stripImageMetadata(img)
+	if err != nil || !bytes.Equal(stripped, testPng(false)) {
+		t.Logf("trailing data not dropped: %q %v", stripped, err)
+		t.Fail()
+	}
+	img = testPng(true)
+	for n := 0; n < len(img); n++ {
+		// cut short files are not taken as whole ones
+		if _, err = stripPngMetadata(img[:n]); err == nil {
+			t.Logf("png cut at %d bytes stripped", n)
+			t.Fail()
+			break
+		}
+	}
+}
+
+// make a minimal extended webp, with exif and xmp chunks if meta is set
+func testWebp(meta bool) []byte {
+	body := []byte("WEBP")
+	chunk := func(kind string, data []byte) {
+		body = append(body, kind...)
+		body = append(body, byte(len(data)), byte(len(data)>>8), byte(len(data)>>16), byte(len(data)>>24))
+		body = append(body, data...)
+		if len(data)%2 == 1 {
+			body = append(body, 0)
+		}
+	}
+	flags := byte(0x10)
+	if meta {
+		flags |= webpMetadataFlags
+	}
+	chunk("VP8X", []byte{flags, 0, 0, 0, 9, 0, 0, 9, 0, 0})
+	chunk("VP8L", []byte("pixels!"))
+	if meta {
+		chunk("EXIF", []byte("MM\x00*GPS data goes here"))
+		chunk("XMP ", []byte("<x:xmpmeta/>"))
+	}
+	b := []byte("RIFF")
+	b = append(b, byte(len(body)), byte(len(body)>>8), byte(len(body)>>16), byte(len(body)>>24))
+	return append(b, body...)
+}
+
+func TestStripWebpMetadata(t *testing.T) {
+	stripped, err := stripImageMetadata(testWebp(true))
+	if err != nil || !bytes.Equal(stripped, testWebp(false)) {
+		t.Logf("metadata not stripped correctly: %q %v", stripped, err)
+		t.Fail()
+	}
+	_, err = stripImageMetadata(testWebp(true)[:30])
+	if err == nil {
+		t.Log("cut short webp stripped")
+		t.Fail()
+	}
+	_, err = stripImageMetadata([]byte("GIF89a"))
+	if err != errNotImage {
+		t.Logf("gif stripped: %v", err)
+		t.Fail()
+	}
+}
+
+func TestExifFilter(t *testing.T) {
+	body := "preamble\n--boundary\nContent-Type: text/plain\n\nhello\n--boundary\nContent-Type: image/jpeg\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(testJpeg(true)) + "\n--boundary--\n"
+	out := new(bytes.Buffer)
+	_, modified, err := ExifFilter{}.FilterAndWriteBody(strings.NewReader(body), out)
+	if err != nil {
+		t.Logf("filter failed: %s", err)
+		t.FailNow()
+	}
+	if !modified {
+		t.Log("body not modified")
+		t.FailNow()
+	}
+	if !strings.HasPrefix(out.String(), "preamble\n") {
+		t.Logf("preamble lost: %q", out.String())
+		t.Fail()
+	}
+	if !strings.Contains(out.String(), base64.StdEncoding.EncodeToString(testJpeg(false))) {
+		t.Logf("stripped jpeg not in body: %q", out.String())
+		t.Fail()
+	}
+	if !strings.Contains(out.String(), "hello") {
+		t.Logf("text part lost: %q", out.String())
+		t.Fail()
+	}
+
+	// plain text passes through untouched
+	out.Reset()
+	_, modified, err = ExifFilter{}.FilterAndWriteBody(strings.NewReader("-- \nsignature\n"), out)
+	if err != nil || modified || out.String() != "-- \nsignature\n" {
+		t.Logf("plain body changed: modified=%v err=%v body=%q", modified, err, out.String())
+		t.Fail()
+	}
+}
+
+func TestWithMetadataFilter(t *testing.T) {
+	filters := make([]ArticleFilter, 1, 2)
+	filters[0] = DateFilter{}
+	conf := &config.MetadataConfig{Local: true}
+	if got := withMetadataFilter(filters, nil, message.Header{}, true); len(got) != 1 {
+		t.Logf("stripping without config: %v", got)
+		t.Fail()
+	}
+	if got := withMetadataFilter(filters, conf, message.Header{}, false); len(got) != 1 {
+		t.Logf("stripping federated article: %v", got)
+		t.Fail()
+	}
+	signed := message.Header{"X-Pubkey-Ed25519": {"00"}}
+	if got := withMetadataFilter(filters, conf, signed, true); len(got) != 1 {
+		t.Logf("stripping signed article: %v", got)
+		t.Fail()
+	}
+	got := withMetadataFilter(filters, conf, message.Header{}, true)
+	if len(got) != 2 {
+		t.Logf("not stripping local article: %v", got)
+		t.Fail()
+	}
+	// the shared filters are left alone
+	withMetadataFilter(filters, conf, message.Header{}, true)[1] = DateFilter{}
+	if _, ok := got[1].(ExifFilter); !ok {
+		t.Log("shared filters changed")
+		t.Fail()
+	}
+}
+
+func TestPrepareArticleStripsMetadata(t *testing.T) {
+	s := NewServer()
+	s.Config = &config.NNTPServerConfig{
+		Name:     "test.tld",
+		Metadata: &config.MetadataConfig{Local: true},
+	}
+	a := s.NewArticle("overchan.test", "", "", "", "hello")
+	a.Attachments = append(a.Attachments, &message.Attachment{
+		Mime:     "image/jpeg",
+		FileName: "a.jpg",
+		Body:     nopCloser{strings.NewReader(string(testJpeg(true)))},
+	})
+	p, err := s.PrepareArticle(a)
+	if err != nil {
+		t.Logf("failed to prepare article: %s", err)
+		t.FailNow()
+	}
+	if !bytes.Contains(p.Body, []byte(base64.StdEncoding.EncodeToString(testJpeg(false)))) {
+		t.Logf("metadata not stripped: %q", p.Body)
+		t.Fail()
+	}
+	if bytes.Contains(p.Body, []byte("\r\n")) {
+		t.Logf("stripped body has crlf line endings: %q", p.Body)
+		t.Fail()
+	}
+}
+
+// filter that upper cases the body
+type upperFilter struct{}
+
+func (upperFilter) FilterHeader(hdr message.Header) (message.Header, error) {
+	return hdr, nil
+}
+
+func (upperFilter) FilterAndWriteBody(body io.Reader, wr io.Writer) (int64, bool, error) {
+	d, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := wr.Write(bytes.ToUpper(d))
+	return int64(n), true, err
+}
+
+// filter that fails without reading the body
+type failFilter struct{}
+
+func (failFilter) FilterHeader(hdr message.Header) (message.Header, error) {
+	return nil, fmt.Errorf("header failed")
+}
+
+func (failFilter) FilterAndWriteBody(body io.Reader, wr io.Writer) (int64, bool, error) {
+	return 0, false, fmt.Errorf("body failed")
+}
+
+func TestFilterBodyChain(t *testing.T) {
+	out := new(bytes.Buffer)
+	body := strings.Repeat("abc\n", 10000)
+	n, err := filterBody([]ArticleFilter{upperFilter{}, &HeaderFilter{}, upperFilter{}}, strings.NewReader(body), out)
+	if err != nil {
+		t.Logf("filter chain failed: %s", err)
+		t.FailNow()
+	}
+	if n != int64(len(body)) || out.String() != strings.ToUpper(body) {
+		t.Logf("filter chain output wrong, %d bytes", n)
+		t.Fail()
+	}
+
+	out.Reset()
+	_, err = filterBody([]ArticleFilter{upperFilter{}, failFilter{}, upperFilter{}}, strings.NewReader(body), out)
+	if err == nil || err.Error() != "body failed" {
+		t.Logf("filter chain gave wrong error: %v", err)
+		t.Fail()
+	}
+
+	_, err = filterHeader([]ArticleFilter{&HeaderFilter{}, failFilter{}}, message.Header{})
+	if err == nil {
+		t.Log("header filter chain did not fail")
+		t.Fail()
+	}
+}
+
+func TestExecFilter(t *testing.T) {
+	_, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	dir, err := ioutil.TempDir("", "srnd-filter")
+	if err != nil {
+		t.Logf("failed to make temp dir: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "filter.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\ncat\n"), 0700)
+	if err != nil {
+		t.Logf("failed to write script: %s", err)
+		t.FailNow()
+	}
+	runner := process.NewRunner(0)
+	runner.Timeout = 200 * time.Millisecond
+	runner.Env = []string{"PATH=/bin:/usr/bin"}
+	f, err := NewFilter(&config.FilterConfig{
+		Name: "cat",
+		Type: "exec",
+		Exec: script,
+	}, runner)
+	if err != nil {
+		t.Logf("failed to create filter: %s", err)
+		t.FailNow()
+	}
+	hdr, err := f.FilterHeader(message.Header{"Subject": {"test"}})
+	if err != nil || hdr.Get("Subject", "") != "test" {
+		t.Logf("exec header filter failed: %v %v", err, hdr)
+		t.Fail()
+	}
+	out := new(bytes.Buffer)
+	n, modified, err := f.FilterAndWriteBody(strings.NewReader("hello\n"), out)
+	if err != nil || modified || n != 6 || out.String() != "hello\n" {
+		t.Logf("exec body filter failed: err=%v modified=%v n=%d", err, modified, n)
+		t.Fail()
+	}
+
+	// filters that hang are killed
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 10\n"), 0700)
+	if err != nil {
+		t.Logf("failed to write script: %s", err)
+		t.FailNow()
+	}
+	out.Reset()
+	_, _, err = f.FilterAndWriteBody(strings.NewReader("hello\n"), out)
+	if err != process.ErrTimeout || out.Len() != 0 {
+		t.Logf("hanging body filter gave %v and wrote %q", err, out.String())
+		t.Fail()
+	}
+}
+
+func TestNewFilterUnknown(t *testing.T) {
+	_, err := NewFilter(&config.FilterConfig{Type: "nope"}, nil)
+	if err != ErrUnknownFilter {
+		t.Logf("unknown filter type gave %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,88 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"strings"
+	"time"
+)
+
+// filter that strips or rewrites article headers
+// implements ArticleFilter
+type HeaderFilter struct {
+	passBody
+	// headers to remove entirely
+	Strip []string
+	// headers to replace the value of if they are present
+	Rewrite map[string]string
+}
+
+func (f *HeaderFilter) FilterHeader(hdr message.Header) (message.Header, error) {
+	for _, key := range f.Strip {
+		for k := findHeaderKey(hdr, key); k != ""; k = findHeaderKey(hdr, key) {
+			delete(hdr, k)
+		}
+	}
+	for key, val := range f.Rewrite {
+		k := findHeaderKey(hdr, key)
+		if k != "" {
+			hdr.Set(k, val)
+		}
+	}
+	return hdr, nil
+}
+
+// date formats we accept in the Date header
+var dateFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC850,
+	time.ANSIC,
+	time.UnixDate,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+}
+
+// parse a date header value in any of the formats we know
+func parseDate(str string) (t time.Time, ok bool) {
+	str = strings.TrimSpace(str)
+	// strip trailing comment, i.e. "(UTC)"
+	if idx := strings.Index(str, " ("); idx > 0 {
+		str = str[:idx]
+	}
+	var err error
+	for _, format := range dateFormats {
+		t, err = time.Parse(format, str)
+		if err == nil {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// filter that rewrites the Date header into RFC 1123 format in UTC
+// articles without a parsable date get the current time
+// relayed articles no longer match the copies other servers have once it is applied
+// implements ArticleFilter
+type DateFilter struct {
+	passBody
+}
+
+func (DateFilter) FilterHeader(hdr message.Header) (message.Header, error) {
+	t := time.Now()
+	k := findHeaderKey(hdr, "Date")
+	if k != "" {
+		parsed, ok := parseDate(hdr.Get(k, ""))
+		if ok {
+			t = parsed
+		}
+		delete(hdr, k)
+	}
+	hdr.Set("Date", t.UTC().Format(time.RFC1123Z))
+	return hdr, nil
+}
@@ -1,25 +1,37 @@
 package nntp
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
 	"github.com/majestrate/srndv2/lib/config"
-	"os/exec"
+	"github.com/majestrate/srndv2/lib/process"
 )
 
 type Hook struct {
-	cfg *config.NNTPHookConfig
+	cfg    *config.NNTPHookConfig
+	runner *process.Runner
 }
 
-func NewHook(cfg *config.NNTPHookConfig) *Hook {
+// create a hook that runs its program with runner, nil for process.DefaultRunner
+func NewHook(cfg *config.NNTPHookConfig, runner *process.Runner) *Hook {
+	if runner == nil {
+		runner = process.DefaultRunner
+	}
 	return &Hook{
-		cfg: cfg,
+		cfg:    cfg,
+		runner: runner,
 	}
 }
 
+// run the hook's program in the background so ingest does not wait on it
+// the runner's slots bound how many run at once
 func (h *Hook) GotArticle(msgid MessageID, group Newsgroup) {
-	c := exec.Command(h.cfg.Exec, group.String(), msgid.String())
+	go h.run(msgid, group)
+}
+
+func (h *Hook) run(msgid MessageID, group Newsgroup) {
 	log.Infof("calling hook %s", h.cfg.Name)
-	err := c.Run()
+	_, err := h.runner.Run(context.Background(), h.cfg.Exec, []string{group.String(), msgid.String()}, nil)
 	if err != nil {
 		log.Errorf("error in nntp hook %s: %s", h.cfg.Name, err.Error())
 	}
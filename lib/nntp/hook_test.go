@@ -0,0 +1,56 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/process"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHookInBackground(t *testing.T) {
+	_, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	dir, err := ioutil.TempDir("", "srnd-hook")
+	if err != nil {
+		t.Logf("failed to make temp dir: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "hook.sh")
+	done := filepath.Join(dir, "done")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 1\necho \"$1 $2\" > "+done+"\n"), 0700)
+	if err != nil {
+		t.Logf("failed to write script: %s", err)
+		t.FailNow()
+	}
+	runner := process.NewRunner(1)
+	runner.Env = []string{"PATH=/bin:/usr/bin"}
+	h := NewHook(&config.NNTPHookConfig{Name: "test", Exec: script}, runner)
+
+	// ingest must not wait on the program
+	started := time.Now()
+	h.GotArticle(MessageID("<test@localhost>"), Newsgroup("overchan.test"))
+	if time.Since(started) > 500*time.Millisecond {
+		t.Logf("hook blocked for %s", time.Since(started))
+		t.Fail()
+	}
+
+	var data []byte
+	for i := 0; i < 50; i++ {
+		data, err = ioutil.ReadFile(done)
+		if err == nil && len(data) > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if string(data) != "overchan.test <test@localhost>\n" {
+		t.Logf("hook did not run: %q %v", data, err)
+		t.Fail()
+	}
+}
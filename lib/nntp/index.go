@@ -0,0 +1,235 @@
+package nntp
+
+import (
+	"bytes"
+	"encoding/base64"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/util"
+	"io"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+)
+
+// keeps track of stored articles and their attachments
+type ArticleIndex interface {
+	// remember an article and its attachments, replacing any earlier entry for it
+	RegisterArticle(a *model.Article) error
+	// forget an article and its attachments
+	DeleteArticle(msgid string) error
+	// get the file names of the attachments of an article
+	ArticleAttachments(msgid string) ([]string, error)
+	// count the articles that have an attachment with this file name
+	CountAttachmentRefs(filename string) (int64, error)
+}
+
+// forgets the thumbnails of attachments that are deleted
+type thumbnailIndex interface {
+	// forget the thumbnail made for an attachment
+	DeleteThumbnail(filename string) error
+}
+
+// thumbnails attachments after they are stored
+type ThumbnailQueue interface {
+	// queue a stored attachment to be thumbnailed without waiting for it
+	Enqueue(filename string) error
+}
+
+// queue every attachment of a stored article to be thumbnailed
+func enqueueThumbnails(q ThumbnailQueue, a *model.Article) {
+	for _, att := range a.Attachments {
+		err := q.Enqueue(att.Path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pkg":      "nntp-index",
+				"msgid":    a.MessageID,
+				"filename": att.Path,
+			}).Warn("attachment not queued for thumbnailing ", err)
+		}
+	}
+}
+
+// where the attachments of an article are stored
+type attachmentStore interface {
+	StoreAttachment(r io.Reader, filename string) (string, error)
+}
+
+// make the index entry for an article from its header
+func articleFromHeader(hdr message.Header) *model.Article {
+	a := &model.Article{
+		MessageID: hdr.MessageID(),
+		Newsgroup: hdr.Newsgroup(),
+		Reference: hdr.Reference(),
+		Subject:   hdr.Get("Subject", ""),
+		Name:      hdr.Get("From", ""),
+		Path:      hdr.Get("Path", ""),
+		Addr:      hdr.Get(EncAddrHeader, ""),
+		Header:    hdr,
+	}
+	if t, ok := parseDate(hdr.Get("Date", "")); ok {
+		a.Posted = t.Unix()
+	}
+	return a
+}
+
+// read the body of an article, storing every attachment in it
+// returns the plain text of the article and the attachments that were stored
+// always reads the body to the end
+func storeAttachments(storage attachmentStore, hdr message.Header, body io.Reader) (text string, atts []model.Attachment, err error) {
+	txt := new(bytes.Buffer)
+	if hdr.IsMultipart() {
+		var params map[string]string
+		_, params, err = hdr.GetMediaType()
+		boundary, ok := params["boundary"]
+		if err == nil && ok {
+			part_r := multipart.NewReader(body, boundary)
+			for err == nil {
+				var part *multipart.Part
+				part, err = part_r.NextPart()
+				if err == io.EOF {
+					// we done
+					err = nil
+					break
+				} else if err != nil {
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-index",
+						"msgid": hdr.MessageID(),
+					}).Error("error reading part ", err)
+					break
+				}
+				var att *model.Attachment
+				att, err = storePart(storage, part, txt)
+				if err == nil && att != nil {
+					atts = append(atts, *att)
+				} else if err != nil {
+					log.WithFields(log.Fields{
+						"pkg":   "nntp-index",
+						"msgid": hdr.MessageID(),
+					}).Error("bad attachment in multipart message ", err)
+				}
+				err = nil
+				part.Close()
+			}
+		}
+	} else if hdr.IsSigned() {
+		// signed message, discard for now
+		_, err = io.Copy(util.Discard, body)
+	} else {
+		// plaintext message
+		_, err = io.Copy(txt, body)
+	}
+	// drain whatever is left so the writer never blocks
+	io.Copy(util.Discard, body)
+	if err == io.EOF {
+		err = nil
+	}
+	text = txt.String()
+	return
+}
+
+// store one part of a multipart article
+// text parts are appended to txt, returns nil attachment for them
+func storePart(storage attachmentStore, part *multipart.Part, txt io.Writer) (att *model.Attachment, err error) {
+	part_hdr := part.Header
+	// check for base64 encoding
+	var part_body io.Reader = part
+	if part_hdr.Get("Content-Transfer-Encoding") == "base64" {
+		part_body = base64.NewDecoder(base64.StdEncoding, part)
+	}
+	// get content type
+	content_type := part_hdr.Get("Content-Type")
+	if len(content_type) == 0 {
+		// assume text/plain
+		content_type = "text/plain; charset=UTF8"
+	}
+	var part_type string
+	// extract mime type
+	part_type, _, err = mime.ParseMediaType(content_type)
+	if err != nil {
+		return
+	}
+	if part_type == "text/plain" {
+		_, err = io.Copy(txt, part_body)
+		return
+	}
+	var fpath string
+	fname := part.FileName()
+	fpath, err = storage.StoreAttachment(part_body, fname)
+	if err == nil && fpath != "" {
+		log.WithFields(log.Fields{
+			"pkg":      "nntp-index",
+			"filename": fname,
+			"filepath": fpath,
+		}).Debug("attachment stored")
+		stored := filepath.Base(fpath)
+		att = &model.Attachment{
+			Path: stored,
+			Name: fname,
+			Mime: part_type,
+			Hash: strings.TrimSuffix(stored, filepath.Ext(stored)),
+		}
+	}
+	return
+}
+
+// delete an article from storage and the index
+// frees the attachments no other article refers to, returns how many were freed
+// attachments stored again recently are left for garbage collection
+// index may be nil in which case attachments are left for garbage collection
+func DeleteStoredArticle(storage store.Storage, index ArticleIndex, msgid string) (freed int64, err error) {
+	var files []string
+	if index != nil {
+		files, err = index.ArticleAttachments(msgid)
+		if err != nil {
+			return
+		}
+	}
+	err = storage.DeleteArticle(msgid)
+	if err == nil && index != nil {
+		err = index.DeleteArticle(msgid)
+	}
+	if err == nil && index != nil {
+		freed = freeAttachments(storage, index, files)
+	}
+	return
+}
+
+// delete the attachments no article in the index refers to and their thumbnails
+// ones stored again recently may belong to an article not indexed yet and are kept
+// returns how many were deleted
+func freeAttachments(storage store.Storage, index ArticleIndex, files []string) (freed int64) {
+	seen := make(map[string]bool)
+	for _, fname := range files {
+		if seen[fname] {
+			continue
+		}
+		seen[fname] = true
+		refs, err := index.CountAttachmentRefs(fname)
+		if err == nil && refs == 0 {
+			err = storage.DeleteOldAttachment(fname, store.MinGarbageAge)
+			if err == nil {
+				freed++
+			}
+			if err == nil || err == store.ErrNoSuchAttachment {
+				err = nil
+				// storage removed the thumbnail file with the attachment
+				if thumbs, ok := index.(thumbnailIndex); ok {
+					err = thumbs.DeleteThumbnail(fname)
+				}
+			} else if err == store.ErrRecentAttachment {
+				err = nil
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pkg":      "nntp-index",
+				"filename": fname,
+			}).Error("failed to free attachment ", err)
+		}
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package nntp
+
+import (
+	"errors"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/util"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrTooManyConns = errors.New("too many connections")
+var ErrTooManyConnsFromIP = errors.New("too many connections from your address")
+
+// counts inbound connections globally and per ip address
+type connTracker struct {
+	access sync.Mutex
+	total  int
+	perIP  map[string]int
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		perIP: make(map[string]int),
+	}
+}
+
+// get the ip address part of a remote address
+func addrIP(addr net.Addr) string {
+	return util.AddrIP(addr.String())
+}
+
+// count a new connection if it is within limits
+// returns an error saying which limit was hit otherwise
+func (t *connTracker) acquire(addr net.Addr, limits *config.LimitsConfig) error {
+	ip := addrIP(addr)
+	t.access.Lock()
+	defer t.access.Unlock()
+	if limits != nil {
+		if limits.MaxConns > 0 && t.total >= limits.MaxConns {
+			return ErrTooManyConns
+		}
+		if limits.MaxConnsPerIP > 0 && t.perIP[ip] >= limits.MaxConnsPerIP {
+			return ErrTooManyConnsFromIP
+		}
+	}
+	t.total++
+	t.perIP[ip]++
+	return nil
+}
+
+// stop counting a connection
+func (t *connTracker) release(addr net.Addr) {
+	ip := addrIP(addr)
+	t.access.Lock()
+	t.total--
+	t.perIP[ip]--
+	if t.perIP[ip] <= 0 {
+		delete(t.perIP, ip)
+	}
+	t.access.Unlock()
+}
+
+// token bucket rate limiter
+type tokenBucket struct {
+	access sync.Mutex
+	// tokens added per second
+	rate float64
+	// max tokens held
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// create a full token bucket
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// add tokens for the time passed since last refill
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// take n tokens, going into debt if there are not enough
+// returns how long to wait until the debt is paid
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// net.Conn that enforces read deadlines and a read rate limit
+type limitedConn struct {
+	net.Conn
+	// deadline for each read, 0 for none
+	timeout time.Duration
+	// deadline for all reads until it is changed, zero for none
+	// stops peers that send a byte just often enough to never hit timeout
+	deadline time.Time
+	// set once a read times out, every read after fails with it
+	err error
+	// read rate limit, nil for none
+	rate *tokenBucket
+}
+
+func newLimitedConn(c net.Conn, limits *config.LimitsConfig) *limitedConn {
+	lc := &limitedConn{
+		Conn: c,
+	}
+	if limits != nil && limits.BytesPerSecond > 0 {
+		lc.rate = newTokenBucket(float64(limits.BytesPerSecond), float64(limits.BytesPerSecond))
+	}
+	return lc
+}
+
+func (c *limitedConn) Read(d []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	deadline := c.deadline
+	if c.timeout > 0 {
+		next := time.Now().Add(c.timeout)
+		if deadline.IsZero() || next.Before(deadline) {
+			deadline = next
+		}
+	}
+	c.Conn.SetReadDeadline(deadline)
+	n, err = c.Conn.Read(d)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.err = err
+	}
+	if n > 0 && c.rate != nil {
+		time.Sleep(c.rate.reserve(n))
+	}
+	return
+}
+
+// create the article rate limiter for a connection, nil for no limit
+func newArticleLimiter(limits *config.LimitsConfig) *tokenBucket {
+	if limits == nil || limits.ArticlesPerMinute <= 0 {
+		return nil
+	}
+	return newTokenBucket(float64(limits.ArticlesPerMinute)/60.0, float64(limits.ArticlesPerMinute))
+}
@@ -0,0 +1,171 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/config"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnTracker(t *testing.T) {
+	limits := &config.LimitsConfig{
+		MaxConns:      3,
+		MaxConnsPerIP: 2,
+	}
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+	tr := newConnTracker()
+	if tr.acquire(a, limits) != nil || tr.acquire(a, limits) != nil {
+		t.Log("connections under limit refused")
+		t.FailNow()
+	}
+	if tr.acquire(a, limits) != ErrTooManyConnsFromIP {
+		t.Log("per ip limit not enforced")
+		t.Fail()
+	}
+	if tr.acquire(b, limits) != nil {
+		t.Log("connection from other ip refused")
+		t.Fail()
+	}
+	if tr.acquire(b, limits) != ErrTooManyConns {
+		t.Log("global limit not enforced")
+		t.Fail()
+	}
+	tr.release(a)
+	if tr.acquire(b, limits) != nil {
+		t.Log("released connection still counted")
+		t.Fail()
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1, 2)
+	if !b.allow() || !b.allow() {
+		t.Log("burst not allowed")
+		t.Fail()
+	}
+	if b.allow() {
+		t.Log("allowed over burst")
+		t.Fail()
+	}
+	if b.reserve(1) <= 0 {
+		t.Log("no wait when bucket is empty")
+		t.Fail()
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServer()
+	s.Config = &config.NNTPServerConfig{
+		Limits: &config.LimitsConfig{IdleTimeout: 1},
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	nc := newInboundConn(s, server)
+	done := make(chan bool)
+	go func() {
+		nc.ProcessInbound(s)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Log("idle connection not closed")
+		t.Fail()
+	}
+}
+
+func TestArticleRateLimit(t *testing.T) {
+	msgid := GenMessageID("test.tld")
+	article := "Message-ID: " + msgid.String() + "\r\nNewsgroups: overchan.test\r\n\r\nhello\r\n.\r\n"
+	c, st := newTestConn("", nil)
+	rwc := &testRWC{Reader: strings.NewReader("IHAVE " + msgid.String() + "\r\n" + article + "IHAVE <other@test.tld>\r\n")}
+	c.C = textproto.NewConn(rwc)
+	c.limits = &config.LimitsConfig{ArticlesPerMinute: 1}
+	c.articles = newArticleLimiter(c.limits)
+	c.cmds = map[string]lineHandlerFunc{
+		"IHAVE": nntpRecvArticle,
+	}
+	c.Process(nil)
+	if _, ok := st.articles[msgid.String()]; !ok {
+		t.Log("first article not stored")
+		t.Fail()
+	}
+	lines := strings.Split(strings.TrimSpace(rwc.out.String()), "\r\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], RPL_TransferDefer) {
+		t.Logf("second article not deferred: %q", lines)
+		t.Fail()
+	}
+}
+
+func TestReadArticleTruncated(t *testing.T) {
+	c, st := newTestConn("Message-ID: <truncated@test.tld>\r\nNewsgroups: overch", nil)
+	status, err := c.readArticle(false, nil)
+	if status.Accept() || err == nil {
+		t.Logf("truncated article gave %s %v", status, err)
+		t.Fail()
+	}
+	if len(st.articles) > 0 {
+		t.Log("truncated article stored")
+		t.Fail()
+	}
+	c, st = newTestConn("Message-ID: <truncated@test.tld>\r\nNewsgroups: overchan.test\r\n\r\nhel", nil)
+	status, err = c.readArticle(false, nil)
+	if status.Accept() || err == nil {
+		t.Logf("truncated body gave %s %v", status, err)
+		t.Fail()
+	}
+	if len(st.articles) > 0 {
+		t.Log("truncated body stored")
+		t.Fail()
+	}
+}
+
+func TestTrickleTimeout(t *testing.T) {
+	s := NewServer()
+	s.Config = &config.NNTPServerConfig{
+		Limits: &config.LimitsConfig{IdleTimeout: 1, ReadTimeout: 1, ArticleTimeout: 1},
+	}
+	for _, input := range []string{
+		// a command line that never ends
+		"MODE READER",
+		// an article that never ends
+		"IHAVE <trickle@test.tld>\r\nMessage-ID: <trickle@test.tld>\r\nNewsgroups: overchan.test\r\n\r\n",
+	} {
+		server, client := net.Pipe()
+		nc := newInboundConn(s, server)
+		done := make(chan bool)
+		go func() {
+			nc.ProcessInbound(s)
+			done <- true
+		}()
+		go func() {
+			// read replies so writes to the client do not block
+			buff := make([]byte, 1024)
+			for {
+				if _, err := client.Read(buff); err != nil {
+					return
+				}
+			}
+		}()
+		client.Write([]byte(input))
+		stop := time.After(time.Second * 5)
+		closed := false
+		for !closed {
+			select {
+			case <-done:
+				closed = true
+			case <-stop:
+				t.Logf("trickling connection not closed after %q", input)
+				t.Fail()
+				closed = true
+			case <-time.After(time.Millisecond * 200):
+				// a byte well within the read timeout
+				client.Write([]byte("x"))
+			}
+		}
+		client.Close()
+	}
+}
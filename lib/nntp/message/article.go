@@ -1,11 +1,127 @@
 package message
 
+import (
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
 // an nntp article
 type Article struct {
 
 	// the article's mime header
 	Header Header
 
+	// plaintext body of the article
+	Text string
+
+	// attachments of the article
+	Attachments []*Attachment
+
 	// unexported fields ...
 
 }
+
+// write the body of this article to an io.Writer
+// sets the Content-Type and Mime-Version headers to match the body written
+// so it must be called before the header is written
+// attachment bodies are read to the end and closed
+func (a *Article) WriteBody(w io.Writer) (err error) {
+	if a.Header == nil {
+		a.Header = make(Header)
+	}
+	a.Header.Set("Mime-Version", "1.0")
+	text := strings.Replace(a.Text, "\r\n", "\n", -1)
+	if len(a.Attachments) == 0 {
+		// plaintext article
+		a.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+		_, err = io.WriteString(w, text)
+		return
+	}
+	defer a.closeAttachments()
+	mw := multipart.NewWriter(w)
+	a.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	var pw io.Writer
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=UTF-8"},
+	})
+	if err == nil {
+		_, err = io.WriteString(pw, text)
+	}
+	for _, att := range a.Attachments {
+		if err != nil {
+			return
+		}
+		pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {att.Mime},
+			"Content-Disposition":       {`attachment; filename="` + escapeQuotes(att.FileName) + `"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err == nil {
+			lw := &lineWriter{w: pw}
+			enc := base64.NewEncoder(base64.StdEncoding, lw)
+			_, err = io.Copy(enc, att.Body)
+			if err == nil {
+				err = enc.Close()
+			}
+			if err == nil {
+				err = lw.Close()
+			}
+		}
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	return
+}
+
+// close all attachment bodies
+func (a *Article) closeAttachments() {
+	for _, att := range a.Attachments {
+		if att.Body != nil {
+			att.Body.Close()
+		}
+	}
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// io.WriteCloser that wraps lines at 76 characters
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWriter) Write(d []byte) (n int, err error) {
+	for len(d) > 0 && err == nil {
+		l := 76 - lw.col
+		if l > len(d) {
+			l = len(d)
+		}
+		var written int
+		written, err = lw.w.Write(d[:l])
+		n += written
+		lw.col += written
+		d = d[written:]
+		if lw.col == 76 && err == nil {
+			_, err = lw.w.Write([]byte{10})
+			lw.col = 0
+		}
+	}
+	return
+}
+
+// terminate the last line
+func (lw *lineWriter) Close() (err error) {
+	if lw.col > 0 {
+		_, err = lw.w.Write([]byte{10})
+		lw.col = 0
+	}
+	return
+}
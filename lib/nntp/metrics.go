@@ -0,0 +1,58 @@
+package nntp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+)
+
+// max number of newsgroups that get their own metrics label
+// anyone can make up new groups so the rest are counted as "other"
+const maxGroupLabels = 256
+
+var articlesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "nntp_articles_received_total",
+	Help: "Articles received and stored by newsgroup and feed.",
+}, []string{"group", "feed"})
+
+var policyResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "nntp_policy_results_total",
+	Help: "Policy results of articles read from connections.",
+}, []string{"status"})
+
+var activeConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "nntp_connections",
+	Help: "Open nntp connections by direction.",
+}, []string{"direction"})
+
+var expiredArticles = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "nntp_articles_expired_total",
+	Help: "Articles removed by expiry by newsgroup.",
+}, []string{"group"})
+
+// newsgroups that have their own metrics label
+type groupLabels struct {
+	access sync.Mutex
+	max    int
+	groups map[string]bool
+}
+
+var metricGroups = &groupLabels{
+	max:    maxGroupLabels,
+	groups: make(map[string]bool),
+}
+
+// get the metrics label for a newsgroup
+// the first groups seen keep their name, after that new groups are "other"
+func (l *groupLabels) label(group string) string {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.groups[group] {
+		return group
+	}
+	if len(l.groups) >= l.max {
+		return "other"
+	}
+	l.groups[group] = true
+	return group
+}
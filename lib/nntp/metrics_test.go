@@ -0,0 +1,27 @@
+package nntp
+
+import (
+	"testing"
+)
+
+func TestGroupLabels(t *testing.T) {
+	l := &groupLabels{
+		max:    2,
+		groups: make(map[string]bool),
+	}
+	for _, tc := range []struct {
+		group, label string
+	}{
+		{"overchan.a", "overchan.a"},
+		{"overchan.b", "overchan.b"},
+		{"overchan.spam1", "other"},
+		{"overchan.a", "overchan.a"},
+		{"overchan.spam2", "other"},
+	} {
+		label := l.label(tc.group)
+		if label != tc.label {
+			t.Logf("label of %s is %s not %s", tc.group, label, tc.label)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package nntp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/store"
+	"github.com/majestrate/srndv2/lib/util"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrInvalidNewsgroup = errors.New("invalid newsgroup")
+var ErrInvalidReference = errors.New("invalid reference")
+var ErrInvalidAddr = errors.New("invalid poster address")
+
+// a locally posted article waiting to be submitted to the server
+type PendingArticle struct {
+	// the article's header after filters
+	Header message.Header
+	// the article's body after filters
+	Body []byte
+	// proof of work difficulty this article should be posted with
+	Bits int
+	// address of the poster, put encrypted into the article when posted
+	Addr string
+}
+
+// get the message-id of this article
+func (p *PendingArticle) MessageID() MessageID {
+	return MessageID(p.Header.MessageID())
+}
+
+// get the newsgroup this article is posted to
+func (p *PendingArticle) Newsgroup() Newsgroup {
+	return Newsgroup(p.Header.Newsgroup())
+}
+
+// get the date header of this article
+func (p *PendingArticle) Date() string {
+	return p.Header.Get("Date", "")
+}
+
+// get the digest of this article's body used for proof of work
+func (p *PendingArticle) BodyDigest() []byte {
+	return PoWBodyDigest(p.Body)
+}
+
+// compute a proof of work for this article and set it in the header
+// blocks until done
+func (p *PendingArticle) SolvePoW() {
+	if p.Bits > 0 {
+		p.Header.Set(PoWHeader, SolvePoW(p.MessageID(), p.Date(), p.BodyDigest(), p.Bits))
+	}
+}
+
+// set a proof of work nonce computed elsewhere
+// returns false and leaves the article as is if the nonce is not good enough
+func (p *PendingArticle) SetPoW(nonce string) bool {
+	if !CheckPoW(p.MessageID(), p.Date(), p.BodyDigest(), nonce, p.Bits) {
+		return false
+	}
+	p.Header.Set(PoWHeader, nonce)
+	return true
+}
+
+// make a header value safe to put in an article
+func headerValue(str string) string {
+	return strings.TrimSpace(headerEscaper.Replace(str))
+}
+
+var headerEscaper = strings.NewReplacer("\r", " ", "\n", " ")
+
+// create a new article posted on this server
+// reference is the message-id of the thread being replied to or empty for a new thread
+func (s *Server) NewArticle(group, reference, name, subject, text string) *message.Article {
+	name = headerValue(name)
+	if name == "" {
+		name = "Anonymous"
+	}
+	subject = headerValue(subject)
+	if subject == "" {
+		subject = "None"
+	}
+	hdr := message.Header{}
+	hdr.Set("Newsgroups", headerValue(group))
+	hdr.Set("From", fmt.Sprintf("%s <poster@%s>", name, s.Name()))
+	hdr.Set("Subject", subject)
+	if reference != "" {
+		hdr.Set("References", headerValue(reference))
+	}
+	return &message.Article{
+		Header: hdr,
+		Text:   text,
+	}
+}
+
+// get the proof of work difficulty in bits for posts to a newsgroup
+func (s *Server) PoWBits(group string) int {
+	if s.Config == nil || s.Config.PoW == nil {
+		return 0
+	}
+	return s.Config.PoW.BitsFor(group)
+}
+
+// get which articles get metadata stripped from their images, nil for none
+func (s *Server) metadataConfig() *config.MetadataConfig {
+	if s.Config == nil {
+		return nil
+	}
+	return s.Config.Metadata
+}
+
+// prepare an article posted on this server for submission
+// sets message-id and date if they are missing, runs filters and computes the
+// proof of work difficulty for the article, the proof of work itself is not done
+func (s *Server) PrepareArticle(a *message.Article) (p *PendingArticle, err error) {
+	body := new(bytes.Buffer)
+	err = a.WriteBody(body)
+	if err != nil {
+		return
+	}
+	hdr := a.Header
+	if !Newsgroup(hdr.Newsgroup()).Valid() {
+		err = ErrInvalidNewsgroup
+		return
+	}
+	if ref := hdr.Get("References", ""); ref != "" && !MessageID(ref).Valid() {
+		err = ErrInvalidReference
+		return
+	}
+	if hdr.MessageID() == "" {
+		hdr.Set("Message-ID", GenMessageID(s.Name()).String())
+	}
+	if !hdr.Has("Date") {
+		hdr.Set("Date", time.Now().UTC().Format(time.RFC1123Z))
+	}
+	// metadata is stripped here so the proof of work covers the stripped body
+	filters := withMetadataFilter(s.Filters, s.metadataConfig(), hdr, true)
+	hdr, err = filterHeader(filters, hdr)
+	if err != nil {
+		return
+	}
+	out := new(bytes.Buffer)
+	_, err = filterBody(filters, body, out)
+	if err != nil {
+		return
+	}
+	p = &PendingArticle{
+		Header: hdr,
+		// articles are relayed with LF line endings, so the proof of work must be too
+		Body: bytes.Replace(out.Bytes(), []byte("\r\n"), []byte("\n"), -1),
+		Bits: s.PoWBits(hdr.Newsgroup()),
+	}
+	return
+}
+
+// submit a prepared article posted on this server
+// stores the article and sends it to our feeds
+// returns the policy status of the article and an error if one occurred
+func (s *Server) PostArticle(p *PendingArticle) (PolicyStatus, error) {
+	if p.Addr != "" && s.Addrs != nil {
+		// record the poster's address so only we can decrypt it
+		key, encaddr := util.NewAddrEnc(p.Addr)
+		if encaddr == "" {
+			return PolicyReject, ErrInvalidAddr
+		}
+		err := s.Addrs.RegisterEncAddr(p.MessageID().String(), encaddr, key)
+		if err != nil {
+			return PolicyDefer, err
+		}
+		p.Header.Set(EncAddrHeader, encaddr)
+	}
+	storage := s.Storage
+	if storage == nil {
+		storage = store.NewNullStorage()
+	}
+	c := &v1Conn{
+		state: ConnState{
+			FeedName: "local",
+			ConnName: "local",
+			Open:     true,
+		},
+		authenticated: true,
+		trusted:       true,
+		serverName:    s.Name(),
+		storage:       storage,
+		index:         s.Index,
+		acceptor:      s.Acceptor,
+		thumbnails:    s.Thumbnails,
+		hdrio:         message.NewHeaderIO(),
+	}
+	r, w := io.Pipe()
+	go func() {
+		err := c.hdrio.WriteHeader(p.Header, w)
+		if err == nil {
+			_, err = w.Write(p.Body)
+		}
+		w.CloseWithError(err)
+	}()
+	defer r.Close()
+	return c.readArticleFrom(r, false, s)
+}
@@ -0,0 +1,51 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"strings"
+	"testing"
+)
+
+// thumbnail queue that remembers what was queued
+type testThumbnails []string
+
+func (q *testThumbnails) Enqueue(filename string) error {
+	*q = append(*q, filename)
+	return nil
+}
+
+func TestPostArticleQueuesThumbnails(t *testing.T) {
+	st := &memStore{articles: make(map[string][]byte)}
+	thumbs := new(testThumbnails)
+	s := NewServer()
+	s.Storage = st
+	s.Thumbnails = thumbs
+	s.Config = &config.NNTPServerConfig{
+		Name: "test.tld",
+	}
+	go func() {
+		for range s.send {
+		}
+	}()
+	a := s.NewArticle("overchan.test", "", "", "test", "hello")
+	a.Attachments = append(a.Attachments, &message.Attachment{
+		Mime:     "image/jpeg",
+		FileName: "a.jpg",
+		Body:     nopCloser{strings.NewReader(string(testJpeg(false)))},
+	})
+	p, err := s.PrepareArticle(a)
+	if err != nil {
+		t.Logf("failed to prepare article: %s", err)
+		t.FailNow()
+	}
+	status, err := s.PostArticle(p)
+	if err != nil || !status.Accept() {
+		t.Logf("article not accepted: %s %v", status, err)
+		t.FailNow()
+	}
+	if len(*thumbs) != 1 || !strings.HasSuffix((*thumbs)[0], ".jpg") {
+		t.Logf("thumbnail jobs queued for posted article: %q", *thumbs)
+		t.Fail()
+	}
+}
@@ -0,0 +1,72 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/crypto"
+	"io"
+	"strconv"
+)
+
+// header holding an article's proof of work nonce
+const PoWHeader = "X-Proof-Of-Work"
+
+// hashcash style proof of work over an article
+// the work is a hash of the message-id, the date header, the hash of the body
+// and a nonce, which must have at least the required number of leading zero bits
+//
+// the body hash is the hash of the article body exactly as it is stored,
+// i.e. after dot decoding with LF line endings
+
+// compute the digest of an article body for proof of work
+func PoWBodyDigest(body []byte) []byte {
+	h := crypto.Hash()
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// compute the proof of work hash for an article given a nonce
+func powHash(msgid MessageID, date string, bodyDigest []byte, nonce string) []byte {
+	h := crypto.Hash()
+	io.WriteString(h, msgid.String())
+	h.Write([]byte{0})
+	io.WriteString(h, date)
+	h.Write([]byte{0})
+	h.Write(bodyDigest)
+	h.Write([]byte{0})
+	io.WriteString(h, nonce)
+	return h.Sum(nil)
+}
+
+// count leading zero bits in a digest
+func leadingZeroBits(d []byte) (n int) {
+	for _, b := range d {
+		if b == 0 {
+			n += 8
+			continue
+		}
+		for b&0x80 == 0 {
+			n++
+			b <<= 1
+		}
+		break
+	}
+	return
+}
+
+// check if a nonce is a valid proof of work of at least bits difficulty
+func CheckPoW(msgid MessageID, date string, bodyDigest []byte, nonce string, bits int) bool {
+	if len(nonce) == 0 || len(nonce) > 64 {
+		return false
+	}
+	return leadingZeroBits(powHash(msgid, date, bodyDigest, nonce)) >= bits
+}
+
+// find a nonce that is a valid proof of work of at least bits difficulty
+// blocks until found, expected work is 2^bits hashes
+func SolvePoW(msgid MessageID, date string, bodyDigest []byte, bits int) (nonce string) {
+	for n := uint64(0); ; n++ {
+		nonce = strconv.FormatUint(n, 16)
+		if CheckPoW(msgid, date, bodyDigest, nonce, bits) {
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/util"
+	"strings"
+	"testing"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	cases := map[string]int{
+		"\x80":         0,
+		"\x01":         7,
+		"\x00\x00\x10": 19,
+		"\x00\x00":     16,
+	}
+	for d, n := range cases {
+		if leadingZeroBits([]byte(d)) != n {
+			t.Logf("%q has %d leading zero bits not %d", d, leadingZeroBits([]byte(d)), n)
+			t.Fail()
+		}
+	}
+}
+
+func TestSolvePoW(t *testing.T) {
+	msgid := MessageID("<test@test.tld>")
+	date := "Mon, 02 Jan 2006 15:04:05 +0000"
+	digest := PoWBodyDigest([]byte("hello\n"))
+	nonce := SolvePoW(msgid, date, digest, 10)
+	if !CheckPoW(msgid, date, digest, nonce, 10) {
+		t.Logf("solved nonce %q does not verify", nonce)
+		t.FailNow()
+	}
+	if CheckPoW(msgid, date, PoWBodyDigest([]byte("goodbye\n")), nonce, 10) && CheckPoW(msgid, "", digest, nonce, 10) {
+		t.Log("nonce verifies for a different article")
+		t.Fail()
+	}
+	if CheckPoW(msgid, date, digest, "", 0) {
+		t.Log("empty nonce verifies")
+		t.Fail()
+	}
+}
+
+func TestReadArticleRequiresPoW(t *testing.T) {
+	msgid := GenMessageID("test.tld")
+	date := "Mon, 02 Jan 2006 15:04:05 +0000"
+	nonce := SolvePoW(msgid, date, PoWBodyDigest([]byte("hello\n")), 8)
+	article := func(nonce string) string {
+		hdr := "Message-ID: " + msgid.String() + "\r\nNewsgroups: overchan.test\r\nDate: " + date + "\r\n"
+		if nonce != "" {
+			hdr += PoWHeader + ": " + nonce + "\r\n"
+		}
+		return hdr + "\r\nhello\r\n.\r\n"
+	}
+	pow := &config.PoWConfig{Bits: 8}
+
+	for _, bad := range []string{"", "nope"} {
+		c, st := newTestConn(article(bad), nil)
+		c.pow = pow
+		status, _ := c.readArticle(false, nil)
+		if status.Accept() {
+			t.Logf("article with nonce %q accepted", bad)
+			t.Fail()
+		}
+		if _, ok := st.articles[msgid.String()]; ok {
+			t.Logf("article with nonce %q stored", bad)
+			t.Fail()
+		}
+	}
+
+	c, st := newTestConn(article(nonce), nil)
+	c.pow = pow
+	status, err := c.readArticle(false, nil)
+	if err != nil || !status.Accept() {
+		t.Logf("article with proof of work not accepted: %s %v", status, err)
+		t.Fail()
+	}
+	if _, ok := st.articles[msgid.String()]; !ok {
+		t.Log("article with proof of work not stored")
+		t.Fail()
+	}
+
+	// posting without logging in as a trusted peer needs it too
+	c, _ = newTestConn("Newsgroups: overchan.test\r\n\r\nhello\r\n.\r\n", nil)
+	c.pow = pow
+	c.authenticated = true
+	status, _ = c.readArticle(true, nil)
+	if status.Accept() {
+		t.Log("post without proof of work accepted")
+		t.Fail()
+	}
+	// posts keep their message-id so they can have proof of work
+	c, st = newTestConn(article(nonce), nil)
+	c.pow = pow
+	c.authenticated = true
+	status, err = c.readArticle(true, nil)
+	if err != nil || !status.Accept() {
+		t.Logf("post with proof of work not accepted: %s %v", status, err)
+		t.Fail()
+	}
+	if _, ok := st.articles[msgid.String()]; !ok {
+		t.Log("post with proof of work not stored under its message-id")
+		t.Fail()
+	}
+
+	// trusted peers need no proof of work
+	c, st = newTestConn(article(""), nil)
+	c.pow = pow
+	c.trusted = true
+	status, _ = c.readArticle(false, nil)
+	if !status.Accept() {
+		t.Logf("article from trusted peer not accepted: %s", status)
+		t.Fail()
+	}
+}
+
+func TestPostArticleWithPoW(t *testing.T) {
+	st := &memStore{articles: make(map[string][]byte)}
+	addrs := make(testAddrs)
+	s := NewServer()
+	s.Storage = st
+	s.Addrs = addrs
+	s.Config = &config.NNTPServerConfig{
+		Name: "test.tld",
+		PoW:  &config.PoWConfig{Bits: 8},
+	}
+	go func() {
+		for range s.send {
+		}
+	}()
+	a := s.NewArticle("overchan.test", "", "", "test\r\ninjected: header", "hello")
+	a.Attachments = append(a.Attachments, &message.Attachment{
+		Mime:     "text/x-test",
+		FileName: "test.txt",
+		Body:     nopCloser{strings.NewReader("attached")},
+	})
+	p, err := s.PrepareArticle(a)
+	if err != nil {
+		t.Logf("failed to prepare article: %s", err)
+		t.FailNow()
+	}
+	if p.Bits != 8 {
+		t.Logf("article has difficulty %d", p.Bits)
+		t.Fail()
+	}
+	if p.SetPoW("nope") {
+		t.Log("bad proof of work accepted")
+		t.Fail()
+	}
+	p.SolvePoW()
+	p.Addr = "127.0.0.1"
+	status, err := s.PostArticle(p)
+	if err != nil || !status.Accept() {
+		t.Logf("article not accepted: %s %v", status, err)
+		t.FailNow()
+	}
+	stored, ok := st.articles[p.MessageID().String()]
+	if !ok {
+		t.Log("article not stored")
+		t.FailNow()
+	}
+	if strings.Contains(string(stored), "\ninjected:") {
+		t.Logf("header injected: %q", stored)
+		t.Fail()
+	}
+	encaddr := p.Header.Get(EncAddrHeader, "")
+	if encaddr == "" || !strings.Contains(string(stored), EncAddrHeader+": "+encaddr+"\n") {
+		t.Logf("encrypted address not in article: %q", stored)
+		t.Fail()
+	}
+	if util.DecAddr(encaddr, addrs[encaddr]) != "127.0.0.1" {
+		t.Log("encrypted address key not recorded")
+		t.Fail()
+	}
+
+	// an untrusted peer relaying the stored article must accept its proof of work
+	c, _ := newTestConn(strings.Replace(string(stored), "\n", "\r\n", -1)+".\r\n", nil)
+	c.pow = s.Config.PoW
+	status, _ = c.readArticle(false, nil)
+	if !status.Accept() {
+		t.Logf("relayed article not accepted: %s", status)
+		t.Fail()
+	}
+}
+
+// records encrypted address keys
+type testAddrs map[string]string
+
+func (a testAddrs) RegisterEncAddr(msgid, encaddr, key string) error {
+	a[encaddr] = key
+	return nil
+}
+
+type nopCloser struct {
+	*strings.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
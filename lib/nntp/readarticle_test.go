@@ -0,0 +1,293 @@
+package nntp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/store"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// in memory article storage for testing
+type memStore struct {
+	store.Storage
+	articles map[string][]byte
+}
+
+func (m *memStore) HasArticle(msgid string) error {
+	_, ok := m.articles[msgid]
+	if ok {
+		return nil
+	}
+	return store.ErrNoSuchArticle
+}
+
+func (m *memStore) StoreArticle(r io.Reader, msgid, newsgroup string) (string, error) {
+	d, err := ioutil.ReadAll(r)
+	if err == nil {
+		m.articles[msgid] = d
+	}
+	return msgid, err
+}
+
+func (m *memStore) DeleteArticle(msgid string) error {
+	delete(m.articles, msgid)
+	return nil
+}
+
+func (m *memStore) StoreAttachment(r io.Reader, filename string) (string, error) {
+	_, err := io.Copy(ioutil.Discard, r)
+	return filename, err
+}
+
+func (m *memStore) BeginArticle(msgid, newsgroup string) (store.ArticleTx, error) {
+	return &memTx{m: m, msgid: msgid}, nil
+}
+
+// article kept in memory until committed
+type memTx struct {
+	bytes.Buffer
+	m     *memStore
+	msgid string
+}
+
+func (tx *memTx) StoreAttachment(r io.Reader, filename string) (string, error) {
+	return tx.m.StoreAttachment(r, filename)
+}
+
+func (tx *memTx) Commit() (string, error) {
+	tx.m.articles[tx.msgid] = tx.Bytes()
+	return tx.msgid, nil
+}
+
+func (tx *memTx) Abort() error {
+	return nil
+}
+
+// acceptor taking everything up to a size
+type sizeAcceptor int64
+
+func (s sizeAcceptor) CheckHeader(hdr message.Header) PolicyStatus {
+	return PolicyAccept
+}
+
+func (s sizeAcceptor) CheckMessageID(msgid MessageID) PolicyStatus {
+	return PolicyAccept
+}
+
+func (s sizeAcceptor) MaxArticleSize() int64 {
+	return int64(s)
+}
+
+// read write closer over a fixed input
+type testRWC struct {
+	io.Reader
+	out bytes.Buffer
+}
+
+func (rwc *testRWC) Write(d []byte) (int, error) {
+	return rwc.out.Write(d)
+}
+
+func (*testRWC) Close() error {
+	return nil
+}
+
+func newTestConn(input string, filters []ArticleFilter) (*v1Conn, *memStore) {
+	st := &memStore{articles: make(map[string][]byte)}
+	c := &v1Conn{
+		C:          textproto.NewConn(&testRWC{Reader: strings.NewReader(input)}),
+		serverName: "test.tld",
+		storage:    st,
+		filters:    filters,
+		hdrio:      message.NewHeaderIO(),
+	}
+	return c, st
+}
+
+func TestReadArticleAppliesFilters(t *testing.T) {
+	msgid := GenMessageID("test.tld")
+	input := "Message-ID: " + msgid.String() + "\r\nNewsgroups: overchan.test\r\nX-Originating-IP: 127.0.0.1\r\n\r\nhello\r\n.\r\n"
+	c, st := newTestConn(input, []ArticleFilter{
+		&HeaderFilter{Strip: []string{"X-Originating-IP"}},
+		upperFilter{},
+	})
+	status, err := c.readArticle(false, nil)
+	if err != nil || !status.Accept() {
+		t.Logf("article not accepted: %s %v", status, err)
+		t.FailNow()
+	}
+	stored, ok := st.articles[msgid.String()]
+	if !ok {
+		t.Log("article not stored")
+		t.FailNow()
+	}
+	if bytes.Contains(stored, []byte("X-Originating-IP")) {
+		t.Logf("header filter not applied: %q", stored)
+		t.Fail()
+	}
+	if !bytes.HasSuffix(stored, []byte("\nHELLO\n")) {
+		t.Logf("body filter not applied: %q", stored)
+		t.Fail()
+	}
+}
+
+func TestReadArticleFilterRejects(t *testing.T) {
+	msgid := GenMessageID("test.tld")
+	input := "Message-ID: " + msgid.String() + "\r\nNewsgroups: overchan.test\r\n\r\nhello\r\n.\r\n"
+	c, st := newTestConn(input, []ArticleFilter{failFilter{}})
+	status, _ := c.readArticle(false, nil)
+	if status.Accept() {
+		t.Log("article accepted when header filter failed")
+		t.Fail()
+	}
+	if _, ok := st.articles[msgid.String()]; ok {
+		t.Log("article stored when header filter failed")
+		t.Fail()
+	}
+}
+
+// index that fails to register articles
+type failIndex struct {
+	memIndex
+}
+
+func (idx *failIndex) RegisterArticle(a *model.Article) error {
+	return errors.New("index is down")
+}
+
+func TestReadArticleIndexFails(t *testing.T) {
+	msgid := GenMessageID("test.tld")
+	input := "Message-ID: " + msgid.String() + "\r\nNewsgroups: overchan.test\r\n\r\nhello\r\n.\r\n"
+	c, st := newTestConn(input, nil)
+	c.index = &failIndex{}
+	_, err := c.readArticle(false, nil)
+	if err == nil {
+		t.Log("article not indexed did not fail")
+		t.Fail()
+	}
+	if _, ok := st.articles[msgid.String()]; ok {
+		t.Log("article not indexed was kept")
+		t.Fail()
+	}
+}
+
+func TestReadArticleOversizedRolledBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-readarticle")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	attachment := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("attachment"), 100))
+	for _, test := range []struct {
+		limit  int64
+		stored bool
+	}{
+		{200, false},
+		{1 << 20, true},
+	} {
+		input := "Message-ID: " + GenMessageID("test.tld").String() + "\r\nNewsgroups: overchan.test\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+			"--b\r\nContent-Type: image/png\r\nContent-Disposition: attachment; filename=\"a.png\"\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			attachment + "\r\n--b--\r\n.\r\n"
+		c, _ := newTestConn(input, nil)
+		c.storage = st
+		c.acceptor = sizeAcceptor(test.limit)
+		status, err := c.readArticle(false, nil)
+		if status.Accept() != test.stored || err != nil {
+			t.Logf("limit %d: wrong status %s %v", test.limit, status, err)
+			t.Fail()
+		}
+		list, _ := st.ListGroup("overchan.test")
+		atts, _ := ioutil.ReadDir(st.AttachmentDir())
+		tmp, _ := ioutil.ReadDir(st.TempDir())
+		if test.stored && (len(list) != 1 || len(atts) != 1) {
+			t.Logf("accepted article not stored: %d articles %d attachments", len(list), len(atts))
+			t.Fail()
+		}
+		if !test.stored && (len(list) != 0 || len(atts) != 0) {
+			t.Logf("oversized article kept: %d articles %d attachments", len(list), len(atts))
+			t.Fail()
+		}
+		if len(tmp) != 0 {
+			t.Logf("%d temp files left", len(tmp))
+			t.Fail()
+		}
+	}
+}
+
+func TestReadArticleStripsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-readarticle")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	// what the stripped attachment is stored as
+	cleanPath, _ := st.StoreAttachment(bytes.NewReader(testJpeg(false)), "clean.jpg")
+	dirtyPath, _ := st.StoreAttachment(bytes.NewReader(testJpeg(true)), "dirty.jpg")
+	for _, test := range []struct {
+		federated bool
+		signed    bool
+		stored    string
+	}{
+		{false, false, dirtyPath},
+		{true, false, cleanPath},
+		{true, true, dirtyPath},
+	} {
+		msgid := GenMessageID("test.tld").String()
+		input := "Message-ID: " + msgid + "\r\nNewsgroups: overchan.test\r\n"
+		if test.signed {
+			input += "X-Pubkey-Ed25519: 00\r\n"
+		}
+		input += "Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+			"--b\r\nContent-Type: image/jpeg\r\nContent-Disposition: attachment; filename=\"a.jpg\"\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			base64.StdEncoding.EncodeToString(testJpeg(true)) + "\r\n--b--\r\n.\r\n"
+		idx := &memIndex{articles: make(map[string]*model.Article)}
+		c, _ := newTestConn(input, nil)
+		c.storage = st
+		c.index = idx
+		c.metadata = &config.MetadataConfig{Local: true, Federated: test.federated}
+		status, err := c.readArticle(false, nil)
+		if err != nil || !status.Accept() {
+			t.Logf("article not accepted: %s %v", status, err)
+			t.FailNow()
+		}
+		a, ok := idx.articles[msgid]
+		if !ok || len(a.Attachments) != 1 {
+			t.Log("article not indexed with its attachment")
+			t.FailNow()
+		}
+		att := a.Attachments[0]
+		if att.Path != filepath.Base(test.stored) || att.Hash != strings.TrimSuffix(att.Path, ".jpg") {
+			t.Logf("federated=%v signed=%v: attachment stored as %s with hash %s, wanted %s", test.federated, test.signed, att.Path, att.Hash, test.stored)
+			t.Fail()
+		}
+		if a.Text != "hello" {
+			t.Logf("text changed to %q", a.Text)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package nntp
+
+import (
+	"encoding/json"
+	"github.com/majestrate/srndv2/lib/config"
+	"sync"
+	"time"
+)
+
+// how many articles can be queued for an outbound feed before sending blocks
+const feedQueueSize = 512
+
+// status of an outbound feed
+type FeedStatus struct {
+	// name of the feed
+	Name string `json:"name"`
+	// address of the remote server
+	Addr string `json:"addr"`
+	// are we currently connected?
+	Connected bool `json:"connected"`
+	// articles waiting to be offered to the feed
+	Queue int `json:"queue"`
+	// last error on this feed, empty if none
+	LastError string `json:"lasterror"`
+	// when the last error happened, zero time if none
+	LastErrorTime time.Time `json:"lasterrortime"`
+	// current connection, nil if not connected
+	Conn json.Marshaler `json:"conn"`
+}
+
+// snapshot of the status of all connections of an nntp server
+type ServerStatus struct {
+	// inbound connections
+	Inbound []json.Marshaler `json:"inbound"`
+	// outbound connections, both streaming feeds and periodic downloads
+	Outbound []json.Marshaler `json:"outbound"`
+	// outbound feeds
+	Feeds []*FeedStatus `json:"feeds"`
+}
+
+// state of one outbound feed
+type feedEntry struct {
+	conf    *config.FeedConfig
+	conn    *v1OBConn
+	err     error
+	errTime time.Time
+}
+
+// tracks active connections for status reporting
+type connRegistry struct {
+	access   sync.Mutex
+	inbound  map[*v1Conn]bool
+	outbound map[*v1Conn]bool
+	feeds    map[string]*feedEntry
+	// names of feeds in the order they were added
+	order []string
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		inbound:  make(map[*v1Conn]bool),
+		outbound: make(map[*v1Conn]bool),
+		feeds:    make(map[string]*feedEntry),
+	}
+}
+
+func (r *connRegistry) addInbound(c *v1Conn) {
+	r.access.Lock()
+	if !r.inbound[c] {
+		r.inbound[c] = true
+		activeConns.WithLabelValues("inbound").Inc()
+	}
+	r.access.Unlock()
+}
+
+func (r *connRegistry) removeInbound(c *v1Conn) {
+	r.access.Lock()
+	if r.inbound[c] {
+		delete(r.inbound, c)
+		activeConns.WithLabelValues("inbound").Dec()
+	}
+	r.access.Unlock()
+}
+
+func (r *connRegistry) addOutbound(c *v1Conn) {
+	r.access.Lock()
+	if !r.outbound[c] {
+		r.outbound[c] = true
+		activeConns.WithLabelValues("outbound").Inc()
+	}
+	r.access.Unlock()
+}
+
+func (r *connRegistry) removeOutbound(c *v1Conn) {
+	r.access.Lock()
+	if r.outbound[c] {
+		delete(r.outbound, c)
+		activeConns.WithLabelValues("outbound").Dec()
+	}
+	r.access.Unlock()
+}
+
+// get or create a feed entry, must hold lock
+func (r *connRegistry) feed(conf *config.FeedConfig) *feedEntry {
+	f, ok := r.feeds[conf.Name]
+	if !ok {
+		f = &feedEntry{conf: conf}
+		r.feeds[conf.Name] = f
+		r.order = append(r.order, conf.Name)
+	}
+	return f
+}
+
+// set the current connection of a feed, nil when disconnected
+func (r *connRegistry) setFeedConn(conf *config.FeedConfig, c *v1OBConn) {
+	r.access.Lock()
+	f := r.feed(conf)
+	if c == nil && f.conn != nil {
+		// keep the last error the connection had
+		if err, t := f.conn.C.lastError(); err != nil {
+			f.err = err
+			f.errTime = t
+		}
+	}
+	f.conn = c
+	r.access.Unlock()
+}
+
+// record an error on a feed
+func (r *connRegistry) feedError(conf *config.FeedConfig, err error) {
+	r.access.Lock()
+	f := r.feed(conf)
+	f.err = err
+	f.errTime = time.Now()
+	r.access.Unlock()
+}
+
+func (r *connRegistry) status() *ServerStatus {
+	r.access.Lock()
+	defer r.access.Unlock()
+	st := &ServerStatus{
+		Inbound:  []json.Marshaler{},
+		Outbound: []json.Marshaler{},
+		Feeds:    []*FeedStatus{},
+	}
+	for c := range r.inbound {
+		st.Inbound = append(st.Inbound, c)
+	}
+	for c := range r.outbound {
+		st.Outbound = append(st.Outbound, c)
+	}
+	for _, name := range r.order {
+		f := r.feeds[name]
+		fs := &FeedStatus{
+			Name: f.conf.Name,
+			Addr: f.conf.Addr,
+		}
+		err, t := f.err, f.errTime
+		if f.conn != nil {
+			fs.Connected = true
+			fs.Queue = len(f.conn.streamChnl)
+			fs.Conn = &f.conn.C
+			if cerr, ct := f.conn.C.lastError(); cerr != nil {
+				err, t = cerr, ct
+			}
+		}
+		if err != nil {
+			fs.LastError = err.Error()
+			fs.LastErrorTime = t
+		}
+		st.Feeds = append(st.Feeds, fs)
+	}
+	return st
+}
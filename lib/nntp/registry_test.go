@@ -0,0 +1,86 @@
+package nntp
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/majestrate/srndv2/lib/config"
+	"strings"
+	"testing"
+)
+
+func TestConnRegistry(t *testing.T) {
+	r := newConnRegistry()
+	conf := &config.FeedConfig{Name: "feed", Addr: "127.0.0.1:1199"}
+	r.setFeedConn(conf, nil)
+	r.feedError(conf, errors.New("connection refused"))
+
+	st := r.status()
+	if len(st.Feeds) != 1 || st.Feeds[0].Connected || st.Feeds[0].LastError != "connection refused" {
+		t.Logf("wrong feed status: %v", st.Feeds)
+		t.Fail()
+	}
+
+	// connected feed reports queue depth and errors from its connection
+	ob := &v1OBConn{conf: conf}
+	ob.C.state.FeedName = conf.Name
+	chnl, _ := ob.StartStreaming()
+	chnl <- ArticleEntry{"<a@test.tld>", "overchan.test"}
+	chnl <- ArticleEntry{"<b@test.tld>", "overchan.test"}
+	r.setFeedConn(conf, ob)
+	ob.C.setError(errors.New("invalid streaming response"))
+	st = r.status()
+	if !st.Feeds[0].Connected || st.Feeds[0].Queue != 2 || st.Feeds[0].LastError != "invalid streaming response" {
+		t.Logf("wrong connected feed status: %v", st.Feeds[0])
+		t.Fail()
+	}
+
+	// last error is kept after disconnecting
+	r.setFeedConn(conf, nil)
+	st = r.status()
+	if st.Feeds[0].Connected || st.Feeds[0].LastError != "invalid streaming response" {
+		t.Logf("wrong disconnected feed status: %v", st.Feeds[0])
+		t.Fail()
+	}
+
+	// inbound connections without a feed policy can be marshalled
+	ib, _ := newTestConn("", nil)
+	ib.state.HostName = "10.0.0.1:4242"
+	r.addInbound(ib)
+	d, err := json.Marshal(r.status())
+	if err != nil || !strings.Contains(string(d), "10.0.0.1:4242") {
+		t.Logf("failed to marshal status: %s %v", d, err)
+		t.Fail()
+	}
+	r.removeInbound(ib)
+	if len(r.status().Inbound) != 0 {
+		t.Log("inbound connection not removed")
+		t.Fail()
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	msgid := GenMessageID("test.tld")
+	article := "Message-ID: " + msgid.String() + "\r\nNewsgroups: overchan.test\r\n\r\nhello\r\n.\r\n"
+	c, _ := newTestConn(article, nil)
+	c.stats = newConnStats()
+	err := nntpRecvArticle(c, "IHAVE "+msgid.String(), nil)
+	if err != nil {
+		t.Logf("IHAVE failed: %s", err)
+		t.FailNow()
+	}
+	err = nntpRecvArticle(c, "IHAVE not-a-msgid", nil)
+	if err != nil {
+		t.Logf("IHAVE failed: %s", err)
+		t.FailNow()
+	}
+	st := c.stats.snapshot()
+	if st.Offered != 2 || st.Accepted != 1 || st.Rejected != 1 || st.Deferred != 0 {
+		t.Logf("wrong counters: %+v", st)
+		t.Fail()
+	}
+	d, _ := json.Marshal(c)
+	if !strings.Contains(string(d), `"accepted":1`) {
+		t.Logf("counters not in connection json: %s", d)
+		t.Fail()
+	}
+}
@@ -0,0 +1,336 @@
+package nntp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrReprocessRunning = errors.New("already reprocessing articles")
+var ErrReprocessStopped = errors.New("reprocessing stopped")
+var ErrNoAcceptor = errors.New("no article acceptor to check articles with")
+var ErrInvalidMessageID = errors.New("invalid message-id")
+
+// how many articles to process between saving how far we got
+const reprocessSaveInterval = 100
+
+// how many articles to process between progress log lines
+const reprocessLogInterval = 1000
+
+// what to do when reprocessing stored articles
+type ReprocessOptions struct {
+	// check every article with the acceptor again and delete the ones it does not allow anymore
+	Recheck bool `json:"recheck"`
+	// continue after the last article an earlier run got to
+	Resume bool `json:"resume"`
+}
+
+// progress of reprocessing stored articles
+type ReprocessProgress struct {
+	// is a run going on right now?
+	Running bool `json:"running"`
+	// options of the current or last run
+	Options ReprocessOptions `json:"options"`
+	// when the current or last run started, zero time if never run
+	Started time.Time `json:"started"`
+	// when the last run ended, zero time if still running
+	Finished time.Time `json:"finished"`
+	// message-id of the last article processed
+	Last string `json:"last"`
+	// articles processed by this run
+	Processed int64 `json:"processed"`
+	// articles deleted because the acceptor does not allow them
+	Deleted int64 `json:"deleted"`
+	// articles that could not be processed
+	Failed int64 `json:"failed"`
+	// error that ended the run, empty if none
+	Error string `json:"error"`
+}
+
+// rebuilds the article index and attachments from the stored articles
+type Reprocessor struct {
+	// where the articles are stored
+	Storage store.Storage
+	// index to register articles with, nil for none
+	Index ArticleIndex
+	// acceptor to check articles with when rechecking
+	Acceptor ArticleAcceptor
+	// file remembering how far the last run got, empty to not remember
+	StateFile string
+	// file marking that a run went through every stored article without failing on any
+	// empty to not mark
+	DoneFile string
+
+	access   sync.Mutex
+	progress ReprocessProgress
+	stop     chan bool
+}
+
+// get the progress of the current or last run
+func (r *Reprocessor) Progress() ReprocessProgress {
+	r.access.Lock()
+	defer r.access.Unlock()
+	return r.progress
+}
+
+// start reprocessing in the background
+func (r *Reprocessor) Start(opts ReprocessOptions) (err error) {
+	err = r.begin(opts)
+	if err == nil {
+		go r.run()
+	}
+	return
+}
+
+// reprocess all stored articles, blocks until done
+func (r *Reprocessor) Run(opts ReprocessOptions) (err error) {
+	err = r.begin(opts)
+	if err == nil {
+		err = r.run()
+	}
+	return
+}
+
+// stop the current run after the article it is at
+func (r *Reprocessor) Stop() {
+	r.access.Lock()
+	if r.progress.Running && r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.access.Unlock()
+}
+
+func (r *Reprocessor) begin(opts ReprocessOptions) error {
+	if opts.Recheck && r.Acceptor == nil {
+		return ErrNoAcceptor
+	}
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.progress.Running {
+		return ErrReprocessRunning
+	}
+	r.progress = ReprocessProgress{
+		Running: true,
+		Options: opts,
+		Started: time.Now(),
+	}
+	r.stop = make(chan bool)
+	return nil
+}
+
+func (r *Reprocessor) run() (err error) {
+	r.access.Lock()
+	opts := r.progress.Options
+	stop := r.stop
+	r.access.Unlock()
+
+	after := ""
+	if opts.Resume {
+		after = r.loadState()
+	}
+	log.WithFields(log.Fields{
+		"pkg":     "nntp-reprocess",
+		"recheck": opts.Recheck,
+		"after":   after,
+	}).Info("reprocessing stored articles")
+
+	hdrio := message.NewHeaderIO()
+	err = r.Storage.WalkArticles(after, func(msgid string) (e error) {
+		select {
+		case <-stop:
+			return ErrReprocessStopped
+		default:
+		}
+		deleted, e := r.reprocess(hdrio, msgid, opts)
+		r.access.Lock()
+		p := &r.progress
+		p.Last = msgid
+		p.Processed++
+		if e != nil {
+			p.Failed++
+		} else if deleted {
+			p.Deleted++
+		}
+		progress := *p
+		r.access.Unlock()
+		if e != nil {
+			log.WithFields(log.Fields{
+				"pkg":   "nntp-reprocess",
+				"msgid": msgid,
+			}).Warn("failed to reprocess article ", e)
+		}
+		if progress.Processed%reprocessLogInterval == 0 {
+			log.WithFields(log.Fields{
+				"pkg":       "nntp-reprocess",
+				"processed": progress.Processed,
+				"deleted":   progress.Deleted,
+				"failed":    progress.Failed,
+				"last":      progress.Last,
+			}).Info("reprocessing")
+		}
+		if progress.Processed%reprocessSaveInterval == 0 {
+			return r.saveState(msgid)
+		}
+		return nil
+	})
+
+	r.access.Lock()
+	p := &r.progress
+	if err == nil {
+		// finished, the next resume starts over
+		if r.StateFile != "" {
+			os.Remove(r.StateFile)
+		}
+		// a resumed run does not know if the runs before it failed on anything
+		if !opts.Resume {
+			r.markDone(p.Failed == 0)
+		}
+	} else {
+		p.Error = err.Error()
+		if p.Last != "" {
+			r.saveState(p.Last)
+		}
+	}
+	p.Running = false
+	p.Finished = time.Now()
+	progress := *p
+	r.access.Unlock()
+
+	log.WithFields(log.Fields{
+		"pkg":       "nntp-reprocess",
+		"processed": progress.Processed,
+		"deleted":   progress.Deleted,
+		"failed":    progress.Failed,
+		"error":     progress.Error,
+	}).Info("done reprocessing")
+	return
+}
+
+// reprocess one stored article
+// returns true if it was deleted
+func (r *Reprocessor) reprocess(hdrio *message.HeaderIO, msgid string, opts ReprocessOptions) (deleted bool, err error) {
+	if !MessageID(msgid).Valid() {
+		err = ErrInvalidMessageID
+		return
+	}
+	var f io.ReadCloser
+	f, err = r.Storage.OpenArticle(msgid)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	// the size is only known once the whole article was read
+	size := new(countWriter)
+	br := bufio.NewReader(io.TeeReader(f, size))
+	var hdr message.Header
+	hdr, err = hdrio.ReadHeader(br)
+	if err != nil {
+		return
+	}
+	// the article is known by the name it is stored as
+	if hdr.MessageID() != msgid {
+		hdr.Set("Message-ID", msgid)
+	}
+	status := PolicyAccept
+	if opts.Recheck {
+		status = r.Acceptor.CheckHeader(hdr)
+	}
+	a := articleFromHeader(hdr)
+	if !status.Reject() {
+		a.Text, a.Attachments, err = storeAttachments(r.Storage, hdr, br)
+		if err == nil {
+			// count whatever was not parsed
+			_, err = io.Copy(ioutil.Discard, br)
+		}
+		if err != nil {
+			return
+		}
+		// attachments of an oversized article are left for garbage collection
+		if opts.Recheck && status.Accept() && size.n > r.Acceptor.MaxArticleSize() {
+			status = PolicyReject
+		}
+	}
+	if status.Reject() {
+		log.WithFields(log.Fields{
+			"pkg":    "nntp-reprocess",
+			"msgid":  msgid,
+			"status": status,
+		}).Info("deleting article the acceptor does not allow")
+		_, err = DeleteStoredArticle(r.Storage, r.Index, msgid)
+		deleted = err == nil
+		return
+	}
+	if r.Index != nil {
+		err = r.Index.RegisterArticle(a)
+	}
+	return
+}
+
+// get the message-id of the last article an earlier run got to
+func (r *Reprocessor) loadState() string {
+	if r.StateFile == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(r.StateFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// has a run gone through every stored article without failing on any?
+func (r *Reprocessor) Done() bool {
+	if r.DoneFile == "" {
+		return false
+	}
+	_, err := os.Stat(r.DoneFile)
+	return err == nil
+}
+
+// mark that a run went through every stored article or remove the mark if it failed on some
+func (r *Reprocessor) markDone(done bool) {
+	if r.DoneFile == "" {
+		return
+	}
+	var err error
+	if done {
+		err = ioutil.WriteFile(r.DoneFile, []byte(time.Now().Format(time.RFC3339)+"\n"), 0600)
+	} else {
+		err = os.Remove(r.DoneFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":  "nntp-reprocess",
+			"file": r.DoneFile,
+		}).Warn("failed to mark reprocessing done ", err)
+	}
+}
+
+// remember the last article processed
+func (r *Reprocessor) saveState(msgid string) (err error) {
+	if r.StateFile == "" {
+		return
+	}
+	tmp := r.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(msgid+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, r.StateFile)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to save reprocess state: %s", err.Error())
+	}
+	return
+}
@@ -0,0 +1,142 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/model"
+	"github.com/majestrate/srndv2/lib/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// in memory article index for testing
+type memIndex struct {
+	articles map[string]*model.Article
+	// attachments whose thumbnails were deleted
+	deletedThumbnails []string
+}
+
+func (idx *memIndex) RegisterArticle(a *model.Article) error {
+	idx.articles[a.MessageID] = a
+	return nil
+}
+
+func (idx *memIndex) DeleteArticle(msgid string) error {
+	delete(idx.articles, msgid)
+	return nil
+}
+
+func (idx *memIndex) ArticleAttachments(msgid string) (files []string, err error) {
+	if a, ok := idx.articles[msgid]; ok {
+		for _, att := range a.Attachments {
+			files = append(files, att.Path)
+		}
+	}
+	return
+}
+
+func (idx *memIndex) CountAttachmentRefs(filename string) (count int64, err error) {
+	for _, a := range idx.articles {
+		for _, att := range a.Attachments {
+			if att.Path == filename {
+				count++
+			}
+		}
+	}
+	return
+}
+
+func (idx *memIndex) DeleteThumbnail(filename string) error {
+	idx.deletedThumbnails = append(idx.deletedThumbnails, filename)
+	return nil
+}
+
+func TestReprocess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-reprocess")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	posts := []struct {
+		msgid, group, body string
+	}{
+		{"<aa@test.tld>", "overchan.test", "Content-Type: multipart/mixed; boundary=\"b\"\nX-Encrypted-IP: enc\n\n" +
+			"--b\nContent-Type: text/plain\n\nhello\n--b\nContent-Type: image/png\nContent-Disposition: attachment; filename=\"x.png\"\n\npng\n--b--\n"},
+		{"<bb@test.tld>", "overchan.cp", "\nbad\n"},
+		{"<cc@test.tld>", "overchan.test", "\nplain\n"},
+	}
+	for _, p := range posts {
+		_, err = st.StoreArticle(strings.NewReader("Message-ID: "+p.msgid+"\nNewsgroups: "+p.group+"\n"+p.body), p.msgid, p.group)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	policy := config.DefaultArticlePolicy
+	idx := &memIndex{articles: make(map[string]*model.Article)}
+	r := &Reprocessor{
+		Storage:   st,
+		Index:     idx,
+		Acceptor:  NewPolicyAcceptor(&policy),
+		StateFile: filepath.Join(dir, "reprocess.state"),
+		DoneFile:  filepath.Join(dir, "reprocess.done"),
+	}
+	err = r.Run(ReprocessOptions{Recheck: true})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	p := r.Progress()
+	if p.Running || p.Processed != 3 || p.Deleted != 1 || p.Failed != 0 {
+		t.Logf("bad progress: %+v", p)
+		t.Fail()
+	}
+	if st.HasArticle("<bb@test.tld>") != store.ErrNoSuchArticle || idx.articles["<bb@test.tld>"] != nil {
+		t.Log("disallowed article not deleted")
+		t.Fail()
+	}
+	a := idx.articles["<aa@test.tld>"]
+	if a == nil || a.Newsgroup != "overchan.test" || strings.TrimSpace(a.Text) != "hello" || len(a.Attachments) != 1 {
+		t.Logf("article not indexed right: %+v", a)
+		t.FailNow()
+	}
+	if _, err = os.Stat(filepath.Join(st.AttachmentDir(), a.Attachments[0].Path)); err != nil {
+		t.Logf("attachment not extracted: %s", err)
+		t.Fail()
+	}
+	if idx.articles["<cc@test.tld>"] == nil {
+		t.Log("plain article not indexed")
+		t.Fail()
+	}
+	if !r.Done() {
+		t.Log("finished run not marked done")
+		t.Fail()
+	}
+
+	// resume after the first article
+	idx.articles = make(map[string]*model.Article)
+	err = ioutil.WriteFile(r.StateFile, []byte("<aa@test.tld>\n"), 0600)
+	if err == nil {
+		err = r.Run(ReprocessOptions{Resume: true})
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(idx.articles) != 1 || idx.articles["<cc@test.tld>"] == nil {
+		t.Logf("resume did not continue after the saved article: %v", idx.articles)
+		t.Fail()
+	}
+	if _, err = os.Stat(r.StateFile); !os.IsNotExist(err) {
+		t.Log("state file kept after finished run")
+		t.Fail()
+	}
+}
@@ -1,6 +1,7 @@
 package nntp
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/majestrate/srndv2/lib/config"
 	"github.com/majestrate/srndv2/lib/network"
@@ -32,23 +33,44 @@ type Server struct {
 	Feeds []*config.FeedConfig
 	// inbound authentiaction mechanism
 	Auth ServerAuth
+	// checks inbound connections for bans, nil for no ban checks
+	Bans BanChecker
+	// stores keys of encrypted poster addresses, nil to not record poster addresses
+	Addrs EncAddrStore
+	// index of stored articles, nil to not index articles
+	Index ArticleIndex
+	// thumbnails stored attachments, nil to not make thumbnails
+	Thumbnails ThumbnailQueue
+	// rebuilds the index from stored articles, nil if not supported
+	Reprocessor *Reprocessor
 	// send to outbound feed channel
 	send chan ArticleEntry
 	// register inbound feed channel
 	regis chan *nntpFeed
 	// deregister inbound feed channel
 	deregis chan *nntpFeed
+	// inbound connection counter
+	conns *connTracker
+	// active connections for status reporting
+	registry *connRegistry
 }
 
 func NewServer() *Server {
 	return &Server{
 		// XXX: buffered?
-		send:    make(chan ArticleEntry),
-		regis:   make(chan *nntpFeed),
-		deregis: make(chan *nntpFeed),
+		send:     make(chan ArticleEntry),
+		regis:    make(chan *nntpFeed),
+		deregis:  make(chan *nntpFeed),
+		conns:    newConnTracker(),
+		registry: newConnRegistry(),
 	}
 }
 
+// get a snapshot of the status of all inbound connections and outbound feeds
+func (s *Server) Status() *ServerStatus {
+	return s.registry.status()
+}
+
 // reload server configuration
 func (s *Server) ReloadServer(c *config.NNTPServerConfig) {
 
@@ -104,6 +126,7 @@ func (s *Server) persist(cfg *config.FeedConfig) {
 			// successful connect
 			delay = time.Second
 			conn := newOutboundConn(c, s, cfg)
+			s.registry.addOutbound(&conn.C)
 			err = conn.Negotiate(true)
 			if err == nil {
 				// negotiation good
@@ -121,9 +144,12 @@ func (s *Server) persist(cfg *config.FeedConfig) {
 						conf: cfg,
 					}
 					s.regis <- f
+					s.registry.setFeedConn(cfg, conn)
 					// start streaming
 					conn.StreamAndQuit()
 					// deregister
+					s.registry.setFeedConn(cfg, nil)
+					s.registry.removeOutbound(&conn.C)
 					s.deregis <- f
 					continue
 				}
@@ -131,9 +157,12 @@ func (s *Server) persist(cfg *config.FeedConfig) {
 				log.WithFields(log.Fields{
 					"name": cfg.Name,
 				}).Info("outbound nntp connection failed to negotiate ", err)
+				s.registry.feedError(cfg, err)
 			}
 			conn.Quit()
+			s.registry.removeOutbound(&conn.C)
 		} else {
+			s.registry.feedError(cfg, err)
 			// failed dial, do exponential backoff up to 1 hour
 			if delay <= time.Hour {
 				delay *= 2
@@ -154,6 +183,8 @@ func (s *Server) downloadPosts(cfg *config.FeedConfig) error {
 		return err
 	}
 	conn := newOutboundConn(c, s, cfg)
+	s.registry.addOutbound(&conn.C)
+	defer s.registry.removeOutbound(&conn.C)
 	err = conn.Negotiate(false)
 	if err != nil {
 		conn.Quit()
@@ -199,6 +230,8 @@ func (s *Server) periodicDownload(cfg *config.FeedConfig) {
 // persist all outbound feeds
 func (s *Server) PersistFeeds() {
 	for _, f := range s.Feeds {
+		// show feeds that have not connected yet
+		s.registry.setFeedConn(f, nil)
 		go s.persist(f)
 		go s.periodicDownload(f)
 	}
@@ -262,7 +295,29 @@ func (s *Server) Serve(l net.Listener) (err error) {
 		c, err = l.Accept()
 		if err == nil {
 			// we got a new connection
-			go s.handleInboundConnection(c)
+			var limits *config.LimitsConfig
+			if s.Config != nil {
+				limits = s.Config.Limits
+			}
+			lerr := s.conns.acquire(c.RemoteAddr(), limits)
+			if lerr == nil {
+				go func(c net.Conn) {
+					if !s.rejectBanned(c) {
+						s.handleInboundConnection(c)
+					}
+					s.conns.release(c.RemoteAddr())
+				}(c)
+			} else {
+				// over connection limits
+				log.WithFields(log.Fields{
+					"pkg":   "nntp-server",
+					"addr":  c.RemoteAddr(),
+					"limit": lerr.Error(),
+				}).Warn("rejecting inbound connection")
+				c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+				fmt.Fprintf(c, "%s %s\r\n", RPL_NotAvaiable, lerr.Error())
+				c.Close()
+			}
 		} else {
 			log.WithFields(log.Fields{
 				"pkg": "nntp-server",
@@ -272,6 +327,36 @@ func (s *Server) Serve(l net.Listener) (err error) {
 	return
 }
 
+// check if an inbound connection is banned and close it if it is
+// returns true if the connection was closed
+func (s *Server) rejectBanned(c net.Conn) bool {
+	if s.Bans == nil {
+		return false
+	}
+	ban, err := s.Bans.CheckAddrBan(addrIP(c.RemoteAddr()))
+	if err != nil {
+		// don't lock everyone out if the ban list is broken
+		log.WithFields(log.Fields{
+			"pkg":  "nntp-server",
+			"addr": c.RemoteAddr(),
+		}).Error("failed to check ban ", err)
+		return false
+	}
+	if ban == nil {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"pkg":    "nntp-server",
+		"addr":   c.RemoteAddr(),
+		"ban":    ban.Addr,
+		"reason": ban.Reason,
+	}).Info("rejecting banned connection")
+	c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprintf(c, "%s banned: %s\r\n", RPL_GenericFatal, headerValue(ban.Reason))
+	c.Close()
+	return true
+}
+
 // get the article policy for a connection given its state
 func (s *Server) getPolicyFor(state *ConnState) ArticleAcceptor {
 	return s.Acceptor
@@ -297,6 +382,10 @@ func (s *Server) handleInboundConnection(c net.Conn) {
 	}).Debug("handling inbound connection")
 	var nc Conn
 	nc = newInboundConn(s, c)
+	if ib, ok := nc.(*v1IBConn); ok {
+		s.registry.addInbound(&ib.C)
+		defer s.registry.removeInbound(&ib.C)
+	}
 	err := nc.Negotiate(true)
 	if err == nil {
 		// do they want to stream?
@@ -0,0 +1,98 @@
+package nntp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// counters for one connection, safe for concurrent use
+// a nil *connStats counts nothing
+type connStats struct {
+	// 64 bit fields first so they are aligned for atomic access
+	offered  int64
+	accepted int64
+	rejected int64
+	deferred int64
+	bytesIn  int64
+	bytesOut int64
+	started  time.Time
+}
+
+// snapshot of the counters of a connection
+type ConnStats struct {
+	// when the connection was made
+	Started time.Time `json:"started"`
+	// articles offered by CHECK, IHAVE or POST
+	Offered int64 `json:"offered"`
+	// articles accepted
+	Accepted int64 `json:"accepted"`
+	// articles rejected
+	Rejected int64 `json:"rejected"`
+	// articles deferred
+	Deferred int64 `json:"deferred"`
+	// bytes read from the connection
+	BytesIn int64 `json:"bytesin"`
+	// bytes written to the connection
+	BytesOut int64 `json:"bytesout"`
+}
+
+func newConnStats() *connStats {
+	return &connStats{
+		started: time.Now(),
+	}
+}
+
+// count an article offered
+func (s *connStats) offer() {
+	if s != nil {
+		atomic.AddInt64(&s.offered, 1)
+	}
+}
+
+// count the outcome of an article
+func (s *connStats) result(status PolicyStatus) {
+	if s == nil {
+		return
+	}
+	if status.Accept() {
+		atomic.AddInt64(&s.accepted, 1)
+	} else if status.Defer() {
+		atomic.AddInt64(&s.deferred, 1)
+	} else {
+		atomic.AddInt64(&s.rejected, 1)
+	}
+}
+
+func (s *connStats) snapshot() (st ConnStats) {
+	if s != nil {
+		st = ConnStats{
+			Started:  s.started,
+			Offered:  atomic.LoadInt64(&s.offered),
+			Accepted: atomic.LoadInt64(&s.accepted),
+			Rejected: atomic.LoadInt64(&s.rejected),
+			Deferred: atomic.LoadInt64(&s.deferred),
+			BytesIn:  atomic.LoadInt64(&s.bytesIn),
+			BytesOut: atomic.LoadInt64(&s.bytesOut),
+		}
+	}
+	return
+}
+
+// net.Conn that counts bytes read and written
+type countConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c *countConn) Read(d []byte) (n int, err error) {
+	n, err = c.Conn.Read(d)
+	atomic.AddInt64(&c.stats.bytesIn, int64(n))
+	return
+}
+
+func (c *countConn) Write(d []byte) (n int, err error) {
+	n, err = c.Conn.Write(d)
+	atomic.AddInt64(&c.stats.bytesOut, int64(n))
+	return
+}
@@ -0,0 +1,57 @@
+package nntp
+
+import (
+	"github.com/majestrate/srndv2/lib/nntp/message"
+	"github.com/majestrate/srndv2/lib/store"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestXOVERReportsUncompressedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-xover")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	st.Compression = store.CompressGzip
+	var articles []string
+	for _, msgid := range []string{"<aa@test.tld>", "<bb@test.tld>"} {
+		article := "Message-ID: " + msgid + "\nNewsgroups: overchan.test\nSubject: hi\n\n" + strings.Repeat("hello world\n", 100)
+		_, err = st.StoreArticle(strings.NewReader(article), msgid, "overchan.test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		articles = append(articles, article)
+	}
+	st.DeleteArticle("<aa@test.tld>")
+
+	rwc := &testRWC{Reader: strings.NewReader("")}
+	c := &v1Conn{
+		C:       textproto.NewConn(rwc),
+		storage: st,
+		hdrio:   message.NewHeaderIO(),
+	}
+	c.state.Group = "overchan.test"
+	err = handleXOVER(c, "XOVER", nil)
+	lines := strings.Split(strings.TrimSpace(rwc.out.String()), "\r\n")
+	if err != nil || len(lines) != 3 || lines[2] != "." {
+		t.Logf("bad overview %q: %v", lines, err)
+		t.FailNow()
+	}
+	fields := strings.Split(lines[1], "\t")
+	if len(fields) != 8 || fields[0] != "000002" || fields[4] != "<bb@test.tld>" || fields[6] != strconv.Itoa(len(articles[1])) {
+		t.Logf("bad overview line %q", fields)
+		t.Fail()
+	}
+}
@@ -0,0 +1,4 @@
+//
+// running external programs with timeouts and resource limits
+//
+package process
@@ -0,0 +1,17 @@
+package process
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var processSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "process_seconds",
+	Help:    "Time external programs ran for by program and result.",
+	Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+}, []string{"program", "result"})
+
+var processRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "process_runs_total",
+	Help: "External programs run by program and result.",
+}, []string{"program", "result"})
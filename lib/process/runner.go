@@ -0,0 +1,186 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+var ErrTimeout = errors.New("program ran for too long and was killed")
+
+// resource limits applied to each program, 0 for no limit
+// on linux they are set by /bin/sh before it runs the program, elsewhere they are ignored
+type Limits struct {
+	// seconds of cpu time
+	CPU uint64
+	// bytes of address space
+	Memory uint64
+	// bytes written to one file
+	FileSize uint64
+	// open files
+	OpenFiles uint64
+}
+
+// runs external programs on untrusted input
+// safe for concurrent use, create with NewRunner or NewRunnerFromConfig
+type Runner struct {
+	// time a program may run before it is killed, 0 for no limit
+	Timeout time.Duration
+	// bytes of stdout and of stderr kept, 0 for no limit
+	MaxOutput int64
+	// environment of programs, nothing is inherited
+	Env []string
+	// directory programs run in, empty for the directory of the daemon
+	Dir string
+	// resource limits of programs
+	Limits Limits
+
+	// free slots for running programs, nil for no limit
+	slots chan struct{}
+}
+
+// what running a program produced
+type Result struct {
+	// what it wrote to stdout and stderr up to MaxOutput
+	Stdout []byte
+	Stderr []byte
+	// was output discarded
+	Truncated bool
+	// time it ran for, not counting waiting for a slot
+	Duration time.Duration
+}
+
+// create a runner that runs at most maxProcs programs at once, 0 for no limit
+func NewRunner(maxProcs int) *Runner {
+	r := new(Runner)
+	if maxProcs > 0 {
+		r.slots = make(chan struct{}, maxProcs)
+	}
+	return r
+}
+
+// create a runner with the limits of a config
+func NewRunnerFromConfig(c *config.ProcessConfig) *Runner {
+	r := NewRunner(c.MaxProcs)
+	r.Timeout = c.TimeLimit()
+	r.MaxOutput = c.MaxOutput
+	r.Env = c.Env
+	r.Dir = c.Dir
+	r.Limits = Limits{
+		CPU:       c.MaxCPU,
+		Memory:    c.MaxMemory,
+		FileSize:  c.MaxFileSize,
+		OpenFiles: c.MaxOpenFiles,
+	}
+	return r
+}
+
+// runner used when none is given
+var DefaultRunner = NewRunnerFromConfig(&config.DefaultProcessConfig)
+
+// keeps the first bytes written to it and discards the rest
+// never fails so programs do not die writing more than is kept
+type capBuffer struct {
+	buff      bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *capBuffer) Write(d []byte) (int, error) {
+	n := len(d)
+	if b.max > 0 {
+		left := b.max - int64(b.buff.Len())
+		if int64(len(d)) > left {
+			b.truncated = true
+			if left < 0 {
+				left = 0
+			}
+			d = d[:left]
+		}
+	}
+	b.buff.Write(d)
+	return n, nil
+}
+
+// run a program with arguments and stdin, which may be nil, until it exits, is killed or ctx is done
+// waits for a slot if too many programs are running
+// returns ErrTimeout if it was killed for running too long
+func (r *Runner) Run(ctx context.Context, exe string, args []string, stdin io.Reader) (res Result, err error) {
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+			defer func() { <-r.slots }()
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	stdout := &capBuffer{max: r.MaxOutput}
+	stderr := &capBuffer{max: r.MaxOutput}
+	wexe, wargs := r.Limits.wrap(exe, args)
+	cmd := exec.Command(wexe, wargs...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// never inherit the environment of the daemon
+	cmd.Env = append([]string{}, r.Env...)
+	cmd.Dir = r.Dir
+	cmd.SysProcAttr = sysProcAttr()
+
+	started := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			killGroup(cmd.Process)
+			<-done
+			err = ctx.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+		}
+	}
+	res.Duration = time.Since(started)
+	res.Stdout = stdout.buff.Bytes()
+	res.Stderr = stderr.buff.Bytes()
+	res.Truncated = stdout.truncated || stderr.truncated
+
+	program := filepath.Base(exe)
+	result := "success"
+	if err == ErrTimeout {
+		result = "timeout"
+	} else if err != nil {
+		result = "failure"
+	}
+	processRuns.WithLabelValues(program, result).Inc()
+	processSeconds.WithLabelValues(program, result).Observe(res.Duration.Seconds())
+	l := log.WithFields(log.Fields{
+		"pkg":       "process",
+		"exec":      exe,
+		"result":    result,
+		"duration":  res.Duration,
+		"truncated": res.Truncated,
+	})
+	if err == nil {
+		l.Debug("program finished")
+	} else {
+		l.WithField("stderr", string(res.Stderr)).Warn("program failed ", err)
+	}
+	return
+}
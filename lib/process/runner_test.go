@@ -0,0 +1,106 @@
+package process
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sh(t *testing.T, r *Runner, script string) (Result, error) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	return r.Run(context.Background(), "/bin/sh", []string{"-c", script}, nil)
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	r := NewRunner(0)
+	r.Timeout = 100 * time.Millisecond
+	// the child keeps stdout open so the group has to be killed too
+	res, err := sh(t, r, "sleep 10 & sleep 10")
+	if err != ErrTimeout || res.Duration > 5*time.Second {
+		t.Logf("ran for %s: %v", res.Duration, err)
+		t.Fail()
+	}
+}
+
+func TestRunnerOutputAndEnv(t *testing.T) {
+	os.Setenv("SRND_SECRET", "leaked")
+	defer os.Unsetenv("SRND_SECRET")
+	dir, err := ioutil.TempDir("", "srnd-process")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	r := NewRunner(0)
+	r.MaxOutput = 8
+	r.Env = []string{"GREETING=hi"}
+	r.Dir = dir
+	res, err := sh(t, r, `echo "$GREETING $SRND_SECRET $(pwd)"; echo oops >&2`)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if string(res.Stdout) != ("hi  " + dir)[:8] || !res.Truncated {
+		t.Logf("stdout %q truncated %v", res.Stdout, res.Truncated)
+		t.Fail()
+	}
+	if string(res.Stderr) != "oops\n" {
+		t.Logf("stderr %q", res.Stderr)
+		t.Fail()
+	}
+	// the program read all its input even though little was kept
+	r.MaxOutput = 1
+	res, err = r.Run(context.Background(), "/bin/sh", []string{"-c", "cat; echo done >&2"}, strings.NewReader(strings.Repeat("x", 1<<20)))
+	if err != nil || string(res.Stdout) != "x" || string(res.Stderr) != "d" {
+		t.Logf("stdout %q stderr %q: %v", res.Stdout, res.Stderr, err)
+		t.Fail()
+	}
+}
+
+func TestRunnerLimits(t *testing.T) {
+	r := NewRunner(0)
+	r.Limits = Limits{OpenFiles: 17, FileSize: 1024 * 1024}
+	res, err := sh(t, r, "ulimit -n; ulimit -f")
+	if err != nil || strings.Join(strings.Fields(string(res.Stdout)), " ") != "17 2048" {
+		t.Logf("limits %q: %v", res.Stdout, err)
+		t.Fail()
+	}
+	// arguments get to the program as they are
+	res, err = r.Run(context.Background(), "/bin/echo", []string{"a b", "$HOME", "'"}, nil)
+	if err != nil || string(res.Stdout) != "a b $HOME '\n" {
+		t.Logf("arguments came out as %q: %v", res.Stdout, err)
+		t.Fail()
+	}
+}
+
+func TestRunnerMaxProcs(t *testing.T) {
+	r := NewRunner(1)
+	var wg sync.WaitGroup
+	started := time.Now()
+	for n := 0; n < 3; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh(t, r, "sleep 0.1")
+		}()
+	}
+	wg.Wait()
+	if time.Since(started) < 300*time.Millisecond {
+		t.Logf("3 programs ran in %s with 1 slot", time.Since(started))
+		t.Fail()
+	}
+	// waiting for a slot stops with the context
+	r.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Run(ctx, "/bin/true", nil, nil); err != context.DeadlineExceeded {
+		t.Logf("waiting for slot gave %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,43 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// run programs in their own process group so everything they start can be killed
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// kill a program and everything it started
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// run a program through a shell that sets the limits and then becomes the program
+// so the limits apply before it runs at all, the program does not run if they cannot be set
+func (l Limits) wrap(exe string, args []string) (string, []string) {
+	var script []string
+	if l.CPU > 0 {
+		script = append(script, fmt.Sprintf("ulimit -t %d", l.CPU))
+	}
+	if l.Memory > 0 {
+		// kilobytes
+		script = append(script, fmt.Sprintf("ulimit -v %d", l.Memory/1024))
+	}
+	if l.FileSize > 0 {
+		// 512 byte blocks for sh
+		script = append(script, fmt.Sprintf("ulimit -f %d", (l.FileSize+511)/512))
+	}
+	if l.OpenFiles > 0 {
+		script = append(script, fmt.Sprintf("ulimit -n %d", l.OpenFiles))
+	}
+	if len(script) == 0 {
+		return exe, args
+	}
+	script = append(script, `exec "$0" "$@"`)
+	return "/bin/sh", append([]string{"-c", strings.Join(script, " && "), exe}, args...)
+}
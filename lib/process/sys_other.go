@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import (
+	"os"
+	"syscall"
+)
+
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func killGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// resource limits are only supported on linux
+func (l Limits) wrap(exe string, args []string) (string, []string) {
+	return exe, args
+}
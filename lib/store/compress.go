@@ -0,0 +1,277 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"strings"
+)
+
+// ways articles can be compressed on disk
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+var ErrUnknownCompression = errors.New("unknown compression, use gzip, zstd or none")
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// get the compression method a config names
+func ParseCompression(method string) (string, error) {
+	switch strings.ToLower(method) {
+	case "", "none":
+		return CompressNone, nil
+	case CompressGzip:
+		return CompressGzip, nil
+	case CompressZstd:
+		return CompressZstd, nil
+	}
+	return "", ErrUnknownCompression
+}
+
+// how the start of an article file is compressed
+// articles begin with a text header so neither magic is ever plain text
+func detectCompression(head []byte) string {
+	if bytes.HasPrefix(head, gzipMagic) {
+		return CompressGzip
+	} else if bytes.HasPrefix(head, zstdMagic) {
+		return CompressZstd
+	}
+	return CompressNone
+}
+
+// read up to n bytes at offset, fewer at the end of the file
+func readAtMost(f *os.File, n int, offset int64) ([]byte, error) {
+	buff := make([]byte, n)
+	n, err := f.ReadAt(buff, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return buff[:n], err
+}
+
+// decompresses an article and closes its file when done
+type decompressReader struct {
+	io.Reader
+	f     *os.File
+	close func()
+}
+
+func (r *decompressReader) Close() error {
+	r.close()
+	return r.f.Close()
+}
+
+// open an article file, decompressing it if it is compressed
+func openArticleFile(fpath string) (r io.ReadCloser, err error) {
+	var f *os.File
+	f, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	var head []byte
+	head, err = readAtMost(f, len(zstdMagic), 0)
+	if err != nil {
+		f.Close()
+		return
+	}
+	switch detectCompression(head) {
+	case CompressGzip:
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(f)
+		if err == nil {
+			r = &decompressReader{zr, f, func() { zr.Close() }}
+		}
+	case CompressZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			r = &decompressReader{zr, f, zr.Close}
+		}
+	default:
+		r = f
+	}
+	if err != nil {
+		f.Close()
+	}
+	return
+}
+
+// size of an article before it was compressed, read from the file without decompressing it
+func articleFileSize(fpath string, info os.FileInfo) (size int64, err error) {
+	size = info.Size()
+	var f *os.File
+	f, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var head []byte
+	// longest zstd frame header
+	head, err = readAtMost(f, zstd.HeaderMaxSize, 0)
+	if err != nil {
+		return
+	}
+	switch detectCompression(head) {
+	case CompressGzip:
+		// the gzip trailer ends with the uncompressed size mod 2^32, articles are never that big
+		if info.Size() < 4 {
+			break
+		}
+		var tail []byte
+		tail, err = readAtMost(f, 4, info.Size()-4)
+		if err == nil && len(tail) == 4 {
+			size = int64(binary.LittleEndian.Uint32(tail))
+		}
+	case CompressZstd:
+		var h zstd.Header
+		err = h.Decode(head)
+		if err == nil && h.HasFCS {
+			size = int64(h.FrameContentSize)
+		}
+	}
+	return
+}
+
+// write a compressed or decompressed copy of src to a new temp file
+// size is how big src is uncompressed, zstd records it for articleFileSize
+func (fs FilesystemStorage) recodeTempFile(src io.Reader, method string, size int64) (tmp string, err error) {
+	var f *os.File
+	f, err = fs.createTempFile()
+	if err != nil {
+		return
+	}
+	tmp = f.Name()
+	var w io.WriteCloser
+	switch method {
+	case CompressGzip:
+		w = gzip.NewWriter(f)
+	case CompressZstd:
+		var zw *zstd.Encoder
+		zw, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err == nil {
+			zw.ResetContentSize(f, size)
+			w = zw
+		}
+	default:
+		w = f
+	}
+	if err == nil {
+		_, err = io.Copy(w, src)
+		if w != f {
+			if e := w.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+	if e := fs.finishTempFile(f); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		tmp = ""
+	}
+	return
+}
+
+// compress a finished temp file with the configured method
+// returns the temp file to commit in its place
+func (fs FilesystemStorage) compressTempFile(tmp string) (ctmp string, err error) {
+	if fs.Compression == CompressNone {
+		return tmp, nil
+	}
+	var f *os.File
+	f, err = os.Open(tmp)
+	if err != nil {
+		return
+	}
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err == nil {
+		ctmp, err = fs.recodeTempFile(f, fs.Compression, info.Size())
+	}
+	f.Close()
+	os.Remove(tmp)
+	return
+}
+
+// what recompressing a storage changed
+type CompressStats struct {
+	// articles rewritten
+	Articles int64 `json:"articles"`
+	// size of the rewritten articles before and after
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int64 `json:"bytes_after"`
+}
+
+// rewrite every stored article compressed with method, or uncompressed with CompressNone
+// articles already stored that way are left alone
+func (fs FilesystemStorage) Recompress(method string) (st CompressStats, err error) {
+	method, err = ParseCompression(method)
+	if err != nil {
+		return
+	}
+	err = walkShards(fs.ArticleDir(), func(fpath string, info os.FileInfo) (err error) {
+		var f *os.File
+		f, err = os.Open(fpath)
+		if err != nil {
+			return
+		}
+		var head []byte
+		head, err = readAtMost(f, len(zstdMagic), 0)
+		f.Close()
+		if err != nil || detectCompression(head) == method {
+			return
+		}
+		var size int64
+		size, err = articleFileSize(fpath, info)
+		if err != nil {
+			return
+		}
+		var r io.ReadCloser
+		r, err = openArticleFile(fpath)
+		if err != nil {
+			return
+		}
+		var tmp string
+		tmp, err = fs.recodeTempFile(r, method, size)
+		r.Close()
+		if err != nil {
+			return
+		}
+		var tinfo os.FileInfo
+		tinfo, err = os.Stat(tmp)
+		if err == nil {
+			// keep the time the article was stored
+			os.Chtimes(tmp, info.ModTime(), info.ModTime())
+			err = os.Rename(tmp, fpath)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return
+		}
+		st.Articles++
+		st.BytesBefore += info.Size()
+		st.BytesAfter += tinfo.Size()
+		return
+	})
+	if err == nil {
+		log.WithFields(log.Fields{
+			"pkg":         "fs-store",
+			"filepath":    fs.String(),
+			"compression": method,
+			"articles":    st.Articles,
+			"before":      st.BytesBefore,
+			"after":       st.BytesAfter,
+		}).Info("recompressed articles")
+	}
+	return
+}
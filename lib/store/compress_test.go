@@ -0,0 +1,87 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// read a stored article back whole
+func readStoredArticle(t *testing.T, fs FilesystemStorage, msgid string) string {
+	r, err := fs.OpenArticle(msgid)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return string(data)
+}
+
+func TestRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-compress")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	group := "overchan.test"
+	article := conformanceArticle("<aa@test.tld>", group) + strings.Repeat("text compresses well\r\n", 200)
+	_, err = fs.StoreArticle(strings.NewReader(article), "<aa@test.tld>", group)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, method := range []string{CompressZstd, CompressGzip, CompressNone, CompressGzip} {
+		st, err := fs.Recompress(method)
+		if err != nil || st.Articles != 1 {
+			t.Logf("recompressing with %q %+v: %v", method, st, err)
+			t.FailNow()
+		}
+		if method != CompressNone && st.BytesAfter >= int64(len(article)) {
+			t.Logf("%s did not compress %+v", method, st)
+			t.Fail()
+		}
+		f, _ := os.Open(fs.articlePath("<aa@test.tld>"))
+		head, _ := readAtMost(f, 4, 0)
+		f.Close()
+		if detectCompression(head) != method {
+			t.Logf("article stored as %q not %q", detectCompression(head), method)
+			t.Fail()
+		}
+		if readStoredArticle(t, fs, "<aa@test.tld>") != article {
+			t.Logf("article changed by %q", method)
+			t.Fail()
+		}
+		list, _ := fs.ListGroup(group)
+		if len(list) != 1 || list[0].Size != int64(len(article)) {
+			t.Logf("wrong size listed with %q: %+v", method, list)
+			t.Fail()
+		}
+	}
+	// already compressed that way
+	st, err := fs.Recompress(CompressGzip)
+	if err != nil || st.Articles != 0 {
+		t.Logf("recompressed again %+v: %v", st, err)
+		t.Fail()
+	}
+	if _, err = fs.Recompress("lzma"); err != ErrUnknownCompression {
+		t.Logf("unknown compression gave %v", err)
+		t.Fail()
+	}
+	report, err := fs.Fsck(false)
+	if err != nil || len(report.Problems) != 0 {
+		t.Logf("problems with compressed articles: %+v %v", report, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,461 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// make an article for the conformance tests
+func conformanceArticle(msgid, group string) string {
+	return "Message-ID: " + msgid + "\r\nNewsgroups: " + group + "\r\n\r\nbody of " + msgid + "\r\n"
+}
+
+// store articles in order, failing the test on error
+func conformanceStore(t *testing.T, st Storage, group string, msgids ...string) {
+	for _, msgid := range msgids {
+		_, err := st.StoreArticle(strings.NewReader(conformanceArticle(msgid, group)), msgid, group)
+		if err != nil {
+			t.Logf("failed to store %s: %v", msgid, err)
+			t.FailNow()
+		}
+	}
+}
+
+// check the watermarks of a newsgroup
+func conformanceWatermark(t *testing.T, st Storage, group string, hi, lo uint64) {
+	h, l, err := st.GetWatermark(group)
+	if err != nil || h != hi || l != lo {
+		t.Logf("watermarks of %s are hi=%d lo=%d not hi=%d lo=%d: %v", group, h, l, hi, lo, err)
+		t.Fail()
+	}
+}
+
+// link a stored article into another newsgroup like a crosspost
+func conformanceLink(st Storage, group, msgid string) (err error) {
+	switch s := st.(type) {
+	case FilesystemStorage:
+		err = s.linkArticle(group, msgid)
+	case *SQLiteStorage:
+		_, err = s.conn.Exec(`INSERT OR IGNORE INTO newsgroups(name) VALUES(?)`, group)
+		if err == nil {
+			_, err = s.conn.Exec(`UPDATE newsgroups SET hi = hi + 1 WHERE name = ?`, group)
+		}
+		if err == nil {
+			_, err = s.conn.Exec(`INSERT INTO group_articles(newsgroup, num, msgid) SELECT name, hi, ? FROM newsgroups WHERE name = ?`, msgid, group)
+		}
+	}
+	return
+}
+
+// run the tests every storage has to pass
+// keeps is false for storage that throws away what it is given
+func testConformance(t *testing.T, st Storage, keeps bool) {
+	t.Run("StoreHasOpen", func(t *testing.T) {
+		msgid := "<store@test.tld>"
+		conformanceStore(t, st, "conf.store", msgid)
+		if st.HasArticle("<missing@test.tld>") != ErrNoSuchArticle {
+			t.Log("missing article found")
+			t.Fail()
+		}
+		if f, err := st.OpenArticle("<missing@test.tld>"); err == nil {
+			f.Close()
+			t.Log("missing article opened")
+			t.Fail()
+		}
+		if !keeps {
+			if st.HasArticle(msgid) != ErrNoSuchArticle {
+				t.Log("article kept")
+				t.Fail()
+			}
+			return
+		}
+		if err := st.HasArticle(msgid); err != nil {
+			t.Logf("stored article not found: %v", err)
+			t.FailNow()
+		}
+		f, err := st.OpenArticle(msgid)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != conformanceArticle(msgid, "conf.store") {
+			t.Logf("wrong article contents %q: %v", data, err)
+			t.Fail()
+		}
+		// storing again keeps the first copy
+		conformanceStore(t, st, "conf.store", msgid)
+		list, _ := st.ListGroup("conf.store")
+		if len(list) != 1 {
+			t.Logf("article stored twice: %+v", list)
+			t.Fail()
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		msgid := "<delete@test.tld>"
+		conformanceStore(t, st, "conf.delete", msgid)
+		if !keeps {
+			return
+		}
+		if err := st.DeleteArticle(msgid); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		if st.HasArticle(msgid) != ErrNoSuchArticle {
+			t.Log("deleted article found")
+			t.Fail()
+		}
+		if list, _ := st.ListGroup("conf.delete"); len(list) != 0 {
+			t.Logf("deleted article still in newsgroup: %+v", list)
+			t.Fail()
+		}
+		if err := st.DeleteArticle(msgid); err != ErrNoSuchArticle {
+			t.Logf("deleting a missing article gave %v", err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Watermarks", func(t *testing.T) {
+		group := "conf.watermark"
+		if !keeps {
+			conformanceStore(t, st, group, "<wm1@test.tld>")
+			return
+		}
+		conformanceWatermark(t, st, group, 0, 1)
+		conformanceStore(t, st, group, "<wm1@test.tld>", "<wm2@test.tld>", "<wm3@test.tld>")
+		conformanceWatermark(t, st, group, 3, 1)
+		list, err := st.ListGroup(group)
+		if err != nil || len(list) != 3 {
+			t.Logf("bad listing %+v: %v", list, err)
+			t.FailNow()
+		}
+		for idx, a := range list {
+			if a.Number != uint64(idx+1) || a.Size == 0 || a.Stored.IsZero() {
+				t.Logf("bad article in listing %+v", a)
+				t.Fail()
+			}
+		}
+		_, err = st.ExpireArticles(group, list[:1])
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		conformanceWatermark(t, st, group, 3, 2)
+		st.DeleteArticle("<wm2@test.tld>")
+		st.DeleteArticle("<wm3@test.tld>")
+		// numbers are never reused
+		conformanceWatermark(t, st, group, 3, 4)
+		conformanceStore(t, st, group, "<wm4@test.tld>")
+		conformanceWatermark(t, st, group, 4, 4)
+	})
+
+	t.Run("ExpireCrossposted", func(t *testing.T) {
+		msgid := "<crosspost@test.tld>"
+		_, err := st.StoreArticle(strings.NewReader(conformanceArticle(msgid, "conf.cross1,conf.cross2")), msgid, "conf.cross1")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		if !keeps {
+			return
+		}
+		err = conformanceLink(st, "conf.cross2", msgid)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		// expiring from one newsgroup keeps it in the other
+		list, _ := st.ListGroup("conf.cross1")
+		deleted, err := st.ExpireArticles("conf.cross1", list)
+		if err != nil || len(deleted) != 0 || st.HasArticle(msgid) != nil {
+			t.Logf("crossposted article deleted %v: %v", deleted, err)
+			t.FailNow()
+		}
+		conformanceWatermark(t, st, "conf.cross1", 1, 2)
+		list, _ = st.ListGroup("conf.cross2")
+		if len(list) != 1 || list[0].MessageID != msgid {
+			t.Logf("crossposted article gone from other newsgroup: %+v", list)
+			t.FailNow()
+		}
+		// and deletes it once no newsgroup has it
+		deleted, err = st.ExpireArticles("conf.cross2", list)
+		if err != nil || len(deleted) != 1 || deleted[0] != msgid || st.HasArticle(msgid) != ErrNoSuchArticle {
+			t.Logf("article left after expiring from every newsgroup %v: %v", deleted, err)
+			t.Fail()
+		}
+		conformanceWatermark(t, st, "conf.cross2", 1, 2)
+	})
+
+	t.Run("ForEachInGroupOrder", func(t *testing.T) {
+		group := "conf.order"
+		// stored in another order than the message-ids sort in
+		msgids := []string{"<ee@test.tld>", "<cc@test.tld>", "<dd@test.tld>", "<aa@test.tld>", "<bb@test.tld>"}
+		conformanceStore(t, st, group, msgids...)
+		chnl := make(chan string, len(msgids))
+		st.ForEachInGroup(group, chnl)
+		close(chnl)
+		var got []string
+		for msgid := range chnl {
+			got = append(got, msgid)
+		}
+		if keeps && strings.Join(got, " ") != strings.Join(msgids, " ") {
+			t.Logf("articles in wrong order: %v", got)
+			t.Fail()
+		}
+		if !keeps && len(got) != 0 {
+			t.Logf("articles kept: %v", got)
+			t.Fail()
+		}
+	})
+
+	t.Run("Newsgroups", func(t *testing.T) {
+		conformanceStore(t, st, "conf.groups", "<groups@test.tld>")
+		groups, err := st.GetAllNewsgroups()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		if !keeps {
+			return
+		}
+		found := false
+		for _, g := range groups {
+			found = found || g == "conf.groups"
+		}
+		if !found {
+			t.Logf("newsgroup not listed: %v", groups)
+			t.Fail()
+		}
+		if has, err := st.HasNewsgroup("conf.groups"); !has || err != nil {
+			t.Logf("newsgroup not found: %v", err)
+			t.Fail()
+		}
+		if has, err := st.HasNewsgroup("conf.nothing"); has || err != nil {
+			t.Logf("newsgroup without articles found: %v", err)
+			t.Fail()
+		}
+	})
+
+	t.Run("AttachmentDedup", func(t *testing.T) {
+		first, err := st.StoreAttachment(strings.NewReader("same"), "first.png")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		second, _ := st.StoreAttachment(strings.NewReader("same"), "second.png")
+		other, _ := st.StoreAttachment(strings.NewReader("other"), "other.png")
+		if !keeps {
+			if _, err = st.OpenAttachment(first); err != ErrNoSuchAttachment {
+				t.Logf("attachment kept: %v", err)
+				t.Fail()
+			}
+			return
+		}
+		if first != second || first == other || filepath.Ext(first) != ".png" {
+			t.Logf("bad attachment names %s %s %s", first, second, other)
+			t.Fail()
+		}
+		r, err := st.OpenAttachment(filepath.Base(first))
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != "same" {
+			t.Logf("wrong attachment contents %q", data)
+			t.Fail()
+		}
+		// just stored, it may belong to an article not indexed yet
+		if err = st.DeleteOldAttachment(filepath.Base(first), time.Hour); err != ErrRecentAttachment {
+			t.Logf("deleting a recent attachment gave %v", err)
+			t.Fail()
+		}
+		if err = st.DeleteAttachment(filepath.Base(first)); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+		if err = st.DeleteOldAttachment(filepath.Base(first), time.Hour); err != ErrNoSuchAttachment {
+			t.Logf("deleting a missing old attachment gave %v", err)
+			t.Fail()
+		}
+		if err = st.DeleteAttachment(filepath.Base(first)); err != ErrNoSuchAttachment {
+			t.Logf("deleting a missing attachment gave %v", err)
+			t.Fail()
+		}
+		if _, err = st.OpenAttachment(filepath.Base(first)); err != ErrNoSuchAttachment {
+			t.Logf("opening a deleted attachment gave %v", err)
+			t.Fail()
+		}
+	})
+
+	t.Run("ConcurrentStores", func(t *testing.T) {
+		group := "conf.concurrent"
+		articles := 20
+		// every article is stored by several connections at once
+		copies := 3
+		var wg sync.WaitGroup
+		errs := make(chan error, articles*copies)
+		for n := 0; n < articles; n++ {
+			msgid := fmt.Sprintf("<concurrent%d@test.tld>", n)
+			for c := 0; c < copies; c++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, e := st.StoreArticle(strings.NewReader(conformanceArticle(msgid, group)), msgid, group)
+					if e != nil {
+						errs <- e
+					}
+				}()
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for e := range errs {
+			t.Log(e)
+			t.Fail()
+		}
+		if !keeps {
+			return
+		}
+		list, err := st.ListGroup(group)
+		if err != nil || len(list) != articles {
+			t.Logf("%d articles listed not %d: %v", len(list), articles, err)
+			t.FailNow()
+		}
+		seen := make(map[string]bool)
+		for idx, a := range list {
+			if a.Number != uint64(idx+1) || seen[a.MessageID] {
+				t.Logf("bad article number %d for %s", a.Number, a.MessageID)
+				t.Fail()
+			}
+			seen[a.MessageID] = true
+		}
+		conformanceWatermark(t, st, group, uint64(articles), 1)
+	})
+
+	t.Run("InvalidNames", func(t *testing.T) {
+		for _, msgid := range []string{"", "../escape", "<../../escape@test.tld>", "<a/b@test.tld>", "<a\\b@test.tld>", "noangles@test.tld"} {
+			if _, err := st.StoreArticle(strings.NewReader(conformanceArticle(msgid, "conf.invalid")), msgid, "conf.invalid"); err == nil {
+				t.Logf("stored article with message-id %q", msgid)
+				t.Fail()
+			}
+			if _, err := st.BeginArticle(msgid, "conf.invalid"); err == nil {
+				t.Logf("began article with message-id %q", msgid)
+				t.Fail()
+			}
+			if st.HasArticle(msgid) == nil {
+				t.Logf("found article with message-id %q", msgid)
+				t.Fail()
+			}
+			if f, err := st.OpenArticle(msgid); err == nil {
+				f.Close()
+				t.Logf("opened article with message-id %q", msgid)
+				t.Fail()
+			}
+			if st.DeleteArticle(msgid) == nil && keeps {
+				t.Logf("deleted article with message-id %q", msgid)
+				t.Fail()
+			}
+		}
+		msgid := "<invalidgroup@test.tld>"
+		for _, group := range []string{"", ".", "..", "../..", "a/b", "a\\b"} {
+			if _, err := st.StoreArticle(strings.NewReader(conformanceArticle(msgid, group)), msgid, group); err == nil {
+				t.Logf("stored article in newsgroup %q", group)
+				t.Fail()
+			}
+			if list, _ := st.ListGroup(group); len(list) != 0 {
+				t.Logf("listed articles of newsgroup %q: %+v", group, list)
+				t.Fail()
+			}
+		}
+		if st.HasArticle(msgid) != ErrNoSuchArticle {
+			t.Log("article in an invalid newsgroup was stored")
+			t.Fail()
+		}
+	})
+}
+
+func TestFilesystemStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-conformance")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := NewFilesytemStorage(filepath.Join(dir, "store"), true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	testConformance(t, st, true)
+	// nothing was written outside of the storage
+	infos, _ := ioutil.ReadDir(dir)
+	if len(infos) != 1 {
+		t.Logf("%d files next to the storage", len(infos))
+		t.Fail()
+	}
+}
+
+func TestShardedFilesystemStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-conformance")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := NewShardedFilesystemStorage(dir, true, 2)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	testConformance(t, st, true)
+}
+
+func TestCompressedFilesystemStorageConformance(t *testing.T) {
+	for _, method := range []string{CompressGzip, CompressZstd} {
+		t.Run(method, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "srnd-conformance")
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			defer os.RemoveAll(dir)
+			st, err := NewFilesytemStorage(dir, true)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			st.Compression = method
+			testConformance(t, st, true)
+		})
+	}
+}
+
+func TestSQLiteStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-conformance")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	st, err := NewSQLiteStorage(filepath.Join(dir, "store.db"), true, false)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer st.Close()
+	testConformance(t, st, true)
+}
+
+func TestNullStorageConformance(t *testing.T) {
+	testConformance(t, NewNullStorage(), false)
+}
@@ -1,16 +1,21 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base32"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/prometheus/client_golang/prometheus"
 	"io"
 	"io/ioutil"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,6 +26,14 @@ const LowWaterHeader = "X-Low-Water"
 type FilesystemStorage struct {
 	root               string
 	discardAttachments bool
+	locks              *groupLocks
+	// levels of directories articles and attachments are spread over
+	shardDepth int
+	// sync files and directories to disk before reporting them stored
+	Fsync bool
+	// how newly stored articles are compressed, one of the Compress constants
+	// articles are read back however they were stored
+	Compression string
 }
 
 func (fs FilesystemStorage) String() string {
@@ -36,6 +49,10 @@ func (fs FilesystemStorage) metadataFileForNewsgroup(newsgroup string) string {
 }
 
 func (fs FilesystemStorage) GetWatermark(newsgroup string) (hi, lo uint64, err error) {
+	err = checkNewsgroup(newsgroup)
+	if err != nil {
+		return
+	}
 	var hdr textproto.MIMEHeader
 	hdr, err = fs.getMetadataForNewsgroup(newsgroup)
 	if err == nil {
@@ -47,30 +64,17 @@ func (fs FilesystemStorage) GetWatermark(newsgroup string) (hi, lo uint64, err e
 	return
 }
 
+// get the metadata of a newsgroup, a newsgroup without any has empty watermarks
 func (fs FilesystemStorage) getMetadataForNewsgroup(newsgroup string) (hdr textproto.MIMEHeader, err error) {
 	var f *os.File
-	fp := fs.metadataFileForNewsgroup(newsgroup)
-	_, err = os.Stat(fp)
+	f, err = os.Open(fs.metadataFileForNewsgroup(newsgroup))
 	if os.IsNotExist(err) {
-		f, err = os.OpenFile(fp, os.O_RDWR|os.O_CREATE, 0600)
-		if err == nil {
-			h := make(textproto.MIMEHeader)
-			h.Set(HighWaterHeader, "0")
-			c := textproto.NewConn(f)
-			for k := range hdr {
-				for _, v := range h[k] {
-					err = c.PrintfLine("%s: %s", k, v)
-					if err != nil {
-						c.Close()
-						return
-					}
-				}
-			}
-			c.Close()
-		}
-	}
-	f, err = os.OpenFile(fp, os.O_RDWR, 0600)
-	if err == nil {
+		// written when the first article is numbered
+		hdr = make(textproto.MIMEHeader)
+		hdr.Set(HighWaterHeader, "0")
+		hdr.Set(LowWaterHeader, "1")
+		err = nil
+	} else if err == nil {
 		c := textproto.NewConn(f)
 		hdr, err = c.ReadMIMEHeader()
 		c.Close()
@@ -78,7 +82,24 @@ func (fs FilesystemStorage) getMetadataForNewsgroup(newsgroup string) (hdr textp
 	return
 }
 
+// write the metadata of a newsgroup, replacing what was there
+// the newsgroup must be locked
+func (fs FilesystemStorage) writeMetadataForNewsgroup(newsgroup string, hdr textproto.MIMEHeader) (err error) {
+	buff := new(bytes.Buffer)
+	for k := range hdr {
+		for _, v := range hdr[k] {
+			fmt.Fprintf(buff, "%s: %s\r\n", k, v)
+		}
+	}
+	// blank line ends the header
+	buff.WriteString("\r\n")
+	return fs.replaceFile(fs.metadataFileForNewsgroup(newsgroup), buff.Bytes())
+}
+
+// allocate the next article number of a newsgroup
 func (fs FilesystemStorage) nextIDForNewsgroup(newsgroup string) (id uint64, err error) {
+	unlock := fs.lockGroup(newsgroup)
+	defer unlock()
 	id, _, err = fs.GetWatermark(newsgroup)
 
 	if err == nil {
@@ -87,43 +108,35 @@ func (fs FilesystemStorage) nextIDForNewsgroup(newsgroup string) (id uint64, err
 		hdr, err = fs.getMetadataForNewsgroup(newsgroup)
 		if err == nil {
 			hdr.Set(HighWaterHeader, fmt.Sprintf("%d", id))
-			var f *os.File
-			f, err = os.OpenFile(fs.metadataFileForNewsgroup(newsgroup), os.O_WRONLY, 0600)
-			if err == nil {
-				c := textproto.NewConn(f)
-				for k := range hdr {
-					for _, v := range hdr[k] {
-						err = c.PrintfLine("%s: %s", k, v)
-						if err != nil {
-							c.Close()
-							return
-						}
-					}
-				}
-				c.Close()
-			}
+			err = fs.writeMetadataForNewsgroup(newsgroup, hdr)
 		}
 	}
 	return
 }
 
 func (fs FilesystemStorage) GetAllNewsgroups() (newsgroups []string, err error) {
-	err = filepath.Walk(fs.NewsgroupsDir(), filepath.WalkFunc(func(f string, info os.FileInfo, e error) (er error) {
-		if e != nil {
-			er = e
-			newsgroups = nil
-		}
-		if info.IsDir() && err == nil {
-			newsgroups = append(newsgroups, f)
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(fs.NewsgroupsDir())
+	for _, info := range infos {
+		if info.IsDir() {
+			group, e := unescapeName(info.Name())
+			if e == nil {
+				newsgroups = append(newsgroups, group)
+			}
 		}
-		return er
-	}))
+	}
 	return
 }
 
 func (fs FilesystemStorage) HasNewsgroup(newsgroup string) (has bool, err error) {
-	_, err = os.Stat(fs.newsgroupDir(newsgroup))
-	has = err == nil
+	err = checkNewsgroup(newsgroup)
+	if err == nil {
+		_, err = os.Stat(fs.newsgroupDir(newsgroup))
+		has = err == nil
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
 	return
 }
 
@@ -160,6 +173,7 @@ func (fs FilesystemStorage) Ensure() (err error) {
 			}
 		}
 	}
+	err = fs.checkLayout()
 	return
 }
 
@@ -173,24 +187,23 @@ func (fs FilesystemStorage) AttachmentDir() string {
 	return filepath.Join(fs.String(), "att")
 }
 
+// get the directory path for thumbnails
+func (fs FilesystemStorage) ThumbnailDir() string {
+	return filepath.Join(fs.String(), "thm")
+}
+
 // get the directory path for articles
 func (fs FilesystemStorage) ArticleDir() string {
 	return filepath.Join(fs.String(), "articles")
 }
 
-// get a temporary file we can use for read/write that deletes itself on close
-func (fs FilesystemStorage) obtainTempFile() (f *os.File, err error) {
-	fname := fmt.Sprintf("tempfile-%x-%d", crypto.RandBytes(4), time.Now().Unix())
-	log.WithFields(log.Fields{
-		"pkg":      "fs-store",
-		"filepath": fname,
-	}).Debug("opening temp file")
-	f, err = os.OpenFile(filepath.Join(fs.TempDir(), fname), os.O_RDWR|os.O_CREATE, 0400)
-	return
-}
-
 // store an article from a reader to disk
 func (fs FilesystemStorage) StoreArticle(r io.Reader, msgid, newsgroup string) (fpath string, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("store_article")).ObserveDuration()
+	err = checkArticle(msgid, newsgroup)
+	if err != nil {
+		return
+	}
 	err = fs.HasArticle(msgid)
 	if err == nil {
 		// discard the body as we have it stored already
@@ -204,70 +217,68 @@ func (fs FilesystemStorage) StoreArticle(r io.Reader, msgid, newsgroup string) (
 			"pkg":   "fs-store",
 			"msgid": msgid,
 		}).Debug("storing article")
-		// don't have an article with this message id, write it to disk
-		var f *os.File
-		fpath = filepath.Join(fs.ArticleDir(), msgid)
-		f, err = os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY, 0644)
+		// don't have an article with this message id, write it to a temp file first
+		// so a failed or partial write never shows up as a stored article
+		var tx ArticleTx
+		tx, err = fs.BeginArticle(msgid, newsgroup)
 		if err == nil {
-			// file opened okay, defer the close
-			defer f.Close()
-			// write to disk
-			log.WithFields(log.Fields{
-				"pkg":   "fs-store",
-				"msgid": msgid,
-			}).Debug("writing to disk")
 			var n int64
-			n, err = io.Copy(f, r)
+			n, err = io.Copy(tx, r)
+			if err == nil {
+				fpath, err = tx.Commit()
+			} else {
+				tx.Abort()
+			}
 			if err == nil {
 				log.WithFields(log.Fields{
 					"pkg":     "fs-store",
 					"msgid":   msgid,
 					"written": n,
 				}).Debug("wrote article to disk")
-				// symlink
-				g := fs.newsgroupDir(newsgroup)
-				_, e := os.Stat(g)
-				if os.IsNotExist(e) {
-					err = os.Mkdir(g, 0700)
-				}
-				var nntpid uint64
-				nntpid, err = fs.nextIDForNewsgroup(newsgroup)
-				if err == nil {
-					err = os.Symlink(filepath.Join("..", "..", "articles", msgid), filepath.Join(g, fmt.Sprintf("%d", nntpid)))
-				}
-				if err != nil {
-					log.WithFields(log.Fields{
-						"pkg":   "fs-store",
-						"msgid": msgid,
-						"group": newsgroup,
-					}).Debug("failed to link article")
-				}
 			} else {
 				log.WithFields(log.Fields{
 					"pkg":     "fs-store",
 					"msgid":   msgid,
 					"written": n,
-				}).Error("write to disk failed")
+				}).Error("write to disk failed ", err)
+			}
+		}
+	}
+	return
+}
+
+// give a stored article the next number in a newsgroup
+func (fs FilesystemStorage) linkArticle(newsgroup, msgid string) (err error) {
+	g := fs.newsgroupDir(newsgroup)
+	err = os.MkdirAll(g, 0700)
+	var nntpid uint64
+	if err == nil {
+		nntpid, err = fs.nextIDForNewsgroup(newsgroup)
+	}
+	link := filepath.Join(g, fmt.Sprintf("%d", nntpid))
+	if err == nil {
+		err = os.Symlink(fs.articleLinkTarget(msgid), link)
+		if err == nil {
+			err = fs.syncDir(g)
+			if err != nil {
+				os.Remove(link)
 			}
-		} else {
-			log.WithFields(log.Fields{
-				"pkg":      "fs-store",
-				"msgid":    msgid,
-				"filepath": fpath,
-			}).Error("did not open file for storage", err)
 		}
 	}
 	return
 }
 
 func (fs FilesystemStorage) newsgroupDir(group string) string {
-	return filepath.Join(fs.NewsgroupsDir(), group)
+	return filepath.Join(fs.NewsgroupsDir(), escapeName(group))
 }
 
 // check if we have the artilce with this message id
 func (fs FilesystemStorage) HasArticle(msgid string) (err error) {
-	fpath := fs.ArticleDir()
-	fpath = filepath.Join(fpath, msgid)
+	err = checkMessageID(msgid)
+	if err != nil {
+		return
+	}
+	fpath := fs.articlePath(msgid)
 	log.WithFields(log.Fields{
 		"pkg":      "fs-store",
 		"msgid":    msgid,
@@ -281,125 +292,461 @@ func (fs FilesystemStorage) HasArticle(msgid string) (err error) {
 }
 
 func (fs FilesystemStorage) DeleteArticle(msgid string) (err error) {
-	err = os.Remove(filepath.Join(fs.ArticleDir(), msgid))
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("delete_article")).ObserveDuration()
+	err = checkMessageID(msgid)
+	if err != nil {
+		return
+	}
+	groups := fs.articleNewsgroups(msgid)
+	err = os.Remove(fs.articlePath(msgid))
+	if os.IsNotExist(err) {
+		err = ErrNoSuchArticle
+	}
+	if err != nil {
+		return
+	}
+	for _, g := range groups {
+		e := fs.unlinkArticle(g, msgid)
+		if e != nil {
+			log.WithFields(log.Fields{
+				"pkg":   "fs-store",
+				"msgid": msgid,
+				"group": g,
+			}).Warn("failed to unlink deleted article ", e)
+		}
+	}
+	return
+}
+
+// get the newsgroups an article is in from its header
+// falls back to all newsgroups if the header cannot be read
+func (fs FilesystemStorage) articleNewsgroups(msgid string) (groups []string) {
+	f, err := openArticleFile(fs.articlePath(msgid))
+	if err == nil {
+		var hdr textproto.MIMEHeader
+		hdr, err = textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+		f.Close()
+		for _, v := range hdr["Newsgroups"] {
+			for _, g := range strings.Split(v, ",") {
+				g = strings.TrimSpace(g)
+				if g != "" {
+					groups = append(groups, g)
+				}
+			}
+		}
+	}
+	if len(groups) == 0 {
+		groups, _ = fs.GetAllNewsgroups()
+	}
+	return
+}
+
+// get the numbers of all articles linked in a newsgroup, unsorted
+func (fs FilesystemStorage) groupNumbers(newsgroup string) (nums []uint64, err error) {
+	var d *os.File
+	d, err = os.Open(fs.newsgroupDir(newsgroup))
+	if err != nil {
+		return
+	}
+	var names []string
+	names, err = d.Readdirnames(-1)
+	d.Close()
+	for _, name := range names {
+		num, e := strconv.ParseUint(name, 10, 64)
+		if e == nil {
+			nums = append(nums, num)
+		}
+	}
+	return
+}
+
+// remove every link to an article from a newsgroup
+func (fs FilesystemStorage) unlinkArticle(newsgroup, msgid string) (err error) {
+	var nums []uint64
+	nums, err = fs.groupNumbers(newsgroup)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	unlinked := false
+	for _, num := range nums {
+		link := filepath.Join(fs.newsgroupDir(newsgroup), strconv.FormatUint(num, 10))
+		target, e := os.Readlink(link)
+		if e != nil {
+			continue
+		}
+		if linked, e := linkMessageID(target); e == nil && linked == msgid {
+			err = os.Remove(link)
+			if err != nil {
+				return
+			}
+			unlinked = true
+		}
+	}
+	if unlinked {
+		err = fs.updateLowWater(newsgroup)
+	}
+	return
+}
+
+// set the low water mark of a newsgroup to its lowest article number
+// an empty newsgroup gets one more than its high water mark
+func (fs FilesystemStorage) updateLowWater(newsgroup string) (err error) {
+	unlock := fs.lockGroup(newsgroup)
+	defer unlock()
+	var nums []uint64
+	nums, err = fs.groupNumbers(newsgroup)
+	if err != nil {
+		return
+	}
+	var hdr textproto.MIMEHeader
+	hdr, err = fs.getMetadataForNewsgroup(newsgroup)
+	if err != nil {
+		return
+	}
+	var lo uint64
+	if len(nums) == 0 {
+		lo, err = strconv.ParseUint(hdr.Get(HighWaterHeader), 10, 64)
+		lo++
+	} else {
+		lo = nums[0]
+		for _, num := range nums[1:] {
+			if num < lo {
+				lo = num
+			}
+		}
+	}
+	if err == nil {
+		hdr.Set(LowWaterHeader, strconv.FormatUint(lo, 10))
+		err = fs.writeMetadataForNewsgroup(newsgroup, hdr)
+	}
+	return
+}
+
+func (fs FilesystemStorage) ListGroup(newsgroup string) (articles []GroupArticle, err error) {
+	err = checkNewsgroup(newsgroup)
+	if err != nil {
+		return
+	}
+	var nums []uint64
+	nums, err = fs.groupNumbers(newsgroup)
+	if os.IsNotExist(err) {
+		// no articles yet
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	sort.Slice(nums, func(i, j int) bool {
+		return nums[i] < nums[j]
+	})
+	for _, num := range nums {
+		target, e := os.Readlink(filepath.Join(fs.newsgroupDir(newsgroup), strconv.FormatUint(num, 10)))
+		if e != nil {
+			// not an article link
+			continue
+		}
+		msgid, e := linkMessageID(target)
+		if e != nil {
+			continue
+		}
+		a := GroupArticle{
+			Number:    num,
+			MessageID: msgid,
+		}
+		// links to deleted articles are listed with no size or time
+		fpath := fs.articlePath(a.MessageID)
+		info, e := os.Stat(fpath)
+		if e == nil {
+			// the size it has uncompressed
+			a.Size, e = articleFileSize(fpath, info)
+		}
+		if e == nil {
+			a.Stored = info.ModTime()
+		} else if os.IsNotExist(e) {
+			a.Size = 0
+		} else {
+			// a zero time would have the article expired as if it was deleted
+			log.WithFields(log.Fields{
+				"pkg":   "fs-store",
+				"msgid": a.MessageID,
+				"group": newsgroup,
+			}).Warn("not listing article that can't be read ", e)
+			continue
+		}
+		articles = append(articles, a)
+	}
+	return
+}
+
+func (fs FilesystemStorage) ExpireArticles(newsgroup string, articles []GroupArticle) (deleted []string, err error) {
+	err = checkNewsgroup(newsgroup)
+	if err != nil || len(articles) == 0 {
+		return
+	}
+	// message-ids linked in the other newsgroups of crossposted articles
+	links := make(map[string]map[string]bool)
+	for _, a := range articles {
+		err = os.Remove(filepath.Join(fs.newsgroupDir(newsgroup), strconv.FormatUint(a.Number, 10)))
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		if fs.linkedElsewhere(newsgroup, a.MessageID, links) {
+			continue
+		}
+		err = os.Remove(fs.articlePath(a.MessageID))
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		deleted = append(deleted, a.MessageID)
+	}
+	err = fs.updateLowWater(newsgroup)
+	return
+}
+
+// check if an article is linked in a newsgroup other than the given one
+// links caches the message-ids linked in each newsgroup looked at
+func (fs FilesystemStorage) linkedElsewhere(newsgroup, msgid string, links map[string]map[string]bool) bool {
+	for _, g := range fs.articleNewsgroups(msgid) {
+		if g == newsgroup {
+			continue
+		}
+		linked, ok := links[g]
+		if !ok {
+			linked = fs.groupLinks(g)
+			links[g] = linked
+		}
+		if linked[msgid] {
+			return true
+		}
+	}
+	return false
+}
+
+// get the message-ids of all articles linked in a newsgroup
+func (fs FilesystemStorage) groupLinks(newsgroup string) (linked map[string]bool) {
+	linked = make(map[string]bool)
+	nums, _ := fs.groupNumbers(newsgroup)
+	for _, num := range nums {
+		target, err := os.Readlink(filepath.Join(fs.newsgroupDir(newsgroup), strconv.FormatUint(num, 10)))
+		if err == nil {
+			msgid, err := linkMessageID(target)
+			if err == nil {
+				linked[msgid] = true
+			}
+		}
+	}
+	return
+}
+
+func (fs FilesystemStorage) DeleteAttachment(filename string) (err error) {
+	filename, err = attachmentBase(filename)
+	if err != nil {
+		return
+	}
+	err = os.Remove(fs.attachmentPath(filename))
+	if os.IsNotExist(err) {
+		return ErrNoSuchAttachment
+	}
+	if err == nil {
+		err = fs.deleteThumbnails(filename)
+	}
+	return
+}
+
+func (fs FilesystemStorage) DeleteOldAttachment(filename string, minAge time.Duration) (err error) {
+	filename, err = attachmentBase(filename)
+	if err != nil {
+		return
+	}
+	var info os.FileInfo
+	info, err = os.Stat(fs.attachmentPath(filename))
+	if os.IsNotExist(err) {
+		return ErrNoSuchAttachment
+	}
+	if err == nil && info.ModTime().After(time.Now().Add(-minAge)) {
+		// storing it again touches it
+		return ErrRecentAttachment
+	}
+	if err == nil {
+		err = fs.DeleteAttachment(filename)
+	}
+	return
+}
+
+// remove the thumbnails of an attachment, thumbnailers may have added an extension to the name
+// not every attachment has a thumbnail
+func (fs FilesystemStorage) deleteThumbnails(filename string) (err error) {
+	thm := fs.thumbnailPath(filename)
+	matches, _ := filepath.Glob(thm + ".*")
+	for _, fpath := range append(matches, thm) {
+		e := os.Remove(fpath)
+		if e != nil && !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return
+}
+
+// get the name of a stored attachment without any directories
+func attachmentBase(filename string) (string, error) {
+	filename = filepath.Base(filename)
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		return "", ErrNoSuchAttachment
+	}
+	return filename, nil
+}
+
+// path of the file a stored attachment is in
+func (fs FilesystemStorage) AttachmentPath(filename string) (fpath string, err error) {
+	filename, err = attachmentBase(filename)
+	if err == nil {
+		fpath = fs.attachmentPath(filename)
+		_, err = os.Stat(fpath)
+		if os.IsNotExist(err) {
+			err = ErrNoSuchAttachment
+		}
+	}
+	return
+}
+
+// path to write the thumbnail of an attachment to, its shard directory is created
+func (fs FilesystemStorage) ThumbnailPath(filename string) (fpath string, err error) {
+	filename, err = attachmentBase(filename)
+	if err == nil {
+		fpath = fs.thumbnailPath(filename)
+		err = os.MkdirAll(filepath.Dir(fpath), 0755)
+	}
 	return
 }
 
+// visit the file name of every stored attachment
+func (fs FilesystemStorage) WalkAttachments(visit func(filename string) error) error {
+	return walkShards(fs.AttachmentDir(), func(fpath string, info os.FileInfo) error {
+		return visit(info.Name())
+	})
+}
+
+// name an attachment is stored as given the hash of its contents and its original file name
+func attachmentFileName(sum []byte, filename string) string {
+	return base32.StdEncoding.EncodeToString(sum) + filepath.Ext(filename)
+}
+
 // store attachment onto filesystem
 func (fs FilesystemStorage) StoreAttachment(r io.Reader, filename string) (fpath string, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("store_attachment")).ObserveDuration()
 	if fs.discardAttachments {
 		_, err = io.Copy(ioutil.Discard, r)
 		return
 	}
-	// open temp file for storage
-	var tf *os.File
-	tf, err = fs.obtainTempFile()
+	// hash while writing to a temp file, the hash names the attachment
+	h := crypto.Hash()
+	var tmp string
+	var n int64
+	tmp, n, err = fs.writeTempFile(io.TeeReader(r, h))
 	if err == nil {
-		// we have the temp file
-
-		// close tempfile when done
-		defer func() {
-			n := tf.Name()
-			tf.Close()
-			os.Remove(n)
-		}()
-
-		// create hasher
-		h := crypto.Hash()
-		// create multiwriter
-		mw := io.MultiWriter(tf, h)
-
-		log.WithFields(log.Fields{
+		d := h.Sum(nil)
+		fpath = fs.attachmentPath(attachmentFileName(d, filename))
+		err = fs.commitTempFile(tmp, fpath)
+		l := log.WithFields(log.Fields{
 			"pkg":      "fs-store",
 			"filename": filename,
-		}).Debug("writing to disk")
-		var n int64
-		// write all of the reader to the multiwriter
-		n, err = io.Copy(mw, r)
-
+			"hash":     d,
+			"filepath": fpath,
+			"size":     n,
+		})
 		if err == nil {
-			// successful write
-
-			// get file checksum
-			d := h.Sum(nil)
-
-			// rename file to hash + extension from filename
-			fpath = base32.StdEncoding.EncodeToString(d) + filepath.Ext(filename)
-			fpath = filepath.Join(fs.AttachmentDir(), fpath)
-
-			_, err = os.Stat(fpath)
-			// is that file there?
-			if os.IsNotExist(err) {
-				// it's not there, let's write it
-				var f *os.File
-				f, err = os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, 0644)
-				if err == nil {
-					// file opened
-					defer f.Close()
-					// seek to beginning of tempfile
-					tf.Seek(0, os.SEEK_SET)
-					// write all of the temp file to the storage file
-					n, err = io.Copy(f, tf)
-					// if err == nil by here it's all good
-					l := log.WithFields(log.Fields{
-						"pkg":      "fs-store",
-						"filename": filename,
-						"hash":     d,
-						"filepath": fpath,
-						"size":     n,
-					})
-					if err == nil {
-						l.Debug("wrote attachment to disk")
-					} else {
-						l.Error("failed to write attachment to disk", err)
-					}
-				} else {
-					log.WithFields(log.Fields{
-						"pkg":      "fs-store",
-						"filename": filename,
-						"hash":     d,
-						"filepath": fpath,
-					}).Error("failed to open file")
-				}
-			} else {
-				log.WithFields(log.Fields{
-					"pkg":      "fs-store",
-					"filename": filename,
-					"hash":     d,
-					"filepath": fpath,
-					"size":     n,
-				}).Debug("attachment exists on disk")
-			}
+			attachmentBytes.Add(float64(n))
+			l.Debug("wrote attachment to disk")
+		} else if os.IsExist(err) {
+			err = touchFile(fpath)
+			l.Debug("attachment exists on disk")
+		}
+		if err != nil {
+			l.Error("failed to write attachment to disk ", err)
 		}
 	} else {
 		log.WithFields(log.Fields{
 			"pkg":      "fs-store",
 			"filename": filename,
-		}).Error("cannot open temp file for attachment", err)
+		}).Error("cannot write temp file for attachment ", err)
 	}
 	return
 }
 
 // open article given message-id
-// does not check validity
-func (fs FilesystemStorage) OpenArticle(msgid string) (r *os.File, err error) {
-	r, err = os.Open(filepath.Join(fs.ArticleDir(), msgid))
+// compressed articles are decompressed while reading
+func (fs FilesystemStorage) OpenArticle(msgid string) (r io.ReadCloser, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("open_article")).ObserveDuration()
+	err = checkMessageID(msgid)
+	if err == nil {
+		r, err = openArticleFile(fs.articlePath(msgid))
+		if os.IsNotExist(err) {
+			err = ErrNoSuchArticle
+		}
+	}
+	return
+}
+
+func (fs FilesystemStorage) OpenAttachment(filename string) (r io.ReadCloser, err error) {
+	filename, err = attachmentBase(filename)
+	if err != nil {
+		return
+	}
+	r, err = os.Open(fs.attachmentPath(filename))
+	if os.IsNotExist(err) {
+		err = ErrNoSuchAttachment
+	}
 	return
 }
 
 func (fs FilesystemStorage) ForEachInGroup(group string, chnl chan string) {
-	g := fs.newsgroupDir(group)
-	filepath.Walk(g, func(path string, info os.FileInfo, err error) error {
-		if info != nil {
-			chnl <- info.Name()
+	articles, _ := fs.ListGroup(group)
+	for _, a := range articles {
+		chnl <- a.MessageID
+	}
+}
+
+func (fs FilesystemStorage) WalkArticles(after string, visit func(msgid string) error) (err error) {
+	var names []string
+	err = walkShards(fs.ArticleDir(), func(fpath string, info os.FileInfo) error {
+		msgid, e := unescapeName(info.Name())
+		if e == nil {
+			names = append(names, msgid)
 		}
-		return err
+		return nil
 	})
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	idx := sort.SearchStrings(names, after)
+	for _, name := range names[idx:] {
+		if name == after {
+			continue
+		}
+		err = visit(name)
+		if err != nil {
+			break
+		}
+	}
+	return
 }
 
 // create a new filesystem storage directory
 // ensure directory and subdirectories
 func NewFilesytemStorage(dirname string, unpackAttachments bool) (fs FilesystemStorage, err error) {
+	return NewShardedFilesystemStorage(dirname, unpackAttachments, 0)
+}
+
+// create a new filesystem storage directory spreading files over shardDepth levels of directories
+// existing storage keeps the depth it was made or migrated with
+func NewShardedFilesystemStorage(dirname string, unpackAttachments bool, shardDepth int) (fs FilesystemStorage, err error) {
+	if shardDepth < 0 || shardDepth > MaxShardDepth {
+		err = ErrBadShardDepth
+		return
+	}
 	dirname, err = filepath.Abs(dirname)
 	if err == nil {
 		log.WithFields(log.Fields{
@@ -408,9 +755,25 @@ func NewFilesytemStorage(dirname string, unpackAttachments bool) (fs FilesystemS
 		}).Info("Creating New Filesystem Storage")
 		fs = FilesystemStorage{
 			root:               dirname,
-			discardAttachments: unpackAttachments,
+			discardAttachments: !unpackAttachments,
+			locks:              newGroupLocks(),
+			shardDepth:         shardDepth,
 		}
 		err = fs.Ensure()
 	}
+	if err == nil {
+		var l fsLayout
+		l, err = fs.readLayout()
+		depth := l.depth
+		if err == nil && depth != shardDepth {
+			log.WithFields(log.Fields{
+				"pkg":        "fs-store",
+				"filepath":   dirname,
+				"depth":      depth,
+				"configured": shardDepth,
+			}).Warn("storage has another shard depth than configured, run the store migrate command to change it")
+		}
+		fs.shardDepth = depth
+	}
 	return
 }
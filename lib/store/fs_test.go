@@ -0,0 +1,244 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStoreArticleConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	fs.Fsync = true
+	group := "overchan.test"
+	articles := 50
+	// every article is stored by several connections at once
+	copies := 4
+	var wg sync.WaitGroup
+	errs := make(chan error, articles*copies)
+	for n := 0; n < articles; n++ {
+		msgid := fmt.Sprintf("<article%d@test.tld>", n)
+		for c := 0; c < copies; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				body := strings.Repeat("line of text\n", 100)
+				_, e := fs.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\nNewsgroups: "+group+"\n\n"+body), msgid, group)
+				if e != nil {
+					errs <- e
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Log(e)
+		t.Fail()
+	}
+	list, err := fs.ListGroup(group)
+	if err != nil || len(list) != articles {
+		t.Logf("%d articles linked not %d: %v", len(list), articles, err)
+		t.FailNow()
+	}
+	seen := make(map[string]bool)
+	for idx, a := range list {
+		if a.Number != uint64(idx+1) || seen[a.MessageID] {
+			t.Logf("bad article number %d for %s", a.Number, a.MessageID)
+			t.Fail()
+		}
+		seen[a.MessageID] = true
+	}
+	hi, lo, err := fs.GetWatermark(group)
+	if err != nil || hi != uint64(articles) || lo != 1 {
+		t.Logf("wrong watermarks hi=%d lo=%d: %v", hi, lo, err)
+		t.Fail()
+	}
+	tmp, _ := ioutil.ReadDir(fs.TempDir())
+	if len(tmp) != 0 {
+		t.Logf("%d temp files left", len(tmp))
+		t.Fail()
+	}
+}
+
+// reader that fails part way through
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(b []byte) (n int, err error) {
+	n, err = f.r.Read(b)
+	if err == io.EOF {
+		err = errors.New("connection lost")
+	}
+	return
+}
+
+func TestStoreArticleFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	msgid := "<aa@test.tld>"
+	_, err = fs.StoreArticle(&failingReader{strings.NewReader("Message-ID: " + msgid + "\n\nhalf an art")}, msgid, "overchan.test")
+	if err == nil {
+		t.Log("failed write not reported")
+		t.Fail()
+	}
+	if fs.HasArticle(msgid) != ErrNoSuchArticle {
+		t.Log("partial article reported as stored")
+		t.Fail()
+	}
+	tmp, _ := ioutil.ReadDir(fs.TempDir())
+	if len(tmp) != 0 {
+		t.Logf("%d temp files left", len(tmp))
+		t.Fail()
+	}
+	// storing again works
+	_, err = fs.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\n\nwhole article\n"), msgid, "overchan.test")
+	if err != nil || fs.HasArticle(msgid) != nil {
+		t.Logf("article not stored on retry: %v", err)
+		t.Fail()
+	}
+}
+
+func TestStoreArticleFailedLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	// the newsgroup directory can't be made
+	err = ioutil.WriteFile(fs.newsgroupDir("overchan.test"), nil, 0600)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	msgid := "<aa@test.tld>"
+	_, err = fs.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\n\nhi\n"), msgid, "overchan.test")
+	if err == nil {
+		t.Log("failed link not reported")
+		t.Fail()
+	}
+	if fs.HasArticle(msgid) != ErrNoSuchArticle {
+		t.Log("article in no newsgroup kept")
+		t.Fail()
+	}
+}
+
+func TestListGroupUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, msgid := range []string{"<aa@test.tld>", "<bb@test.tld>", "<cc@test.tld>"} {
+		_, err = fs.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\n\nhi\n"), msgid, "overchan.test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	// deleted out from under the link
+	os.Remove(fs.articlePath("<aa@test.tld>"))
+	// there but can't be read
+	os.Remove(fs.articlePath("<bb@test.tld>"))
+	os.Mkdir(fs.articlePath("<bb@test.tld>"), 0700)
+	list, err := fs.ListGroup("overchan.test")
+	if err != nil || len(list) != 2 {
+		t.Logf("bad group listing %+v: %v", list, err)
+		t.FailNow()
+	}
+	if list[0].MessageID != "<aa@test.tld>" || !list[0].Stored.IsZero() {
+		t.Logf("deleted article listed as %+v", list[0])
+		t.Fail()
+	}
+	if list[1].MessageID != "<cc@test.tld>" || list[1].Stored.IsZero() {
+		t.Logf("stored article listed as %+v", list[1])
+		t.Fail()
+	}
+}
+
+func TestAttachmentThumbnailPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewShardedFilesystemStorage(dir, true, 2)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	fpath, _ := fs.StoreAttachment(strings.NewReader("attachment"), "file.png")
+	name := filepath.Base(fpath)
+	if apath, err := fs.AttachmentPath(name); err != nil || apath != fpath {
+		t.Logf("attachment path %s not %s: %v", apath, fpath, err)
+		t.Fail()
+	}
+	if _, err = fs.AttachmentPath("missing.png"); err != ErrNoSuchAttachment {
+		t.Logf("missing attachment gave %v", err)
+		t.Fail()
+	}
+	var walked []string
+	fs.WalkAttachments(func(filename string) error {
+		walked = append(walked, filename)
+		return nil
+	})
+	if len(walked) != 1 || walked[0] != name {
+		t.Logf("walked %v", walked)
+		t.Fail()
+	}
+	// thumbnailers may add an extension
+	tpath, err := fs.ThumbnailPath(name)
+	if err == nil {
+		err = ioutil.WriteFile(tpath+".jpeg", []byte("thumbnail"), 0600)
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err = fs.DeleteAttachment(name); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err = os.Stat(tpath + ".jpeg"); !os.IsNotExist(err) {
+		t.Log("thumbnail left after deleting attachment")
+		t.Fail()
+	}
+}
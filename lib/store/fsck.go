@@ -0,0 +1,273 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// kinds of problems fsck finds
+const (
+	// article file has no readable header
+	FsckBadArticle = "bad-article"
+	// article header has another message-id than its file name
+	FsckMessageIDMismatch = "msgid-mismatch"
+	// newsgroup link to an article that does not exist
+	FsckDanglingLink = "dangling-link"
+	// more than one link to the same article in a newsgroup
+	FsckDuplicateLink = "duplicate-link"
+	// newsgroup metadata that is missing or does not match the links
+	FsckWatermark = "watermark"
+	// attachment whose contents do not hash to its name
+	FsckBadAttachment = "bad-attachment"
+	// article, attachment or link in another shard directory than its name belongs in
+	FsckMisplaced = "misplaced"
+)
+
+// one problem found by fsck
+type FsckProblem struct {
+	// what is wrong, one of the Fsck constants
+	Kind string `json:"kind"`
+	// file the problem is with
+	Path string `json:"path"`
+	// human readable details
+	Detail string `json:"detail"`
+	// was it repaired?
+	Repaired bool `json:"repaired"`
+}
+
+// result of checking a storage
+type FsckReport struct {
+	Articles    int64          `json:"articles"`
+	Newsgroups  int64          `json:"newsgroups"`
+	Links       int64          `json:"links"`
+	Attachments int64          `json:"attachments"`
+	Problems    []*FsckProblem `json:"problems"`
+}
+
+func (r *FsckReport) problem(kind, path, detail string) *FsckProblem {
+	p := &FsckProblem{
+		Kind:   kind,
+		Path:   path,
+		Detail: detail,
+	}
+	r.Problems = append(r.Problems, p)
+	log.WithFields(log.Fields{
+		"pkg":      "fs-store",
+		"kind":     kind,
+		"filepath": path,
+	}).Debug("fsck: ", detail)
+	return p
+}
+
+// directory broken files are moved to on repair
+func (fs FilesystemStorage) LostFoundDir() string {
+	return filepath.Join(fs.String(), "lost+found")
+}
+
+// move a broken file out of the way
+func (fs FilesystemStorage) quarantine(fpath string) (err error) {
+	err = os.MkdirAll(fs.LostFoundDir(), 0700)
+	if err == nil {
+		err = os.Rename(fpath, filepath.Join(fs.LostFoundDir(), filepath.Base(fpath)))
+	}
+	return
+}
+
+// check the storage for inconsistencies
+// with repair set, broken articles and attachments are moved to lost+found,
+// bad links are removed and watermarks are rewritten
+// the daemon should not be running while repairing
+func (fs FilesystemStorage) Fsck(repair bool) (report *FsckReport, err error) {
+	report = new(FsckReport)
+	err = fs.fsckArticles(report, repair)
+	if err == nil {
+		err = fs.fsckNewsgroups(report, repair)
+	}
+	if err == nil {
+		err = fs.fsckAttachments(report, repair)
+	}
+	return
+}
+
+// read the message-id from an article file
+func readArticleMessageID(fpath string) (msgid string, err error) {
+	var f io.ReadCloser
+	f, err = openArticleFile(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var hdr textproto.MIMEHeader
+	hdr, err = textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if err == nil {
+		msgid = hdr.Get("Message-Id")
+		if msgid == "" {
+			msgid = hdr.Get("Messageid")
+		}
+	}
+	return
+}
+
+func (fs FilesystemStorage) fsckArticles(report *FsckReport, repair bool) error {
+	return walkShards(fs.ArticleDir(), func(fpath string, info os.FileInfo) (err error) {
+		report.Articles++
+		var p *FsckProblem
+		name, e := unescapeName(info.Name())
+		var msgid string
+		if e == nil {
+			msgid, e = readArticleMessageID(fpath)
+		}
+		if e != nil {
+			p = report.problem(FsckBadArticle, fpath, fmt.Sprintf("cannot read header: %s", e.Error()))
+		} else if msgid != name {
+			p = report.problem(FsckMessageIDMismatch, fpath, fmt.Sprintf("header has message-id %q", msgid))
+		} else if fpath != fs.articlePath(name) {
+			p = report.problem(FsckMisplaced, fpath, fmt.Sprintf("should be at %s", fs.articlePath(name)))
+			if repair {
+				err = fs.moveFile(fpath, fs.articlePath(name))
+				p.Repaired = err == nil
+			}
+			return
+		}
+		if p != nil && repair {
+			err = fs.quarantine(fpath)
+			p.Repaired = err == nil
+		}
+		return
+	})
+}
+
+func (fs FilesystemStorage) fsckNewsgroups(report *FsckReport, repair bool) (err error) {
+	var groups []string
+	groups, err = fs.GetAllNewsgroups()
+	for _, group := range groups {
+		report.Newsgroups++
+		var nums []uint64
+		nums, err = fs.groupNumbers(group)
+		if err != nil {
+			return
+		}
+		sort.Slice(nums, func(i, j int) bool {
+			return nums[i] < nums[j]
+		})
+		seen := make(map[string]uint64)
+		var lo, maxnum uint64
+		for _, num := range nums {
+			link := filepath.Join(fs.newsgroupDir(group), strconv.FormatUint(num, 10))
+			target, e := os.Readlink(link)
+			if e != nil {
+				// not a link
+				continue
+			}
+			report.Links++
+			// numbers of bad links were handed out too so they count for the high water mark
+			maxnum = num
+			msgid, e := linkMessageID(target)
+			var p *FsckProblem
+			if e == nil {
+				_, e = os.Stat(fs.articlePath(msgid))
+			}
+			if e != nil {
+				p = report.problem(FsckDanglingLink, link, fmt.Sprintf("article %s is gone", msgid))
+			} else if first, ok := seen[msgid]; ok {
+				p = report.problem(FsckDuplicateLink, link, fmt.Sprintf("article %s is also number %d", msgid, first))
+			} else {
+				seen[msgid] = num
+				if target != fs.articleLinkTarget(msgid) {
+					// right article in the wrong place, point the link there
+					lp := report.problem(FsckMisplaced, link, fmt.Sprintf("points at %s", target))
+					if repair {
+						err = replaceLink(link, fs.articleLinkTarget(msgid))
+						if err != nil {
+							return
+						}
+						lp.Repaired = true
+					}
+				}
+			}
+			if p != nil {
+				if repair {
+					err = os.Remove(link)
+					if err != nil {
+						return
+					}
+					p.Repaired = true
+				}
+				continue
+			}
+			if lo == 0 {
+				lo = num
+			}
+		}
+		unlock := fs.lockGroup(group)
+		// the high water mark never goes down so numbers are not reused
+		// stat first so a missing metadata file is reported rather than created
+		var curhi, curlo uint64
+		_, e := os.Stat(fs.metadataFileForNewsgroup(group))
+		if e == nil {
+			curhi, curlo, e = fs.GetWatermark(group)
+		}
+		hi := curhi
+		if e != nil || maxnum > hi {
+			hi = maxnum
+		}
+		if lo == 0 {
+			lo = hi + 1
+		}
+		if e != nil || hi != curhi || lo != curlo {
+			p := report.problem(FsckWatermark, fs.metadataFileForNewsgroup(group), fmt.Sprintf("watermarks should be %d %d", hi, lo))
+			if repair {
+				hdr := make(textproto.MIMEHeader)
+				hdr.Set(HighWaterHeader, strconv.FormatUint(hi, 10))
+				hdr.Set(LowWaterHeader, strconv.FormatUint(lo, 10))
+				err = fs.writeMetadataForNewsgroup(group, hdr)
+				p.Repaired = err == nil
+			}
+		}
+		unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (fs FilesystemStorage) fsckAttachments(report *FsckReport, repair bool) error {
+	return walkShards(fs.AttachmentDir(), func(fpath string, info os.FileInfo) (err error) {
+		report.Attachments++
+		var f *os.File
+		f, err = os.Open(fpath)
+		if err != nil {
+			return
+		}
+		h := crypto.Hash()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return
+		}
+		expected := attachmentFileName(h.Sum(nil), info.Name())
+		if expected != info.Name() {
+			p := report.problem(FsckBadAttachment, fpath, fmt.Sprintf("contents hash to %s", expected))
+			if repair {
+				err = fs.quarantine(fpath)
+				p.Repaired = err == nil
+			}
+		} else if fpath != fs.attachmentPath(info.Name()) {
+			p := report.problem(FsckMisplaced, fpath, fmt.Sprintf("should be at %s", fs.attachmentPath(info.Name())))
+			if repair {
+				err = fs.moveFile(fpath, fs.attachmentPath(info.Name()))
+				p.Repaired = err == nil
+			}
+		}
+		return
+	})
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fsck")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	group := "overchan.test"
+	for _, msgid := range []string{"<aa@test.tld>", "<bb@test.tld>", "<cc@test.tld>"} {
+		_, err = fs.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\nNewsgroups: "+group+"\n\nhi\n"), msgid, group)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	report, err := fs.Fsck(false)
+	if err != nil || len(report.Problems) != 0 || report.Articles != 3 || report.Links != 3 {
+		t.Logf("problems in clean storage: %+v %v", report, err)
+		t.FailNow()
+	}
+
+	// break things
+	gdir := fs.newsgroupDir(group)
+	os.Symlink(fs.articleLinkTarget("<aa@test.tld>"), filepath.Join(gdir, "4"))
+	os.Symlink(fs.articleLinkTarget("<zz@test.tld>"), filepath.Join(gdir, "5"))
+	for msgid, body := range map[string]string{"<dd@test.tld>": "Message-ID: <ee@test.tld>\n\nhi\n", "<ff@test.tld>": "garbage"} {
+		os.MkdirAll(filepath.Dir(fs.articlePath(msgid)), 0755)
+		ioutil.WriteFile(fs.articlePath(msgid), []byte(body), 0600)
+	}
+	att, _ := fs.StoreAttachment(strings.NewReader("attachment"), "file.png")
+	ioutil.WriteFile(att, []byte("changed"), 0644)
+	ioutil.WriteFile(fs.metadataFileForNewsgroup(group), []byte("X-High-Water: 3\nX-Low-Water: 7\n\n"), 0600)
+
+	kinds := []string{FsckBadArticle, FsckMessageIDMismatch, FsckDanglingLink, FsckDuplicateLink, FsckWatermark, FsckBadAttachment}
+	count := func(report *FsckReport) map[string]int {
+		found := make(map[string]int)
+		for _, p := range report.Problems {
+			found[p.Kind]++
+			if !p.Repaired {
+				found["unrepaired"]++
+			}
+		}
+		return found
+	}
+
+	report, err = fs.Fsck(false)
+	found := count(report)
+	if err != nil || len(report.Problems) != len(kinds) || found["unrepaired"] != len(kinds) {
+		t.Logf("bad report: %+v %v", found, err)
+		t.FailNow()
+	}
+	for _, kind := range kinds {
+		if found[kind] != 1 {
+			t.Logf("found %d %s problems", found[kind], kind)
+			t.Fail()
+		}
+	}
+	if _, err = os.Stat(att); err != nil {
+		t.Log("report only mode changed storage")
+		t.Fail()
+	}
+
+	report, err = fs.Fsck(true)
+	found = count(report)
+	if err != nil || len(report.Problems) != len(kinds) || found["unrepaired"] != 0 {
+		t.Logf("bad repair: %+v %v", found, err)
+		t.FailNow()
+	}
+	report, err = fs.Fsck(false)
+	if err != nil || len(report.Problems) != 0 {
+		t.Logf("problems left after repair: %+v %v", count(report), err)
+		t.Fail()
+	}
+	hi, lo, err := fs.GetWatermark(group)
+	if err != nil || hi != 5 || lo != 1 {
+		t.Logf("wrong watermarks after repair hi=%d lo=%d: %v", hi, lo, err)
+		t.Fail()
+	}
+	list, _ := fs.ListGroup(group)
+	if len(list) != 3 {
+		t.Logf("wrong articles left in group: %+v", list)
+		t.Fail()
+	}
+	for _, name := range []string{"<dd@test.tld>", "<ff@test.tld>", filepath.Base(att)} {
+		if _, err = os.Stat(filepath.Join(fs.LostFoundDir(), name)); err != nil {
+			t.Logf("%s not moved to lost+found", name)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// what a garbage collection removed
+type GCStats struct {
+	// attachments no article refers to
+	Attachments int64 `json:"attachments"`
+	// thumbnails of attachments that are gone
+	Thumbnails int64 `json:"thumbnails"`
+	// leftover temp files
+	TempFiles int64 `json:"tempfiles"`
+	// total bytes freed
+	Bytes int64 `json:"bytes"`
+}
+
+// tells if an attachment file name is referred to by any article
+type AttachmentRefChecker func(filename string) (bool, error)
+
+// remove attachments nothing refers to, thumbnails of missing attachments and leftover temp files
+// files modified less than minAge ago are kept as they may belong to an article being stored
+// with dryRun set nothing is removed but the stats are what would be removed
+func (fs FilesystemStorage) CollectGarbage(referenced AttachmentRefChecker, minAge time.Duration, dryRun bool) (st GCStats, err error) {
+	cutoff := time.Now().Add(-minAge)
+	remove := func(fpath string, info os.FileInfo, count *int64) error {
+		l := log.WithFields(log.Fields{
+			"pkg":      "fs-store",
+			"filepath": fpath,
+			"dryrun":   dryRun,
+		})
+		if !dryRun {
+			e := os.Remove(fpath)
+			if e != nil && !os.IsNotExist(e) {
+				return e
+			}
+		}
+		l.Debug("garbage collected")
+		*count++
+		st.Bytes += info.Size()
+		return nil
+	}
+
+	// attachments left after collecting
+	kept := make(map[string]bool)
+	err = walkShards(fs.AttachmentDir(), func(fpath string, info os.FileInfo) error {
+		if info.ModTime().After(cutoff) {
+			kept[info.Name()] = true
+			return nil
+		}
+		ref, e := referenced(info.Name())
+		if e != nil {
+			return e
+		}
+		if ref {
+			kept[info.Name()] = true
+			return nil
+		}
+		// stored again by a new article while we checked
+		info, e = os.Stat(fpath)
+		if os.IsNotExist(e) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		if info.ModTime().After(cutoff) {
+			kept[info.Name()] = true
+			return nil
+		}
+		return remove(fpath, info, &st.Attachments)
+	})
+	if err != nil {
+		return
+	}
+
+	err = walkShards(fs.ThumbnailDir(), func(fpath string, info os.FileInfo) error {
+		// thumbnails are named after their attachment, maybe with another extension
+		base := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		if kept[info.Name()] || kept[base] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		return remove(fpath, info, &st.Thumbnails)
+	})
+	if err != nil {
+		return
+	}
+
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(fs.TempDir())
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		err = remove(filepath.Join(fs.TempDir(), info.Name()), info, &st.TempFiles)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-gc")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	used, _ := fs.StoreAttachment(strings.NewReader("used"), "used.png")
+	unused, _ := fs.StoreAttachment(strings.NewReader("unused"), "unused.png")
+	fresh, _ := fs.StoreAttachment(strings.NewReader("fresh"), "fresh.png")
+	files := []string{
+		used,
+		unused,
+		filepath.Join(fs.ThumbnailDir(), filepath.Base(used)+".jpg"),
+		filepath.Join(fs.ThumbnailDir(), filepath.Base(unused)),
+		filepath.Join(fs.ThumbnailDir(), "orphan.jpg"),
+		filepath.Join(fs.TempDir(), "tempfile-left"),
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, f := range files {
+		ioutil.WriteFile(f, []byte("data"), 0644)
+		os.Chtimes(f, old, old)
+	}
+	referenced := func(fname string) (bool, error) {
+		return fname == filepath.Base(used), nil
+	}
+
+	st, err := fs.CollectGarbage(referenced, time.Hour, true)
+	if err != nil || st.Attachments != 1 || st.Thumbnails != 2 || st.TempFiles != 1 {
+		t.Logf("bad dry run: %+v %v", st, err)
+		t.Fail()
+	}
+	if _, err = os.Stat(unused); err != nil {
+		t.Log("dry run removed a file")
+		t.FailNow()
+	}
+
+	st, err = fs.CollectGarbage(referenced, time.Hour, false)
+	if err != nil || st.Attachments != 1 || st.Thumbnails != 2 || st.TempFiles != 1 {
+		t.Logf("bad collection: %+v %v", st, err)
+		t.Fail()
+	}
+	for idx, f := range files {
+		_, err = os.Stat(f)
+		// the used attachment and its thumbnail are kept
+		if (idx == 0 || idx == 2) != (err == nil) {
+			t.Logf("wrong state of %s after collecting: %v", f, err)
+			t.Fail()
+		}
+	}
+	if _, err = os.Stat(fresh); err != nil {
+		t.Log("fresh attachment removed")
+		t.Fail()
+	}
+
+	// storing an old attachment again keeps it until the new article is indexed
+	os.Chtimes(fresh, old, old)
+	_, err = fs.StoreAttachment(strings.NewReader("fresh"), "again.png")
+	if err == nil {
+		st, err = fs.CollectGarbage(referenced, time.Hour, false)
+	}
+	if err != nil || st.Attachments != 0 {
+		t.Logf("bad collection after storing again: %+v %v", st, err)
+		t.Fail()
+	}
+	if _, err = os.Stat(fresh); err != nil {
+		t.Log("attachment stored again removed")
+		t.Fail()
+	}
+}
+
+func TestSQLiteCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-gc")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSQLiteStorage(filepath.Join(dir, "store.db"), true, false)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	unused, _ := s.StoreAttachment(strings.NewReader("unused"), "unused.png")
+	again, _ := s.StoreAttachment(strings.NewReader("again"), "again.png")
+	racing, _ := s.StoreAttachment(strings.NewReader("racing"), "racing.png")
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	s.conn.Exec(`UPDATE attachments SET stored = ?`, old)
+
+	// storing an old attachment again keeps it until the new article is indexed
+	_, err = s.StoreAttachment(strings.NewReader("again"), "again.png")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	referenced := func(fname string) (bool, error) {
+		if fname == filepath.Base(racing) {
+			// stored again by an article being ingested while gc runs
+			_, err := s.StoreAttachment(strings.NewReader("racing"), "racing.png")
+			return false, err
+		}
+		return false, nil
+	}
+	st, err := s.CollectGarbage(referenced, time.Hour, false)
+	if err != nil || st.Attachments != 1 {
+		t.Logf("bad collection: %+v %v", st, err)
+		t.Fail()
+	}
+	if _, err = s.OpenAttachment(unused); err != ErrNoSuchAttachment {
+		t.Logf("unused attachment kept: %v", err)
+		t.Fail()
+	}
+	for _, fname := range []string{again, racing} {
+		f, err := s.OpenAttachment(fname)
+		if err != nil {
+			t.Logf("attachment stored again removed: %s %v", fname, err)
+			t.Fail()
+		} else {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// version of the on disk layout of a FilesystemStorage
+// storage from before there were versions has no layout file and is read as version 0,
+// it has every article in one directory named by its raw message-id
+// 2 is articles and attachments in shard directories with escaped names
+const fsLayoutVersion = 2
+
+const LayoutVersionHeader = "X-Layout-Version"
+const ShardDepthHeader = "X-Shard-Depth"
+
+// set while a migration is moving files, the layout version it started from
+const MigratingFromHeader = "X-Migrating-From"
+
+// deepest sharding allowed, each level is up to 256 directories
+const MaxShardDepth = 3
+
+var ErrOldLayout = errors.New("storage uses an old layout, stop the daemon and run the store migrate command")
+var ErrUnknownLayout = errors.New("storage uses an unknown layout")
+var ErrBadShardDepth = fmt.Errorf("shard depth must be between 0 and %d", MaxShardDepth)
+
+// bytes kept as they are in names on disk, everything else is percent escaped
+func safeNameByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("<>@$.+_=-", c) >= 0
+}
+
+// map a message-id or newsgroup to a name that is a single safe path element
+// valid message-ids and newsgroups map to themselves
+func escapeName(name string) string {
+	buff := new(bytes.Buffer)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		// a leading dot would make . and .. or hidden files
+		if safeNameByte(c) && !(i == 0 && c == '.') {
+			buff.WriteByte(c)
+		} else {
+			fmt.Fprintf(buff, "%%%02X", c)
+		}
+	}
+	return buff.String()
+}
+
+// get the message-id or newsgroup a name on disk is for
+func unescapeName(fname string) (string, error) {
+	return url.PathUnescape(fname)
+}
+
+// hex sha1 of a message-id, same as nntp.MessageID.LongHash
+func messageIDHash(msgid string) string {
+	sum := sha1.Sum([]byte(msgid))
+	return hex.EncodeToString(sum[:])
+}
+
+// directories a file goes in given the hash it is sharded by, two characters of the hash per level
+func (fs FilesystemStorage) shardDirs(hash string) string {
+	dirs := make([]string, 0, fs.shardDepth)
+	for level := 0; level < fs.shardDepth && len(hash) >= 2*(level+1); level++ {
+		dirs = append(dirs, hash[2*level:2*(level+1)])
+	}
+	return filepath.Join(dirs...)
+}
+
+// path of the file an article is stored in
+func (fs FilesystemStorage) articlePath(msgid string) string {
+	return filepath.Join(fs.ArticleDir(), fs.shardDirs(messageIDHash(msgid)), escapeName(msgid))
+}
+
+// path of the file an attachment is stored in, attachment names start with their hash
+func (fs FilesystemStorage) attachmentPath(filename string) string {
+	return filepath.Join(fs.AttachmentDir(), fs.shardDirs(filename), filename)
+}
+
+// path of the thumbnail of an attachment, sharded like the attachment
+func (fs FilesystemStorage) thumbnailPath(filename string) string {
+	return filepath.Join(fs.ThumbnailDir(), fs.shardDirs(filename), filename)
+}
+
+// what newsgroup links to an article point at, relative to the newsgroup directory
+func (fs FilesystemStorage) articleLinkTarget(msgid string) string {
+	return filepath.Join("..", "..", "articles", fs.shardDirs(messageIDHash(msgid)), escapeName(msgid))
+}
+
+// get the message-id of the article a newsgroup link points at
+func linkMessageID(target string) (string, error) {
+	return unescapeName(filepath.Base(target))
+}
+
+// visit every file under a sharded directory
+func walkShards(dir string, visit func(fpath string, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return visit(fpath, info)
+	})
+}
+
+// move a file to where it belongs, dropping it if a copy is already there
+func (fs FilesystemStorage) moveFile(src, dst string) (err error) {
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil {
+		err = os.Link(src, dst)
+		if os.IsExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Remove(src)
+	}
+	return
+}
+
+// remove shard directories left empty, deepest first
+func removeEmptyShards(dir string) {
+	var dirs []string
+	filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && fpath != dir {
+			dirs = append(dirs, fpath)
+		}
+		return nil
+	})
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		// fails for directories that still have files
+		os.Remove(dirs[idx])
+	}
+}
+
+func (fs FilesystemStorage) layoutFile() string {
+	return filepath.Join(fs.String(), "layout")
+}
+
+// layout of a FilesystemStorage as recorded in its layout file
+type fsLayout struct {
+	// layout version, 0 if there is no layout file
+	version int
+	// shard depth
+	depth int
+	// set while a migration is moving files
+	migrating bool
+	// version the migration started from
+	migratingFrom int
+}
+
+// read the layout of the storage, version 0 if it has none
+func (fs FilesystemStorage) readLayout() (l fsLayout, err error) {
+	var f *os.File
+	f, err = os.Open(fs.layoutFile())
+	if os.IsNotExist(err) {
+		return fsLayout{}, nil
+	} else if err != nil {
+		return
+	}
+	c := textproto.NewConn(f)
+	var hdr textproto.MIMEHeader
+	hdr, err = c.ReadMIMEHeader()
+	c.Close()
+	if err == nil {
+		l.version, err = strconv.Atoi(hdr.Get(LayoutVersionHeader))
+	}
+	if err == nil {
+		if hdr.Get(ShardDepthHeader) == "" {
+			// written before the depth was configurable
+			l.depth = 1
+		} else {
+			l.depth, err = strconv.Atoi(hdr.Get(ShardDepthHeader))
+		}
+	}
+	if err == nil && hdr.Get(MigratingFromHeader) != "" {
+		l.migrating = true
+		l.migratingFrom, err = strconv.Atoi(hdr.Get(MigratingFromHeader))
+	}
+	if err == nil && (l.depth < 0 || l.depth > MaxShardDepth) {
+		err = ErrBadShardDepth
+	}
+	return
+}
+
+// record the current layout with the shard depth of the storage
+func (fs FilesystemStorage) writeLayout() error {
+	return fs.replaceFile(fs.layoutFile(), []byte(fmt.Sprintf("%s: %d\r\n%s: %d\r\n\r\n", LayoutVersionHeader, fsLayoutVersion, ShardDepthHeader, fs.shardDepth)))
+}
+
+// record that a migration from a layout version is moving files
+// the storage can't be opened until the migration is done
+func (fs FilesystemStorage) writeMigrating(from int) error {
+	return fs.replaceFile(fs.layoutFile(), []byte(fmt.Sprintf("%s: %d\r\n%s: %d\r\n%s: %d\r\n\r\n", LayoutVersionHeader, fsLayoutVersion, ShardDepthHeader, fs.shardDepth, MigratingFromHeader, from)))
+}
+
+// are there articles stored directly in the article directory like the old layout has
+func (fs FilesystemStorage) hasFlatArticles() (flat bool, err error) {
+	var d *os.File
+	d, err = os.Open(fs.ArticleDir())
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	for !flat {
+		var infos []os.FileInfo
+		infos, err = d.Readdir(64)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		for _, info := range infos {
+			flat = flat || !info.IsDir()
+		}
+	}
+	return
+}
+
+// make sure the storage has the current layout
+// new storage gets it, storage with an old layout has to be migrated
+func (fs FilesystemStorage) checkLayout() (err error) {
+	var l fsLayout
+	l, err = fs.readLayout()
+	if err != nil {
+		return
+	}
+	version := l.version
+	if l.migrating {
+		// an interrupted migration has to be run again
+		err = ErrOldLayout
+	} else if version == 0 {
+		var flat bool
+		flat, err = fs.hasFlatArticles()
+		if err == nil && flat {
+			err = ErrOldLayout
+		} else if err == nil {
+			err = fs.writeLayout()
+		}
+	} else if version < fsLayoutVersion {
+		err = ErrOldLayout
+	} else if version > fsLayoutVersion {
+		err = ErrUnknownLayout
+	}
+	return
+}
+
+// what a layout migration changed
+type MigrateStats struct {
+	// articles moved
+	Articles int64 `json:"articles"`
+	// attachments and thumbnails moved
+	Attachments int64 `json:"attachments"`
+	// newsgroup directories renamed
+	Newsgroups int64 `json:"newsgroups"`
+	// newsgroup links pointed at the moved articles
+	Links int64 `json:"links"`
+}
+
+// point a newsgroup link somewhere else
+func replaceLink(link, target string) (err error) {
+	tmp := link + ".new"
+	os.Remove(tmp)
+	err = os.Symlink(target, tmp)
+	if err == nil {
+		err = os.Rename(tmp, link)
+	}
+	return
+}
+
+// get the message-id or newsgroup a name on disk is for while migrating from a layout version
+// names of old layouts are raw unless placed tells the file already is where its escaped name puts it,
+// which is the case for files an interrupted migration moved
+func layoutName(fname string, version int, placed func(name string) bool) (name string, err error) {
+	name, err = unescapeName(fname)
+	if version >= fsLayoutVersion || (err == nil && placed(name)) {
+		return
+	}
+	return fname, nil
+}
+
+// convert a filesystem storage in place to the current layout with files spread over shardDepth levels
+// safe to run again if interrupted but not while the daemon runs
+func MigrateFilesystemStorage(dirname string, shardDepth int) (st MigrateStats, err error) {
+	if shardDepth < 0 || shardDepth > MaxShardDepth {
+		err = ErrBadShardDepth
+		return
+	}
+	dirname, err = filepath.Abs(dirname)
+	if err != nil {
+		return
+	}
+	fs := FilesystemStorage{
+		root:       dirname,
+		locks:      newGroupLocks(),
+		shardDepth: shardDepth,
+	}
+	var l fsLayout
+	l, err = fs.readLayout()
+	if err != nil || (l.version == fsLayoutVersion && l.depth == shardDepth && !l.migrating) {
+		return
+	} else if l.version > fsLayoutVersion {
+		err = ErrUnknownLayout
+		return
+	}
+	version := l.version
+	if l.migrating {
+		// run again after being interrupted, some files are moved already
+		version = l.migratingFrom
+	}
+	err = fs.writeMigrating(version)
+	if err != nil {
+		return
+	}
+
+	// move articles into their directories
+	err = walkShards(fs.ArticleDir(), func(fpath string, info os.FileInfo) error {
+		msgid, e := layoutName(info.Name(), version, func(msgid string) bool {
+			return fpath == fs.articlePath(msgid)
+		})
+		if e != nil {
+			// not an article
+			return nil
+		}
+		if fpath == fs.articlePath(msgid) {
+			return nil
+		}
+		st.Articles++
+		return fs.moveFile(fpath, fs.articlePath(msgid))
+	})
+	if err != nil {
+		return
+	}
+	// then attachments and their thumbnails
+	err = walkShards(fs.AttachmentDir(), func(fpath string, info os.FileInfo) error {
+		if fpath == fs.attachmentPath(info.Name()) {
+			return nil
+		}
+		st.Attachments++
+		return fs.moveFile(fpath, fs.attachmentPath(info.Name()))
+	})
+	if err == nil {
+		err = walkShards(fs.ThumbnailDir(), func(fpath string, info os.FileInfo) error {
+			if fpath == fs.thumbnailPath(info.Name()) {
+				return nil
+			}
+			st.Attachments++
+			return fs.moveFile(fpath, fs.thumbnailPath(info.Name()))
+		})
+	}
+	if err != nil {
+		return
+	}
+	for _, dir := range []string{fs.ArticleDir(), fs.AttachmentDir(), fs.ThumbnailDir()} {
+		removeEmptyShards(dir)
+	}
+
+	// rename newsgroups and point their links at the moved articles
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(fs.NewsgroupsDir())
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		gdir := filepath.Join(fs.NewsgroupsDir(), info.Name())
+		group, e := layoutName(info.Name(), version, func(group string) bool {
+			return gdir == fs.newsgroupDir(group)
+		})
+		if e != nil {
+			// name from the old layout
+			group = info.Name()
+		}
+		if fs.newsgroupDir(group) != gdir {
+			err = os.Rename(gdir, fs.newsgroupDir(group))
+			if err != nil {
+				return
+			}
+			gdir = fs.newsgroupDir(group)
+			st.Newsgroups++
+		}
+		var nums []uint64
+		nums, err = fs.groupNumbers(group)
+		if err != nil {
+			return
+		}
+		sort.Slice(nums, func(i, j int) bool {
+			return nums[i] < nums[j]
+		})
+		for _, num := range nums {
+			link := filepath.Join(gdir, strconv.FormatUint(num, 10))
+			target, e := os.Readlink(link)
+			if e != nil {
+				continue
+			}
+			msgid, e := layoutName(filepath.Base(target), version, func(msgid string) bool {
+				return target == fs.articleLinkTarget(msgid)
+			})
+			if e != nil {
+				continue
+			}
+			if target == fs.articleLinkTarget(msgid) {
+				continue
+			}
+			err = replaceLink(link, fs.articleLinkTarget(msgid))
+			if err != nil {
+				return
+			}
+			st.Links++
+		}
+	}
+	err = fs.writeLayout()
+	if err == nil {
+		log.WithFields(log.Fields{
+			"pkg":         "fs-store",
+			"filepath":    dirname,
+			"depth":       shardDepth,
+			"articles":    st.Articles,
+			"attachments": st.Attachments,
+			"newsgroups":  st.Newsgroups,
+			"links":       st.Links,
+		}).Info("migrated storage layout")
+	}
+	return
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEscapeName(t *testing.T) {
+	for _, name := range []string{"<aa@test.tld>", "overchan.test", "../x", "..", ".hidden", "a/b", "a\\b", "100%", "sp ace"} {
+		escaped := escapeName(name)
+		if strings.ContainsAny(escaped, "/\\") || escaped == "." || escaped == ".." || strings.HasPrefix(escaped, ".") {
+			t.Logf("unsafe name %q for %q", escaped, name)
+			t.Fail()
+		}
+		unescaped, err := unescapeName(escaped)
+		if err != nil || unescaped != name {
+			t.Logf("%q escaped to %q came back as %q: %v", name, escaped, unescaped, err)
+			t.Fail()
+		}
+	}
+	for _, name := range []string{"<aa@test.tld>", "overchan.test", "ano.paste"} {
+		if escapeName(name) != name {
+			t.Logf("valid name %q escaped to %q", name, escapeName(name))
+			t.Fail()
+		}
+	}
+}
+
+func TestMigrateFilesystemStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-migrate")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	// build storage with the old flat layout
+	group := "overchan.test"
+	msgids := []string{"<aa@test.tld>", "<bb@test.tld>"}
+	for _, subdir := range []string{"att", "thm", "articles", "tmp", filepath.Join("newsgroups", group)} {
+		os.MkdirAll(filepath.Join(dir, subdir), 0700)
+	}
+	for idx, msgid := range msgids {
+		ioutil.WriteFile(filepath.Join(dir, "articles", msgid), []byte(conformanceArticle(msgid, group)), 0600)
+		os.Symlink(filepath.Join("..", "..", "articles", msgid), filepath.Join(dir, "newsgroups", group, strings.Repeat("1", idx+1)))
+	}
+	ioutil.WriteFile(filepath.Join(dir, "newsgroups", group, "metadata"), []byte("X-High-Water: 11\r\nX-Low-Water: 1\r\n\r\n"), 0600)
+
+	if _, err = NewFilesytemStorage(dir, true); err != ErrOldLayout {
+		t.Logf("opening old layout gave %v", err)
+		t.FailNow()
+	}
+	st, err := MigrateFilesystemStorage(dir, 1)
+	if err != nil || st.Articles != 2 || st.Links != 2 {
+		t.Logf("bad migration %+v: %v", st, err)
+		t.FailNow()
+	}
+	// running again changes nothing
+	st, err = MigrateFilesystemStorage(dir, 1)
+	if err != nil || st.Articles != 0 || st.Links != 0 {
+		t.Logf("second migration %+v: %v", st, err)
+		t.Fail()
+	}
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	list, err := fs.ListGroup(group)
+	if err != nil || len(list) != 2 || list[0].MessageID != msgids[0] || list[1].Number != 11 || list[1].Size == 0 {
+		t.Logf("bad listing after migration %+v: %v", list, err)
+		t.Fail()
+	}
+	for _, msgid := range msgids {
+		if err = fs.HasArticle(msgid); err != nil {
+			t.Logf("%s missing after migration: %v", msgid, err)
+			t.Fail()
+		}
+	}
+	report, err := fs.Fsck(false)
+	if err != nil || len(report.Problems) != 0 || report.Articles != 2 {
+		t.Logf("problems after migration: %+v %v", report, err)
+		t.Fail()
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-migrate")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	// old flat layout with a message-id that gets escaped
+	group := "overchan.test"
+	msgids := []string{"<a!b@test.tld>", "<cc@test.tld>"}
+	for _, subdir := range []string{"att", "thm", "articles", "tmp", filepath.Join("newsgroups", group)} {
+		os.MkdirAll(filepath.Join(dir, subdir), 0700)
+	}
+	for idx, msgid := range msgids {
+		ioutil.WriteFile(filepath.Join(dir, "articles", msgid), []byte(conformanceArticle(msgid, group)), 0600)
+		os.Symlink(filepath.Join("..", "..", "articles", msgid), filepath.Join(dir, "newsgroups", group, strconv.Itoa(idx+1)))
+	}
+	ioutil.WriteFile(filepath.Join(dir, "newsgroups", group, "metadata"), []byte("X-High-Water: 2\r\nX-Low-Water: 1\r\n\r\n"), 0600)
+
+	// a migration that stopped after moving the first article and its link
+	fs := FilesystemStorage{root: dir, locks: newGroupLocks(), shardDepth: 1}
+	err = fs.writeMigrating(0)
+	if err == nil {
+		err = fs.moveFile(filepath.Join(dir, "articles", msgids[0]), fs.articlePath(msgids[0]))
+	}
+	if err == nil {
+		err = replaceLink(filepath.Join(dir, "newsgroups", group, "1"), fs.articleLinkTarget(msgids[0]))
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err = NewFilesytemStorage(dir, true); err != ErrOldLayout {
+		t.Logf("opening half migrated storage gave %v", err)
+		t.FailNow()
+	}
+
+	st, err := MigrateFilesystemStorage(dir, 1)
+	if err != nil || st.Articles != 1 || st.Links != 1 {
+		t.Logf("bad migration after interruption %+v: %v", st, err)
+		t.FailNow()
+	}
+	fs, err = NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	list, err := fs.ListGroup(group)
+	if err != nil || len(list) != 2 || list[0].MessageID != msgids[0] || list[0].Size == 0 || list[1].Size == 0 {
+		t.Logf("bad listing after migration %+v: %v", list, err)
+		t.Fail()
+	}
+	report, err := fs.Fsck(false)
+	if err != nil || len(report.Problems) != 0 || report.Articles != 2 {
+		t.Logf("problems after migration: %+v %v", report, err)
+		t.Fail()
+	}
+}
+
+func TestMigrateShardDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-migrate")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFilesytemStorage(dir, true)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	group := "overchan.test"
+	msgids := []string{"<aa@test.tld>", "<bb@test.tld>", "<cc@test.tld>"}
+	for _, msgid := range msgids {
+		fs.StoreArticle(strings.NewReader(conformanceArticle(msgid, group)), msgid, group)
+	}
+	att, _ := fs.StoreAttachment(strings.NewReader("attachment"), "file.png")
+	if filepath.Dir(att) != fs.AttachmentDir() || filepath.Dir(fs.articlePath(msgids[0])) != fs.ArticleDir() {
+		t.Logf("unsharded storage put %s in a shard", att)
+		t.Fail()
+	}
+
+	for _, depth := range []int{2, 0} {
+		st, err := MigrateFilesystemStorage(dir, depth)
+		if err != nil || st.Articles != 3 || st.Attachments != 1 || st.Links != 3 {
+			t.Logf("bad migration to depth %d %+v: %v", depth, st, err)
+			t.FailNow()
+		}
+		// the configured depth only applies to new storage
+		fs, err = NewShardedFilesystemStorage(dir, true, 1)
+		if err != nil || fs.shardDepth != depth {
+			t.Logf("opened with depth %d not %d: %v", fs.shardDepth, depth, err)
+			t.FailNow()
+		}
+		att = fs.attachmentPath(filepath.Base(att))
+		if rel, _ := filepath.Rel(fs.AttachmentDir(), att); strings.Count(rel, string(filepath.Separator)) != depth {
+			t.Logf("attachment at %s for depth %d", rel, depth)
+			t.Fail()
+		}
+		if _, err = os.Stat(att); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+		list, err := fs.ListGroup(group)
+		if err != nil || len(list) != 3 || list[2].MessageID != msgids[2] || list[2].Size == 0 {
+			t.Logf("bad listing at depth %d %+v: %v", depth, list, err)
+			t.Fail()
+		}
+		var walked []string
+		fs.WalkArticles("", func(msgid string) error {
+			walked = append(walked, msgid)
+			return nil
+		})
+		if strings.Join(walked, " ") != strings.Join(msgids, " ") {
+			t.Logf("walked %v at depth %d", walked, depth)
+			t.Fail()
+		}
+		report, err := fs.Fsck(false)
+		if err != nil || len(report.Problems) != 0 || report.Attachments != 1 {
+			t.Logf("problems at depth %d: %+v %v", depth, report, err)
+			t.Fail()
+		}
+	}
+	// nothing but the files are left at depth 0
+	infos, _ := ioutil.ReadDir(fs.ArticleDir())
+	if len(infos) != 3 {
+		t.Logf("%d entries left in article directory", len(infos))
+		t.Fail()
+	}
+}
+
+func TestFsckMisplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-fsck")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewShardedFilesystemStorage(dir, true, 2)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	msgid := "<aa@test.tld>"
+	fs.StoreArticle(strings.NewReader(conformanceArticle(msgid, "overchan.test")), msgid, "overchan.test")
+	att, _ := fs.StoreAttachment(strings.NewReader("attachment"), "file.png")
+	// move both into a shard they do not belong in
+	wrong := filepath.Join(fs.ArticleDir(), "zz")
+	os.Mkdir(wrong, 0755)
+	os.Rename(fs.articlePath(msgid), filepath.Join(wrong, msgid))
+	os.Rename(att, filepath.Join(wrong, "..", "..", "att", filepath.Base(att)))
+
+	report, err := fs.Fsck(true)
+	misplaced := 0
+	for _, p := range report.Problems {
+		if p.Kind == FsckMisplaced && p.Repaired {
+			misplaced++
+		}
+	}
+	if err != nil || misplaced != 2 || len(report.Problems) != 2 {
+		t.Logf("bad repair %d misplaced of %d problems: %v", misplaced, len(report.Problems), err)
+		t.FailNow()
+	}
+	if fs.HasArticle(msgid) != nil {
+		t.Log("misplaced article not moved back")
+		t.Fail()
+	}
+	if _, err = os.Stat(att); err != nil {
+		t.Log("misplaced attachment not moved back")
+		t.Fail()
+	}
+}
@@ -0,0 +1,16 @@
+package store
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var storeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "store_operation_seconds",
+	Help: "Time taken by article storage operations.",
+}, []string{"op"})
+
+var attachmentBytes = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "store_attachment_bytes_total",
+	Help: "Bytes of attachments written to storage.",
+})
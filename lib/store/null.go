@@ -3,7 +3,7 @@ package store
 import (
 	"github.com/majestrate/srndv2/lib/util"
 	"io"
-	"os"
+	"time"
 )
 
 type nullStore struct{}
@@ -15,7 +15,11 @@ func (n *nullStore) discard(r io.Reader) (s string, err error) {
 }
 
 func (n *nullStore) HasArticle(msgid string) error {
-	return ErrNoSuchArticle
+	err := checkMessageID(msgid)
+	if err == nil {
+		err = ErrNoSuchArticle
+	}
+	return err
 }
 
 func (n *nullStore) StoreAttachment(r io.Reader, filename string) (string, error) {
@@ -23,13 +27,54 @@ func (n *nullStore) StoreAttachment(r io.Reader, filename string) (string, error
 }
 
 func (n *nullStore) StoreArticle(r io.Reader, msgid, newsgroup string) (string, error) {
+	err := checkArticle(msgid, newsgroup)
+	if err != nil {
+		return "", err
+	}
 	return n.discard(r)
 }
 
+// article transaction that keeps nothing
+type nullTx struct {
+	n *nullStore
+}
+
+func (tx nullTx) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (tx nullTx) StoreAttachment(r io.Reader, filename string) (string, error) {
+	return tx.n.discard(r)
+}
+
+func (tx nullTx) Commit() (string, error) {
+	return "/dev/null", nil
+}
+
+func (tx nullTx) Abort() error {
+	return nil
+}
+
+func (n *nullStore) BeginArticle(msgid, newsgroup string) (ArticleTx, error) {
+	err := checkArticle(msgid, newsgroup)
+	if err != nil {
+		return nil, err
+	}
+	return nullTx{n}, nil
+}
+
 func (n *nullStore) DeleteArticle(msgid string) (err error) {
 	return
 }
 
+func (n *nullStore) DeleteAttachment(filename string) (err error) {
+	return
+}
+
+func (n *nullStore) DeleteOldAttachment(filename string, minAge time.Duration) (err error) {
+	return
+}
+
 func (n *nullStore) Ensure() (err error) {
 	return
 }
@@ -38,8 +83,20 @@ func (n *nullStore) ForEachInGroup(newsgroup string, chnl chan string) {
 	return
 }
 
-func (n *nullStore) OpenArticle(msgid string) (r *os.File, err error) {
-	err = ErrNoSuchArticle
+func (n *nullStore) WalkArticles(after string, visit func(msgid string) error) error {
+	return nil
+}
+
+func (n *nullStore) OpenArticle(msgid string) (r io.ReadCloser, err error) {
+	err = checkMessageID(msgid)
+	if err == nil {
+		err = ErrNoSuchArticle
+	}
+	return
+}
+
+func (n *nullStore) OpenAttachment(filename string) (r io.ReadCloser, err error) {
+	err = ErrNoSuchAttachment
 	return
 }
 
@@ -52,6 +109,14 @@ func (n *nullStore) GetAllNewsgroups() (list []string, err error) {
 	return
 }
 
+func (n *nullStore) ListGroup(newsgroup string) (list []GroupArticle, err error) {
+	return
+}
+
+func (n *nullStore) ExpireArticles(newsgroup string, articles []GroupArticle) (deleted []string, err error) {
+	return
+}
+
 func (n *nullStore) GetWatermark(newsgroup string) (hi, lo uint64, err error) {
 	return
 }
@@ -0,0 +1,639 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/crypto"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how many message-ids WalkArticles reads from the database at once
+const sqliteWalkBatch = 1000
+
+// storage of nntp articles and attachments in a single sqlite database file
+type SQLiteStorage struct {
+	conn               *sql.DB
+	path               string
+	discardAttachments bool
+}
+
+func (s *SQLiteStorage) String() string {
+	return s.path
+}
+
+// create all tables
+func (s *SQLiteStorage) Ensure() (err error) {
+	tables := []string{
+		// stored articles, stored is when as a unix timestamp
+		`CREATE TABLE IF NOT EXISTS articles (
+			msgid TEXT PRIMARY KEY,
+			body BLOB NOT NULL,
+			stored INTEGER NOT NULL
+		)`,
+		// watermarks of newsgroups
+		`CREATE TABLE IF NOT EXISTS newsgroups (
+			name TEXT PRIMARY KEY,
+			hi INTEGER NOT NULL DEFAULT 0,
+			lo INTEGER NOT NULL DEFAULT 1
+		)`,
+		// article numbers in newsgroups
+		`CREATE TABLE IF NOT EXISTS group_articles (
+			newsgroup TEXT NOT NULL,
+			num INTEGER NOT NULL,
+			msgid TEXT NOT NULL,
+			PRIMARY KEY (newsgroup, num)
+		)`,
+		`CREATE INDEX IF NOT EXISTS group_articles_msgid ON group_articles(msgid)`,
+		// attachments named by the hash of their contents
+		`CREATE TABLE IF NOT EXISTS attachments (
+			filename TEXT PRIMARY KEY,
+			body BLOB NOT NULL,
+			stored INTEGER NOT NULL
+		)`,
+	}
+	for _, q := range tables {
+		_, err = s.conn.Exec(q)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// path an attachment is reported as stored at
+// not a real file, the base name is the name of the attachment in the database
+func (s *SQLiteStorage) attachmentPath(filename string) string {
+	return filepath.Join(s.path, "att", filename)
+}
+
+// path an article is reported as stored at, like attachmentPath
+func (s *SQLiteStorage) articlePath(msgid string) string {
+	return filepath.Join(s.path, "articles", msgid)
+}
+
+// read an attachment into memory, returns its name and contents
+func readAttachment(r io.Reader, filename string) (name string, data []byte, err error) {
+	h := crypto.Hash()
+	data, err = ioutil.ReadAll(io.TeeReader(r, h))
+	if err == nil {
+		name = attachmentFileName(h.Sum(nil), filename)
+	}
+	return
+}
+
+func (s *SQLiteStorage) StoreAttachment(r io.Reader, filename string) (fpath string, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("store_attachment")).ObserveDuration()
+	if s.discardAttachments {
+		_, err = io.Copy(ioutil.Discard, r)
+		return
+	}
+	var name string
+	var data []byte
+	name, data, err = readAttachment(r, filename)
+	if err == nil {
+		var added bool
+		added, err = storeAttachmentRow(s.conn, name, data)
+		if err == nil {
+			fpath = s.attachmentPath(name)
+			if added {
+				attachmentBytes.Add(float64(len(data)))
+			}
+		}
+	}
+	return
+}
+
+// something to store attachments with, *sql.DB or *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// store an attachment, one already stored is marked as stored now
+// so gc keeps it until the article using it again is indexed
+// returns true if the attachment was not stored before
+func storeAttachmentRow(e sqlExecer, name string, data []byte) (added bool, err error) {
+	var n int64
+	err = e.QueryRow(`SELECT COUNT(*) FROM attachments WHERE filename = ?`, name).Scan(&n)
+	if err == nil {
+		_, err = e.Exec(`INSERT INTO attachments(filename, body, stored) VALUES(?, ?, ?)
+			ON CONFLICT(filename) DO UPDATE SET stored = excluded.stored`, name, data, time.Now().Unix())
+		added = err == nil && n == 0
+	}
+	return
+}
+
+func (s *SQLiteStorage) StoreArticle(r io.Reader, msgid, newsgroup string) (fpath string, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("store_article")).ObserveDuration()
+	err = checkArticle(msgid, newsgroup)
+	if err != nil {
+		return
+	}
+	err = s.HasArticle(msgid)
+	if err == nil {
+		// discard the body as we have it stored already
+		_, err = io.Copy(ioutil.Discard, r)
+	} else if err == ErrNoSuchArticle {
+		var tx ArticleTx
+		tx, err = s.BeginArticle(msgid, newsgroup)
+		if err == nil {
+			_, err = io.Copy(tx, r)
+			if err == nil {
+				fpath, err = tx.Commit()
+			} else {
+				tx.Abort()
+			}
+		}
+	}
+	return
+}
+
+// an article being stored into an SQLiteStorage
+// everything is kept in memory until commit
+type sqliteArticleTx struct {
+	s         *SQLiteStorage
+	msgid     string
+	newsgroup string
+	body      bytes.Buffer
+	// attachments are stored while the article is written so this guards them
+	access      sync.Mutex
+	attachments map[string][]byte
+	done        bool
+}
+
+func (s *SQLiteStorage) BeginArticle(msgid, newsgroup string) (ArticleTx, error) {
+	err := checkArticle(msgid, newsgroup)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteArticleTx{
+		s:           s,
+		msgid:       msgid,
+		newsgroup:   newsgroup,
+		attachments: make(map[string][]byte),
+	}, nil
+}
+
+func (tx *sqliteArticleTx) Write(data []byte) (int, error) {
+	return tx.body.Write(data)
+}
+
+func (tx *sqliteArticleTx) StoreAttachment(r io.Reader, filename string) (fpath string, err error) {
+	if tx.s.discardAttachments {
+		_, err = io.Copy(ioutil.Discard, r)
+		return
+	}
+	var name string
+	var data []byte
+	name, data, err = readAttachment(r, filename)
+	if err != nil {
+		return
+	}
+	tx.access.Lock()
+	if tx.done {
+		err = ErrTxDone
+	} else {
+		tx.attachments[name] = data
+		fpath = tx.s.attachmentPath(name)
+	}
+	tx.access.Unlock()
+	return
+}
+
+func (tx *sqliteArticleTx) Commit() (fpath string, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("commit_article")).ObserveDuration()
+	tx.access.Lock()
+	defer tx.access.Unlock()
+	if tx.done {
+		err = ErrTxDone
+		return
+	}
+	tx.done = true
+	defer func() {
+		tx.attachments = nil
+	}()
+	var dbtx *sql.Tx
+	dbtx, err = tx.s.conn.Begin()
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	res, err = dbtx.Exec(`INSERT OR IGNORE INTO articles(msgid, body, stored) VALUES(?, ?, ?)`, tx.msgid, tx.body.Bytes(), time.Now().Unix())
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err == nil && n == 0 {
+		// stored by another connection while we were writing
+		log.WithFields(log.Fields{
+			"pkg":   "sqlite-store",
+			"msgid": tx.msgid,
+		}).Debug("article stored concurrently, discarding")
+		err = dbtx.Rollback()
+		return
+	}
+	var stored int64
+	for name, data := range tx.attachments {
+		if err != nil {
+			break
+		}
+		var added bool
+		added, err = storeAttachmentRow(dbtx, name, data)
+		if added {
+			stored += int64(len(data))
+		}
+	}
+	if err == nil {
+		_, err = dbtx.Exec(`INSERT OR IGNORE INTO newsgroups(name) VALUES(?)`, tx.newsgroup)
+	}
+	if err == nil {
+		_, err = dbtx.Exec(`UPDATE newsgroups SET hi = hi + 1 WHERE name = ?`, tx.newsgroup)
+	}
+	if err == nil {
+		_, err = dbtx.Exec(`INSERT INTO group_articles(newsgroup, num, msgid) SELECT name, hi, ? FROM newsgroups WHERE name = ?`, tx.msgid, tx.newsgroup)
+	}
+	if err == nil {
+		err = dbtx.Commit()
+	} else {
+		dbtx.Rollback()
+	}
+	if err == nil {
+		fpath = tx.s.articlePath(tx.msgid)
+		attachmentBytes.Add(float64(stored))
+	}
+	return
+}
+
+func (tx *sqliteArticleTx) Abort() (err error) {
+	tx.access.Lock()
+	defer tx.access.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.attachments = nil
+	tx.body.Reset()
+	return
+}
+
+func (s *SQLiteStorage) HasArticle(msgid string) (err error) {
+	err = checkMessageID(msgid)
+	if err != nil {
+		return
+	}
+	var one int
+	err = s.conn.QueryRow(`SELECT 1 FROM articles WHERE msgid = ?`, msgid).Scan(&one)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchArticle
+	}
+	return
+}
+
+// set the low water mark of a newsgroup to its lowest article number
+// an empty newsgroup gets one more than its high water mark
+func updateLowWaterSQL(dbtx *sql.Tx, newsgroup string) (err error) {
+	_, err = dbtx.Exec(`UPDATE newsgroups SET lo = COALESCE((SELECT MIN(num) FROM group_articles WHERE newsgroup = ?), hi + 1) WHERE name = ?`, newsgroup, newsgroup)
+	return
+}
+
+func (s *SQLiteStorage) DeleteArticle(msgid string) (err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("delete_article")).ObserveDuration()
+	err = checkMessageID(msgid)
+	if err != nil {
+		return
+	}
+	var dbtx *sql.Tx
+	dbtx, err = s.conn.Begin()
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	res, err = dbtx.Exec(`DELETE FROM articles WHERE msgid = ?`, msgid)
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err == nil && n == 0 {
+		err = ErrNoSuchArticle
+	}
+	var groups []string
+	if err == nil {
+		groups, err = queryStrings(dbtx, `SELECT DISTINCT newsgroup FROM group_articles WHERE msgid = ?`, msgid)
+	}
+	if err == nil {
+		_, err = dbtx.Exec(`DELETE FROM group_articles WHERE msgid = ?`, msgid)
+	}
+	for _, g := range groups {
+		if err == nil {
+			err = updateLowWaterSQL(dbtx, g)
+		}
+	}
+	if err == nil {
+		err = dbtx.Commit()
+	} else {
+		dbtx.Rollback()
+	}
+	return
+}
+
+func (s *SQLiteStorage) DeleteAttachment(filename string) (err error) {
+	var res sql.Result
+	res, err = s.conn.Exec(`DELETE FROM attachments WHERE filename = ?`, filepath.Base(filename))
+	if err == nil {
+		var n int64
+		n, err = res.RowsAffected()
+		if err == nil && n == 0 {
+			err = ErrNoSuchAttachment
+		}
+	}
+	return
+}
+
+func (s *SQLiteStorage) DeleteOldAttachment(filename string, minAge time.Duration) (err error) {
+	filename = filepath.Base(filename)
+	var res sql.Result
+	res, err = s.conn.Exec(`DELETE FROM attachments WHERE filename = ? AND stored < ?`, filename, time.Now().Add(-minAge).Unix())
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err == nil && n == 0 {
+		err = s.conn.QueryRow(`SELECT COUNT(*) FROM attachments WHERE filename = ?`, filename).Scan(&n)
+		if err == nil && n > 0 {
+			err = ErrRecentAttachment
+		} else if err == nil {
+			err = ErrNoSuchAttachment
+		}
+	}
+	return
+}
+
+// open article given message-id
+func (s *SQLiteStorage) OpenArticle(msgid string) (r io.ReadCloser, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("open_article")).ObserveDuration()
+	err = checkMessageID(msgid)
+	if err != nil {
+		return
+	}
+	var body []byte
+	err = s.conn.QueryRow(`SELECT body FROM articles WHERE msgid = ?`, msgid).Scan(&body)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchArticle
+	}
+	if err == nil {
+		r = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return
+}
+
+// open an attachment given its file name
+func (s *SQLiteStorage) OpenAttachment(filename string) (r io.ReadCloser, err error) {
+	var body []byte
+	err = s.conn.QueryRow(`SELECT body FROM attachments WHERE filename = ?`, filepath.Base(filename)).Scan(&body)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchAttachment
+	}
+	if err == nil {
+		r = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return
+}
+
+// something to query, *sql.DB or *sql.Tx
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// run a query returning one string per row
+func queryStrings(q sqlQueryer, query string, args ...interface{}) (list []string, err error) {
+	var rows *sql.Rows
+	rows, err = q.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var str string
+		err = rows.Scan(&str)
+		if err != nil {
+			return
+		}
+		list = append(list, str)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SQLiteStorage) ForEachInGroup(group string, chnl chan string) {
+	articles, _ := s.ListGroup(group)
+	for _, a := range articles {
+		chnl <- a.MessageID
+	}
+}
+
+func (s *SQLiteStorage) WalkArticles(after string, visit func(msgid string) error) (err error) {
+	for {
+		// read a batch at a time so visit can use the database
+		var msgids []string
+		msgids, err = queryStrings(s.conn, `SELECT msgid FROM articles WHERE msgid > ? ORDER BY msgid LIMIT ?`, after, sqliteWalkBatch)
+		if err != nil || len(msgids) == 0 {
+			return
+		}
+		for _, msgid := range msgids {
+			err = visit(msgid)
+			if err != nil {
+				return
+			}
+		}
+		after = msgids[len(msgids)-1]
+	}
+}
+
+func (s *SQLiteStorage) GetAllNewsgroups() ([]string, error) {
+	return queryStrings(s.conn, `SELECT name FROM newsgroups ORDER BY name`)
+}
+
+func (s *SQLiteStorage) HasNewsgroup(newsgroup string) (has bool, err error) {
+	var one int
+	err = s.conn.QueryRow(`SELECT 1 FROM newsgroups WHERE name = ?`, newsgroup).Scan(&one)
+	has = err == nil
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (s *SQLiteStorage) ListGroup(newsgroup string) (articles []GroupArticle, err error) {
+	var rows *sql.Rows
+	rows, err = s.conn.Query(`SELECT g.num, g.msgid, COALESCE(LENGTH(a.body), 0), COALESCE(a.stored, 0)
+		FROM group_articles g LEFT JOIN articles a ON a.msgid = g.msgid
+		WHERE g.newsgroup = ? ORDER BY g.num`, newsgroup)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a GroupArticle
+		var stored int64
+		err = rows.Scan(&a.Number, &a.MessageID, &a.Size, &stored)
+		if err != nil {
+			return
+		}
+		// links to deleted articles are listed with no size or time
+		if stored > 0 {
+			a.Stored = time.Unix(stored, 0)
+		}
+		articles = append(articles, a)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SQLiteStorage) ExpireArticles(newsgroup string, articles []GroupArticle) (deleted []string, err error) {
+	if len(articles) == 0 {
+		return
+	}
+	var dbtx *sql.Tx
+	dbtx, err = s.conn.Begin()
+	if err != nil {
+		return
+	}
+	for _, a := range articles {
+		_, err = dbtx.Exec(`DELETE FROM group_articles WHERE newsgroup = ? AND num = ?`, newsgroup, a.Number)
+		// crossposted articles stay until no newsgroup has them
+		var links int64
+		if err == nil {
+			err = dbtx.QueryRow(`SELECT COUNT(*) FROM group_articles WHERE msgid = ?`, a.MessageID).Scan(&links)
+		}
+		if err == nil && links == 0 {
+			_, err = dbtx.Exec(`DELETE FROM articles WHERE msgid = ?`, a.MessageID)
+			deleted = append(deleted, a.MessageID)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = updateLowWaterSQL(dbtx, newsgroup)
+	}
+	if err == nil {
+		err = dbtx.Commit()
+	} else {
+		dbtx.Rollback()
+	}
+	if err != nil {
+		deleted = nil
+	}
+	return
+}
+
+func (s *SQLiteStorage) GetWatermark(newsgroup string) (hi, lo uint64, err error) {
+	err = s.conn.QueryRow(`SELECT hi, lo FROM newsgroups WHERE name = ?`, newsgroup).Scan(&hi, &lo)
+	if err == sql.ErrNoRows {
+		// a newsgroup without articles
+		hi, lo, err = 0, 1, nil
+	}
+	return
+}
+
+// close the database
+func (s *SQLiteStorage) Close() error {
+	return s.conn.Close()
+}
+
+// open or create an sqlite storage database file
+// with fsync set every commit is synced to disk, otherwise only the write ahead log is
+func NewSQLiteStorage(fpath string, unpackAttachments, fsync bool) (s *SQLiteStorage, err error) {
+	fpath, err = filepath.Abs(fpath)
+	if err != nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"pkg":      "sqlite-store",
+		"filepath": fpath,
+	}).Info("Opening SQLite Storage")
+	syncMode := "NORMAL"
+	if fsync {
+		syncMode = "FULL"
+	}
+	// immediate transactions take the write lock up front so concurrent commits wait instead of failing
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=10000&_journal_mode=WAL&_synchronous=%s&_txlock=immediate", fpath, syncMode)
+	var conn *sql.DB
+	conn, err = sql.Open("sqlite3", dsn)
+	if err == nil {
+		s = &SQLiteStorage{
+			conn:               conn,
+			path:               fpath,
+			discardAttachments: !unpackAttachments,
+		}
+		err = s.Ensure()
+		if err != nil {
+			conn.Close()
+			s = nil
+		}
+	}
+	return
+}
+
+// remove attachments nothing refers to
+// attachments stored less than minAge ago are kept as they may belong to an article being stored
+// with dryRun set nothing is removed but the stats are what would be removed
+func (s *SQLiteStorage) CollectGarbage(referenced AttachmentRefChecker, minAge time.Duration, dryRun bool) (st GCStats, err error) {
+	cutoff := time.Now().Add(-minAge).Unix()
+	var rows *sql.Rows
+	rows, err = s.conn.Query(`SELECT filename, LENGTH(body) FROM attachments WHERE stored < ?`, cutoff)
+	if err != nil {
+		return
+	}
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var size int64
+		err = rows.Scan(&name, &size)
+		if err != nil {
+			break
+		}
+		sizes[name] = size
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	for name, size := range sizes {
+		if err != nil {
+			return
+		}
+		var ref bool
+		ref, err = referenced(name)
+		if err != nil || ref {
+			continue
+		}
+		if !dryRun {
+			// unless stored again since we looked, then it belongs to an article not indexed yet
+			var res sql.Result
+			res, err = s.conn.Exec(`DELETE FROM attachments WHERE filename = ? AND stored < ?`, name, cutoff)
+			if err != nil {
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue
+			}
+		}
+		log.WithFields(log.Fields{
+			"pkg":      "sqlite-store",
+			"filename": name,
+			"dryrun":   dryRun,
+		}).Debug("garbage collected")
+		st.Attachments++
+		st.Bytes += size
+	}
+	return
+}
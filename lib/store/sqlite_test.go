@@ -0,0 +1,86 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-sqlite")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSQLiteStorage(filepath.Join(dir, "store.db"), true, false)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	group := "overchan.test"
+	for _, msgid := range []string{"<aa@test.tld>", "<bb@test.tld>", "<cc@test.tld>"} {
+		_, err = s.StoreArticle(strings.NewReader("Message-ID: "+msgid+"\n\nhi\n"), msgid, group)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	// aborted articles and their attachments are not kept
+	tx, _ := s.BeginArticle("<dd@test.tld>", group)
+	tx.Write([]byte("Message-ID: <dd@test.tld>\n\nhi\n"))
+	att, err := tx.StoreAttachment(strings.NewReader("attachment"), "a.png")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	tx.Abort()
+	if s.HasArticle("<dd@test.tld>") != ErrNoSuchArticle {
+		t.Log("aborted article stored")
+		t.Fail()
+	}
+	if _, err = s.OpenAttachment(att); err != ErrNoSuchAttachment {
+		t.Logf("aborted attachment stored: %v", err)
+		t.Fail()
+	}
+
+	list, err := s.ListGroup(group)
+	if err != nil || len(list) != 3 || list[2].Number != 3 || list[2].Size == 0 {
+		t.Logf("bad group listing %+v: %v", list, err)
+		t.FailNow()
+	}
+	_, err = s.ExpireArticles(group, list[:1])
+	if err == nil {
+		err = s.DeleteArticle("<cc@test.tld>")
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	hi, lo, err := s.GetWatermark(group)
+	if err != nil || hi != 3 || lo != 2 {
+		t.Logf("wrong watermarks hi=%d lo=%d: %v", hi, lo, err)
+		t.Fail()
+	}
+	f, err := s.OpenArticle("<bb@test.tld>")
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "Message-ID: <bb@test.tld>\n\nhi\n" {
+			t.Logf("wrong article contents %q", data)
+			t.Fail()
+		}
+	}
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if s.DeleteArticle("<cc@test.tld>") != ErrNoSuchArticle {
+		t.Log("deleting a missing article did not fail")
+		t.Fail()
+	}
+}
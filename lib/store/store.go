@@ -2,11 +2,82 @@ package store
 
 import (
 	"errors"
+	"github.com/majestrate/srndv2/lib/config"
 	"io"
-	"os"
+	"strings"
+	"time"
 )
 
 var ErrNoSuchArticle = errors.New("no such article")
+var ErrNoSuchAttachment = errors.New("no such attachment")
+var ErrRecentAttachment = errors.New("attachment was stored too recently to delete")
+var ErrTxDone = errors.New("article already committed or aborted")
+var ErrInvalidMessageID = errors.New("invalid message-id")
+var ErrInvalidNewsgroup = errors.New("invalid newsgroup")
+
+// attachments stored or stored again more recently than this may belong to an article that is not indexed yet
+// so they are not deleted for having no articles that refer to them
+const MinGarbageAge = time.Hour
+
+// can a name be used as a single path element
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// check that a message-id is well formed enough to be stored
+func checkMessageID(msgid string) error {
+	if len(msgid) < 3 || msgid[0] != '<' || msgid[len(msgid)-1] != '>' || !safeName(msgid) {
+		return ErrInvalidMessageID
+	}
+	return nil
+}
+
+// check that a newsgroup name is well formed enough to be stored
+func checkNewsgroup(newsgroup string) error {
+	if !safeName(newsgroup) {
+		return ErrInvalidNewsgroup
+	}
+	return nil
+}
+
+// check a message-id and newsgroup of an article to store
+func checkArticle(msgid, newsgroup string) (err error) {
+	err = checkMessageID(msgid)
+	if err == nil {
+		err = checkNewsgroup(newsgroup)
+	}
+	return
+}
+
+// an article linked in a newsgroup
+type GroupArticle struct {
+	// article number in the newsgroup
+	Number uint64
+	// message-id of the article
+	MessageID string
+	// size of the article in bytes, 0 if the article is gone
+	Size int64
+	// when the article was stored, zero time if the article is gone
+	Stored time.Time
+}
+
+// an article being stored
+// nothing written to it or stored with it is visible until it is committed
+type ArticleTx interface {
+	// write more of the article
+	io.Writer
+
+	// store an attachment of the article, kept only if the article is committed
+	// returns the filepath the attachment will have once committed
+	StoreAttachment(r io.Reader, filename string) (string, error)
+
+	// make the article and its attachments visible and number it in its newsgroup
+	// returns the filepath of the article or an empty string if it was already stored
+	Commit() (string, error)
+
+	// throw away the article and its attachments
+	Abort() error
+}
 
 // storage for nntp articles and attachments
 type Storage interface {
@@ -22,15 +93,32 @@ type Storage interface {
 	// returns empty string and error if an error ocurred while storing
 	StoreArticle(r io.Reader, msgid, newsgroup string) (string, error)
 
+	// begin storing an article that can be aborted until it is committed
+	BeginArticle(msgid, newsgroup string) (ArticleTx, error)
+
 	// return nil if the article with the given message id exists in this storage
 	// return ErrNoSuchArticle if it does not exist or an error if another error occured while checking
 	HasArticle(msgid string) error
 
-	// delete article from underlying storage
+	// delete article from underlying storage and from every newsgroup it is in
+	// returns ErrNoSuchArticle if it does not exist
 	DeleteArticle(msgid string) error
 
+	// delete an attachment and its thumbnail given the attachment's file name
+	// returns ErrNoSuchAttachment if it does not exist
+	DeleteAttachment(filename string) error
+
+	// delete an attachment and its thumbnail unless it was stored or stored again less than minAge ago
+	// returns ErrNoSuchAttachment if it does not exist and ErrRecentAttachment if it is too new
+	DeleteOldAttachment(filename string, minAge time.Duration) error
+
 	// open article for reading
-	OpenArticle(msgid string) (*os.File, error)
+	// returns ErrNoSuchArticle if it does not exist
+	OpenArticle(msgid string) (io.ReadCloser, error)
+
+	// open an attachment for reading given its file name
+	// returns ErrNoSuchAttachment if it does not exist
+	OpenAttachment(filename string) (io.ReadCloser, error)
 
 	// ensure the underlying storage backend is created
 	Ensure() error
@@ -39,12 +127,57 @@ type Storage interface {
 	// send results down a channel
 	ForEachInGroup(newsgroup string, cnhl chan string)
 
+	// call visit with the message-id of every stored article after the given one in lexical order
+	// pass an empty string to start at the first article
+	// stops at the first error visit returns and returns it
+	WalkArticles(after string, visit func(msgid string) error) error
+
 	// get a list of all newsgroups
 	GetAllNewsgroups() ([]string, error)
 
 	// determine if we have a newsgroup
 	HasNewsgroup(newsgroup string) (bool, error)
 
+	// get all articles in a newsgroup ordered by article number
+	// a newsgroup without articles has none
+	ListGroup(newsgroup string) ([]GroupArticle, error)
+
+	// remove articles from a newsgroup
+	// articles no other newsgroup links to are deleted and their message-ids returned
+	// updates the low water mark of the newsgroup
+	ExpireArticles(newsgroup string, articles []GroupArticle) ([]string, error)
+
 	// get hi/lo watermark for newsgroup
 	GetWatermark(newsgroup string) (uint64, uint64, error)
 }
+
+// create the storage a config describes
+// the storage type defaults to filesystem
+func NewStorageFromConfig(c *config.StoreConfig, unpackAttachments bool) (st Storage, err error) {
+	storetype := strings.ToLower(c.Type)
+	var compression string
+	compression, err = ParseCompression(c.Compression)
+	if err != nil {
+		return
+	}
+	if storetype == "" || storetype == "filesystem" {
+		var fs FilesystemStorage
+		fs, err = NewShardedFilesystemStorage(c.Path, unpackAttachments, c.ShardDepth)
+		if err == nil {
+			fs.Fsync = c.Fsync
+			fs.Compression = compression
+			st = fs
+		}
+	} else if compression != CompressNone {
+		err = errors.New("only filesystem storage can compress articles")
+	} else if storetype == "sqlite" {
+		var s *SQLiteStorage
+		s, err = NewSQLiteStorage(c.Path, unpackAttachments, c.Fsync)
+		if err == nil {
+			st = s
+		}
+	} else {
+		err = errors.New("no such storage type: " + c.Type)
+	}
+	return
+}
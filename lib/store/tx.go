@@ -0,0 +1,167 @@
+package store
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// an attachment written to a temp file waiting for its article to be committed
+type pendingAttachment struct {
+	fpath string
+	size  int64
+}
+
+// an article being stored into a FilesystemStorage
+// everything is kept in temp files until commit
+type fsArticleTx struct {
+	fs        FilesystemStorage
+	msgid     string
+	newsgroup string
+	f         *os.File
+	// attachments are stored while the article is written so this guards them
+	access      sync.Mutex
+	attachments map[string]pendingAttachment
+	done        bool
+}
+
+// begin storing an article
+func (fs FilesystemStorage) BeginArticle(msgid, newsgroup string) (tx ArticleTx, err error) {
+	err = checkArticle(msgid, newsgroup)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = fs.createTempFile()
+	if err == nil {
+		tx = &fsArticleTx{
+			fs:          fs,
+			msgid:       msgid,
+			newsgroup:   newsgroup,
+			f:           f,
+			attachments: make(map[string]pendingAttachment),
+		}
+	}
+	return
+}
+
+func (tx *fsArticleTx) Write(data []byte) (int, error) {
+	return tx.f.Write(data)
+}
+
+func (tx *fsArticleTx) StoreAttachment(r io.Reader, filename string) (fpath string, err error) {
+	if tx.fs.discardAttachments {
+		_, err = io.Copy(ioutil.Discard, r)
+		return
+	}
+	h := crypto.Hash()
+	var tmp string
+	var n int64
+	tmp, n, err = tx.fs.writeTempFile(io.TeeReader(r, h))
+	if err != nil {
+		return
+	}
+	fpath = tx.fs.attachmentPath(attachmentFileName(h.Sum(nil), filename))
+	tx.access.Lock()
+	if tx.done {
+		os.Remove(tmp)
+		fpath = ""
+		err = ErrTxDone
+	} else {
+		tx.attachments[tmp] = pendingAttachment{fpath, n}
+	}
+	tx.access.Unlock()
+	return
+}
+
+// remove the temp files of attachments that were not committed
+func (tx *fsArticleTx) dropAttachments() {
+	for tmp := range tx.attachments {
+		os.Remove(tmp)
+	}
+	tx.attachments = nil
+}
+
+func (tx *fsArticleTx) Commit() (fpath string, err error) {
+	defer prometheus.NewTimer(storeSeconds.WithLabelValues("commit_article")).ObserveDuration()
+	tx.access.Lock()
+	defer tx.access.Unlock()
+	if tx.done {
+		err = ErrTxDone
+		return
+	}
+	tx.done = true
+	defer tx.dropAttachments()
+	tmp := tx.f.Name()
+	err = tx.fs.finishTempFile(tx.f)
+	if err == nil && tx.fs.HasArticle(tx.msgid) == nil {
+		// stored by another connection while we were writing
+		log.WithFields(log.Fields{
+			"pkg":   "fs-store",
+			"msgid": tx.msgid,
+		}).Debug("article stored concurrently, discarding")
+		os.Remove(tmp)
+		return
+	}
+	if err == nil {
+		tmp, err = tx.fs.compressTempFile(tmp)
+	}
+	// attachments go first so a committed article never misses any
+	for atmp, att := range tx.attachments {
+		if err != nil {
+			break
+		}
+		err = tx.fs.commitTempFile(atmp, att.fpath)
+		if err == nil {
+			attachmentBytes.Add(float64(att.size))
+		} else if os.IsExist(err) {
+			err = touchFile(att.fpath)
+		}
+	}
+	if err == nil {
+		fpath = tx.fs.articlePath(tx.msgid)
+		err = tx.fs.commitTempFile(tmp, fpath)
+		if os.IsExist(err) {
+			fpath = ""
+			err = nil
+			return
+		}
+	} else {
+		os.Remove(tmp)
+	}
+	if err == nil {
+		err = tx.fs.linkArticle(tx.newsgroup, tx.msgid)
+		if err != nil {
+			// an article in no newsgroup is not stored, readers would never see it
+			log.WithFields(log.Fields{
+				"pkg":   "fs-store",
+				"msgid": tx.msgid,
+				"group": tx.newsgroup,
+			}).Error("failed to link article ", err)
+			os.Remove(fpath)
+			fpath = ""
+		}
+	}
+	return
+}
+
+func (tx *fsArticleTx) Abort() (err error) {
+	tx.access.Lock()
+	defer tx.access.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.f.Close()
+	err = os.Remove(tx.f.Name())
+	tx.dropAttachments()
+	log.WithFields(log.Fields{
+		"pkg":   "fs-store",
+		"msgid": tx.msgid,
+	}).Debug("article aborted")
+	return
+}
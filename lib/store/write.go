@@ -0,0 +1,141 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/crypto"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// per newsgroup locks held while changing newsgroup metadata
+type groupLocks struct {
+	access sync.Mutex
+	groups map[string]*sync.Mutex
+}
+
+func newGroupLocks() *groupLocks {
+	return &groupLocks{
+		groups: make(map[string]*sync.Mutex),
+	}
+}
+
+// lock a newsgroup, returns the function that unlocks it
+func (l *groupLocks) lock(newsgroup string) func() {
+	l.access.Lock()
+	mtx, ok := l.groups[newsgroup]
+	if !ok {
+		mtx = new(sync.Mutex)
+		l.groups[newsgroup] = mtx
+	}
+	l.access.Unlock()
+	mtx.Lock()
+	return mtx.Unlock
+}
+
+// lock a newsgroup of this storage, returns the function that unlocks it
+func (fs FilesystemStorage) lockGroup(newsgroup string) func() {
+	return fs.locks.lock(newsgroup)
+}
+
+// sync a directory so renames and links in it are on disk, if fsync is enabled
+func (fs FilesystemStorage) syncDir(dir string) (err error) {
+	if !fs.Fsync {
+		return
+	}
+	var d *os.File
+	d, err = os.Open(dir)
+	if err == nil {
+		err = d.Sync()
+		d.Close()
+	}
+	return
+}
+
+// create a new file in the temp directory
+func (fs FilesystemStorage) createTempFile() (f *os.File, err error) {
+	fname := filepath.Join(fs.TempDir(), fmt.Sprintf("tempfile-%x-%d", crypto.RandBytes(4), time.Now().Unix()))
+	f, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	return
+}
+
+// close a temp file that was written, syncing it to disk first if fsync is enabled
+func (fs FilesystemStorage) finishTempFile(f *os.File) (err error) {
+	if fs.Fsync {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return
+}
+
+// write everything from a reader to a new file in the temp directory
+// the file is synced to disk if fsync is enabled and removed again on error
+func (fs FilesystemStorage) writeTempFile(r io.Reader) (fname string, n int64, err error) {
+	var f *os.File
+	f, err = fs.createTempFile()
+	if err != nil {
+		return
+	}
+	fname = f.Name()
+	n, err = io.Copy(f, r)
+	if err == nil {
+		err = fs.finishTempFile(f)
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pkg":      "fs-store",
+			"filepath": fname,
+			"written":  n,
+		}).Debug("removing incomplete temp file")
+		os.Remove(fname)
+	}
+	return
+}
+
+// move a finished temp file to fpath without replacing anything already there
+// the temp file is gone afterwards either way
+// returns an error satisfying os.IsExist if fpath exists
+func (fs FilesystemStorage) commitTempFile(tmp, fpath string) (err error) {
+	// shard directories are made as they are needed
+	err = os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err == nil {
+		err = os.Link(tmp, fpath)
+	}
+	os.Remove(tmp)
+	if err == nil {
+		err = fs.syncDir(filepath.Dir(fpath))
+	}
+	return
+}
+
+// set the modification time of an existing file to now
+// done to attachments stored again so garbage collection does not take them
+// before the index knows about the new article that refers to them
+func touchFile(fpath string) error {
+	now := time.Now()
+	return os.Chtimes(fpath, now, now)
+}
+
+// atomically replace the contents of a file
+func (fs FilesystemStorage) replaceFile(fpath string, data []byte) (err error) {
+	var tmp string
+	tmp, _, err = fs.writeTempFile(bytes.NewReader(data))
+	if err == nil {
+		err = os.Rename(tmp, fpath)
+		if err == nil {
+			err = fs.syncDir(filepath.Dir(fpath))
+		} else {
+			os.Remove(tmp)
+		}
+	}
+	return
+}
@@ -0,0 +1,184 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/process"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// longest part of an audio file drawn in a waveform
+const maxWaveformSeconds = 3600
+
+// sample rate audio is decoded at for waveforms, plenty for a few hundred columns
+const waveformRate = 4000
+
+var audioAccept = regexp.MustCompilePOSIX(`\.(flac|mp3|mp2|wav|ogg|opus|m4a)$`)
+
+// thumbnail audio with its embedded cover art or otherwise a drawing of its waveform
+// cover art is read and waveforms are drawn in process, ffmpeg only decodes compressed audio to wav
+type AudioThumbnailer struct {
+	// size of thumbnails, waveforms are half as high
+	Config *Config
+	// path to ffmpeg, empty to only draw waveforms of wav files
+	FFMpeg string
+	// runs ffmpeg with limits, nil for process.DefaultRunner
+	Runner *process.Runner
+	// limits on cover art like ImageThumbnailer
+	MaxPixels int64
+	MaxMemory int64
+}
+
+// create a thumbnailer for audio that decodes compressed audio with ffmpeg
+func GoAudioThumbnailer(ffmpegPath string, conf *Config) Thumbnailer {
+	if conf == nil {
+		conf = defaultCfg
+	}
+	return &AudioThumbnailer{
+		Config: conf,
+		FFMpeg: ffmpegPath,
+	}
+}
+
+func (th *AudioThumbnailer) CanThumbnail(infpath string) bool {
+	return audioAccept.MatchString(infpath)
+}
+
+// thumbnail the cover art embedded in an audio file
+func (th *AudioThumbnailer) cover(infpath, outfpath string) (err error) {
+	var f *os.File
+	f, err = os.Open(infpath)
+	if err != nil {
+		return
+	}
+	var pic []byte
+	pic, err = coverArt(f)
+	f.Close()
+	if err == nil && pic == nil {
+		err = ErrCannotThumbanil
+	}
+	if err != nil {
+		return
+	}
+	images := &ImageThumbnailer{
+		Config:    th.Config,
+		MaxPixels: th.MaxPixels,
+		MaxMemory: th.MaxMemory,
+	}
+	img, format, err := images.decodeReader(bytes.NewReader(pic))
+	if err == nil {
+		asJpeg := th.Config.JpegOnly || format == "jpeg"
+		err = writeThumbnail(outfpath, images.scale(img, asJpeg), asJpeg)
+	}
+	return
+}
+
+// decode compressed audio to a temporary mono wav file with ffmpeg
+func (th *AudioThumbnailer) decodeWav(infpath string) (wavfpath string, err error) {
+	if th.FFMpeg == "" {
+		return "", ErrCannotThumbanil
+	}
+	var f *os.File
+	f, err = ioutil.TempFile("", "srnd-waveform-")
+	if err != nil {
+		return
+	}
+	wavfpath = f.Name()
+	f.Close()
+	runner := th.Runner
+	if runner == nil {
+		runner = process.DefaultRunner
+	}
+	_, err = runner.Run(context.Background(), th.FFMpeg, []string{
+		"-nostdin", "-v", "error", "-y", "-i", infpath,
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(waveformRate), "-t", strconv.Itoa(maxWaveformSeconds),
+		"-acodec", "pcm_s16le", "-f", "wav", wavfpath,
+	}, nil)
+	if err != nil {
+		os.Remove(wavfpath)
+		wavfpath = ""
+	}
+	return
+}
+
+// draw the waveform of a wav file
+func (th *AudioThumbnailer) drawWaveform(wavfpath, outfpath string) (err error) {
+	var f *os.File
+	f, err = os.Open(wavfpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err != nil {
+		return
+	}
+	var w *wavReader
+	w, err = openWav(f, info.Size())
+	if err != nil {
+		return
+	}
+	// wav files are not resampled, only draw as much as an hour at 64khz
+	if limit := int64(maxWaveformSeconds * 64000); w.frames > limit {
+		w.frames = limit
+	}
+	height := th.Config.ThumbH / 2
+	if height < 1 {
+		height = 1
+	}
+	img, err := w.render(th.Config.ThumbW, height)
+	if err == nil {
+		err = writeThumbnail(outfpath, img, th.Config.JpegOnly)
+	}
+	return
+}
+
+// thumbnail the waveform of an audio file
+func (th *AudioThumbnailer) waveform(infpath, outfpath string) (err error) {
+	if filepath.Ext(infpath) == ".wav" {
+		err = th.drawWaveform(infpath, outfpath)
+		if err != ErrUnsupportedWav {
+			return
+		}
+		// compressed wav, let ffmpeg decode it
+	}
+	var wavfpath string
+	wavfpath, err = th.decodeWav(infpath)
+	if err == nil {
+		err = th.drawWaveform(wavfpath, outfpath)
+		os.Remove(wavfpath)
+	}
+	return
+}
+
+// make the thumbnail from the cover art if there is any, otherwise from the waveform
+// waveforms get png thumbnails unless JpegOnly is set
+func (th *AudioThumbnailer) Generate(infpath, outfpath string) (err error) {
+	if !th.CanThumbnail(infpath) {
+		return ErrCannotThumbanil
+	}
+	started := time.Now()
+	err = th.cover(infpath, outfpath)
+	if err != nil {
+		if err != ErrCannotThumbanil {
+			log.WithFields(log.Fields{
+				"pkg":      "thumbnail",
+				"filepath": infpath,
+			}).Debug("cannot use cover art ", err)
+		}
+		err = th.waveform(infpath, outfpath)
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	thumbnailSeconds.WithLabelValues("go-audio", result).Observe(time.Since(started).Seconds())
+	return
+}
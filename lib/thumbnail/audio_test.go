@@ -0,0 +1,343 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// encode a png of one color to use as cover art
+func testCover(t *testing.T, w, h int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	buff := new(bytes.Buffer)
+	if err := png.Encode(buff, img); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return buff.Bytes()
+}
+
+// a wav file of a sine wave with samples of width bytes
+func testWav(rate, channels, width, frames int, float bool) []byte {
+	data := new(bytes.Buffer)
+	for n := 0; n < frames; n++ {
+		v := 0.8 * math.Sin(2*math.Pi*440*float64(n)/float64(rate))
+		for ch := 0; ch < channels; ch++ {
+			switch {
+			case float:
+				binary.Write(data, binary.LittleEndian, float32(v))
+			case width == 1:
+				data.WriteByte(byte(int(v*127) + 128))
+			case width == 2:
+				binary.Write(data, binary.LittleEndian, int16(v*32767))
+			case width == 3:
+				s := int32(v * 8388607)
+				data.Write([]byte{byte(s), byte(s >> 8), byte(s >> 16)})
+			}
+		}
+	}
+	format := uint16(wavPCM)
+	if float {
+		format = wavFloat
+	}
+	buff := new(bytes.Buffer)
+	buff.WriteString("RIFF")
+	binary.Write(buff, binary.LittleEndian, uint32(4+8+16+8+data.Len()))
+	buff.WriteString("WAVEfmt ")
+	for _, v := range []interface{}{
+		uint32(16), format, uint16(channels), uint32(rate), uint32(rate * channels * width),
+		uint16(channels * width), uint16(width * 8),
+	} {
+		binary.Write(buff, binary.LittleEndian, v)
+	}
+	buff.WriteString("data")
+	binary.Write(buff, binary.LittleEndian, uint32(data.Len()))
+	buff.Write(data.Bytes())
+	return buff.Bytes()
+}
+
+// an id3v2.3 tag with pictures of the given types followed by something like mpeg frames
+func testMP3(pics map[byte][]byte) []byte {
+	frames := new(bytes.Buffer)
+	// a text frame before the pictures
+	frames.WriteString("TIT2")
+	binary.Write(frames, binary.BigEndian, uint32(6))
+	frames.Write([]byte{0, 0, 0, 't', 'e', 's', 't', 0})
+	for _, ptype := range []byte{0, 3} {
+		pic, ok := pics[ptype]
+		if !ok {
+			continue
+		}
+		body := append([]byte{0}, "image/png\x00"...)
+		body = append(body, ptype)
+		body = append(body, "cover\x00"...)
+		body = append(body, pic...)
+		frames.WriteString("APIC")
+		binary.Write(frames, binary.BigEndian, uint32(len(body)))
+		frames.Write([]byte{0, 0})
+		frames.Write(body)
+	}
+	// padding
+	frames.Write(make([]byte, 16))
+	size := frames.Len()
+	buff := bytes.NewBufferString("ID3\x03\x00\x00")
+	buff.Write([]byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)})
+	buff.Write(frames.Bytes())
+	buff.Write(bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x00}, 64))
+	return buff.Bytes()
+}
+
+// a flac picture block body
+func testFlacPicture(ptype uint32, pic []byte) []byte {
+	buff := new(bytes.Buffer)
+	binary.Write(buff, binary.BigEndian, ptype)
+	binary.Write(buff, binary.BigEndian, uint32(len("image/png")))
+	buff.WriteString("image/png")
+	binary.Write(buff, binary.BigEndian, uint32(0))
+	buff.Write(make([]byte, 16))
+	binary.Write(buff, binary.BigEndian, uint32(len(pic)))
+	buff.Write(pic)
+	return buff.Bytes()
+}
+
+// flac metadata with an optional picture and no audio frames
+func testFlac(pic []byte) []byte {
+	buff := bytes.NewBufferString("fLaC")
+	blocks := [][]byte{make([]byte, 34)}
+	types := []byte{0}
+	if pic != nil {
+		blocks = append(blocks, testFlacPicture(frontCover, pic))
+		types = append(types, 6)
+	}
+	for idx, block := range blocks {
+		hdr := types[idx]
+		if idx == len(blocks)-1 {
+			hdr |= 0x80
+		}
+		buff.Write([]byte{hdr, byte(len(block) >> 16), byte(len(block) >> 8), byte(len(block))})
+		buff.Write(block)
+	}
+	return buff.Bytes()
+}
+
+// an ogg page holding whole packets
+func testOggPage(serial, seq uint32, packets ...[]byte) []byte {
+	var lacing []byte
+	body := new(bytes.Buffer)
+	for _, pkt := range packets {
+		n := len(pkt)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body.Write(pkt)
+	}
+	buff := bytes.NewBufferString("OggS\x00\x00")
+	buff.Write(make([]byte, 8))
+	binary.Write(buff, binary.LittleEndian, serial)
+	binary.Write(buff, binary.LittleEndian, seq)
+	// crc is not checked
+	buff.Write(make([]byte, 4))
+	buff.WriteByte(byte(len(lacing)))
+	buff.Write(lacing)
+	buff.Write(body.Bytes())
+	return buff.Bytes()
+}
+
+// an ogg opus stream with the cover in its comments after a page of another stream
+func testOpus(pic []byte) []byte {
+	tags := bytes.NewBufferString("OpusTags")
+	binary.Write(tags, binary.LittleEndian, uint32(4))
+	tags.WriteString("test")
+	comments := []string{
+		"TITLE=test",
+		"METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(testFlacPicture(frontCover, pic)),
+	}
+	binary.Write(tags, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		binary.Write(tags, binary.LittleEndian, uint32(len(c)))
+		tags.WriteString(c)
+	}
+	buff := new(bytes.Buffer)
+	buff.Write(testOggPage(0, 0, []byte("OpusHead\x01\x01\x00\x00\x80\xbb\x00\x00\x00\x00\x00")))
+	buff.Write(testOggPage(7, 0, []byte("other stream")))
+	buff.Write(testOggPage(0, 1, tags.Bytes()))
+	return buff.Bytes()
+}
+
+// an mp4 atom
+func testAtom(kind string, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	buff := new(bytes.Buffer)
+	binary.Write(buff, binary.BigEndian, uint32(8+len(b)))
+	buff.WriteString(kind)
+	buff.Write(b)
+	return buff.Bytes()
+}
+
+// an m4a file with a cover in its metadata after its media data
+func testM4A(pic []byte) []byte {
+	return bytes.Join([][]byte{
+		testAtom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		testAtom("mdat", make([]byte, 100)),
+		testAtom("moov",
+			testAtom("mvhd", make([]byte, 100)),
+			testAtom("udta",
+				testAtom("meta", make([]byte, 4),
+					testAtom("hdlr", make([]byte, 25)),
+					testAtom("ilst",
+						testAtom("covr",
+							testAtom("data", []byte{0, 0, 0, 14, 0, 0, 0, 0}, pic)))))),
+	}, nil)
+}
+
+func TestCoverArt(t *testing.T) {
+	front := testCover(t, 600, 600, color.RGBA{R: 255, A: 255})
+	back := testCover(t, 10, 10, color.RGBA{B: 255, A: 255})
+	for name, data := range map[string][]byte{
+		"mp3":      testMP3(map[byte][]byte{0: back, 3: front}),
+		"flac":     testFlac(front),
+		"id3+flac": append(testMP3(nil)[:len(testMP3(nil))-256], testFlac(front)...),
+		"opus":     testOpus(front),
+		"m4a":      testM4A(front),
+	} {
+		pic, err := coverArt(bytes.NewReader(data))
+		if err != nil || !bytes.Equal(pic, front) {
+			t.Logf("%s: got %d byte cover: %v", name, len(pic), err)
+			t.Fail()
+		}
+		// nothing cut short makes it fail badly
+		for n := 0; n < len(data); n += 7 {
+			coverArt(bytes.NewReader(data[:n]))
+		}
+	}
+	for name, data := range map[string][]byte{
+		"mp3":  testMP3(nil),
+		"flac": testFlac(nil),
+		"wav":  testWav(8000, 1, 2, 100, false),
+	} {
+		if pic, err := coverArt(bytes.NewReader(data)); pic != nil || err != nil {
+			t.Logf("%s without cover gave %d bytes: %v", name, len(pic), err)
+			t.Fail()
+		}
+	}
+}
+
+func TestWavSamples(t *testing.T) {
+	for _, c := range []struct {
+		channels, width int
+		float           bool
+	}{
+		{1, 1, false}, {2, 2, false}, {1, 3, false}, {2, 4, true},
+	} {
+		data := testWav(8000, c.channels, c.width, 8000, c.float)
+		w, err := openWav(bytes.NewReader(data), int64(len(data)))
+		if err != nil || w.frames != 8000 {
+			t.Logf("%+v: %v", c, err)
+			t.Fail()
+			continue
+		}
+		peak := 0.0
+		for n := 0; n < 8000; n++ {
+			v, err := w.next()
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			peak = math.Max(peak, math.Abs(v))
+		}
+		if peak < 0.75 || peak > 0.85 {
+			t.Logf("%+v: peak %f not 0.8", c, peak)
+			t.Fail()
+		}
+	}
+}
+
+func TestAudioThumbnailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-thumbnail")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	th := &AudioThumbnailer{Config: &Config{ThumbW: 300, ThumbH: 200}}
+	files := map[string][]byte{
+		"cover.mp3":   testMP3(map[byte][]byte{3: testCover(t, 600, 600, color.RGBA{R: 255, A: 255})}),
+		"wave.wav":    testWav(8000, 2, 2, 8000, false),
+		"nocover.mp3": testMP3(nil),
+	}
+	for name, data := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	if err = th.Generate(filepath.Join(dir, "cover.mp3"), filepath.Join(dir, "thm-cover")); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	checkThumbnail(t, filepath.Join(dir, "thm-cover.png"), "png", 200, 200)
+
+	if err = th.Generate(filepath.Join(dir, "wave.wav"), filepath.Join(dir, "thm-wave")); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	checkThumbnail(t, filepath.Join(dir, "thm-wave.png"), "png", 300, 100)
+	f, err := os.Open(filepath.Join(dir, "thm-wave.png"))
+	if err == nil {
+		img, _ := png.Decode(f)
+		f.Close()
+		// a loud sine fills most of the height but not all of it
+		if img == nil || img.At(150, 50) != waveformForeground || img.At(150, 15) != waveformForeground || img.At(150, 2) != waveformBackground {
+			t.Log("waveform not drawn")
+			t.Fail()
+		}
+	}
+
+	// compressed audio needs ffmpeg to draw
+	if err = th.Generate(filepath.Join(dir, "nocover.mp3"), filepath.Join(dir, "thm-nocover")); err != ErrCannotThumbanil {
+		t.Logf("mp3 without cover or ffmpeg gave %v", err)
+		t.Fail()
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "thm-nocover*")); len(matches) != 0 {
+		t.Logf("failed thumbnail left %v", matches)
+		t.Fail()
+	}
+}
+
+func TestAudioThumbnailerFFMpeg(t *testing.T) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	dir, err := ioutil.TempDir("", "srnd-thumbnail")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	// make compressed audio from a generated wav
+	wav := filepath.Join(dir, "in.wav")
+	ioutil.WriteFile(wav, testWav(8000, 1, 2, 16000, false), 0600)
+	ogg := filepath.Join(dir, "in.ogg")
+	if out, err := exec.Command(ffmpeg, "-v", "error", "-i", wav, ogg).CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot encode ogg: %s", out)
+	}
+	th := GoAudioThumbnailer(ffmpeg, &Config{ThumbW: 300, ThumbH: 200, JpegOnly: true})
+	if err = th.Generate(ogg, filepath.Join(dir, "thm")); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	checkThumbnail(t, filepath.Join(dir, "thm.jpeg"), "jpeg", 300, 100)
+}
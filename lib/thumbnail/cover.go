@@ -0,0 +1,447 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// biggest tag, comment or picture read looking for cover art
+const maxTagSize = 16 * 1024 * 1024
+
+// picture type of a front cover in id3 and flac
+const frontCover = 3
+
+var errBadTag = errors.New("malformed audio tag")
+
+// get the cover art embedded in an audio file
+// returns nil if it has none
+func coverArt(r io.ReadSeeker) (pic []byte, err error) {
+	head := make([]byte, 12)
+	_, err = io.ReadFull(r, head)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, nil
+	}
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		pic, err = id3Cover(r)
+		if err == nil && pic == nil {
+			// flac files may start with an id3 tag
+			pic, err = flacCover(r)
+		}
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		pic, err = flacCover(r)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		pic, err = oggCover(r)
+	case bytes.Equal(head[4:8], []byte("ftyp")):
+		pic, err = mp4Cover(r, -1, []string{"moov", "udta", "meta", "ilst", "covr", "data"})
+	}
+	return
+}
+
+// read exactly n bytes unless that is more than maxTagSize
+func readTag(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 || n > maxTagSize {
+		return nil, errBadTag
+	}
+	buff := make([]byte, n)
+	_, err := io.ReadFull(r, buff)
+	return buff, err
+}
+
+// decode a 28 bit id3 syncsafe integer
+func syncsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+// undo id3 unsynchronisation
+func unsync(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// skip a string terminated by a nul in an id3 text encoding
+func skipID3String(b []byte, encoding byte) []byte {
+	if encoding == 1 || encoding == 2 {
+		// utf-16, the nul is 2 bytes on a 2 byte boundary
+		for idx := 0; idx+1 < len(b); idx += 2 {
+			if b[idx] == 0 && b[idx+1] == 0 {
+				return b[idx+2:]
+			}
+		}
+		return nil
+	}
+	idx := bytes.IndexByte(b, 0)
+	if idx < 0 {
+		return nil
+	}
+	return b[idx+1:]
+}
+
+// get the cover art from an id3v2 tag at the start of r, leaving r after the tag
+func id3Cover(r io.ReadSeeker) (pic []byte, err error) {
+	hdr := make([]byte, 10)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return
+	}
+	version, flags := hdr[3], hdr[5]
+	var tag []byte
+	tag, err = readTag(r, syncsafe(hdr[6:]))
+	if err == nil && flags&0x10 != 0 {
+		// 2.4 footer
+		_, err = readTag(r, 10)
+	}
+	if err != nil || version < 2 || version > 4 {
+		return
+	}
+	if flags&0x80 != 0 && version < 4 {
+		tag = unsync(tag)
+	}
+	if flags&0x40 != 0 && version > 2 {
+		// skip the extended header
+		if len(tag) < 4 {
+			return nil, errBadTag
+		}
+		skip := int64(binary.BigEndian.Uint32(tag)) + 4
+		if version == 4 {
+			skip = syncsafe(tag)
+		}
+		if skip > int64(len(tag)) {
+			return nil, errBadTag
+		}
+		tag = tag[skip:]
+	}
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	best := -1
+	for len(tag) >= hdrLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int64
+		var fflags uint16
+		switch version {
+		case 2:
+			size = int64(tag[3])<<16 | int64(tag[4])<<8 | int64(tag[5])
+		case 3:
+			size = int64(binary.BigEndian.Uint32(tag[4:]))
+			fflags = binary.BigEndian.Uint16(tag[8:])
+		case 4:
+			size = syncsafe(tag[4:])
+			fflags = binary.BigEndian.Uint16(tag[8:])
+		}
+		if size > int64(len(tag)-hdrLen) {
+			return nil, errBadTag
+		}
+		data := tag[hdrLen : int64(hdrLen)+size]
+		tag = tag[int64(hdrLen)+size:]
+		if id != "APIC" && id != "PIC" {
+			continue
+		}
+		if (version == 3 && fflags&0xc0 != 0) || (version == 4 && fflags&0x0c != 0) {
+			// compressed or encrypted
+			continue
+		}
+		if version == 4 && fflags&0x02 != 0 {
+			data = unsync(data)
+		}
+		if ((version == 3 && fflags&0x20 != 0) || (version == 4 && fflags&0x40 != 0)) && len(data) >= 1 {
+			// group id
+			data = data[1:]
+		}
+		if version == 4 && fflags&0x01 != 0 && len(data) >= 4 {
+			// data length indicator
+			data = data[4:]
+		}
+		if len(data) < 2 {
+			continue
+		}
+		encoding := data[0]
+		if id == "PIC" {
+			// 3 byte image format
+			if len(data) < 5 {
+				continue
+			}
+			data = data[4:]
+		} else {
+			data = skipID3String(data[1:], 0)
+			if len(data) < 1 {
+				continue
+			}
+		}
+		ptype := int(data[0])
+		data = skipID3String(data[1:], encoding)
+		if len(data) == 0 {
+			continue
+		}
+		if pic == nil || ptype == frontCover && best != frontCover {
+			pic, best = data, ptype
+		}
+	}
+	return
+}
+
+// parse a flac picture block, the same is base64 encoded in ogg comments
+// returns the picture type and data
+func flacPicture(b []byte) (ptype uint32, data []byte, err error) {
+	err = errBadTag
+	next := func() (n uint32, ok bool) {
+		if len(b) < 4 {
+			return 0, false
+		}
+		n = binary.BigEndian.Uint32(b)
+		b = b[4:]
+		return n, true
+	}
+	skip := func(n uint32) bool {
+		if uint64(n) > uint64(len(b)) {
+			return false
+		}
+		b = b[n:]
+		return true
+	}
+	var n uint32
+	var ok bool
+	if ptype, ok = next(); !ok {
+		return
+	}
+	// mime type and description
+	for idx := 0; idx < 2; idx++ {
+		if n, ok = next(); !ok || !skip(n) {
+			return
+		}
+	}
+	// width, height, depth and colors
+	if !skip(16) {
+		return
+	}
+	if n, ok = next(); !ok || uint64(n) > uint64(len(b)) {
+		return
+	}
+	return ptype, b[:n], nil
+}
+
+// get the cover art from the metadata blocks of a flac stream starting at r
+func flacCover(r io.Reader) (pic []byte, err error) {
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != "fLaC" {
+		return nil, nil
+	}
+	best := uint32(0)
+	hdr := make([]byte, 4)
+	for last := false; !last; {
+		_, err = io.ReadFull(r, hdr)
+		if err != nil {
+			return
+		}
+		last = hdr[0]&0x80 != 0
+		size := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		var block []byte
+		block, err = readTag(r, size)
+		if err != nil {
+			return
+		}
+		if hdr[0]&0x7f != 6 {
+			continue
+		}
+		ptype, data, e := flacPicture(block)
+		if e == nil && len(data) > 0 && (pic == nil || ptype == frontCover && best != frontCover) {
+			pic, best = data, ptype
+		}
+	}
+	return
+}
+
+// reads the packets of the first logical stream of an ogg file
+type oggReader struct {
+	r io.Reader
+	// serial number of the first stream, set once its first page is read
+	serial  uint32
+	started bool
+	// segments of the current page not read yet
+	segs []byte
+}
+
+// read the next packet, no bigger than maxTagSize
+func (o *oggReader) packet() (pkt []byte, err error) {
+	for {
+		for len(o.segs) > 0 {
+			n := int(o.segs[0])
+			o.segs = o.segs[1:]
+			var seg []byte
+			seg, err = readTag(o.r, int64(n))
+			if err != nil {
+				return
+			}
+			if len(pkt)+n > maxTagSize {
+				return nil, errBadTag
+			}
+			pkt = append(pkt, seg...)
+			if n < 255 {
+				return
+			}
+		}
+		hdr := make([]byte, 27)
+		_, err = io.ReadFull(o.r, hdr)
+		if err != nil {
+			return
+		}
+		if string(hdr[:4]) != "OggS" {
+			return nil, errBadTag
+		}
+		serial := binary.LittleEndian.Uint32(hdr[14:])
+		o.segs = make([]byte, hdr[26])
+		_, err = io.ReadFull(o.r, o.segs)
+		if err != nil {
+			return
+		}
+		if !o.started {
+			o.serial, o.started = serial, true
+		} else if serial != o.serial {
+			// page of another stream, skip it
+			total := 0
+			for _, n := range o.segs {
+				total += int(n)
+			}
+			_, err = readTag(o.r, int64(total))
+			o.segs = nil
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// get the cover art from the comment header of an ogg vorbis or opus stream
+func oggCover(r io.Reader) (pic []byte, err error) {
+	o := &oggReader{r: r}
+	// the comments are the second packet
+	var pkt []byte
+	for idx := 0; idx < 2 && err == nil; idx++ {
+		pkt, err = o.packet()
+	}
+	if err != nil {
+		return
+	}
+	if bytes.HasPrefix(pkt, []byte("\x03vorbis")) {
+		pkt = pkt[7:]
+	} else if bytes.HasPrefix(pkt, []byte("OpusTags")) {
+		pkt = pkt[8:]
+	} else {
+		return nil, nil
+	}
+	next := func() ([]byte, bool) {
+		if len(pkt) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(pkt)
+		if uint64(n) > uint64(len(pkt)-4) {
+			return nil, false
+		}
+		s := pkt[4 : 4+n]
+		pkt = pkt[4+n:]
+		return s, true
+	}
+	// vendor
+	if _, ok := next(); !ok || len(pkt) < 4 {
+		return nil, errBadTag
+	}
+	count := binary.LittleEndian.Uint32(pkt)
+	pkt = pkt[4:]
+	best := uint32(0)
+	for idx := uint32(0); idx < count; idx++ {
+		comment, ok := next()
+		if !ok {
+			return nil, errBadTag
+		}
+		eq := bytes.IndexByte(comment, '=')
+		if eq < 0 || !strings.EqualFold(string(comment[:eq]), "METADATA_BLOCK_PICTURE") {
+			continue
+		}
+		block, e := base64.StdEncoding.DecodeString(string(comment[eq+1:]))
+		if e != nil {
+			continue
+		}
+		ptype, data, e := flacPicture(block)
+		if e == nil && len(data) > 0 && (pic == nil || ptype == frontCover && best != frontCover) {
+			pic, best = data, ptype
+		}
+	}
+	return
+}
+
+// find the atom at the end of a path in an mp4 file and read its contents
+// searches from the current offset of r up to end, -1 for the end of the file
+func mp4Cover(r io.ReadSeeker, end int64, path []string) (pic []byte, err error) {
+	hdr := make([]byte, 8)
+	for {
+		var pos int64
+		pos, err = r.Seek(0, io.SeekCurrent)
+		if err != nil || (end >= 0 && pos+8 > end) {
+			return
+		}
+		_, err = io.ReadFull(r, hdr)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		} else if err != nil {
+			return
+		}
+		size := int64(binary.BigEndian.Uint32(hdr))
+		kind := string(hdr[4:])
+		body := pos + 8
+		if size == 1 {
+			// 64 bit size follows
+			_, err = io.ReadFull(r, hdr)
+			if err != nil {
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(hdr))
+			body += 8
+		}
+		atomEnd := pos + size
+		if size == 0 {
+			atomEnd = end
+		} else if size < body-pos || (end >= 0 && atomEnd > end) {
+			return nil, errBadTag
+		}
+		if kind == path[0] {
+			if len(path) == 1 {
+				// data atoms start with a type and locale
+				if atomEnd >= 0 && atomEnd-body < 8 {
+					return nil, errBadTag
+				}
+				_, err = r.Seek(body+8, io.SeekStart)
+				if err == nil {
+					pic, err = readTag(r, atomEnd-body-8)
+				}
+				return
+			}
+			if kind == "meta" {
+				// full atom with a version and flags
+				body += 4
+			}
+			_, err = r.Seek(body, io.SeekStart)
+			if err == nil {
+				pic, err = mp4Cover(r, atomEnd, path[1:])
+			}
+			return
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		_, err = r.Seek(atomEnd, io.SeekStart)
+		if err != nil {
+			return
+		}
+	}
+}
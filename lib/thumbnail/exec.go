@@ -1,8 +1,11 @@
 package thumbnail
 
 import (
-	"os/exec"
+	"context"
+	"github.com/majestrate/srndv2/lib/process"
+	"path/filepath"
 	"regexp"
+	"time"
 )
 
 // thumbnail by executing an external program
@@ -15,6 +18,8 @@ type ExecThumbnailer struct {
 	// inf and outf are the filenames of the input and output files respectively
 	// if this is nil the command will be passed in 2 arguments, infile and outfile
 	GenArgs func(inf, outf string) []string
+	// runs the program with limits, nil for process.DefaultRunner
+	Runner *process.Runner
 }
 
 func (exe *ExecThumbnailer) CanThumbnail(infpath string) bool {
@@ -31,8 +36,17 @@ func (exe *ExecThumbnailer) Generate(infpath, outfpath string) (err error) {
 		} else {
 			args = exe.GenArgs(infpath, outfpath)
 		}
-		cmd := exec.Command(exe.Exec, args...)
-		_, err = cmd.CombinedOutput()
+		runner := exe.Runner
+		if runner == nil {
+			runner = process.DefaultRunner
+		}
+		started := time.Now()
+		_, err = runner.Run(context.Background(), exe.Exec, args, nil)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		thumbnailSeconds.WithLabelValues(filepath.Base(exe.Exec), result).Observe(time.Since(started).Seconds())
 	} else {
 		err = ErrCannotThumbanil
 	}
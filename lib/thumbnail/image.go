@@ -0,0 +1,219 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// default limits on images decoded in process
+const (
+	DefaultMaxPixels = 50 * 1000 * 1000
+	DefaultMaxMemory = 256 * 1024 * 1024
+)
+
+var ErrImageTooBig = errors.New("image is too big to thumbnail")
+
+// thumbnail images by decoding them in process without running any program
+type ImageThumbnailer struct {
+	// size of thumbnails
+	Config *Config
+	// most pixels an image may have, 0 for DefaultMaxPixels
+	MaxPixels int64
+	// most bytes a decoded image may take, 0 for DefaultMaxMemory
+	MaxMemory int64
+}
+
+var imageAccept = regexp.MustCompilePOSIX(`\.(png|jpg|jpeg|gif|webp)$`)
+
+// formats decoded in process, gif only gets its first frame
+var imageFormats = map[string]bool{
+	"png":  true,
+	"jpeg": true,
+	"gif":  true,
+	"webp": true,
+}
+
+// create a thumbnailer that decodes images in process
+func GoImageThumbnailer(conf *Config) Thumbnailer {
+	if conf == nil {
+		conf = defaultCfg
+	}
+	return &ImageThumbnailer{
+		Config: conf,
+	}
+}
+
+func (th *ImageThumbnailer) CanThumbnail(infpath string) bool {
+	return imageAccept.MatchString(infpath)
+}
+
+// bytes per pixel an image with a color model decodes to
+func bytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	// paletted and ycbcr images take less, assume the worst
+	return 4
+}
+
+// check the size of an image before decoding it
+func (th *ImageThumbnailer) checkLimits(r io.Reader) (format string, err error) {
+	var cfg image.Config
+	cfg, format, err = image.DecodeConfig(r)
+	if err != nil {
+		return
+	}
+	if !imageFormats[format] {
+		return "", ErrCannotThumbanil
+	}
+	maxPixels := th.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxPixels
+	}
+	maxMemory := th.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = DefaultMaxMemory
+	}
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if cfg.Width <= 0 || cfg.Height <= 0 || pixels > maxPixels || pixels*bytesPerPixel(cfg.ColorModel) > maxMemory {
+		err = ErrImageTooBig
+	}
+	return
+}
+
+// decode an image file within the limits
+func (th *ImageThumbnailer) decode(infpath string) (img image.Image, format string, err error) {
+	var f *os.File
+	f, err = os.Open(infpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return th.decodeReader(f)
+}
+
+// decode an image within the limits
+func (th *ImageThumbnailer) decodeReader(r io.ReadSeeker) (img image.Image, format string, err error) {
+	format, err = th.checkLimits(r)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return
+	}
+	// decoders are not hardened against every crafted file
+	defer func() {
+		if p := recover(); p != nil {
+			img = nil
+			err = fmt.Errorf("decoding %s panicked: %v", format, p)
+		}
+	}()
+	img, _, err = image.Decode(r)
+	return
+}
+
+// size to scale w by h down to so it fits in the thumbnail keeping its aspect ratio
+// images that already fit are not scaled up
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		// wider than the thumbnail
+		h = h * maxW / w
+		w = maxW
+	} else {
+		w = w * maxH / h
+		h = maxH
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// scale an image to fit the thumbnail
+// images made into jpegs are put on white so transparency does not turn black
+func (th *ImageThumbnailer) scale(img image.Image, opaque bool) image.Image {
+	b := img.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), th.Config.ThumbW, th.Config.ThumbH)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	op := draw.Over
+	if opaque {
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	} else {
+		op = draw.Src
+	}
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, op, nil)
+	return dst
+}
+
+// write a thumbnail to a file, removing it if writing fails
+// jpeg thumbnails get .jpeg added to outfpath
+// png thumbnails get .png added to outfpath unless it already ends with it
+func writeThumbnail(outfpath string, img image.Image, asJpeg bool) (err error) {
+	if asJpeg {
+		outfpath += ".jpeg"
+	} else if filepath.Ext(outfpath) != ".png" {
+		outfpath += ".png"
+	}
+	var f *os.File
+	f, err = os.Create(outfpath)
+	if err != nil {
+		return
+	}
+	if asJpeg {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(f, img)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(outfpath)
+	}
+	return
+}
+
+// make the thumbnail
+// jpegs and every image with JpegOnly set get jpeg thumbnails, the rest get png thumbnails
+func (th *ImageThumbnailer) Generate(infpath, outfpath string) (err error) {
+	if !th.CanThumbnail(infpath) {
+		return ErrCannotThumbanil
+	}
+	started := time.Now()
+	var img image.Image
+	var format string
+	img, format, err = th.decode(infpath)
+	if err == nil {
+		asJpeg := th.Config.JpegOnly || format == "jpeg"
+		err = writeThumbnail(outfpath, th.scale(img, asJpeg), asJpeg)
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	thumbnailSeconds.WithLabelValues("go", result).Observe(time.Since(started).Seconds())
+	return
+}
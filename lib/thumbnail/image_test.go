@@ -0,0 +1,152 @@
+package thumbnail
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 1x1 lossless webp
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestFitSize(t *testing.T) {
+	for _, c := range [][6]int{
+		// w, h, max w, max h, expected w, h
+		{600, 300, 300, 200, 300, 150},
+		{300, 600, 300, 200, 100, 200},
+		{100, 50, 300, 200, 100, 50},
+		{10000, 1, 300, 200, 300, 1},
+	} {
+		w, h := fitSize(c[0], c[1], c[2], c[3])
+		if w != c[4] || h != c[5] {
+			t.Logf("%dx%d in %dx%d fit to %dx%d", c[0], c[1], c[2], c[3], w, h)
+			t.Fail()
+		}
+	}
+}
+
+// write a test image in a format
+func writeTestImage(t *testing.T, fpath string, w, h int) {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, x%h, color.NRGBA{R: 255, A: 128})
+	}
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer f.Close()
+	switch filepath.Ext(fpath) {
+	case ".png":
+		err = png.Encode(f, img)
+	case ".jpg":
+		err = jpeg.Encode(f, img, nil)
+	case ".gif":
+		err = gif.Encode(f, img, nil)
+	case ".webp":
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(tinyWebP)
+		if err == nil {
+			_, err = f.Write(data)
+		}
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+}
+
+// decode a thumbnail and check its format and size
+func checkThumbnail(t *testing.T, fpath, format string, w, h int) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	defer f.Close()
+	cfg, got, err := image.DecodeConfig(f)
+	if err != nil || got != format || cfg.Width != w || cfg.Height != h {
+		t.Logf("%s is a %dx%d %s not a %dx%d %s: %v", fpath, cfg.Width, cfg.Height, got, w, h, format, err)
+		t.Fail()
+	}
+}
+
+func TestGoImageThumbnailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-thumbnail")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	jpegOnly := GoImageThumbnailer(&Config{ThumbW: 300, ThumbH: 200, JpegOnly: true})
+	keep := GoImageThumbnailer(&Config{ThumbW: 300, ThumbH: 200})
+	for _, name := range []string{"a.png", "a.jpg", "a.gif", "a.webp"} {
+		inf := filepath.Join(dir, name)
+		writeTestImage(t, inf, 600, 300)
+		w, h := 300, 150
+		if name == "a.webp" {
+			w, h = 1, 1
+		}
+		outf := filepath.Join(dir, "thm-"+name)
+		if err = jpegOnly.Generate(inf, outf); err != nil {
+			t.Logf("%s: %v", name, err)
+			t.Fail()
+			continue
+		}
+		checkThumbnail(t, outf+".jpeg", "jpeg", w, h)
+		outf = filepath.Join(dir, "keep-"+name)
+		if err = keep.Generate(inf, outf); err != nil {
+			t.Logf("%s: %v", name, err)
+			t.Fail()
+			continue
+		}
+		if name == "a.jpg" {
+			checkThumbnail(t, outf+".jpeg", "jpeg", w, h)
+		} else if name == "a.png" {
+			checkThumbnail(t, outf, "png", w, h)
+		} else {
+			checkThumbnail(t, outf+".png", "png", w, h)
+		}
+	}
+}
+
+func TestGoImageThumbnailerLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srnd-thumbnail")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	inf := filepath.Join(dir, "a.png")
+	writeTestImage(t, inf, 600, 300)
+	th := &ImageThumbnailer{Config: defaultCfg, MaxPixels: 600*300 - 1}
+	if err = th.Generate(inf, inf+".thm"); err != ErrImageTooBig {
+		t.Logf("too many pixels gave %v", err)
+		t.Fail()
+	}
+	th = &ImageThumbnailer{Config: defaultCfg, MaxMemory: 600 * 300}
+	if err = th.Generate(inf, inf+".thm"); err != ErrImageTooBig {
+		t.Logf("too much memory gave %v", err)
+		t.Fail()
+	}
+	// not an image at all
+	ioutil.WriteFile(inf, []byte("not a png"), 0600)
+	th = &ImageThumbnailer{Config: defaultCfg}
+	if err = th.Generate(inf, inf+".thm"); err != image.ErrFormat {
+		t.Logf("garbage gave %v", err)
+		t.Fail()
+	}
+	if matches, _ := filepath.Glob(inf + ".thm*"); len(matches) != 0 {
+		t.Logf("failed thumbnails left %v", matches)
+		t.Fail()
+	}
+}
@@ -0,0 +1,17 @@
+package thumbnail
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var thumbnailSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "thumbnail_seconds",
+	Help:    "Time taken to generate thumbnails by program and result.",
+	Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+}, []string{"program", "result"})
+
+var thumbnailJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "thumbnail_jobs_total",
+	Help: "Attachments thumbnailed by the worker pool by result.",
+}, []string{"result"})
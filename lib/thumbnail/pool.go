@@ -0,0 +1,336 @@
+package thumbnail
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/srndv2/lib/config"
+	"github.com/majestrate/srndv2/lib/process"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("thumbnail queue is full")
+var ErrPoolStopped = errors.New("thumbnail pool is stopped")
+
+// where attachments are read from and their thumbnails written to
+type Store interface {
+	// path of the file a stored attachment is in
+	AttachmentPath(filename string) (string, error)
+	// path to write the thumbnail of an attachment to, thumbnailers may add an extension
+	ThumbnailPath(filename string) (string, error)
+	// visit the file name of every stored attachment
+	WalkAttachments(visit func(filename string) error) error
+}
+
+// remembers the thumbnails of attachments for the frontend
+type Recorder interface {
+	// record the file name of the thumbnail made for an attachment
+	RegisterThumbnail(filename, thumbnail string) error
+}
+
+// an attachment waiting to be thumbnailed
+type job struct {
+	filename string
+	// tries made so far
+	attempt int
+}
+
+// thumbnails attachments in the background with a fixed number of workers
+type Pool struct {
+	// makes the thumbnails
+	Thumbnailer Thumbnailer
+	// where attachments and thumbnails are
+	Store Store
+	// where made thumbnails are recorded, nil for nowhere
+	Recorder Recorder
+	// thumbnails made at the same time, at least 1
+	Workers int
+	// attachments waiting before new ones are dropped, at least 1
+	QueueSize int
+	// times a failed thumbnail is tried again
+	Retries int
+	// time to wait before trying again
+	RetryDelay time.Duration
+
+	access  sync.Mutex
+	queue   chan job
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// get the path of a configured program, empty if it is not installed
+func installed(path string) string {
+	if path == "" {
+		return ""
+	}
+	if _, err := exec.LookPath(path); err != nil {
+		log.WithFields(log.Fields{
+			"pkg":  "thumbnail",
+			"exec": path,
+		}).Warn("thumbnailer not installed ", err)
+		return ""
+	}
+	return path
+}
+
+// create the thumbnailer for a config
+// images and audio are handled in process, other files use the programs that are installed run by runner
+func NewThumbnailerFromConfig(c *config.ThumbnailConfig, runner *process.Runner) Thumbnailer {
+	conf := &Config{
+		ThumbW:   c.Width,
+		ThumbH:   c.Height,
+		JpegOnly: c.JpegOnly,
+	}
+	ffmpeg := installed(c.FFMpegPath)
+	impls := []Thumbnailer{
+		&ImageThumbnailer{
+			Config:    conf,
+			MaxPixels: c.MaxPixels,
+			MaxMemory: c.MaxMemory,
+		},
+		&AudioThumbnailer{
+			Config:    conf,
+			FFMpeg:    ffmpeg,
+			Runner:    runner,
+			MaxPixels: c.MaxPixels,
+			MaxMemory: c.MaxMemory,
+		},
+	}
+	for _, prog := range []struct {
+		path string
+		make func(string, *Config) Thumbnailer
+	}{
+		{installed(c.ConvertPath), ImageMagickThumbnailer},
+		{ffmpeg, FFMpegThumbnailer},
+	} {
+		if prog.path == "" {
+			continue
+		}
+		th := prog.make(prog.path, conf)
+		th.(*ExecThumbnailer).Runner = runner
+		impls = append(impls, th)
+	}
+	return MuxThumbnailers(impls...)
+}
+
+// create a pool thumbnailing with what a config names
+func NewPoolFromConfig(c *config.ThumbnailConfig, runner *process.Runner, st Store, rec Recorder) *Pool {
+	return &Pool{
+		Thumbnailer: NewThumbnailerFromConfig(c, runner),
+		Store:       st,
+		Recorder:    rec,
+		Workers:     c.Workers,
+		QueueSize:   c.QueueSize,
+		Retries:     c.Retries,
+		RetryDelay:  c.RetryAfter(),
+	}
+}
+
+func (p *Pool) workers() int {
+	if p.Workers < 1 {
+		return 1
+	}
+	return p.Workers
+}
+
+// start the workers
+func (p *Pool) Start() {
+	size := p.QueueSize
+	if size < 1 {
+		size = 1
+	}
+	p.access.Lock()
+	p.queue = make(chan job, size)
+	p.stopped = false
+	p.access.Unlock()
+	for n := 0; n < p.workers(); n++ {
+		p.wg.Add(1)
+		go p.work(p.queue)
+	}
+}
+
+// stop the workers after the thumbnails being made are done
+// queued attachments and pending retries are dropped
+func (p *Pool) Stop() {
+	p.access.Lock()
+	if p.queue != nil && !p.stopped {
+		p.stopped = true
+		close(p.queue)
+	}
+	p.access.Unlock()
+	p.wg.Wait()
+}
+
+// queue an attachment to be thumbnailed without waiting for it
+// attachments no thumbnailer handles are ignored
+func (p *Pool) Enqueue(filename string) error {
+	if !p.Thumbnailer.CanThumbnail(filename) {
+		return nil
+	}
+	return p.enqueue(job{filename: filename})
+}
+
+func (p *Pool) enqueue(j job) (err error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.queue == nil || p.stopped {
+		return ErrPoolStopped
+	}
+	select {
+	case p.queue <- j:
+	default:
+		thumbnailJobs.WithLabelValues("dropped").Inc()
+		err = ErrQueueFull
+	}
+	return
+}
+
+func (p *Pool) work(queue chan job) {
+	defer p.wg.Done()
+	for j := range queue {
+		_, err := p.Thumbnail(j.filename)
+		if err == nil {
+			continue
+		}
+		l := log.WithFields(log.Fields{
+			"pkg":      "thumbnail",
+			"filename": j.filename,
+			"attempt":  j.attempt + 1,
+		})
+		if !retryable(err) || j.attempt >= p.Retries {
+			l.Error("failed to make thumbnail ", err)
+			continue
+		}
+		l.Warn("failed to make thumbnail, trying again later ", err)
+		thumbnailJobs.WithLabelValues("retried").Inc()
+		retry := job{filename: j.filename, attempt: j.attempt + 1}
+		time.AfterFunc(p.RetryDelay, func() {
+			p.enqueue(retry)
+		})
+	}
+}
+
+// can trying again later make a thumbnail after this error
+func retryable(err error) bool {
+	switch err {
+	case ErrCannotThumbanil, ErrNoThumbnailer, ErrImageTooBig, image.ErrFormat, process.ErrTimeout:
+		return false
+	}
+	return true
+}
+
+// find the thumbnail a thumbnailer made given the path it was told to write to
+// returns an empty string if there is none
+func findThumbnail(outfpath string) string {
+	if _, err := os.Stat(outfpath); err == nil {
+		return outfpath
+	}
+	matches, _ := filepath.Glob(outfpath + ".*")
+	if len(matches) > 0 {
+		return matches[0]
+	}
+	return ""
+}
+
+// make the thumbnail of an attachment now, replacing any it has
+// returns the file name of the thumbnail
+func (p *Pool) Thumbnail(filename string) (thumb string, err error) {
+	var inf, outf string
+	inf, err = p.Store.AttachmentPath(filename)
+	if err == nil {
+		outf, err = p.Store.ThumbnailPath(filename)
+	}
+	if err == nil {
+		err = p.Thumbnailer.Generate(inf, outf)
+	}
+	if err == nil {
+		thumb = filepath.Base(findThumbnail(outf))
+		if thumb == "." {
+			// the program said it worked but wrote nothing
+			err = ErrCannotThumbanil
+			thumb = ""
+		}
+	}
+	if err == nil && p.Recorder != nil {
+		err = p.Recorder.RegisterThumbnail(filename, thumb)
+	}
+	if err == nil {
+		thumbnailJobs.WithLabelValues("made").Inc()
+		log.WithFields(log.Fields{
+			"pkg":       "thumbnail",
+			"filename":  filename,
+			"thumbnail": thumb,
+		}).Debug("made thumbnail")
+	} else {
+		thumbnailJobs.WithLabelValues("failed").Inc()
+	}
+	return
+}
+
+// what rebuilding thumbnails did
+type RethumbStats struct {
+	// attachments that were thumbnailed
+	Made int64 `json:"made"`
+	// attachments that failed to thumbnail
+	Failed int64 `json:"failed"`
+	// attachments that already had a thumbnail or cannot have one
+	Skipped int64 `json:"skipped"`
+}
+
+// make thumbnails of stored attachments using the workers of the pool
+// with all set every attachment is thumbnailed again, otherwise only the ones without a thumbnail
+// does not need the pool to be started
+func (p *Pool) Rethumb(all bool) (st RethumbStats, err error) {
+	var access sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for n := 0; n < p.workers(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range jobs {
+				_, e := p.Thumbnail(filename)
+				access.Lock()
+				if e == nil {
+					st.Made++
+				} else {
+					st.Failed++
+					log.WithFields(log.Fields{
+						"pkg":      "thumbnail",
+						"filename": filename,
+					}).Error("failed to make thumbnail ", e)
+				}
+				access.Unlock()
+			}
+		}()
+	}
+	err = p.Store.WalkAttachments(func(filename string) error {
+		if !p.Thumbnailer.CanThumbnail(filename) {
+			access.Lock()
+			st.Skipped++
+			access.Unlock()
+			return nil
+		}
+		if !all {
+			outf, e := p.Store.ThumbnailPath(filename)
+			if e != nil {
+				return e
+			}
+			if findThumbnail(outf) != "" {
+				access.Lock()
+				st.Skipped++
+				access.Unlock()
+				return nil
+			}
+		}
+		jobs <- filename
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	return
+}
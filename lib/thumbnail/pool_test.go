@@ -0,0 +1,170 @@
+package thumbnail
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// attachments and thumbnails in two flat directories
+type dirStore struct {
+	dir string
+}
+
+func (s dirStore) AttachmentPath(filename string) (string, error) {
+	fpath := filepath.Join(s.dir, "att", filename)
+	_, err := os.Stat(fpath)
+	return fpath, err
+}
+
+func (s dirStore) ThumbnailPath(filename string) (string, error) {
+	return filepath.Join(s.dir, "thm", filename), nil
+}
+
+func (s dirStore) WalkAttachments(visit func(filename string) error) error {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "att"))
+	for idx := 0; err == nil && idx < len(infos); idx++ {
+		err = visit(infos[idx].Name())
+	}
+	return err
+}
+
+// writes a jpeg thumbnail after failing a number of times for each file
+type fakeThumbnailer struct {
+	access sync.Mutex
+	fails  int
+	calls  map[string]int
+}
+
+func (th *fakeThumbnailer) CanThumbnail(infpath string) bool {
+	return strings.HasSuffix(infpath, ".png")
+}
+
+func (th *fakeThumbnailer) Generate(infpath, outfpath string) error {
+	th.access.Lock()
+	th.calls[filepath.Base(infpath)]++
+	calls := th.calls[filepath.Base(infpath)]
+	th.access.Unlock()
+	if calls <= th.fails {
+		return errors.New("thumbnailer failed")
+	}
+	return ioutil.WriteFile(outfpath+".jpeg", []byte("thumbnail"), 0600)
+}
+
+type mapRecorder struct {
+	access sync.Mutex
+	thumbs map[string]string
+}
+
+func (r *mapRecorder) RegisterThumbnail(filename, thumbnail string) error {
+	r.access.Lock()
+	r.thumbs[filename] = thumbnail
+	r.access.Unlock()
+	return nil
+}
+
+func (r *mapRecorder) get(filename string) string {
+	r.access.Lock()
+	defer r.access.Unlock()
+	return r.thumbs[filename]
+}
+
+func newTestPool(t *testing.T, fails int, files ...string) (*Pool, *mapRecorder, string) {
+	dir, err := ioutil.TempDir("", "srnd-thumbnail")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	os.Mkdir(filepath.Join(dir, "att"), 0700)
+	os.Mkdir(filepath.Join(dir, "thm"), 0700)
+	for _, f := range files {
+		ioutil.WriteFile(filepath.Join(dir, "att", f), []byte("attachment"), 0600)
+	}
+	rec := &mapRecorder{thumbs: make(map[string]string)}
+	p := &Pool{
+		Thumbnailer: &fakeThumbnailer{fails: fails, calls: make(map[string]int)},
+		Store:       dirStore{dir},
+		Recorder:    rec,
+		Workers:     2,
+		QueueSize:   4,
+		Retries:     2,
+		RetryDelay:  time.Millisecond,
+	}
+	return p, rec, dir
+}
+
+// wait for a thumbnail to be recorded
+func waitThumbnail(rec *mapRecorder, filename string) string {
+	for tries := 0; tries < 200 && rec.get(filename) == ""; tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return rec.get(filename)
+}
+
+func TestPoolRetries(t *testing.T) {
+	p, rec, dir := newTestPool(t, 2, "aa.png", "bb.txt")
+	defer os.RemoveAll(dir)
+	p.Start()
+	defer p.Stop()
+	if err := p.Enqueue("aa.png"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	// not thumbnailable, ignored
+	if err := p.Enqueue("bb.txt"); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if thumb := waitThumbnail(rec, "aa.png"); thumb != "aa.png.jpeg" {
+		t.Logf("recorded thumbnail %q after retries", thumb)
+		t.Fail()
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thm", "aa.png.jpeg")); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+func TestPoolGivesUp(t *testing.T) {
+	p, rec, dir := newTestPool(t, 10, "aa.png")
+	defer os.RemoveAll(dir)
+	p.Start()
+	p.Enqueue("aa.png")
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+	th := p.Thumbnailer.(*fakeThumbnailer)
+	if calls := th.calls["aa.png"]; calls != p.Retries+1 {
+		t.Logf("tried %d times with %d retries", calls, p.Retries)
+		t.Fail()
+	}
+	if rec.get("aa.png") != "" {
+		t.Log("failed thumbnail was recorded")
+		t.Fail()
+	}
+	if err := p.Enqueue("aa.png"); err != ErrPoolStopped {
+		t.Logf("enqueue after stop gave %v", err)
+		t.Fail()
+	}
+}
+
+func TestRethumb(t *testing.T) {
+	p, rec, dir := newTestPool(t, 0, "aa.png", "bb.png", "cc.txt")
+	defer os.RemoveAll(dir)
+	// aa already has a thumbnail
+	ioutil.WriteFile(filepath.Join(dir, "thm", "aa.png.jpeg"), []byte("old"), 0600)
+	st, err := p.Rethumb(false)
+	if err != nil || st.Made != 1 || st.Skipped != 2 || st.Failed != 0 || rec.get("bb.png") != "bb.png.jpeg" {
+		t.Logf("rethumb missing %+v: %v", st, err)
+		t.Fail()
+	}
+	st, err = p.Rethumb(true)
+	if err != nil || st.Made != 2 || st.Skipped != 1 || rec.get("aa.png") != "aa.png.jpeg" {
+		t.Logf("rethumb all %+v: %v", st, err)
+		t.Fail()
+	}
+}
@@ -54,3 +54,15 @@ func TestCanThumbnailVideo(t *testing.T) {
 
 	doTestThumb(t, th, allowed, disallowed)
 }
+
+func TestCanThumbnailGoImage(t *testing.T) {
+	th := GoImageThumbnailer(nil)
+	var disallowed []string
+
+	disallowed = append(disallowed, _video...)
+	disallowed = append(disallowed, _sound...)
+	disallowed = append(disallowed, _misc...)
+	disallowed = append(disallowed, _garbage...)
+
+	doTestThumb(t, th, _image, disallowed)
+}
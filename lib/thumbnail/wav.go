@@ -0,0 +1,203 @@
+package thumbnail
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+var ErrUnsupportedWav = errors.New("not a pcm wav file")
+
+// wav format codes
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xfffe
+)
+
+// colors of waveform thumbnails
+var (
+	waveformBackground = color.RGBA{0xf0, 0xe0, 0xd6, 0xff}
+	waveformForeground = color.RGBA{0x80, 0x00, 0x00, 0xff}
+)
+
+// reads the samples of a pcm wav file
+type wavReader struct {
+	r        *bufio.Reader
+	channels int
+	// bytes per sample of one channel
+	width int
+	float bool
+	// frames in the data chunk
+	frames int64
+	frame  []byte
+}
+
+// read the header of a wav file up to its samples
+// size is the size of the file, used when the data chunk does not say how long it is
+func openWav(r io.Reader, size int64) (w *wavReader, err error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 12)
+	_, err = io.ReadFull(br, hdr)
+	if err != nil {
+		return
+	}
+	if string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return nil, ErrUnsupportedWav
+	}
+	offset := int64(12)
+	chunk := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(br, chunk)
+		if err != nil {
+			return
+		}
+		offset += 8
+		id := string(chunk[:4])
+		length := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if id == "data" {
+			break
+		}
+		if id == "fmt " {
+			var f []byte
+			f, err = readTag(br, length)
+			if err != nil {
+				return
+			}
+			w, err = parseWavFormat(f)
+			if err != nil {
+				return
+			}
+		} else {
+			_, err = io.CopyN(ioutil.Discard, br, length)
+			if err != nil {
+				return
+			}
+		}
+		// chunks are padded to an even length
+		if length%2 == 1 {
+			br.ReadByte()
+			offset++
+		}
+		offset += length
+	}
+	if w == nil {
+		return nil, ErrUnsupportedWav
+	}
+	length := int64(binary.LittleEndian.Uint32(chunk[4:]))
+	if length == 0 || length == math.MaxUint32 || length > size-offset {
+		// streamed files do not know their length
+		length = size - offset
+	}
+	w.r = br
+	w.frame = make([]byte, w.channels*w.width)
+	w.frames = length / int64(len(w.frame))
+	return
+}
+
+// parse the fmt chunk of a wav file
+func parseWavFormat(f []byte) (w *wavReader, err error) {
+	if len(f) < 16 {
+		return nil, ErrUnsupportedWav
+	}
+	format := binary.LittleEndian.Uint16(f)
+	if format == wavExtensible && len(f) >= 26 {
+		// the format is at the start of the sub format guid
+		format = binary.LittleEndian.Uint16(f[24:])
+	}
+	w = &wavReader{
+		channels: int(binary.LittleEndian.Uint16(f[2:])),
+		width:    int(binary.LittleEndian.Uint16(f[14:])+7) / 8,
+		float:    format == wavFloat,
+	}
+	if w.channels < 1 || (format != wavPCM && format != wavFloat) {
+		return nil, ErrUnsupportedWav
+	}
+	if (w.float && w.width != 4 && w.width != 8) || (!w.float && (w.width < 1 || w.width > 4)) {
+		return nil, ErrUnsupportedWav
+	}
+	return
+}
+
+// decode one sample to between -1 and 1
+func (w *wavReader) sample(b []byte) float64 {
+	if w.float {
+		if w.width == 4 {
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	switch w.width {
+	case 1:
+		// 8 bit samples are unsigned
+		return (float64(b[0]) - 128) / 128
+	case 2:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case 3:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float64(v) / (1 << 23)
+	}
+	return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+}
+
+// read the next frame mixed down to one sample
+func (w *wavReader) next() (v float64, err error) {
+	_, err = io.ReadFull(w.r, w.frame)
+	if err != nil {
+		return
+	}
+	for ch := 0; ch < w.channels; ch++ {
+		v += w.sample(w.frame[ch*w.width:])
+	}
+	return v / float64(w.channels), nil
+}
+
+// draw the waveform of a wav file as an image width by height
+// each column shows the lowest and highest sample of its part of the audio
+func (w *wavReader) render(width, height int) (img image.Image, err error) {
+	if w.frames < 1 || width < 1 || height < 1 {
+		return nil, ErrCannotThumbanil
+	}
+	columns := int64(width)
+	if w.frames < columns {
+		columns = w.frames
+	}
+	perColumn := (w.frames + columns - 1) / columns
+	dst := image.NewRGBA(image.Rect(0, 0, int(columns), height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(waveformBackground), image.Point{}, draw.Src)
+	mid := float64(height-1) / 2
+	for x := 0; int64(x) < columns; x++ {
+		low, high := 1.0, -1.0
+		for n := int64(0); n < perColumn && int64(x)*perColumn+n < w.frames; n++ {
+			var v float64
+			v, err = w.next()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// cut short, draw what there is
+				err = nil
+				break
+			} else if err != nil {
+				return
+			}
+			if math.IsNaN(v) {
+				continue
+			}
+			low = math.Min(low, v)
+			high = math.Max(high, v)
+		}
+		if low > high {
+			low, high = 0, 0
+		}
+		top := int(math.Round(mid - math.Min(high, 1)*mid))
+		bottom := int(math.Round(mid - math.Max(low, -1)*mid))
+		for y := top; y <= bottom; y++ {
+			dst.SetRGBA(x, y, waveformForeground)
+		}
+	}
+	return dst, nil
+}
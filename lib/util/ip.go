@@ -6,6 +6,7 @@ import (
 	"github.com/majestrate/srndv2/lib/crypto/nacl"
 	"log"
 	"net"
+	"strings"
 )
 
 // given an address
@@ -89,3 +90,53 @@ func ZeroIPString(ip net.IP) string {
 	}
 	return "?"
 }
+
+// decrypt an address encrypted with EncAddr
+// returns empty string if the key or encrypted address are malformed
+func DecAddr(encaddr, key string) string {
+	key_bytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		log.Println("decAddr() key base64 decode", err)
+		return ""
+	}
+	enc_bytes, err := base64.StdEncoding.DecodeString(encaddr)
+	if err != nil {
+		log.Println("decAddr() encaddr base64 decode", err)
+		return ""
+	}
+	if len(enc_bytes) != len(key_bytes) {
+		log.Println("decAddr() len(encaddr) != len(key_bytes)")
+		return ""
+	}
+	res_bytes := make([]byte, len(enc_bytes))
+	for idx, b := range key_bytes {
+		res_bytes[idx] = enc_bytes[idx] ^ b
+	}
+	return strings.TrimRight(string(res_bytes), " ")
+}
+
+// parse an ip address or CIDR range into a CIDR range
+// a single address becomes a range holding only that address
+func ParseAddrRange(str string) (*net.IPNet, error) {
+	if ok, inet := IsSubnet(str); ok {
+		return inet, nil
+	}
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", str)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// get the ip address part of a host:port address such as a remote address
+// returns the address as is if it has no port
+func AddrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
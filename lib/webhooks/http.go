@@ -1,6 +1,7 @@
 package webhooks
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -41,7 +42,7 @@ func (h *httpWebhook) sendArticle(msgid nntp.MessageID, group nntp.Newsgroup) {
 		var r *http.Response
 		var ctype string
 		if h.conf.Dialect == "vichan" {
-			c := textproto.NewConn(f)
+			c := textproto.NewReader(bufio.NewReader(f))
 			var hdr textproto.MIMEHeader
 			hdr, err = c.ReadMIMEHeader()
 			if err == nil {
@@ -112,12 +113,15 @@ func (h *httpWebhook) sendArticle(msgid nntp.MessageID, group nntp.Newsgroup) {
 				r, err = http.Post(u.String(), ctype, body)
 			}
 		} else {
-			var sz int64
-			sz, err = f.Seek(0, 2)
-			if err != nil {
-				return
+			// compressed articles do not know their size and are sent chunked
+			sz := int64(-1)
+			if s, ok := f.(io.Seeker); ok {
+				sz, err = s.Seek(0, io.SeekEnd)
+				if err != nil {
+					return
+				}
+				s.Seek(0, io.SeekStart)
 			}
-			f.Seek(0, 0)
 			// regular webhook
 			ctype = "text/plain; charset=UTF-8"
 			cl := new(http.Client)
@@ -135,13 +139,18 @@ func (h *httpWebhook) sendArticle(msgid nntp.MessageID, group nntp.Newsgroup) {
 			if err == nil || err == io.EOF {
 				msg, ok := result["error"]
 				if ok {
+					webhookCalls.WithLabelValues(h.conf.Name, "failure").Inc()
 					log.Warnf("hook gave error: %s", msg)
 				} else {
+					webhookCalls.WithLabelValues(h.conf.Name, "success").Inc()
 					log.Debugf("hook response: %s", result)
 				}
 			} else {
+				webhookCalls.WithLabelValues(h.conf.Name, "success").Inc()
 				log.Warnf("hook response does not look like json: %s", err)
 			}
+			// the hook was called, a bad reply is not an error of ours
+			err = nil
 			r.Body.Close()
 			log.Infof("hook called for %s", msgid)
 		}
@@ -149,6 +158,7 @@ func (h *httpWebhook) sendArticle(msgid nntp.MessageID, group nntp.Newsgroup) {
 		f.Close()
 	}
 	if err != nil {
+		webhookCalls.WithLabelValues(h.conf.Name, "failure").Inc()
 		log.Errorf("error calling web hook %s: %s", h.conf.Name, err.Error())
 	}
 }
@@ -0,0 +1,11 @@
+package webhooks
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var webhookCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "webhook_calls_total",
+	Help: "Web hook calls by hook and result.",
+}, []string{"hook", "result"})